@@ -10,11 +10,14 @@ import (
 	"os/signal"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/netflix/rend/consul"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/handlers/couchbase"
+	"github.com/netflix/rend/handlers/keymap"
 	"github.com/netflix/rend/handlers/memcached"
+	"github.com/netflix/rend/handlers/memcached/cluster"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/orcas"
 	"github.com/netflix/rend/protocol"
@@ -37,9 +40,32 @@ var (
 	consulAddr     string
 	listenPort     int
 	adminPort      int
+	backfillOpts   orcas.BackfillOpts
+
+	readOnly bool
+
+	migrationPhase   string
+	migrationCompare bool
+
+	hashLongKeys bool
+	keymapOpts   keymap.Opts
+
+	clusterOpts cluster.Opts
+	healthOpts  cluster.HealthOpts
+)
+
+// The Consul watches following each cluster, stopped on shutdown
+var (
+	watchersMu sync.Mutex
+	watchers   []*consul.Watcher
 )
 
 func init() {
+	var tempWriteConsistency string
+	var tempNodeTimeout, tempHealthInterval, tempHealthTimeout int
+	var tempPoolCheckInterval int
+	var tempEjection string
+
 	flag.IntVar(&listenPort, "p", 11211, "External port to listen on")
 	flag.IntVar(&adminPort, "admin-port", 8080, "Admin port for metrics and debug")
 	flag.StringVar(&consulAddr, "consul-addr", "localhost:8500", "Consul addr for service resolution (set --hostnames to no use)")
@@ -57,8 +83,68 @@ func init() {
 	flag.StringVar(&dstClusterDC, "destination-datacenter", "", "The datacenter used for destination cluster (empty for local)")
 	flag.StringVar(&dstBucketName, "destination-bucket", "", "The bucket to use for destination couchbase cluster configuration")
 
+	var tempBackfillExptime int
+
+	flag.IntVar(&backfillOpts.Workers, "backfill-workers", 0, "The number of background workers copying keys from the source to the destination cluster. Positive values only. 0 assumes default.")
+	flag.IntVar(&backfillOpts.QueueSize, "backfill-queue-size", 0, "The number of keys that can wait to be backfilled. Keys missed while the queue is full are not backfilled. Positive values only. 0 assumes default.")
+	flag.IntVar(&tempBackfillExptime, "backfill-exptime", 0, "The TTL given to backfilled items (seconds). Positive values only. 0 assumes default.")
+	flag.BoolVar(&backfillOpts.PreserveTTL, "backfill-preserve-ttl", false, "Copy each item's TTL from the source cluster instead of using --backfill-exptime, if the source supports it")
+
+	flag.BoolVar(&readOnly, "read-only", false, "In forwarder mode, reject every command that changes data instead of forwarding it")
+
+	flag.StringVar(&migrationPhase, "migration-phase", "", "Run a live migration from the source to the destination cluster, starting in this phase: source-primary, dual or destination-primary. The phase can be changed at runtime with a POST to /migration on the admin port.")
+	flag.BoolVar(&migrationCompare, "migration-compare", false, "During a migration, also read every key from the non-primary cluster and record divergence metrics")
+
+	flag.IntVar(&clusterOpts.Replicas, "replicas", 1, "The number of nodes each key is written to in memcached clusters. Reads fall back to the next replica on a miss or error.")
+	flag.StringVar(&tempWriteConsistency, "write-consistency", "all", "How many replicas must acknowledge a write to a memcached cluster: all, quorum or one")
+	flag.IntVar(&tempNodeTimeout, "node-timeout-ms", 1000, "How long a command to a memcached node may take, including waiting for a pooled connection and dialing, before it fails (milliseconds)")
+	flag.IntVar(&tempHealthInterval, "health-check-ms", 1000, "How often every memcached node is health checked (milliseconds). 0 disables health checks and ejection.")
+	flag.IntVar(&tempHealthTimeout, "health-check-timeout-ms", 500, "How long a memcached node has to answer a health check (milliseconds)")
+	flag.IntVar(&healthOpts.FailureThreshold, "node-failure-threshold", 3, "The number of failures in a row, from health checks or commands, that ejects a memcached node")
+	flag.IntVar(&healthOpts.RecoveryThreshold, "node-recovery-threshold", 2, "The number of health checks in a row an ejected memcached node must pass to be reinstated")
+	flag.StringVar(&tempEjection, "ejection", "rehash", "What happens to the keys of an ejected memcached node: rehash moves them to the next nodes, fail-fast fails their commands")
+	flag.IntVar(&clusterOpts.Pool.Size, "node-pool-size", 32, "The most connections the proxy opens to each memcached node, shared by every client. Commands wait for a free connection, for at most --node-timeout-ms.")
+	flag.IntVar(&tempPoolCheckInterval, "node-pool-check-sec", 30, "How often idle connections to memcached nodes are checked and closed if broken (seconds)")
+	flag.BoolVar(&hashLongKeys, "hash-long-keys", false, "Store keys longer than memcached allows under a hash of the key, with the key kept alongside the value. Every proxy in front of a cluster must agree on this.")
+	flag.BoolVar(&keymapOpts.HashAll, "hash-all-keys", false, "With --hash-long-keys, store every key under its hash")
+
 	flag.Parse()
 
+	if backfillOpts.Workers < 0 || backfillOpts.QueueSize < 0 || tempBackfillExptime < 0 {
+		log.Fatalf("Error: --backfill-workers, --backfill-queue-size and --backfill-exptime must be >= 0")
+	}
+	backfillOpts.Exptime = uint32(tempBackfillExptime)
+
+	if clusterOpts.Replicas < 1 {
+		log.Fatalf("Error: --replicas must be >= 1")
+	}
+	consistency, err := cluster.ParseConsistency(tempWriteConsistency)
+	if err != nil {
+		log.Fatalf("Error: bad argument for --write-consistency: %v", err)
+	}
+	clusterOpts.WriteConsistency = consistency
+
+	if tempNodeTimeout < 1 {
+		log.Fatalf("Error: --node-timeout-ms must be >= 1")
+	}
+	if tempHealthInterval < 0 || tempHealthTimeout < 0 {
+		log.Fatalf("Error: --health-check-ms and --health-check-timeout-ms must be >= 0")
+	}
+	clusterOpts.Timeout = time.Duration(tempNodeTimeout) * time.Millisecond
+
+	if clusterOpts.Pool.Size < 1 || tempPoolCheckInterval < 1 {
+		log.Fatalf("Error: --node-pool-size and --node-pool-check-sec must be >= 1")
+	}
+	clusterOpts.Pool.IdleCheckInterval = time.Duration(tempPoolCheckInterval) * time.Second
+	healthOpts.Interval = time.Duration(tempHealthInterval) * time.Millisecond
+	healthOpts.Timeout = time.Duration(tempHealthTimeout) * time.Millisecond
+
+	ejection, err := cluster.ParseEjection(tempEjection)
+	if err != nil {
+		log.Fatalf("Error: bad argument for --ejection: %v", err)
+	}
+	healthOpts.Ejection = ejection
+
 	// Setting up signal handlers
 	sigs := make(chan os.Signal)
 	signal.Notify(sigs, os.Interrupt)
@@ -66,6 +152,13 @@ func init() {
 	go func() {
 		<-sigs
 		log.Println("Keyboard Interrupt")
+
+		watchersMu.Lock()
+		for _, w := range watchers {
+			w.Stop()
+		}
+		watchersMu.Unlock()
+
 		os.Exit(0)
 	}()
 
@@ -96,7 +189,28 @@ func newHandlerFromConfig(clusterType string, hostnames string, clusterName stri
 		if len(instances) <= 0 || len(instances[0]) <= 0 {
 			log.Fatalf("Error: Cannot create a cluster (cluster: %s) of 0 nodes", clusterName)
 		}
-		return memcached.Cluster(instances, clusterName)
+		m := cluster.NewMembershipWithPool(clusterName, instances, clusterOpts.Pool)
+		if hostnames == "" {
+			// Follow the service in Consul so nodes can join and leave
+			w, err := consul.WatchNodes(clusterName, consulAddr, dc, m.Update)
+			if err != nil {
+				log.Fatalf("Error: couldn't watch service in Consul: %s", err)
+			}
+
+			watchersMu.Lock()
+			watchers = append(watchers, w)
+			watchersMu.Unlock()
+		}
+		if healthOpts.Interval > 0 {
+			m.StartHealthChecks(healthOpts)
+		}
+		h := memcached.ClusterWithMembership(m, clusterOpts)
+		// Keys are mapped before the cluster picks a node, so every proxy sends
+		// a key to the same node
+		if hashLongKeys {
+			return keymap.Handler(h, keymapOpts)
+		}
+		return h
 	case "couchbase":
 		if len(instances) <= 0 || len(instances[0]) <= 0 {
 			log.Fatalf("Error: Cannot create a cluster (cluster: %s) of 0 nodes", clusterName)
@@ -118,12 +232,25 @@ func main() {
 	sourceCluster := newHandlerFromConfig(srcType, srcHostnames, srcClusterName, srcClusterDC, srcBucketName)
 	backfillCluster := newHandlerFromConfig(dstType, dstHostnames, dstClusterName, dstClusterDC, dstBucketName)
 
-	if dstType == "noop" {
-		log.Printf("Starting Rend (in GET forwarder mode) on port %d", listenPort)
-		go server.ListenAndServe(l, protocols, server.Default, orcas.L1OnlyForwardGet, sourceCluster, backfillCluster)
+	if migrationPhase != "" {
+		phase, err := orcas.ParseMigrationPhase(migrationPhase)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+
+		m := orcas.NewMigration(phase, migrationCompare)
+		http.Handle("/migration", m)
+
+		log.Printf("Starting Rend (migration mode, %s) on port %d", phase, listenPort)
+		go server.ListenAndServe(l, protocols, server.Default, orcas.Migrating(m), sourceCluster, backfillCluster)
+	} else if dstType == "noop" {
+		log.Printf("Starting Rend (in forwarder mode) on port %d", listenPort)
+		go server.ListenAndServe(l, protocols, server.Default, orcas.L1OnlyForwardGetWithOpts(orcas.ForwardGetOpts{ReadOnly: readOnly}), sourceCluster, backfillCluster)
 	} else {
 		log.Printf("Starting Rend (backfill mode) on port %d", listenPort)
-		go server.ListenAndServe(l, protocols, server.Default, orcas.Backfill, sourceCluster, backfillCluster)
+		// The backfill workers make their own connections to the source cluster
+		o := orcas.Backfill(sourceCluster, backfillCluster, backfillOpts)
+		go server.ListenAndServe(l, protocols, server.Default, o, handlers.NilHandler, backfillCluster)
 	}
 
 	// Block forever
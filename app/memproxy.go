@@ -17,15 +17,27 @@ package main
 import (
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/breaker"
+	"github.com/netflix/rend/handlers/compression"
+	"github.com/netflix/rend/handlers/disk"
+	"github.com/netflix/rend/handlers/encryption"
 	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/handlers/integrity"
+	"github.com/netflix/rend/handlers/keymap"
 	"github.com/netflix/rend/handlers/memcached"
 	"github.com/netflix/rend/handlers/memcached/batched"
 	"github.com/netflix/rend/metrics"
@@ -43,11 +55,12 @@ func init() {
 	}
 
 	// Setting up signal handlers
-	sigs := make(chan os.Signal)
-	signal.Notify(sigs, os.Interrupt)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
 		<-sigs
+		runShutdownHooks()
 		panic("Keyboard Interrupt")
 	}()
 
@@ -58,21 +71,68 @@ func init() {
 	metrics.SetPrefix("rend_")
 }
 
+var (
+	shutdownHooks   []func()
+	shutdownHooksMu sync.Mutex
+)
+
+// onShutdown registers a function to run when the process is interrupted.
+func onShutdown(f func()) {
+	shutdownHooksMu.Lock()
+	shutdownHooks = append(shutdownHooks, f)
+	shutdownHooksMu.Unlock()
+}
+
+func runShutdownHooks() {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	for _, f := range shutdownHooks {
+		f()
+	}
+}
+
 // Flags
 var (
 	chunked bool
 	l1sock  string
 	l1inmem bool
 
+	inmemOpts inmem.Opts
+
+	inmemSnapshot         string
+	inmemSnapshotInterval time.Duration
+
 	l1batched bool
 	batchOpts batched.Opts
 
+	l1compress      bool
+	compressionOpts compression.Opts
+
+	keyring *encryption.Keyring
+
+	checksums bool
+
+	hashLongKeys bool
+	keymapOpts   keymap.Opts
+
 	l2enabled bool
 	l2sock    string
+	l2disk    string
+	diskOpts  disk.Opts
+	l1l2Opts  orcas.L1L2Opts
+
+	breakers    bool
+	breakerOpts breaker.Opts
 
-	locked      bool
-	concurrency int
-	multiReader bool
+	routes []orcas.Route
+
+	ttlPolicy *orcas.TTLPolicy
+
+	locked          bool
+	concurrency     int
+	multiReader     bool
+	perKeyLocks     bool
+	tempLockTimeout int
 
 	port            int
 	batchPort       int
@@ -82,7 +142,21 @@ var (
 
 func init() {
 	flag.BoolVar(&chunked, "chunked", false, "If --chunked is specified, the chunked handler is used for L1")
-	flag.BoolVar(&l1inmem, "l1-inmem", false, "Use the debug in-memory in-process L1 cache")
+	flag.BoolVar(&l1inmem, "l1-inmem", false, "Use the in-memory in-process L1 cache instead of memcached")
+
+	var tempInmemMaxBytes uint64
+	var tempInmemShards, tempInmemSweepSec int
+	var tempInmemEviction string
+
+	flag.Uint64Var(&tempInmemMaxBytes, "inmem-max-bytes", 0, "The memory budget of the in-memory L1 cache (bytes). Each shard gets an equal part, which is also the largest item it takes. 0 is unbounded.")
+	flag.IntVar(&tempInmemShards, "inmem-shards", 0, "The number of independently locked shards in the in-memory L1 cache, rounded up to a power of 2. Positive values only. 0 assumes default.")
+	flag.StringVar(&tempInmemEviction, "inmem-eviction", "lru", "The eviction policy of the in-memory L1 cache: lru, lfu or tinylfu")
+	flag.IntVar(&tempInmemSweepSec, "inmem-sweep-sec", 0, "The interval between sweeps for expired items in the in-memory L1 cache (seconds). Positive values only. 0 assumes default.")
+
+	var tempInmemSnapshotSec int
+
+	flag.StringVar(&inmemSnapshot, "inmem-snapshot", "", "Snapshot the in-memory L1 cache to this file periodically and on shutdown, and restore it on startup. Empty disables.")
+	flag.IntVar(&tempInmemSnapshotSec, "inmem-snapshot-sec", 0, "The interval between snapshots of the in-memory L1 cache (seconds). Positive values only. 0 assumes default.")
 	flag.StringVar(&l1sock, "l1-sock", "invalid.sock", "Specifies the unix socket to connect to L1")
 
 	var tempBatchSize,
@@ -103,12 +177,71 @@ func init() {
 	flag.Float64Var(&tempBatchLoadFactorRatio, "batch-expand-load-factor-ratio", 0, "The ratio of average batch size above which the pool will expand (float). Positive values only between 0 and 1. 0 assumes default.")
 	flag.Float64Var(&tempBatchOverloadedRatio, "batch-expand-overloaded-ratio", 0, "The ratio of connections whose average size is greater than the max batch size - 1 above which the pool will expand (float). Positive values only between 0 and 1. 0 assumes default.")
 
+	var tempCompressCodec string
+	var tempCompressLevel, tempCompressThreshold int
+
+	flag.StringVar(&tempCompressCodec, "l1-compress", "", "Compress large values stored in L1 with this codec: flate, gzip or zlib. Empty disables.")
+	flag.IntVar(&tempCompressLevel, "compress-level", -1, "The compression level, from 1 (fastest) to 9 (smallest). -1 assumes the codec's default.")
+	flag.IntVar(&tempCompressThreshold, "compress-threshold", 0, "Only compress values of at least this many bytes (bytes). Positive values only. 0 assumes default.")
+
+	flag.BoolVar(&checksums, "checksums", false, "Store a CRC32C checksum with every value in L1 and L2 and treat items that fail it as misses, deleting them")
+
+	flag.BoolVar(&hashLongKeys, "hash-long-keys", false, "Store keys longer than memcached allows under a hash of the key, with the key kept alongside the value")
+	flag.BoolVar(&keymapOpts.HashAll, "hash-all-keys", false, "With --hash-long-keys, store every key under its hash")
+
+	var tempKeyring string
+	var tempKeyringReloadSec int
+
+	flag.StringVar(&tempKeyring, "keyring", "", "Encrypt values in L1 and L2 with the AES keys in this file. Each line is a key version and a base64 encoded key; the highest version encrypts new values. Empty disables.")
+	flag.IntVar(&tempKeyringReloadSec, "keyring-reload-sec", 60, "How often to check the keyring file for rotated keys (seconds). 0 disables reloading.")
+
 	flag.BoolVar(&l2enabled, "l2-enabled", false, "Specifies if l2 is enabled")
 	flag.StringVar(&l2sock, "l2-sock", "invalid.sock", "Specifies the unix socket to connect to L2. Only used if --l2-enabled is true.")
+	flag.StringVar(&l2disk, "l2-disk", "", "Use the built in log-structured store in this directory as L2 instead of the server at --l2-sock. Only used if --l2-enabled is true. Empty disables.")
+
+	var tempDiskSegmentMB int
+	var tempDiskCompactRatio float64
+
+	flag.IntVar(&tempDiskSegmentMB, "l2-disk-segment-mb", 0, "The size of each segment file of the --l2-disk store (megabytes). Positive values only. 0 assumes default.")
+	flag.Float64Var(&tempDiskCompactRatio, "l2-disk-compact-ratio", 0, "The fraction of live data below which a segment of the --l2-disk store is compacted (float). Positive values only between 0 and 1. 0 assumes default.")
+
+	var tempStaleGrace,
+		tempRefreshLease int
+
+	flag.IntVar(&tempStaleGrace, "stale-grace", 0, "Serve items as stale for this many seconds past their TTL while one client refreshes them (seconds). Only used if --l2-enabled is true. Items are only marked stale if L1 supports GetE, like --l1-inmem. 0 disables.")
+	flag.Float64Var(&l1l2Opts.EarlyRefreshDelta, "early-refresh-delta", 0, "Expected time for a client to recompute an item, used to pick clients to refresh items before they expire (seconds, float). Only used if --l2-enabled is true. 0 disables.")
+	flag.Float64Var(&l1l2Opts.EarlyRefreshBeta, "early-refresh-beta", 0, "Scales --early-refresh-delta. Values over 1 favor earlier refreshes (float). 0 assumes default.")
+	flag.IntVar(&tempRefreshLease, "refresh-lease", 0, "How long a client told to refresh an item has to do so before another client is told to (seconds). 0 assumes default.")
+
+	var tempAdmission string
+	var tempAdmissionMaxSize,
+		tempTinyLFUCounters int
+
+	flag.StringVar(&tempAdmission, "l1-admission", "always", "Policy for copying L2 hits back into L1: always or tinylfu. Only used if --l2-enabled is true.")
+	flag.IntVar(&tempAdmissionMaxSize, "l1-admission-max-size", 0, "Only copy L2 hits of at most this many bytes back into L1 (bytes). Only used if --l2-enabled is true. 0 disables.")
+	flag.IntVar(&tempTinyLFUCounters, "tinylfu-counters", 0, "The number of counters per row in the TinyLFU frequency sketch. Positive values only. 0 assumes default.")
+
+	var tempBreakerSlowMillis,
+		tempBreakerOpenSec int
+
+	flag.BoolVar(&breakers, "breakers", false, "Put circuit breakers in front of L1 and L2 and route around a layer while its breaker is open")
+	flag.Float64Var(&breakerOpts.ErrorRatio, "breaker-error-ratio", 0, "The ratio of failed calls at or above which a breaker opens (float). Positive values only between 0 and 1. 0 assumes default.")
+	flag.IntVar(&tempBreakerSlowMillis, "breaker-slow-ms", 0, "Calls slower than this count toward opening a breaker (milliseconds). Positive values only. 0 disables.")
+	flag.IntVar(&tempBreakerOpenSec, "breaker-open-sec", 0, "How long a breaker stays open before probing the backend again (seconds). Positive values only. 0 assumes default.")
+
+	var tempRoutes string
+
+	flag.StringVar(&tempRoutes, "routes", "", "Comma separated list of name:prefix:l1sock[:l2sock] routes that serve keys starting with prefix from their own memcached instances. A prefix starting with ~ is a regular expression. Keys that match no route use the normal L1 and L2.")
+
+	var tempTTLRules string
+
+	flag.StringVar(&tempTTLRules, "ttl-rules", "", "Comma separated list of prefix:min:max:default:jitter TTL rules (seconds, jitter in percent). Writes to keys starting with prefix get their TTL clamped to [min, max], 0 replaced by default and shortened by up to jitter percent. 0 leaves a part alone. The rule with the longest prefix wins and an empty prefix matches every key.")
 
 	flag.BoolVar(&locked, "locked", false, "Add locking to overall operations (above L1/L2 layers)")
 	flag.IntVar(&concurrency, "concurrency", 8, "Concurrency level. 2^(concurrency) parallel operations permitted, assuming no collisions. Large values (>16) are likely useless and will eat up RAM. Default of 8 means 256 operations (on different keys) can happen in parallel.")
 	flag.BoolVar(&multiReader, "multi-reader", true, "Allow (or disallow) multiple readers on the same key. If chunking is used, this will always be false and setting it to true will be ignored.")
+	flag.BoolVar(&perKeyLocks, "per-key-locks", false, "Give every key its own lock instead of sharing 2^(concurrency) locks between all keys. --concurrency will be ignored.")
+	flag.IntVar(&tempLockTimeout, "lock-timeout-ms", 0, "Fail operations that wait longer than this for their lock with a busy error (milliseconds). Only used if --locked is true. Positive values only. 0 waits forever.")
 
 	flag.IntVar(&port, "p", 11211, "External port to listen on")
 	flag.IntVar(&batchPort, "bp", 11212, "External port to listen on for batch systems")
@@ -147,10 +280,53 @@ func init() {
 		os.Exit(-1)
 	}
 
+	if tempStaleGrace < 0 {
+		fmt.Println("ERROR: argument --stale-grace must be >= 0")
+		os.Exit(-1)
+	}
+	if tempRefreshLease < 0 {
+		fmt.Println("ERROR: argument --refresh-lease must be >= 0")
+		os.Exit(-1)
+	}
+	if l1l2Opts.EarlyRefreshDelta < 0 {
+		fmt.Println("ERROR: argument --early-refresh-delta must be >= 0")
+		os.Exit(-1)
+	}
+	if l1l2Opts.EarlyRefreshBeta < 0 {
+		fmt.Println("ERROR: argument --early-refresh-beta must be >= 0")
+		os.Exit(-1)
+	}
+
+	if tempAdmissionMaxSize < 0 {
+		fmt.Println("ERROR: argument --l1-admission-max-size must be >= 0")
+		os.Exit(-1)
+	}
+	if tempTinyLFUCounters < 0 {
+		fmt.Println("ERROR: argument --tinylfu-counters must be >= 0")
+		os.Exit(-1)
+	}
+
+	if breakerOpts.ErrorRatio < 0 || breakerOpts.ErrorRatio > 1 {
+		fmt.Println("ERROR: argument --breaker-error-ratio must be between 0 and 1")
+		os.Exit(-1)
+	}
+	if tempBreakerSlowMillis < 0 {
+		fmt.Println("ERROR: argument --breaker-slow-ms must be >= 0")
+		os.Exit(-1)
+	}
+	if tempBreakerOpenSec < 0 {
+		fmt.Println("ERROR: argument --breaker-open-sec must be >= 0")
+		os.Exit(-1)
+	}
+
 	if concurrency >= 64 {
 		fmt.Println("ERROR: Concurrency cannot be more than 2^64")
 		os.Exit(-1)
 	}
+	if tempLockTimeout < 0 {
+		fmt.Println("ERROR: argument --lock-timeout-ms must be >= 0")
+		os.Exit(-1)
+	}
 
 	batchOpts = batched.Opts{
 		BatchSize:             uint32(tempBatchSize),
@@ -161,6 +337,189 @@ func init() {
 		LoadFactorExpandRatio: tempBatchLoadFactorRatio,
 		OverloadedConnRatio:   tempBatchOverloadedRatio,
 	}
+
+	if tempDiskSegmentMB < 0 {
+		fmt.Println("ERROR: argument --l2-disk-segment-mb must be >= 0")
+		os.Exit(-1)
+	}
+	if tempDiskCompactRatio < 0 || tempDiskCompactRatio > 1 {
+		fmt.Println("ERROR: argument --l2-disk-compact-ratio must be between 0 and 1")
+		os.Exit(-1)
+	}
+	diskOpts = disk.Opts{
+		Dir:          l2disk,
+		SegmentBytes: int64(tempDiskSegmentMB) * 1024 * 1024,
+		CompactRatio: tempDiskCompactRatio,
+	}
+
+	if tempInmemShards < 0 {
+		fmt.Println("ERROR: argument --inmem-shards must be >= 0")
+		os.Exit(-1)
+	}
+	if tempInmemSweepSec < 0 {
+		fmt.Println("ERROR: argument --inmem-sweep-sec must be >= 0")
+		os.Exit(-1)
+	}
+	eviction, err := inmem.PolicyByName(tempInmemEviction)
+	if err != nil {
+		fmt.Printf("ERROR: bad argument for --inmem-eviction: %v\n", err)
+		os.Exit(-1)
+	}
+	if tempInmemSnapshotSec < 0 {
+		fmt.Println("ERROR: argument --inmem-snapshot-sec must be >= 0")
+		os.Exit(-1)
+	}
+	inmemSnapshotInterval = 5 * time.Minute
+	if tempInmemSnapshotSec > 0 {
+		inmemSnapshotInterval = time.Duration(tempInmemSnapshotSec) * time.Second
+	}
+	inmemOpts = inmem.Opts{
+		MaxBytes:      tempInmemMaxBytes,
+		Shards:        tempInmemShards,
+		Eviction:      eviction,
+		SweepInterval: time.Duration(tempInmemSweepSec) * time.Second,
+	}
+
+	if tempCompressThreshold < 0 {
+		fmt.Println("ERROR: argument --compress-threshold must be >= 0")
+		os.Exit(-1)
+	}
+	if tempCompressCodec != "" {
+		codec, err := compression.ByName(tempCompressCodec, tempCompressLevel)
+		if err != nil {
+			fmt.Printf("ERROR: bad argument for --l1-compress or --compress-level: %v\n", err)
+			os.Exit(-1)
+		}
+		l1compress = true
+		compressionOpts = compression.Opts{
+			Codec:     codec,
+			Threshold: uint32(tempCompressThreshold),
+		}
+	}
+
+	if tempKeyringReloadSec < 0 {
+		fmt.Println("ERROR: argument --keyring-reload-sec must be >= 0")
+		os.Exit(-1)
+	}
+	if tempKeyring != "" {
+		var err error
+		if keyring, err = encryption.LoadKeyring(tempKeyring); err != nil {
+			fmt.Printf("ERROR: could not load --keyring: %v\n", err)
+			os.Exit(-1)
+		}
+		if tempKeyringReloadSec > 0 {
+			go keyring.Watch(time.Duration(tempKeyringReloadSec) * time.Second)
+		}
+	}
+
+	breakerOpts.SlowCallMillis = uint32(tempBreakerSlowMillis)
+	breakerOpts.OpenSec = uint32(tempBreakerOpenSec)
+
+	l1l2Opts.StaleGrace = uint32(tempStaleGrace)
+	l1l2Opts.RefreshLease = uint32(tempRefreshLease)
+
+	var policies []orcas.Admission
+	if tempAdmissionMaxSize > 0 {
+		policies = append(policies, orcas.SizeThreshold(tempAdmissionMaxSize))
+	}
+
+	switch tempAdmission {
+	case "always":
+	case "tinylfu":
+		policies = append(policies, orcas.NewTinyLFU(orcas.TinyLFUOpts{
+			Counters: uint32(tempTinyLFUCounters),
+		}))
+	default:
+		fmt.Println("ERROR: argument --l1-admission must be one of always or tinylfu")
+		os.Exit(-1)
+	}
+
+	if len(policies) > 0 {
+		l1l2Opts.Admission = orcas.AdmitAll(policies...)
+	}
+
+	for _, spec := range strings.Split(tempRoutes, ",") {
+		if spec == "" {
+			continue
+		}
+
+		parts := strings.Split(spec, ":")
+		if len(parts) < 3 || len(parts) > 4 || parts[0] == "" {
+			fmt.Println("ERROR: argument --routes must be a list of name:prefix:l1sock[:l2sock]")
+			os.Exit(-1)
+		}
+
+		r := orcas.Route{
+			Name:   parts[0],
+			Prefix: []byte(parts[1]),
+			L1:     memcached.Regular(parts[2]),
+			Orca:   orcas.L1Only,
+		}
+
+		if strings.HasPrefix(parts[1], "~") {
+			re, err := regexp.Compile(parts[1][1:])
+			if err != nil {
+				fmt.Printf("ERROR: bad pattern for route %s: %v\n", parts[0], err)
+				os.Exit(-1)
+			}
+			r.Pattern = re
+		}
+
+		if len(parts) == 4 {
+			r.L2 = memcached.Regular(parts[3])
+			r.Orca = orcas.L1L2WithOpts(l1l2Opts)
+		}
+
+		routes = append(routes, r)
+	}
+
+	var ttlRules []orcas.TTLRule
+	for _, spec := range strings.Split(tempTTLRules, ",") {
+		if spec == "" {
+			continue
+		}
+
+		parts := strings.Split(spec, ":")
+		if len(parts) != 5 {
+			fmt.Println("ERROR: argument --ttl-rules must be a list of prefix:min:max:default:jitter")
+			os.Exit(-1)
+		}
+
+		var vals [4]uint32
+		for i, part := range parts[1:] {
+			val, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				fmt.Printf("ERROR: bad number %q in TTL rule %s\n", part, spec)
+				os.Exit(-1)
+			}
+			vals[i] = uint32(val)
+		}
+
+		ttlRules = append(ttlRules, orcas.TTLRule{
+			Prefix:        []byte(parts[0]),
+			Min:           vals[0],
+			Max:           vals[1],
+			Default:       vals[2],
+			JitterPercent: vals[3],
+		})
+	}
+
+	if len(ttlRules) > 0 {
+		ttlPolicy = orcas.NewTTLPolicy(ttlRules)
+	}
+}
+
+// requireGetE exits unless the backend made by hc supports GetE.
+func requireGetE(hc handlers.HandlerConst, layer string) {
+	ok, err := handlers.SupportsGetE(hc)
+	if err != nil {
+		fmt.Printf("ERROR: could not check whether %s supports GetE: %v\n", layer, err)
+		os.Exit(-1)
+	}
+	if !ok {
+		fmt.Printf("ERROR: %s doesn't support GetE, which appends and prepends to checksummed, encrypted or compressed values need\n", layer)
+		os.Exit(-1)
+	}
 }
 
 // And away we go
@@ -181,7 +540,25 @@ func main() {
 
 	// Choose the proper L1 handler
 	if l1inmem {
-		h1 = inmem.New
+		cache := inmem.NewHandler(inmemOpts)
+
+		if inmemSnapshot != "" {
+			n, err := cache.Restore(inmemSnapshot)
+			if err == nil {
+				log.Printf("Restored %d items from %s\n", n, inmemSnapshot)
+			} else if !os.IsNotExist(err) {
+				log.Printf("Error restoring the in-memory cache from %s after %d items: %v\n", inmemSnapshot, n, err)
+			}
+
+			go cache.SnapshotEvery(inmemSnapshot, inmemSnapshotInterval)
+			onShutdown(func() {
+				if err := cache.Snapshot(inmemSnapshot); err != nil {
+					log.Printf("Error snapshotting the in-memory cache to %s: %v\n", inmemSnapshot, err)
+				}
+			})
+		}
+
+		h1 = inmem.HandlerConst(cache)
 	} else if chunked {
 		h1 = memcached.Chunked(l1sock)
 	} else if l1batched {
@@ -191,24 +568,99 @@ func main() {
 	}
 
 	if l2enabled {
-		o = orcas.L1L2
-		h2 = memcached.Regular(l2sock)
+		o = orcas.L1L2WithOpts(l1l2Opts)
+
+		if l2disk != "" {
+			store, err := disk.Open(diskOpts)
+			if err != nil {
+				fmt.Printf("ERROR: could not open the --l2-disk store: %v\n", err)
+				os.Exit(-1)
+			}
+			onShutdown(func() {
+				if err := store.Close(); err != nil {
+					log.Printf("Error closing the disk store: %v\n", err)
+				}
+			})
+
+			h2 = disk.Handler(store)
+		} else {
+			h2 = memcached.Regular(l2sock)
+		}
 	} else {
 		o = orcas.L1Only
 		h2 = handlers.NilHandler
 	}
 
+	// Appends and prepends to checksummed, encrypted or compressed items are
+	// written back with their TTL, which only GetE can read
+	if checksums || keyring != nil || l1compress {
+		requireGetE(h1, "L1")
+	}
+	if l2enabled && (checksums || keyring != nil) {
+		requireGetE(h2, "L2")
+	}
+
+	// Checksums go closest to the backends so they cover exactly what is stored
+	if checksums {
+		h1 = integrity.Handler(h1, "l1")
+		if l2enabled {
+			h2 = integrity.Handler(h2, "l2")
+		}
+	}
+
+	// Encryption goes under compression since encrypted data doesn't compress
+	if keyring != nil {
+		h1 = encryption.Handler(h1, keyring)
+		if l2enabled {
+			h2 = encryption.Handler(h2, keyring)
+		}
+	}
+	if l1compress {
+		h1 = compression.Handler(h1, compressionOpts)
+	}
+	if hashLongKeys {
+		h1 = keymap.Handler(h1, keymapOpts)
+		if l2enabled {
+			h2 = keymap.Handler(h2, keymapOpts)
+		}
+	}
+
+	// Add circuit breakers if requested. The breakers are shared by every
+	// connection and both listeners, since they track the health of the backends.
+	var b1, b2 *breaker.Breaker
+	if breakers {
+		b1 = breaker.New("l1", breakerOpts)
+		h1 = breaker.Handler(h1, b1)
+
+		if l2enabled {
+			b2 = breaker.New("l2", breakerOpts)
+			h2 = breaker.Handler(h2, b2)
+		}
+
+		o = orcas.Failover(o, b1, b2)
+	}
+
+	// Serve keys for the other logical caches from their own backends
+	if len(routes) > 0 {
+		o = orcas.Routed(routes, o)
+	}
+
+	if ttlPolicy != nil {
+		o = orcas.Build(o).Use(orcas.TTLPolicyMiddleware(ttlPolicy)).OrcaConst()
+	}
+
 	// Add the locking wrapper if requested. The locking wrapper can either allow mutltiple readers
 	// or not, with the same difference in semantics between a sync.Mutex and a sync.RWMutex. If
 	// chunking is enabled, we want to ensure that stricter locking is enabled, since concurrent
 	// sets into L1 with chunking can collide and cause data corruption.
 	var lockset uint32
 	if locked {
-		if chunked || !multiReader {
-			o, lockset = orcas.Locked(o, false, uint8(concurrency))
-		} else {
-			o, lockset = orcas.Locked(o, true, uint8(concurrency))
-		}
+		o, lockset = orcas.LockedWithOpts(o, orcas.LockOpts{
+			MultipleReaders: multiReader && !chunked,
+			Concurrency:     uint8(concurrency),
+			PerKey:          perKeyLocks,
+			TimeoutMillis:   uint32(tempLockTimeout),
+		})
 	}
 
 	go server.ListenAndServe(l, protocols, server.Default, o, h1, h2)
@@ -216,7 +668,15 @@ func main() {
 	if l2enabled {
 		// If L2 is enabled, start the batch L1 / L2 orchestrator
 		l = server.TCPListener(batchPort)
-		o := orcas.L1L2Batch
+		o := orcas.L1L2BatchWithOpts(l1l2Opts)
+
+		if breakers {
+			o = orcas.Failover(o, b1, b2)
+		}
+
+		if ttlPolicy != nil {
+			o = orcas.Build(o).Use(orcas.TTLPolicyMiddleware(ttlPolicy)).OrcaConst()
+		}
 
 		if locked {
 			o = orcas.LockedWithExisting(o, lockset)
@@ -302,6 +302,12 @@ type GetResponse struct {
 	Flags  uint32
 	Miss   bool
 	Quiet  bool
+
+	// Stale and Refresh are only set by orcas serving stale-while-revalidate.
+	// Stale means the item is past its soft TTL and is being served from the
+	// grace window. Refresh means this client was chosen to refresh the item.
+	Stale   bool
+	Refresh bool
 }
 
 // GetEResponse is used in the GetE protocol extension
@@ -6,6 +6,10 @@ import (
 	"log"
 )
 
+// serviceFunc is the signature of api.Health.Service, so tests can fake the
+// Consul health API.
+type serviceFunc func(string, string, bool, *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error)
+
 // GetNodes return a list of node addresses from a given Consul service
 func GetNodes(service string, consulAddr string, dc string) ([]string, error) {
 	defaultConfig := api.DefaultConfig()
@@ -22,7 +26,7 @@ func GetNodes(service string, consulAddr string, dc string) ([]string, error) {
 	return getServiceFromConsul(health.Service, service, dc)
 }
 
-func getServiceFromConsul(getService func(string, string, bool, *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error), service string, dc string) ([]string, error) {
+func getServiceFromConsul(getService serviceFunc, service string, dc string) ([]string, error) {
 	entries, _, err := getService(service, "", true, &api.QueryOptions{Datacenter: dc})
 	if err != nil {
 		log.Println("Failed to get service from Consul:", err)
@@ -0,0 +1,127 @@
+package consul
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	// How long Consul holds a blocking query open when nothing changes
+	watchWaitTime = 5 * time.Minute
+
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+var (
+	MetricWatchErrors  = metrics.AddCounter("consul_watch_errors", nil)
+	MetricWatchChanges = metrics.AddCounter("consul_watch_changes", nil)
+)
+
+// Watcher follows the healthy nodes of a Consul service with blocking queries.
+type Watcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// WatchNodes calls onChange with the addresses of a service's healthy nodes
+// whenever they change, until the watcher is stopped. The first call is made
+// once the current nodes are known. Queries that fail are retried with backoff
+// and the last known nodes stay in place meanwhile.
+func WatchNodes(service string, consulAddr string, dc string, onChange func([]string)) (*Watcher, error) {
+	defaultConfig := api.DefaultConfig()
+	defaultConfig.Address = consulAddr
+	client, err := api.NewClient(defaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return watch(client.Health().Service, service, dc, onChange), nil
+}
+
+func watch(getService serviceFunc, service string, dc string, onChange func([]string)) *Watcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Watcher{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go w.run(ctx, getService, service, dc, onChange)
+
+	return w
+}
+
+// Stop ends the watch and waits for any call to onChange to return.
+func (w *Watcher) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *Watcher) run(ctx context.Context, getService serviceFunc, service string, dc string, onChange func([]string)) {
+	defer close(w.done)
+
+	var index uint64
+	var last []string
+	delay := minRetryDelay
+
+	for {
+		q := &api.QueryOptions{
+			Datacenter: dc,
+			WaitIndex:  index,
+			WaitTime:   watchWaitTime,
+		}
+
+		entries, meta, err := getService(service, "", true, q.WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil || meta == nil {
+			metrics.IncCounter(MetricWatchErrors)
+			log.Printf("Failed to watch service %s in Consul, retrying in %v: %v\n", service, delay, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+		delay = minRetryDelay
+
+		// Waiting on an index below 1 returns at once, so Consul's guidance is
+		// to wait on 1 instead, or this would query in a busy loop.
+		next := meta.LastIndex
+		if next < 1 {
+			next = 1
+		}
+
+		// The index going backwards means Consul's state was reset, so the
+		// next query must start over instead of waiting on a stale index.
+		if next < index {
+			index = 0
+			continue
+		}
+		index = next
+
+		nodes := extractNodesAddresses(entries)
+		sort.Strings(nodes)
+		if last != nil && reflect.DeepEqual(nodes, last) {
+			continue
+		}
+		last = nodes
+
+		metrics.IncCounter(MetricWatchChanges)
+		onChange(nodes)
+	}
+}
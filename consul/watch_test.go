@@ -0,0 +1,166 @@
+package consul
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// fakeHealth is a local stand-in for Consul's health API that answers blocking
+// queries like the real one does.
+type fakeHealth struct {
+	mu      sync.Mutex
+	index   uint64
+	nodes   []*api.ServiceEntry
+	fail    bool
+	queries int
+	changed chan struct{}
+}
+
+func newFakeHealth() *fakeHealth {
+	return &fakeHealth{index: 1, changed: make(chan struct{})}
+}
+
+func (f *fakeHealth) set(index uint64, fail bool, addrs ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nodes = nil
+	for _, addr := range addrs {
+		f.nodes = append(f.nodes, &api.ServiceEntry{Service: &api.AgentService{Address: addr, Port: 11211}})
+	}
+	f.index = index
+	f.fail = fail
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeHealth) service(service string, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	f.mu.Lock()
+	f.queries++
+	f.mu.Unlock()
+
+	for {
+		f.mu.Lock()
+		index, nodes, fail, changed := f.index, f.nodes, f.fail, f.changed
+		f.mu.Unlock()
+
+		if fail {
+			return nil, nil, errors.New("consul unavailable")
+		}
+
+		// A query without an index returns at once, and one waiting on 1 waits
+		// for the index to be over 1 even if it is reported as 0
+		waitOn := index
+		if waitOn < 1 {
+			waitOn = 1
+		}
+		if q.WaitIndex == 0 || waitOn != q.WaitIndex {
+			return nodes, &api.QueryMeta{LastIndex: index}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-q.Context().Done():
+			return nil, nil, q.Context().Err()
+		}
+	}
+}
+
+func TestWatchNodes(t *testing.T) {
+	fake := newFakeHealth()
+	fake.set(1, false, "b", "a")
+
+	changes := make(chan []string, 10)
+	w := watch(fake.service, "memcached", "", func(nodes []string) { changes <- nodes })
+	defer w.Stop()
+
+	expect := func(expected ...string) {
+		select {
+		case nodes := <-changes:
+			if !reflect.DeepEqual(nodes, expected) {
+				t.Fatalf("Expected %v, got %v", expected, nodes)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %v, got no change", expected)
+		}
+	}
+	expectNone := func() {
+		select {
+		case nodes := <-changes:
+			t.Fatalf("Expected no change, got %v", nodes)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	expect("a:11211", "b:11211")
+
+	t.Run("Changes", func(t *testing.T) {
+		fake.set(2, false, "a", "b", "c")
+		expect("a:11211", "b:11211", "c:11211")
+
+		fake.set(3, false, "c")
+		expect("c:11211")
+	})
+	t.Run("SameNodes", func(t *testing.T) {
+		// A new index for the same nodes, e.g. a check's output changing
+		fake.set(4, false, "c")
+		expectNone()
+	})
+	t.Run("IndexReset", func(t *testing.T) {
+		fake.set(1, false, "d")
+		expect("d:11211")
+	})
+	t.Run("Errors", func(t *testing.T) {
+		fake.set(1, true)
+		expectNone()
+
+		// The watch retries after a second and keeps going
+		fake.set(5, false, "e")
+		expect("e:11211")
+	})
+}
+
+func TestWatchZeroIndex(t *testing.T) {
+	fake := newFakeHealth()
+	fake.set(0, false, "a")
+
+	changes := make(chan []string, 10)
+	w := watch(fake.service, "memcached", "", func(nodes []string) { changes <- nodes })
+	defer w.Stop()
+
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the nodes, got no change")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	fake.mu.Lock()
+	queries := fake.queries
+	fake.mu.Unlock()
+	if queries > 3 {
+		t.Fatalf("Expected the watch to block with an index of 0, got %d queries", queries)
+	}
+}
+
+func TestWatcherStop(t *testing.T) {
+	fake := newFakeHealth()
+	w := watch(fake.service, "memcached", "", func([]string) {})
+
+	done := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Stop to end a blocked query")
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package breaker provides circuit breakers for handlers. A breaker watches the
+// error rate and latency of every call made to one backend across all client
+// connections. Once the backend looks unhealthy the breaker opens and calls fail
+// fast without touching the backend. After a while a single probe call is let
+// through (half-open) and its outcome decides whether the breaker closes again.
+package breaker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// State is the state of a breaker.
+type State uint32
+
+const (
+	// Closed lets every call through.
+	Closed State = iota
+	// Open fails every call fast.
+	Open
+	// HalfOpen lets a single probe call through to test the backend.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	defaultErrorRatio  = 0.5
+	defaultSlowRatio   = 0.5
+	defaultMinRequests = 20
+	defaultWindowSec   = 10
+	defaultOpenSec     = 5
+)
+
+// Opts configures a breaker. Any zero value assumes the default.
+type Opts struct {
+	// ErrorRatio is the fraction of failed calls in a window at or above which
+	// the breaker opens. Default: 0.5
+	ErrorRatio float64
+
+	// SlowCallMillis is the duration above which a call counts as slow. Slow
+	// calls only open the breaker when this is set. Default: 0 (disabled)
+	SlowCallMillis uint32
+
+	// SlowRatio is the fraction of slow calls in a window at or above which the
+	// breaker opens. Default: 0.5
+	SlowRatio float64
+
+	// MinRequests is the number of calls a window must see before the breaker
+	// is allowed to open. Default: 20
+	MinRequests uint32
+
+	// WindowSec is the length of the window calls are counted in. Default: 10
+	WindowSec uint32
+
+	// OpenSec is how long the breaker stays open before letting a probe call
+	// through. Default: 5
+	OpenSec uint32
+}
+
+func uint32ValueOrDefault(val, def uint32) uint32 {
+	if val == 0 {
+		return def
+	}
+	return val
+}
+
+func float64ValueOrDefault(val, def float64) float64 {
+	if val == 0 {
+		return def
+	}
+	return val
+}
+
+// Breaker is a circuit breaker for a single backend. It is safe for concurrent
+// use and is meant to be shared by every connection to that backend.
+type Breaker struct {
+	name string
+
+	errorRatio  float64
+	slowRatio   float64
+	slowCall    time.Duration
+	minRequests uint32
+	window      time.Duration
+	openFor     time.Duration
+
+	lock        sync.Mutex
+	state       State
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+	calls       uint32
+	failures    uint32
+	slow        uint32
+
+	metricOpened   uint32
+	metricClosed   uint32
+	metricRejected uint32
+	metricFailures uint32
+}
+
+var (
+	breakersLock = new(sync.Mutex)
+	breakers     = make(map[string]*Breaker)
+)
+
+func init() {
+	http.Handle("/breakers", http.HandlerFunc(printBreakers))
+}
+
+// New returns the breaker with the given name, creating it with the given options
+// if it doesn't exist yet. The name identifies the breaker in metrics and on the
+// /breakers debug endpoint.
+func New(name string, opts Opts) *Breaker {
+	breakersLock.Lock()
+	defer breakersLock.Unlock()
+
+	if b, ok := breakers[name]; ok {
+		return b
+	}
+
+	tags := metrics.Tags{"breaker": name}
+
+	b := &Breaker{
+		name:        name,
+		errorRatio:  float64ValueOrDefault(opts.ErrorRatio, defaultErrorRatio),
+		slowRatio:   float64ValueOrDefault(opts.SlowRatio, defaultSlowRatio),
+		slowCall:    time.Duration(opts.SlowCallMillis) * time.Millisecond,
+		minRequests: uint32ValueOrDefault(opts.MinRequests, defaultMinRequests),
+		window:      time.Duration(uint32ValueOrDefault(opts.WindowSec, defaultWindowSec)) * time.Second,
+		openFor:     time.Duration(uint32ValueOrDefault(opts.OpenSec, defaultOpenSec)) * time.Second,
+		windowStart: time.Now(),
+
+		metricOpened:   metrics.AddCounter("breaker_opened", tags),
+		metricClosed:   metrics.AddCounter("breaker_closed", tags),
+		metricRejected: metrics.AddCounter("breaker_rejected", tags),
+		metricFailures: metrics.AddCounter("breaker_failures", tags),
+	}
+
+	// 0 is closed, 1 is open and 2 is half-open
+	metrics.RegisterIntGaugeCallback("breaker_state", tags, func() uint64 {
+		return uint64(b.State())
+	})
+
+	breakers[name] = b
+	return b
+}
+
+// Name returns the name the breaker was created with.
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the current state of the breaker. An open breaker whose open
+// period has passed reports half-open, since the next call will be a probe.
+func (b *Breaker) State() State {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.state == Open && time.Since(b.openedAt) >= b.openFor {
+		return HalfOpen
+	}
+	return b.state
+}
+
+// Allow reports whether a call may go to the backend. Every call that is allowed
+// must be followed by exactly one Record with its outcome.
+func (b *Breaker) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case Closed:
+		return true
+
+	case Open:
+		if time.Since(b.openedAt) < b.openFor {
+			break
+		}
+		b.state = HalfOpen
+		b.probing = true
+		return true
+
+	case HalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true
+		}
+	}
+
+	metrics.IncCounter(b.metricRejected)
+	return false
+}
+
+// Record reports the outcome of a call that was allowed.
+func (b *Breaker) Record(failed bool, dur time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if failed {
+		metrics.IncCounter(b.metricFailures)
+	}
+
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.close()
+		}
+		return
+
+	case Open:
+		// A call that started before the breaker opened
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(b.windowStart) >= b.window {
+		b.resetWindow(now)
+	}
+
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if b.slowCall > 0 && dur > b.slowCall {
+		b.slow++
+	}
+
+	if b.calls < b.minRequests {
+		return
+	}
+
+	calls := float64(b.calls)
+	if float64(b.failures)/calls >= b.errorRatio ||
+		(b.slowCall > 0 && float64(b.slow)/calls >= b.slowRatio) {
+		b.open()
+	}
+}
+
+func (b *Breaker) open() {
+	b.state = Open
+	b.openedAt = time.Now()
+	metrics.IncCounter(b.metricOpened)
+}
+
+func (b *Breaker) close() {
+	b.state = Closed
+	b.resetWindow(time.Now())
+	metrics.IncCounter(b.metricClosed)
+}
+
+func (b *Breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.calls = 0
+	b.failures = 0
+	b.slow = 0
+}
+
+func printBreakers(w http.ResponseWriter, r *http.Request) {
+	breakersLock.Lock()
+	var names []string
+	for name := range breakers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bs := make([]*Breaker, len(names))
+	for i, name := range names {
+		bs[i] = breakers[name]
+	}
+	breakersLock.Unlock()
+
+	for _, b := range bs {
+		fmt.Fprintf(w, "%s %s\n", b.name, b.State())
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package breaker
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// fresh returns a new breaker even if a previous test run registered the name.
+func fresh(name string, opts Opts) *Breaker {
+	breakersLock.Lock()
+	delete(breakers, name)
+	breakersLock.Unlock()
+	return New(name, opts)
+}
+
+func TestBreaker(t *testing.T) {
+	t.Run("ErrorRatio", func(t *testing.T) {
+		b := fresh("test-error-ratio", Opts{MinRequests: 4})
+
+		b.Record(false, 0)
+		b.Record(true, 0)
+		b.Record(false, 0)
+		if b.State() != Closed {
+			t.Fatalf("Expected the breaker to stay closed under MinRequests")
+		}
+
+		b.Record(true, 0)
+		if b.State() != Open {
+			t.Fatalf("Expected the breaker to open at a 50%% error ratio, got %v", b.State())
+		}
+		if b.Allow() {
+			t.Fatalf("Expected an open breaker to reject calls")
+		}
+	})
+	t.Run("Latency", func(t *testing.T) {
+		b := fresh("test-latency", Opts{MinRequests: 2, SlowCallMillis: 10})
+
+		b.Record(false, time.Second)
+		b.Record(false, time.Second)
+		if b.State() != Open {
+			t.Fatalf("Expected slow calls to open the breaker, got %v", b.State())
+		}
+	})
+	t.Run("HalfOpen", func(t *testing.T) {
+		b := fresh("test-half-open", Opts{MinRequests: 1})
+		b.openFor = time.Millisecond
+
+		b.Record(true, 0)
+		time.Sleep(2 * time.Millisecond)
+
+		if b.State() != HalfOpen {
+			t.Fatalf("Expected the breaker to be half-open, got %v", b.State())
+		}
+		if !b.Allow() {
+			t.Fatalf("Expected a probe to be allowed")
+		}
+		if b.Allow() {
+			t.Fatalf("Expected only one probe at a time")
+		}
+
+		// A failed probe opens it again, a good one closes it
+		b.Record(true, 0)
+		if b.State() != Open {
+			t.Fatalf("Expected a failed probe to reopen the breaker, got %v", b.State())
+		}
+
+		time.Sleep(2 * time.Millisecond)
+		if !b.Allow() {
+			t.Fatalf("Expected a probe to be allowed")
+		}
+		b.Record(false, 0)
+		if b.State() != Closed {
+			t.Fatalf("Expected a good probe to close the breaker, got %v", b.State())
+		}
+	})
+	t.Run("DebugEndpoint", func(t *testing.T) {
+		fresh("test-debug", Opts{})
+
+		w := httptest.NewRecorder()
+		printBreakers(w, httptest.NewRequest("GET", "/breakers", nil))
+
+		if !strings.Contains(w.Body.String(), "test-debug closed\n") {
+			t.Fatalf("Expected the breaker in the output, got '%v'", w.Body.String())
+		}
+	})
+}
+
+type flakyHandler struct {
+	handlers.Handler
+	err    error
+	closed bool
+}
+
+func (h *flakyHandler) Set(cmd common.SetRequest) error { return h.err }
+func (h *flakyHandler) Close() error {
+	h.closed = true
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	b := fresh("test-handler", Opts{MinRequests: 4})
+
+	var dials int
+	var dialErr error
+	inner := &flakyHandler{err: io.EOF}
+
+	hc := Handler(func() (handlers.Handler, error) {
+		dials++
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		return inner, nil
+	}, b)
+
+	h, err := hc()
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+
+	// Fatal errors become temporary failures and drop the inner handler
+	if err := h.Set(common.SetRequest{}); err != common.ErrTempFailure {
+		t.Fatalf("Expected ErrTempFailure, got %v", err)
+	}
+	if !inner.closed {
+		t.Fatalf("Expected the broken handler to be closed")
+	}
+
+	// Protocol errors pass through and don't count against the backend
+	inner.err = common.ErrItemNotStored
+	if err := h.Set(common.SetRequest{}); err != common.ErrItemNotStored {
+		t.Fatalf("Expected ErrItemNotStored, got %v", err)
+	}
+	if dials != 2 {
+		t.Fatalf("Expected the handler to be recreated once, got %d dials", dials)
+	}
+
+	// A backend that can't be reached opens the breaker and calls stop dialing
+	dialErr = errors.New("connection refused")
+	inner.err = io.EOF
+	h.Set(common.SetRequest{})
+	h.Set(common.SetRequest{})
+
+	if b.State() != Open {
+		t.Fatalf("Expected the breaker to be open, got %v", b.State())
+	}
+
+	dials = 0
+	if err := h.Set(common.SetRequest{}); err != common.ErrTempFailure {
+		t.Fatalf("Expected ErrTempFailure, got %v", err)
+	}
+	if dials != 0 {
+		t.Fatalf("Expected no dials while the breaker is open, got %d", dials)
+	}
+}
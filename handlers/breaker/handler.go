@@ -0,0 +1,276 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package breaker
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// Handler wraps a handler constructor so every call goes through the breaker.
+//
+// Backend failures never reach the caller as fatal errors. A call that fails
+// with one, or that the breaker rejects, returns common.ErrTempFailure instead,
+// so the client connection stays up while the backend is down. The underlying
+// handler is dropped after a fatal error and a new one is created the next time
+// the breaker allows a call, which also means a connection can be accepted while
+// the backend is unreachable.
+func Handler(hc handlers.HandlerConst, b *Breaker) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		h := &handler{
+			hc: hc,
+			b:  b,
+		}
+
+		// Try to connect up front, but don't fail the client connection over it
+		if b.Allow() {
+			start := time.Now()
+			inner, err := hc()
+			b.Record(err != nil, time.Since(start))
+			if err == nil {
+				h.h = inner
+			}
+		}
+
+		return h, nil
+	}
+}
+
+type handler struct {
+	hc handlers.HandlerConst
+	b  *Breaker
+	h  handlers.Handler
+}
+
+// failed reports whether an error means the backend is unhealthy. Protocol
+// errors like a key not being found are normal responses from a healthy backend.
+func failed(err error) bool {
+	return err != nil && !common.IsAppError(err)
+}
+
+// acquire asks the breaker for permission to make a call and makes sure there
+// is a handler to make it with. On success the caller must call release.
+func (h *handler) acquire() (handlers.Handler, time.Time, error) {
+	if !h.b.Allow() {
+		return nil, time.Time{}, common.ErrTempFailure
+	}
+
+	start := time.Now()
+
+	if h.h == nil {
+		inner, err := h.hc()
+		if err != nil {
+			h.b.Record(true, time.Since(start))
+			return nil, time.Time{}, common.ErrTempFailure
+		}
+		h.h = inner
+	}
+
+	return h.h, start, nil
+}
+
+// release records the outcome of a call and converts backend failures into
+// temporary failures after throwing away the broken handler.
+func (h *handler) release(start time.Time, err error) error {
+	h.b.Record(failed(err), time.Since(start))
+
+	if failed(err) {
+		h.drop()
+		return common.ErrTempFailure
+	}
+
+	return err
+}
+
+func (h *handler) drop() {
+	if h.h != nil {
+		h.h.Close()
+		h.h = nil
+	}
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Set(cmd))
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Add(cmd))
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Replace(cmd))
+}
+
+func (h *handler) Append(cmd common.SetRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Append(cmd))
+}
+
+func (h *handler) Prepend(cmd common.SetRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Prepend(cmd))
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Delete(cmd))
+}
+
+func (h *handler) Touch(cmd common.TouchRequest) error {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return err
+	}
+	return h.release(start, inner.Touch(cmd))
+}
+
+func (h *handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	inner, start, err := h.acquire()
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+	res, err := inner.GAT(cmd)
+	return res, h.release(start, err)
+}
+
+func errorChans(err error) chan error {
+	errchan := make(chan error, 1)
+	errchan <- err
+	close(errchan)
+	return errchan
+}
+
+// Get results are passed through as they arrive. The outcome is only known once
+// the inner channels are done, and it is recorded before the outer channels are
+// closed so the handler is in a consistent state for the next call.
+func (h *handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	inner, start, err := h.acquire()
+	if err != nil {
+		reschan := make(chan common.GetResponse)
+		close(reschan)
+		return reschan, errorChans(err)
+	}
+
+	resChan, errChan := inner.Get(cmd)
+	outRes := make(chan common.GetResponse, len(cmd.Keys))
+	outErr := make(chan error, 1)
+
+	go func() {
+		var err error
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					outRes <- res
+				}
+
+			case getErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					err = getErr
+				}
+			}
+
+			if resChan == nil && errChan == nil {
+				break
+			}
+		}
+
+		if err = h.release(start, err); err != nil {
+			outErr <- err
+		}
+		close(outRes)
+		close(outErr)
+	}()
+
+	return outRes, outErr
+}
+
+func (h *handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	inner, start, err := h.acquire()
+	if err != nil {
+		reschan := make(chan common.GetEResponse)
+		close(reschan)
+		return reschan, errorChans(err)
+	}
+
+	resChan, errChan := inner.GetE(cmd)
+	outRes := make(chan common.GetEResponse, len(cmd.Keys))
+	outErr := make(chan error, 1)
+
+	go func() {
+		var err error
+		for {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					outRes <- res
+				}
+
+			case getErr, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					err = getErr
+				}
+			}
+
+			if resChan == nil && errChan == nil {
+				break
+			}
+		}
+
+		if err = h.release(start, err); err != nil {
+			outErr <- err
+		}
+		close(outRes)
+		close(outErr)
+	}()
+
+	return outRes, outErr
+}
+
+func (h *handler) Close() error {
+	h.drop()
+	return nil
+}
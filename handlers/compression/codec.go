@@ -0,0 +1,228 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// Codec compresses and decompresses values. Every codec has an ID that is
+// stored with the values it compresses, so items written with one codec can
+// still be read after the handler is switched to another. Codecs must be safe
+// for concurrent use.
+type Codec interface {
+	// ID identifies the codec in stored values. IDs 0-15 are reserved for the
+	// codecs in this package.
+	ID() byte
+	// Name identifies the codec in metrics and flags.
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+const (
+	FlateID byte = 1
+	GzipID  byte = 2
+	ZlibID  byte = 3
+)
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// streamCodec adapts one of the stdlib compress packages to Codec. Writers are
+// expensive to set up, so they are pooled.
+type streamCodec struct {
+	id        byte
+	name      string
+	writers   *sync.Pool
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+func newStreamCodec(id byte, name string, level int,
+	newWriter func(w io.Writer, level int) (resetWriter, error),
+	newReader func(r io.Reader) (io.ReadCloser, error)) (Codec, error) {
+
+	// Fail up front on a bad level instead of on every compression
+	if _, err := newWriter(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+
+	return &streamCodec{
+		id:   id,
+		name: name,
+		writers: &sync.Pool{
+			New: func() interface{} {
+				w, _ := newWriter(ioutil.Discard, level)
+				return w
+			},
+		},
+		newReader: newReader,
+	}, nil
+}
+
+func (c *streamCodec) ID() byte     { return c.id }
+func (c *streamCodec) Name() string { return c.name }
+
+func (c *streamCodec) Compress(data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+
+	w := c.writers.Get().(resetWriter)
+	defer c.writers.Put(w)
+	w.Reset(buf)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *streamCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := c.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Flate returns a raw DEFLATE codec at the given compress/flate level.
+func Flate(level int) (Codec, error) {
+	return newStreamCodec(FlateID, "flate", level,
+		func(w io.Writer, level int) (resetWriter, error) {
+			return flate.NewWriter(w, level)
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		})
+}
+
+// Gzip returns a gzip codec at the given compress/gzip level.
+func Gzip(level int) (Codec, error) {
+	return newStreamCodec(GzipID, "gzip", level,
+		func(w io.Writer, level int) (resetWriter, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		})
+}
+
+// Zlib returns a zlib codec at the given compress/zlib level.
+func Zlib(level int) (Codec, error) {
+	return newStreamCodec(ZlibID, "zlib", level,
+		func(w io.Writer, level int) (resetWriter, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		})
+}
+
+// ByName returns one of the codecs in this package by name.
+func ByName(name string, level int) (Codec, error) {
+	switch name {
+	case "flate":
+		return Flate(level)
+	case "gzip":
+		return Gzip(level)
+	case "zlib":
+		return Zlib(level)
+	}
+	return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+// codecInfo is a registered codec and its metrics.
+type codecInfo struct {
+	codec Codec
+
+	metricCompressed     uint32
+	metricSkipped        uint32
+	metricBytesIn        uint32
+	metricBytesOut       uint32
+	metricDecompressed   uint32
+	metricDecompressErrs uint32
+	histCompress         uint32
+	histDecompress       uint32
+	histRatio            uint32
+}
+
+var (
+	codecsLock = new(sync.RWMutex)
+	codecs     [256]*codecInfo
+)
+
+func init() {
+	// Items compressed by any of the stdlib codecs can always be read back. The
+	// level doesn't matter for decompression.
+	for _, c := range []func(int) (Codec, error){Flate, Gzip, Zlib} {
+		codec, _ := c(flate.DefaultCompression)
+		Register(codec)
+	}
+}
+
+// Register makes a codec available for decompressing values. Handlers register
+// the codec they compress with themselves; this is only needed to read items
+// written by a codec that is no longer used to write. Registering a different
+// codec under an ID that is already taken replaces the old one.
+func Register(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	// Keep the metrics when a codec is registered again, e.g. with a new level
+	if old := codecs[c.ID()]; old != nil && old.codec.Name() == c.Name() {
+		info := *old
+		info.codec = c
+		codecs[c.ID()] = &info
+		return
+	}
+
+	tags := metrics.Tags{"codec": c.Name()}
+
+	codecs[c.ID()] = &codecInfo{
+		codec: c,
+
+		metricCompressed:     metrics.AddCounter("compress_compressed", tags),
+		metricSkipped:        metrics.AddCounter("compress_skipped", tags),
+		metricBytesIn:        metrics.AddCounter("compress_bytes_in", tags),
+		metricBytesOut:       metrics.AddCounter("compress_bytes_out", tags),
+		metricDecompressed:   metrics.AddCounter("compress_decompressed", tags),
+		metricDecompressErrs: metrics.AddCounter("compress_decompress_errors", tags),
+		histCompress:         metrics.AddHistogram("compress_time", false, tags),
+		histDecompress:       metrics.AddHistogram("decompress_time", false, tags),
+		histRatio:            metrics.AddHistogram("compress_ratio_percent", false, tags),
+	}
+}
+
+func lookup(id byte) *codecInfo {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecs[id]
+}
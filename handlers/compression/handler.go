@@ -0,0 +1,280 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compression provides a handler wrapper that transparently compresses
+// large values on their way into a backend and decompresses them on the way out.
+//
+// Compressed items are marked with FlagCompressed and their data starts with the
+// ID of the codec that compressed them. Items without the flag are passed through
+// untouched, so data written before compression was turned on keeps working.
+package compression
+
+import (
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// FlagCompressed is the bit in an item's flags that marks it as compressed. It is
+// reserved: clients can't set it and never see it.
+const FlagCompressed uint32 = 1 << 31
+
+const defaultThreshold = 1024
+
+// Opts configures the compression handler. Any zero value assumes the default.
+type Opts struct {
+	// Codec compresses new values. Default: flate at the default level
+	Codec Codec
+
+	// Threshold is the size in bytes at or above which values are compressed.
+	// Default: 1024
+	Threshold uint32
+}
+
+// Handler wraps a handler constructor so values of at least opts.Threshold bytes
+// are compressed on Set, Add and Replace and decompressed on Get, GetE and GAT.
+// Values that don't get smaller are stored as is.
+//
+// Appending to a compressed item means decompressing it first, so Append and
+// Prepend read the whole item and write it back recompressed with Replace. A
+// write to the key in between is overwritten; put the locked orca in front if
+// keys that are appended to are also written concurrently.
+func Handler(hc handlers.HandlerConst, opts Opts) handlers.HandlerConst {
+	if opts.Codec == nil {
+		opts.Codec, _ = Flate(-1)
+	}
+	if opts.Threshold == 0 {
+		opts.Threshold = defaultThreshold
+	}
+
+	Register(opts.Codec)
+
+	return func() (handlers.Handler, error) {
+		inner, err := hc()
+		if err != nil {
+			return nil, err
+		}
+
+		return &handler{
+			h:         inner,
+			codec:     opts.Codec,
+			info:      lookup(opts.Codec.ID()),
+			threshold: opts.Threshold,
+		}, nil
+	}
+}
+
+type handler struct {
+	h         handlers.Handler
+	codec     Codec
+	info      *codecInfo
+	threshold uint32
+}
+
+// encode compresses a value for storage, returning the data and flags to store.
+func (h *handler) encode(data []byte, flags uint32) ([]byte, uint32) {
+	if uint32(len(data)) < h.threshold {
+		return data, flags
+	}
+
+	start := timer.Now()
+	compressed, err := h.codec.Compress(data)
+	metrics.ObserveHist(h.info.histCompress, timer.Since(start))
+
+	// Not worth it, so keep the original
+	if err != nil || len(compressed)+1 >= len(data) {
+		metrics.IncCounter(h.info.metricSkipped)
+		return data, flags
+	}
+
+	out := make([]byte, len(compressed)+1)
+	out[0] = h.codec.ID()
+	copy(out[1:], compressed)
+
+	metrics.IncCounter(h.info.metricCompressed)
+	metrics.IncCounterBy(h.info.metricBytesIn, uint64(len(data)))
+	metrics.IncCounterBy(h.info.metricBytesOut, uint64(len(out)))
+	metrics.ObserveHist(h.info.histRatio, uint64(len(out)*100/len(data)))
+
+	return out, flags | FlagCompressed
+}
+
+// decode returns the value a client stored. ok is false if the item is
+// compressed and can't be decompressed.
+func decode(data []byte, flags uint32) (out []byte, outFlags uint32, ok bool) {
+	if flags&FlagCompressed == 0 {
+		return data, flags, true
+	}
+	flags &^= FlagCompressed
+
+	if len(data) == 0 {
+		return nil, flags, false
+	}
+
+	info := lookup(data[0])
+	if info == nil {
+		return nil, flags, false
+	}
+
+	start := timer.Now()
+	out, err := info.codec.Decompress(data[1:])
+	metrics.ObserveHist(info.histDecompress, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(info.metricDecompressErrs)
+		return nil, flags, false
+	}
+
+	metrics.IncCounter(info.metricDecompressed)
+	return out, flags, true
+}
+
+func (h *handler) store(cmd common.SetRequest, f func(common.SetRequest) error) error {
+	if cmd.Flags&FlagCompressed != 0 {
+		return common.ErrInvalidArgs
+	}
+	cmd.Data, cmd.Flags = h.encode(cmd.Data, cmd.Flags)
+	return f(cmd)
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Set)
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Add)
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Replace)
+}
+
+func (h *handler) Append(cmd common.SetRequest) error {
+	return h.concat(cmd, h.h.Append, handlers.AppendData)
+}
+
+func (h *handler) Prepend(cmd common.SetRequest) error {
+	return h.concat(cmd, h.h.Prepend, handlers.PrependData)
+}
+
+// concat passes an append or prepend through if the stored item isn't
+// compressed. Otherwise it decompresses the item, joins the new data on and
+// replaces the item with the result, keeping its flags and TTL.
+func (h *handler) concat(cmd common.SetRequest, f func(common.SetRequest) error, join func(old, data []byte) []byte) error {
+	return handlers.Concat(h.h, cmd, FlagCompressed, f, func(cur common.GetEResponse) error {
+		data, flags, ok := decode(cur.Data, cur.Flags)
+		if !ok {
+			return common.ErrInternal
+		}
+
+		data, flags = h.encode(join(data, cmd.Data), flags)
+
+		return h.h.Replace(common.SetRequest{
+			Key:     cmd.Key,
+			Data:    data,
+			Flags:   flags,
+			Exptime: cur.Exptime,
+			Opaque:  cmd.Opaque,
+			Quiet:   cmd.Quiet,
+		})
+	})
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	return h.h.Delete(cmd)
+}
+
+func (h *handler) Touch(cmd common.TouchRequest) error {
+	return h.h.Touch(cmd)
+}
+
+func (h *handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.h.GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+
+	var ok bool
+	if res.Data, res.Flags, ok = decode(res.Data, res.Flags); !ok {
+		return common.GetResponse{
+			Miss:   true,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
+			Key:    res.Key,
+		}, nil
+	}
+
+	return res, nil
+}
+
+// Get results are decompressed as they arrive. An item that can't be
+// decompressed is returned as a miss.
+func (h *handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan, errChan := h.h.Get(cmd)
+	outRes := make(chan common.GetResponse, len(cmd.Keys))
+
+	go func() {
+		for res := range resChan {
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = decode(res.Data, res.Flags); !ok {
+					res = common.GetResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    res.Key,
+					}
+				}
+			}
+			outRes <- res
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan, errChan := h.h.GetE(cmd)
+	if resChan == nil {
+		return resChan, errChan
+	}
+
+	outRes := make(chan common.GetEResponse, len(cmd.Keys))
+
+	go func() {
+		for res := range resChan {
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = decode(res.Data, res.Flags); !ok {
+					res = common.GetEResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    res.Key,
+					}
+				}
+			}
+			outRes <- res
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) Close() error {
+	return h.h.Close()
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compression
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+type item struct {
+	data    []byte
+	flags   uint32
+	exptime uint32
+}
+
+// storeHandler keeps items in a map and stores exactly what it is given.
+type storeHandler struct {
+	handlers.Handler
+	items map[string]item
+}
+
+func newStoreHandler() *storeHandler {
+	return &storeHandler{items: make(map[string]item)}
+}
+
+func (h *storeHandler) Set(cmd common.SetRequest) error {
+	h.items[string(cmd.Key)] = item{cmd.Data, cmd.Flags, cmd.Exptime}
+	return nil
+}
+
+func (h *storeHandler) Replace(cmd common.SetRequest) error {
+	if _, ok := h.items[string(cmd.Key)]; !ok {
+		return common.ErrItemNotStored
+	}
+	return h.Set(cmd)
+}
+
+func (h *storeHandler) Append(cmd common.SetRequest) error {
+	it, ok := h.items[string(cmd.Key)]
+	if !ok {
+		return common.ErrItemNotStored
+	}
+	it.data = append(it.data[:len(it.data):len(it.data)], cmd.Data...)
+	h.items[string(cmd.Key)] = it
+	return nil
+}
+
+func (h *storeHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for _, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetResponse{Key: key, Data: it.data, Flags: it.flags, Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (h *storeHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for _, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetEResponse{Key: key, Data: it.data, Flags: it.flags, Exptime: it.exptime, Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (h *storeHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	it, ok := h.items[string(cmd.Key)]
+	return common.GetResponse{Key: cmd.Key, Data: it.data, Flags: it.flags, Miss: !ok}, nil
+}
+
+func get(t *testing.T, h handlers.Handler, key string) common.GetResponse {
+	res, err := handlers.DrainGet(h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}))
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return res
+}
+
+func TestHandler(t *testing.T) {
+	big := []byte(strings.Repeat("recommendation ", 200))
+
+	for _, name := range []string{"flate", "gzip", "zlib"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := ByName(name, -1)
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			store := newStoreHandler()
+			h, _ := Handler(func() (handlers.Handler, error) { return store, nil }, Opts{Codec: codec})()
+
+			if err := h.Set(common.SetRequest{Key: []byte("big"), Data: big, Flags: 7}); err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			stored := store.items["big"]
+			if stored.flags != 7|FlagCompressed || len(stored.data) >= len(big) || stored.data[0] != codec.ID() {
+				t.Fatalf("Expected a compressed item, got %d bytes with flags %x", len(stored.data), stored.flags)
+			}
+
+			res := get(t, h, "big")
+			if res.Miss || res.Flags != 7 || !bytes.Equal(res.Data, big) {
+				t.Fatalf("Expected the original value back, got flags %x and %d bytes", res.Flags, len(res.Data))
+			}
+
+			gat, err := h.GAT(common.GATRequest{Key: []byte("big")})
+			if err != nil || gat.Flags != 7 || !bytes.Equal(gat.Data, big) {
+				t.Fatalf("Expected the original value from GAT, got %v", err)
+			}
+		})
+	}
+
+	store := newStoreHandler()
+	h, _ := Handler(func() (handlers.Handler, error) { return store, nil }, Opts{})()
+
+	t.Run("Small", func(t *testing.T) {
+		h.Set(common.SetRequest{Key: []byte("small"), Data: []byte("foo"), Flags: 1})
+		if it := store.items["small"]; it.flags != 1 || string(it.data) != "foo" {
+			t.Fatalf("Expected small values to be stored as is, got %q", it.data)
+		}
+	})
+	t.Run("Legacy", func(t *testing.T) {
+		store.items["legacy"] = item{data: big, flags: 3}
+		if res := get(t, h, "legacy"); res.Flags != 3 || !bytes.Equal(res.Data, big) {
+			t.Fatalf("Expected uncompressed items to pass through")
+		}
+	})
+	t.Run("ReservedFlag", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte("bad"), Flags: FlagCompressed}); err != common.ErrInvalidArgs {
+			t.Fatalf("Expected ErrInvalidArgs, got %v", err)
+		}
+	})
+	t.Run("Corrupt", func(t *testing.T) {
+		store.items["corrupt"] = item{data: []byte{FlateID, 0xff, 0xff}, flags: FlagCompressed}
+		if res := get(t, h, "corrupt"); !res.Miss {
+			t.Fatalf("Expected an item that can't be decompressed to be a miss")
+		}
+	})
+	t.Run("Append", func(t *testing.T) {
+		h.Set(common.SetRequest{Key: []byte("append"), Data: big, Exptime: 60})
+		if err := h.Append(common.SetRequest{Key: []byte("append"), Data: []byte("tail")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Prepend(common.SetRequest{Key: []byte("append"), Data: []byte("head")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		want := "head" + string(big) + "tail"
+		if res := get(t, h, "append"); string(res.Data) != want {
+			t.Fatalf("Expected the appended value, got %d bytes", len(res.Data))
+		}
+		if it := store.items["append"]; it.flags&FlagCompressed == 0 || it.exptime != 60 {
+			t.Fatalf("Expected the item to stay compressed with its TTL, got flags %x and TTL %d", it.flags, it.exptime)
+		}
+
+		// Uncompressed items are appended to directly
+		if err := h.Append(common.SetRequest{Key: []byte("small"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if it := store.items["small"]; string(it.data) != "foobar" {
+			t.Fatalf("Expected foobar, got %q", it.data)
+		}
+
+		if err := h.Append(common.SetRequest{Key: []byte("missing"), Data: []byte("bar")}); err != common.ErrItemNotStored {
+			t.Fatalf("Expected ErrItemNotStored, got %v", err)
+		}
+	})
+}
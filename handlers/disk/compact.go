@@ -0,0 +1,160 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+func (s *Store) compactLoop() {
+	defer close(s.done)
+
+	t := time.NewTicker(s.opts.CompactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			if err := s.Compact(); err != nil {
+				log.Printf("Error compacting disk store in %s: %v\n", s.opts.Dir, err)
+			}
+		}
+	}
+}
+
+// Compact rewrites every full segment whose share of live data is below the
+// compaction ratio. Expired items count as dead, so segments of short lived
+// data are reclaimed without waiting for their items to be overwritten. It is
+// run periodically in the background, and is only exported for tools and tests.
+func (s *Store) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	start := timer.Now()
+	defer func() { metrics.ObserveHist(HistCompact, timer.Since(start)) }()
+
+	now := uint32(time.Now().Unix())
+
+	s.mu.RLock()
+	oldest := s.oldest()
+	live := make(map[uint32]int64, len(s.segments))
+	for _, l := range s.index {
+		// Tombstones are needed until no older segment could hold the key
+		if l.deleted && l.seg == oldest || !l.deleted && l.isExpired(now) {
+			continue
+		}
+		live[l.seg] += int64(l.size)
+	}
+
+	var ids []uint32
+	for id, seg := range s.segments {
+		if seg != s.active && float64(live[id]) < s.opts.CompactRatio*float64(seg.size) {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		if err := s.compactSegment(id); err != nil {
+			metrics.IncCounter(MetricCompactErrors)
+			return err
+		}
+		metrics.IncCounter(MetricCompactions)
+	}
+
+	return nil
+}
+
+// oldest returns the id of the oldest segment. The caller must hold mu.
+func (s *Store) oldest() uint32 {
+	oldest := s.active.id
+	for id := range s.segments {
+		if id < oldest {
+			oldest = id
+		}
+	}
+	return oldest
+}
+
+// compactSegment copies the live records in a sealed segment to the active one
+// and removes it. Only one record is copied per hold of the lock, so requests
+// aren't blocked for the whole segment. The segment can be read without the
+// lock because it doesn't change and only compaction removes it.
+func (s *Store) compactSegment(id uint32) error {
+	s.mu.RLock()
+	seg := s.segments[id]
+	s.mu.RUnlock()
+
+	var werr error
+	_, err := scan(seg.f, seg.size, func(off int64, kind byte, key []byte, flags, exptime uint32, data []byte) {
+		if werr != nil {
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Skip records that have been replaced since
+		l, ok := s.index[string(key)]
+		if !ok || l.seg != id || l.off != off {
+			return
+		}
+
+		dead := l.deleted || l.isExpired(uint32(time.Now().Unix()))
+		switch {
+		case dead && id == s.oldest():
+			// No older segment can bring the key back on recovery
+			delete(s.index, string(key))
+		case dead:
+			werr = s.write(string(key), encode(recordDelete, key, 0, 0, nil), 0, true)
+		default:
+			werr = s.write(string(key), encode(recordPut, key, flags, exptime, data), exptime, false)
+			metrics.IncCounterBy(MetricCompactCopied, uint64(l.size))
+		}
+	})
+	if werr != nil {
+		return werr
+	}
+
+	// A bad record ends the scan like it did on recovery, and the rest of the
+	// segment is dropped with it
+	if err != nil && err != errCorrupt {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Make sure the copies are on disk before the originals are gone
+	if err := s.active.f.Sync(); err != nil {
+		return err
+	}
+
+	delete(s.segments, id)
+	seg.f.Close()
+	metrics.IncCounterBy(MetricCompactReclaimed, uint64(seg.size))
+
+	return os.Remove(seg.f.Name())
+}
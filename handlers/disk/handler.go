@@ -0,0 +1,283 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+// Handler returns a constructor that serves every connection from the same
+// store. Closing a connection's handler leaves the store open.
+func Handler(s *Store) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return handler{s}, nil
+	}
+}
+
+type handler struct {
+	s *Store
+}
+
+// absExptime turns a relative exptime into an absolute one.
+func absExptime(exptime uint32) uint32 {
+	if exptime == 0 || exptime > maxRelativeExptime {
+		return exptime
+	}
+	return uint32(time.Now().Unix()) + exptime
+}
+
+// remainingTTL turns an absolute exptime back into the number of seconds left,
+// unless that is too long to be relative.
+func remainingTTL(exptime uint32) uint32 {
+	if exptime == 0 {
+		return 0
+	}
+
+	now := uint32(time.Now().Unix())
+	if exptime <= now {
+		return 1
+	}
+	if ttl := exptime - now; ttl <= maxRelativeExptime {
+		return ttl
+	}
+	return exptime
+}
+
+// live returns the location of a key's item if it is there and not expired. The
+// caller must hold mu.
+func (s *Store) live(key []byte) (loc, bool) {
+	l, ok := s.index[string(key)]
+	if !ok || l.deleted || l.isExpired(uint32(time.Now().Unix())) {
+		return loc{}, false
+	}
+	return l, true
+}
+
+// get reads a key's item, treating a corrupt record as a miss.
+func (s *Store) get(key []byte) (flags uint32, data []byte, exptime uint32, ok bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	l, ok := s.live(key)
+	if !ok {
+		return 0, nil, 0, false, nil
+	}
+
+	flags, data, err = s.read(l)
+	if err == errCorrupt {
+		return 0, nil, 0, false, nil
+	}
+	if err != nil {
+		return 0, nil, 0, false, err
+	}
+	return flags, data, l.exptime, true, nil
+}
+
+// put writes an item. The caller must hold mu.
+func (s *Store) put(key []byte, flags, exptime uint32, data []byte) error {
+	if len(key) > 0xffff {
+		return common.ErrInvalidArgs
+	}
+	return s.write(string(key), encode(recordPut, key, flags, exptime, data), exptime, false)
+}
+
+func (h handler) Set(cmd common.SetRequest) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	return h.s.put(cmd.Key, cmd.Flags, absExptime(cmd.Exptime), cmd.Data)
+}
+
+func (h handler) Add(cmd common.SetRequest) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	if _, ok := h.s.live(cmd.Key); ok {
+		return common.ErrKeyExists
+	}
+	return h.s.put(cmd.Key, cmd.Flags, absExptime(cmd.Exptime), cmd.Data)
+}
+
+func (h handler) Replace(cmd common.SetRequest) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	if _, ok := h.s.live(cmd.Key); !ok {
+		return common.ErrKeyNotFound
+	}
+	return h.s.put(cmd.Key, cmd.Flags, absExptime(cmd.Exptime), cmd.Data)
+}
+
+// modify rewrites a key's item with f applied to its data, keeping its flags and
+// exptime.
+func (h handler) modify(key []byte, f func([]byte) []byte) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	l, ok := h.s.live(key)
+	if !ok {
+		return common.ErrItemNotStored
+	}
+
+	flags, data, err := h.s.read(l)
+	if err == errCorrupt {
+		return common.ErrItemNotStored
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.s.put(key, flags, l.exptime, f(data))
+}
+
+func (h handler) Append(cmd common.SetRequest) error {
+	return h.modify(cmd.Key, func(data []byte) []byte {
+		return append(data, cmd.Data...)
+	})
+}
+
+func (h handler) Prepend(cmd common.SetRequest) error {
+	return h.modify(cmd.Key, func(data []byte) []byte {
+		return append(cmd.Data[:len(cmd.Data):len(cmd.Data)], data...)
+	})
+}
+
+func (h handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	dataOut := make(chan common.GetResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	for idx, key := range cmd.Keys {
+		flags, data, _, ok, err := h.s.get(key)
+		if err != nil {
+			errorOut <- err
+			break
+		}
+
+		dataOut <- common.GetResponse{
+			Miss:   !ok,
+			Quiet:  cmd.Quiet[idx],
+			Opaque: cmd.Opaques[idx],
+			Flags:  flags,
+			Key:    key,
+			Data:   data,
+		}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+// GetE returns the seconds each item has left to live as its exptime.
+func (h handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
+	errorOut := make(chan error, 1)
+
+	for idx, key := range cmd.Keys {
+		flags, data, exptime, ok, err := h.s.get(key)
+		if err != nil {
+			errorOut <- err
+			break
+		}
+
+		dataOut <- common.GetEResponse{
+			Miss:    !ok,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Exptime: remainingTTL(exptime),
+			Flags:   flags,
+			Key:     key,
+			Data:    data,
+		}
+	}
+
+	close(dataOut)
+	close(errorOut)
+	return dataOut, errorOut
+}
+
+func (h handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	miss := common.GetResponse{
+		Miss:   true,
+		Opaque: cmd.Opaque,
+		Key:    cmd.Key,
+	}
+
+	l, ok := h.s.live(cmd.Key)
+	if !ok {
+		return miss, nil
+	}
+
+	flags, data, err := h.s.read(l)
+	if err == errCorrupt {
+		return miss, nil
+	}
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+
+	if err := h.s.put(cmd.Key, flags, absExptime(cmd.Exptime), data); err != nil {
+		return common.GetResponse{}, err
+	}
+
+	return common.GetResponse{
+		Miss:   false,
+		Opaque: cmd.Opaque,
+		Flags:  flags,
+		Key:    cmd.Key,
+		Data:   data,
+	}, nil
+}
+
+func (h handler) Delete(cmd common.DeleteRequest) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	if _, ok := h.s.live(cmd.Key); !ok {
+		return common.ErrKeyNotFound
+	}
+	return h.s.write(string(cmd.Key), encode(recordDelete, cmd.Key, 0, 0, nil), 0, true)
+}
+
+func (h handler) Touch(cmd common.TouchRequest) error {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	l, ok := h.s.live(cmd.Key)
+	if !ok {
+		return common.ErrKeyNotFound
+	}
+
+	flags, data, err := h.s.read(l)
+	if err == errCorrupt {
+		return common.ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return h.s.put(cmd.Key, flags, absExptime(cmd.Exptime), data)
+}
+
+// Close does nothing, since the store outlives the connections using it.
+func (h handler) Close() error {
+	return nil
+}
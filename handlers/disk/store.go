@@ -0,0 +1,457 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package disk is a log-structured store on local disk that can be used as L2
+// in place of a separate server.
+//
+// Every write appends a record to the newest segment file, and an in-memory
+// index maps each key to its latest record. Deletes append a tombstone so the
+// key stays deleted after a restart. Once the newest segment is full a new one
+// is started. A background compactor rewrites older segments that are mostly
+// overwritten, deleted or expired data by copying their live records to the
+// newest segment and removing the old file. On startup the index is rebuilt by
+// scanning the segments from oldest to newest, and a torn write at the end of
+// the newest segment is cut off.
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+const (
+	defaultSegmentBytes    = 64 * 1024 * 1024
+	defaultCompactRatio    = 0.5
+	defaultCompactInterval = time.Minute
+
+	segmentExt = ".seg"
+
+	// Exptimes above this are absolute unix timestamps, like in memcached
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// Record layout, all integers big endian:
+//
+//	crc32c uint32 of the rest of the record
+//	kind uint8, key length uint16, flags uint32, exptime uint32, data length uint32
+//	key, data
+const (
+	recordPut    = 1
+	recordDelete = 2
+
+	headerSize = 4 + 1 + 2 + 4 + 4 + 4
+)
+
+var (
+	errCorrupt = errors.New("disk: corrupt record")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	MetricCorrupt           = metrics.AddCounter("disk_corrupt_records", nil)
+	MetricRecovered         = metrics.AddCounter("disk_recovered_records", nil)
+	MetricRecoveryTruncated = metrics.AddCounter("disk_recovery_truncated", nil)
+	MetricCompactions       = metrics.AddCounter("disk_compactions", nil)
+	MetricCompactCopied     = metrics.AddCounter("disk_compact_copied_bytes", nil)
+	MetricCompactReclaimed  = metrics.AddCounter("disk_compact_reclaimed_bytes", nil)
+	MetricCompactErrors     = metrics.AddCounter("disk_compact_errors", nil)
+
+	HistCompact = metrics.AddHistogram("disk_compact", false, nil)
+)
+
+// Opts configures a disk store.
+type Opts struct {
+	// Dir holds the segment files. It is created if it doesn't exist.
+	Dir string
+
+	// SegmentBytes is the size at which a new segment is started. Default: 64MB
+	SegmentBytes int64
+
+	// CompactRatio is the fraction of live data below which a segment is
+	// compacted. Default: 0.5
+	CompactRatio float64
+
+	// CompactInterval is the time between compaction passes. Default: 1 minute
+	CompactInterval time.Duration
+
+	// SyncWrites syncs the segment to disk after every write instead of leaving
+	// it to the OS. Default: false
+	SyncWrites bool
+}
+
+type segment struct {
+	id   uint32
+	f    *os.File
+	size int64
+}
+
+// loc is where the latest record for a key is, with enough of the record to
+// answer whether it is live without reading it.
+type loc struct {
+	seg     uint32
+	off     int64
+	size    uint32
+	exptime uint32
+	deleted bool
+}
+
+func (l loc) isExpired(now uint32) bool {
+	return l.exptime != 0 && l.exptime < now
+}
+
+// Store is a log-structured store shared by every connection. Use Handler to
+// serve it.
+type Store struct {
+	opts Opts
+
+	// mu guards the index and segments. Reads share it, and writes and the
+	// removal of compacted segments take it exclusively.
+	mu       sync.RWMutex
+	index    map[string]loc
+	segments map[uint32]*segment
+	active   *segment
+
+	// compactMu allows one compaction at a time
+	compactMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Open opens the store in opts.Dir, rebuilding the index from the segments
+// there, and starts the background compactor.
+func Open(opts Opts) (*Store, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("disk: no directory")
+	}
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = defaultSegmentBytes
+	}
+	if opts.CompactRatio <= 0 {
+		opts.CompactRatio = defaultCompactRatio
+	}
+	if opts.CompactInterval <= 0 {
+		opts.CompactInterval = defaultCompactInterval
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		opts:     opts,
+		index:    make(map[string]loc),
+		segments: make(map[uint32]*segment),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := s.recover(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	metrics.RegisterIntGaugeCallback("disk_bytes", nil, func() uint64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		var total int64
+		for _, seg := range s.segments {
+			total += seg.size
+		}
+		return uint64(total)
+	})
+	metrics.RegisterIntGaugeCallback("disk_keys", nil, func() uint64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return uint64(len(s.index))
+	})
+	metrics.RegisterIntGaugeCallback("disk_segments", nil, func() uint64 {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return uint64(len(s.segments))
+	})
+
+	go s.compactLoop()
+
+	return s, nil
+}
+
+// Close stops the compactor and syncs and closes the segment files. The store
+// can't be used afterwards.
+func (s *Store) Close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.active != nil {
+		err = s.active.f.Sync()
+	}
+	if cerr := s.closeFiles(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Store) closeFiles() error {
+	var err error
+	for _, seg := range s.segments {
+		if cerr := seg.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func segmentPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%08x%s", id, segmentExt))
+}
+
+// recover rebuilds the index from the segments on disk, oldest first so later
+// records replace earlier ones.
+func (s *Store) recover() error {
+	files, err := ioutil.ReadDir(s.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	var ids []uint32
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) != segmentExt {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), segmentExt), 16, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		f, err := os.OpenFile(segmentPath(s.opts.Dir, id), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, f: f}
+		s.segments[id] = seg
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		end, err := scan(f, fi.Size(), func(off int64, kind byte, key []byte, flags, exptime uint32, data []byte) {
+			s.index[string(key)] = loc{
+				seg:     id,
+				off:     off,
+				size:    uint32(headerSize + len(key) + len(data)),
+				exptime: exptime,
+				deleted: kind == recordDelete,
+			}
+			metrics.IncCounter(MetricRecovered)
+		})
+		if err != nil && err != errCorrupt {
+			return err
+		}
+		seg.size = end
+
+		if err == errCorrupt {
+			metrics.IncCounter(MetricRecoveryTruncated)
+
+			// The end of the newest segment is most likely a write that was
+			// cut off by a crash, and new writes go after it, so cut it off.
+			// In an older segment it is left for compaction to drop.
+			if i == len(ids)-1 {
+				log.Printf("Truncating segment %s after a bad record at offset %d\n", f.Name(), end)
+				if err := f.Truncate(end); err != nil {
+					return err
+				}
+			} else {
+				log.Printf("Skipping the rest of segment %s after a bad record at offset %d\n", f.Name(), end)
+				seg.size = fi.Size()
+			}
+		}
+
+		s.active = seg
+	}
+
+	if s.active == nil || s.active.size >= s.opts.SegmentBytes {
+		return s.rotate()
+	}
+	return nil
+}
+
+// scan calls f for each good record in a segment of the given size and returns
+// the offset after the last one. It returns errCorrupt if it stopped early at a
+// bad or partial record.
+func scan(r io.ReaderAt, size int64, f func(off int64, kind byte, key []byte, flags, exptime uint32, data []byte)) (int64, error) {
+	var off int64
+	header := make([]byte, headerSize)
+
+	for {
+		n, err := r.ReadAt(header, off)
+		if n == 0 && err == io.EOF {
+			return off, nil
+		}
+		if n < headerSize {
+			if err == nil || err == io.EOF {
+				return off, errCorrupt
+			}
+			return off, err
+		}
+
+		keyLen := int(binary.BigEndian.Uint16(header[5:]))
+		dataLen := int64(binary.BigEndian.Uint32(header[15:]))
+
+		// Check the length before trusting it with an allocation
+		recLen := int64(headerSize+keyLen) + dataLen
+		if off+recLen > size {
+			return off, errCorrupt
+		}
+
+		rec := make([]byte, recLen)
+		if n, err := r.ReadAt(rec, off); n < len(rec) {
+			if err == nil || err == io.EOF {
+				return off, errCorrupt
+			}
+			return off, err
+		}
+
+		kind, key, flags, exptime, data, err := decode(rec)
+		if err != nil {
+			return off, err
+		}
+
+		f(off, kind, key, flags, exptime, data)
+		off += int64(len(rec))
+	}
+}
+
+func encode(kind byte, key []byte, flags, exptime uint32, data []byte) []byte {
+	rec := make([]byte, headerSize+len(key)+len(data))
+	rec[4] = kind
+	binary.BigEndian.PutUint16(rec[5:], uint16(len(key)))
+	binary.BigEndian.PutUint32(rec[7:], flags)
+	binary.BigEndian.PutUint32(rec[11:], exptime)
+	binary.BigEndian.PutUint32(rec[15:], uint32(len(data)))
+	copy(rec[headerSize:], key)
+	copy(rec[headerSize+len(key):], data)
+	binary.BigEndian.PutUint32(rec, crc32.Checksum(rec[4:], crcTable))
+	return rec
+}
+
+func decode(rec []byte) (kind byte, key []byte, flags, exptime uint32, data []byte, err error) {
+	if len(rec) < headerSize || binary.BigEndian.Uint32(rec) != crc32.Checksum(rec[4:], crcTable) {
+		return 0, nil, 0, 0, nil, errCorrupt
+	}
+
+	kind = rec[4]
+	keyLen := int(binary.BigEndian.Uint16(rec[5:]))
+	flags = binary.BigEndian.Uint32(rec[7:])
+	exptime = binary.BigEndian.Uint32(rec[11:])
+
+	if (kind != recordPut && kind != recordDelete) || headerSize+keyLen > len(rec) {
+		return 0, nil, 0, 0, nil, errCorrupt
+	}
+
+	key = rec[headerSize : headerSize+keyLen]
+	data = rec[headerSize+keyLen:]
+	return kind, key, flags, exptime, data, nil
+}
+
+// rotate starts a new segment. The caller must hold mu, except during recovery.
+func (s *Store) rotate() error {
+	var id uint32
+	if s.active != nil {
+		id = s.active.id + 1
+		if err := s.active.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(segmentPath(s.opts.Dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	seg := &segment{id: id, f: f}
+	s.segments[id] = seg
+	s.active = seg
+	return nil
+}
+
+// write appends an encoded record to the active segment and points the index at
+// it. The caller must hold mu.
+func (s *Store) write(key string, rec []byte, exptime uint32, deleted bool) error {
+	if s.active.size > 0 && s.active.size+int64(len(rec)) > s.opts.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	seg := s.active
+	if _, err := seg.f.WriteAt(rec, seg.size); err != nil {
+		return err
+	}
+	if s.opts.SyncWrites {
+		if err := seg.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.index[key] = loc{
+		seg:     seg.id,
+		off:     seg.size,
+		size:    uint32(len(rec)),
+		exptime: exptime,
+		deleted: deleted,
+	}
+	seg.size += int64(len(rec))
+	return nil
+}
+
+// read returns the flags and data of the record at l. The caller must hold mu.
+func (s *Store) read(l loc) (uint32, []byte, error) {
+	seg, ok := s.segments[l.seg]
+	if !ok {
+		return 0, nil, errCorrupt
+	}
+
+	rec := make([]byte, l.size)
+	if _, err := seg.f.ReadAt(rec, l.off); err != nil {
+		return 0, nil, err
+	}
+
+	_, _, flags, _, data, err := decode(rec)
+	if err == errCorrupt {
+		metrics.IncCounter(MetricCorrupt)
+	}
+	return flags, data, err
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+func open(t *testing.T, opts Opts) (*Store, handlers.Handler) {
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	h, _ := Handler(s)()
+	return s, h
+}
+
+func getE(t *testing.T, h handlers.Handler, key string) common.GetEResponse {
+	resChan, errChan := h.GetE(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	for err := range errChan {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return <-resChan
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return dir
+}
+
+func TestHandler(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, h := open(t, Opts{Dir: dir})
+	defer s.Close()
+
+	key := []byte("key")
+
+	if err := h.Add(common.SetRequest{Key: key, Data: []byte("mid"), Flags: 7, Exptime: 100}); err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	if err := h.Add(common.SetRequest{Key: key}); err != common.ErrKeyExists {
+		t.Fatalf("Expected ErrKeyExists, got %v", err)
+	}
+	h.Append(common.SetRequest{Key: key, Data: []byte("end")})
+	h.Prepend(common.SetRequest{Key: key, Data: []byte("start")})
+
+	res := getE(t, h, "key")
+	if res.Miss || string(res.Data) != "startmidend" || res.Flags != 7 {
+		t.Fatalf("Expected startmidend with flags 7, got %+v", res)
+	}
+	if res.Exptime < 99 || res.Exptime > 100 {
+		t.Fatalf("Expected about 100 seconds left, got %d", res.Exptime)
+	}
+
+	if err := h.Touch(common.TouchRequest{Key: key, Exptime: 1000}); err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	if res := getE(t, h, "key"); res.Exptime < 999 {
+		t.Fatalf("Expected the touch to extend the TTL, got %d", res.Exptime)
+	}
+
+	if err := h.Append(common.SetRequest{Key: []byte("missing")}); err != common.ErrItemNotStored {
+		t.Fatalf("Expected ErrItemNotStored, got %v", err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: key}); err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	if err := h.Delete(common.DeleteRequest{Key: key}); err != common.ErrKeyNotFound {
+		t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	past := uint32(time.Now().Unix()) - 10
+	h.Set(common.SetRequest{Key: []byte("expired"), Data: []byte("x"), Exptime: past})
+	if res, _ := h.GAT(common.GATRequest{Key: []byte("expired")}); !res.Miss {
+		t.Fatalf("Expected an expired item to be a miss")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, h := open(t, Opts{Dir: dir, SegmentBytes: 1024})
+	for i := 0; i < 100; i++ {
+		h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key%d", i)), Data: []byte(fmt.Sprintf("value%d", i))})
+	}
+	h.Set(common.SetRequest{Key: []byte("key1"), Data: []byte("newer")})
+	h.Delete(common.DeleteRequest{Key: []byte("key2")})
+	active := s.active.f.Name()
+	s.Close()
+
+	// Simulate a write cut off by a crash
+	f, _ := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encode(recordPut, []byte("torn"), 0, 0, []byte("data"))[:10])
+	f.Close()
+
+	s, h = open(t, Opts{Dir: dir, SegmentBytes: 1024})
+
+	if len(s.segments) < 2 {
+		t.Fatalf("Expected the data to span segments, got %d", len(s.segments))
+	}
+	if res := getE(t, h, "key50"); string(res.Data) != "value50" {
+		t.Fatalf("Expected value50, got %+v", res)
+	}
+	if res := getE(t, h, "key1"); string(res.Data) != "newer" {
+		t.Fatalf("Expected the newer value, got %+v", res)
+	}
+	if res := getE(t, h, "key2"); !res.Miss {
+		t.Fatalf("Expected the deleted key to stay deleted")
+	}
+
+	// Writes after the truncated record are readable after another restart
+	h.Set(common.SetRequest{Key: []byte("after"), Data: []byte("crash")})
+	s.Close()
+
+	s, h = open(t, Opts{Dir: dir, SegmentBytes: 1024})
+	defer s.Close()
+	if res := getE(t, h, "after"); string(res.Data) != "crash" {
+		t.Fatalf("Expected the write after the crash, got %+v", res)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, h := open(t, Opts{Dir: dir, SegmentBytes: 1024})
+
+	// Overwrite the same keys many times, with some short lived ones in between
+	past := uint32(time.Now().Unix()) - 10
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 10; i++ {
+			h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key%d", i)), Data: []byte(fmt.Sprintf("value%d-%d", i, round))})
+		}
+		h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("temp%d", round)), Data: []byte("x"), Exptime: past})
+	}
+	h.Delete(common.DeleteRequest{Key: []byte("key9")})
+
+	before := len(s.segments)
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	if after := len(s.segments); after >= before {
+		t.Fatalf("Expected compaction to remove segments, had %d and now %d", before, after)
+	}
+
+	check := func(h handlers.Handler) {
+		for i := 0; i < 9; i++ {
+			if res := getE(t, h, fmt.Sprintf("key%d", i)); string(res.Data) != fmt.Sprintf("value%d-19", i) {
+				t.Fatalf("Expected the latest value for key%d, got %+v", i, res)
+			}
+		}
+		if res := getE(t, h, "key9"); !res.Miss {
+			t.Fatalf("Expected the deleted key to stay deleted")
+		}
+	}
+
+	check(h)
+	s.Close()
+
+	s, h = open(t, Opts{Dir: dir, SegmentBytes: 1024})
+	defer s.Close()
+	check(h)
+}
@@ -0,0 +1,289 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption provides a handler wrapper that encrypts values at rest with
+// AES-GCM and decrypts them transparently on the way out.
+//
+// Encrypted items are marked with FlagEncrypted and their data starts with a
+// header holding the format version and the version of the key that encrypted
+// them, followed by the nonce and the sealed value. The item's key is used as
+// additional data, so a value copied under another key fails to decrypt. Flags
+// and TTLs are not encrypted. Items without the flag are passed through
+// untouched, so data written before encryption was turned on keeps working.
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// FlagEncrypted is the bit in an item's flags that marks it as encrypted. It is
+// reserved: clients can't set it and never see it.
+const FlagEncrypted uint32 = 1 << 30
+
+const (
+	formatVersion = 1
+
+	// format version, key version
+	headerLen = 1 + 4
+)
+
+var (
+	MetricEncrypted          = metrics.AddCounter("encryption_encrypted", nil)
+	MetricDecrypted          = metrics.AddCounter("encryption_decrypted", nil)
+	MetricDecryptErrors      = metrics.AddCounter("encryption_decrypt_errors", nil)
+	MetricUnknownKeyVersions = metrics.AddCounter("encryption_unknown_key_versions", nil)
+
+	HistEncrypt = metrics.AddHistogram("encrypt", false, nil)
+	HistDecrypt = metrics.AddHistogram("decrypt", false, nil)
+)
+
+// Handler wraps a handler constructor so every value is encrypted with the
+// keyring's active key on Set, Add and Replace and decrypted on Get, GetE and
+// GAT. It works on top of any handler, since the inner handler only ever sees
+// opaque bytes.
+//
+// Ciphertext can't be appended to, so Append and Prepend on an encrypted item
+// decrypt it and write it back encrypted again with Replace. Two of them racing
+// on one key can lose one of the changes unless the locked orca serializes
+// writes.
+func Handler(hc handlers.HandlerConst, keys *Keyring) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		inner, err := hc()
+		if err != nil {
+			return nil, err
+		}
+
+		return &handler{
+			h:    inner,
+			keys: keys,
+		}, nil
+	}
+}
+
+type handler struct {
+	h    handlers.Handler
+	keys *Keyring
+}
+
+func (h *handler) encrypt(key, data []byte) ([]byte, error) {
+	start := timer.Now()
+
+	ks := h.keys.current()
+	aead := ks.aeads[ks.active]
+
+	out := make([]byte, headerLen+aead.NonceSize(), headerLen+aead.NonceSize()+len(data)+aead.Overhead())
+	out[0] = formatVersion
+	binary.BigEndian.PutUint32(out[1:headerLen], ks.active)
+
+	nonce := out[headerLen:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out = aead.Seal(out, nonce, data, key)
+
+	metrics.IncCounter(MetricEncrypted)
+	metrics.ObserveHist(HistEncrypt, timer.Since(start))
+
+	return out, nil
+}
+
+// decrypt returns the value a client stored. ok is false if the item is
+// encrypted and can't be decrypted.
+func (h *handler) decrypt(key, data []byte, flags uint32) (out []byte, outFlags uint32, ok bool) {
+	if flags&FlagEncrypted == 0 {
+		return data, flags, true
+	}
+	flags &^= FlagEncrypted
+
+	start := timer.Now()
+	defer func() {
+		metrics.ObserveHist(HistDecrypt, timer.Since(start))
+	}()
+
+	if len(data) < headerLen || data[0] != formatVersion {
+		metrics.IncCounter(MetricDecryptErrors)
+		return nil, flags, false
+	}
+
+	aead, known := h.keys.current().aeads[binary.BigEndian.Uint32(data[1:headerLen])]
+	if !known {
+		metrics.IncCounter(MetricUnknownKeyVersions)
+		return nil, flags, false
+	}
+
+	data = data[headerLen:]
+	if len(data) < aead.NonceSize() {
+		metrics.IncCounter(MetricDecryptErrors)
+		return nil, flags, false
+	}
+
+	out, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], key)
+	if err != nil {
+		metrics.IncCounter(MetricDecryptErrors)
+		return nil, flags, false
+	}
+
+	metrics.IncCounter(MetricDecrypted)
+	return out, flags, true
+}
+
+func (h *handler) store(cmd common.SetRequest, f func(common.SetRequest) error) error {
+	if cmd.Flags&FlagEncrypted != 0 {
+		return common.ErrInvalidArgs
+	}
+
+	data, err := h.encrypt(cmd.Key, cmd.Data)
+	if err != nil {
+		return common.ErrInternal
+	}
+
+	cmd.Data = data
+	cmd.Flags |= FlagEncrypted
+	return f(cmd)
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Set)
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Add)
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Replace)
+}
+
+func (h *handler) Append(cmd common.SetRequest) error {
+	return h.concat(cmd, h.h.Append, handlers.AppendData)
+}
+
+func (h *handler) Prepend(cmd common.SetRequest) error {
+	return h.concat(cmd, h.h.Prepend, handlers.PrependData)
+}
+
+// concat passes an append or prepend through if the stored item isn't
+// encrypted. Otherwise it decrypts the item, joins the new data on and replaces
+// the item with the result, keeping its flags and TTL.
+func (h *handler) concat(cmd common.SetRequest, f func(common.SetRequest) error, join func(old, data []byte) []byte) error {
+	return handlers.Concat(h.h, cmd, FlagEncrypted, f, func(cur common.GetEResponse) error {
+		data, flags, ok := h.decrypt(cmd.Key, cur.Data, cur.Flags)
+		if !ok {
+			return common.ErrInternal
+		}
+
+		return h.store(common.SetRequest{
+			Key:     cmd.Key,
+			Data:    join(data, cmd.Data),
+			Flags:   flags,
+			Exptime: cur.Exptime,
+			Opaque:  cmd.Opaque,
+			Quiet:   cmd.Quiet,
+		}, h.h.Replace)
+	})
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	return h.h.Delete(cmd)
+}
+
+func (h *handler) Touch(cmd common.TouchRequest) error {
+	return h.h.Touch(cmd)
+}
+
+func (h *handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.h.GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+
+	var ok bool
+	if res.Data, res.Flags, ok = h.decrypt(cmd.Key, res.Data, res.Flags); !ok {
+		return common.GetResponse{
+			Miss:   true,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
+			Key:    res.Key,
+		}, nil
+	}
+
+	return res, nil
+}
+
+// Get results are decrypted as they arrive. An item that can't be decrypted is
+// returned as a miss.
+func (h *handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan, errChan := h.h.Get(cmd)
+	outRes := make(chan common.GetResponse, len(cmd.Keys))
+
+	go func() {
+		for res := range resChan {
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = h.decrypt(res.Key, res.Data, res.Flags); !ok {
+					res = common.GetResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    res.Key,
+					}
+				}
+			}
+			outRes <- res
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan, errChan := h.h.GetE(cmd)
+	if resChan == nil {
+		return resChan, errChan
+	}
+
+	outRes := make(chan common.GetEResponse, len(cmd.Keys))
+
+	go func() {
+		for res := range resChan {
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = h.decrypt(res.Key, res.Data, res.Flags); !ok {
+					res = common.GetEResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    res.Key,
+					}
+				}
+			}
+			outRes <- res
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) Close() error {
+	return h.h.Close()
+}
@@ -0,0 +1,211 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+type item struct {
+	data    []byte
+	flags   uint32
+	exptime uint32
+}
+
+// storeHandler keeps items in a map and stores exactly what it is given.
+type storeHandler struct {
+	handlers.Handler
+	items map[string]item
+}
+
+func newStoreHandler() *storeHandler {
+	return &storeHandler{items: make(map[string]item)}
+}
+
+func (h *storeHandler) Set(cmd common.SetRequest) error {
+	h.items[string(cmd.Key)] = item{cmd.Data, cmd.Flags, cmd.Exptime}
+	return nil
+}
+
+func (h *storeHandler) Replace(cmd common.SetRequest) error {
+	if _, ok := h.items[string(cmd.Key)]; !ok {
+		return common.ErrItemNotStored
+	}
+	return h.Set(cmd)
+}
+
+func (h *storeHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for _, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetResponse{Key: key, Data: it.data, Flags: it.flags, Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+// GetE isn't supported, like the chunked handler
+func (h *storeHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return nil, nil
+}
+
+func writeKeyring(t *testing.T, path, contents string) {
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Error writing keyring: %v", err)
+	}
+}
+
+func get(t *testing.T, h handlers.Handler, key string) common.GetResponse {
+	res, err := handlers.DrainGet(h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}))
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return res
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring")
+
+	for _, bad := range []string{
+		"",
+		"1",
+		"0 q83vEjRWeJCrze8SNFZ4kA==",
+		"1 not-base64",
+		"1 AAAA",
+		"1 q83vEjRWeJCrze8SNFZ4kA==\n1 3q2+796tvu/erb7v3q2+7w==",
+	} {
+		writeKeyring(t, path, bad)
+		if _, err := LoadKeyring(path); err == nil {
+			t.Fatalf("Expected keyring %q to be rejected", bad)
+		}
+	}
+
+	writeKeyring(t, path, "# comment\n\n2 3q2+796tvu/erb7v3q2+7w==\n1 q83vEjRWeJCrze8SNFZ4kA==\n")
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	if k.ActiveVersion() != 2 {
+		t.Fatalf("Expected the highest version to be active, got %d", k.ActiveVersion())
+	}
+
+	// A broken file keeps the old keys
+	writeKeyring(t, path, "garbage")
+	if err := k.Reload(); err == nil || k.ActiveVersion() != 2 {
+		t.Fatalf("Expected the reload to fail and keep version 2")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring")
+
+	writeKeyring(t, path, "1 q83vEjRWeJCrze8SNFZ4kA==\n")
+	keys, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+
+	store := newStoreHandler()
+	h, _ := Handler(func() (handlers.Handler, error) { return store, nil }, keys)()
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte("pii"), Data: []byte("secret"), Flags: 5}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		it := store.items["pii"]
+		if it.flags != 5|FlagEncrypted || bytes.Contains(it.data, []byte("secret")) {
+			t.Fatalf("Expected an encrypted item, got flags %x", it.flags)
+		}
+		if binary.BigEndian.Uint32(it.data[1:headerLen]) != 1 {
+			t.Fatalf("Expected key version 1 in the header")
+		}
+
+		if res := get(t, h, "pii"); res.Miss || res.Flags != 5 || string(res.Data) != "secret" {
+			t.Fatalf("Expected the original value back, got %q with flags %x", res.Data, res.Flags)
+		}
+	})
+	t.Run("Rotation", func(t *testing.T) {
+		writeKeyring(t, path, "1 q83vEjRWeJCrze8SNFZ4kA==\n2 3q2+796tvu/erb7v3q2+7w==\n")
+		if err := keys.Reload(); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// Old items still decrypt, new ones use the new key
+		if res := get(t, h, "pii"); string(res.Data) != "secret" {
+			t.Fatalf("Expected items from the old key to decrypt, got %q", res.Data)
+		}
+
+		h.Set(common.SetRequest{Key: []byte("new"), Data: []byte("secret")})
+		if it := store.items["new"]; binary.BigEndian.Uint32(it.data[1:headerLen]) != 2 {
+			t.Fatalf("Expected key version 2 in the header")
+		}
+
+		// Once the old key is dropped its items become misses
+		writeKeyring(t, path, "2 3q2+796tvu/erb7v3q2+7w==\n")
+		keys.Reload()
+		if res := get(t, h, "pii"); !res.Miss {
+			t.Fatalf("Expected a miss for an item with a removed key")
+		}
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		// A value moved to another key doesn't decrypt
+		store.items["moved"] = store.items["new"]
+		if res := get(t, h, "moved"); !res.Miss {
+			t.Fatalf("Expected a miss for a value under the wrong key")
+		}
+	})
+	t.Run("Legacy", func(t *testing.T) {
+		store.items["legacy"] = item{data: []byte("plain"), flags: 3}
+		if res := get(t, h, "legacy"); res.Flags != 3 || string(res.Data) != "plain" {
+			t.Fatalf("Expected unencrypted items to pass through")
+		}
+	})
+	t.Run("ReservedFlag", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte("bad"), Flags: FlagEncrypted}); err != common.ErrInvalidArgs {
+			t.Fatalf("Expected ErrInvalidArgs, got %v", err)
+		}
+	})
+	t.Run("AppendWithoutGetE", func(t *testing.T) {
+		// The TTL can't be read back, so the item would lose it
+		if err := h.Append(common.SetRequest{Key: []byte("new"), Data: []byte("more")}); err != common.ErrNotSupported {
+			t.Fatalf("Expected ErrNotSupported, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+// Keyring holds the versioned keys values are encrypted with. New values are
+// always encrypted with the highest version. Older versions are only used to
+// decrypt items written before the last rotation, so they should stay in the
+// file until those items have expired.
+type Keyring struct {
+	path string
+	keys atomic.Value // *keySet
+}
+
+type keySet struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+}
+
+var metricKeyringReloadErrors = metrics.AddCounter("keyring_reload_errors", nil)
+
+// LoadKeyring reads a keyring file. Each line holds a key version and a base64
+// encoded 16, 24 or 32 byte AES key, separated by whitespace. Blank lines and
+// lines starting with # are ignored. For example:
+//
+//	# rotated 2017-03-01
+//	1 q83vEjRWeJCrze8SNFZ4kA==
+//	2 3q2+796tvu/erb7v3q2+7w==
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+
+	metrics.RegisterIntGaugeCallback("keyring_active_version", nil, func() uint64 {
+		return uint64(k.current().active)
+	})
+
+	return k, nil
+}
+
+// Reload reads the keyring file again. If the file is invalid the keys in use
+// stay as they are.
+func (k *Keyring) Reload() error {
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	ks, err := parseKeyring(data)
+	if err != nil {
+		return fmt.Errorf("keyring %s: %v", k.path, err)
+	}
+
+	k.keys.Store(ks)
+	return nil
+}
+
+// Watch reloads the keyring whenever the file changes, checking at the given
+// interval. It never returns, so it should be run in its own goroutine.
+func (k *Keyring) Watch(interval time.Duration) {
+	var last time.Time
+	if fi, err := os.Stat(k.path); err == nil {
+		last = fi.ModTime()
+	}
+
+	for range time.Tick(interval) {
+		fi, err := os.Stat(k.path)
+		if err != nil || fi.ModTime().Equal(last) {
+			continue
+		}
+		last = fi.ModTime()
+
+		if err := k.Reload(); err != nil {
+			metrics.IncCounter(metricKeyringReloadErrors)
+			log.Printf("Error reloading keyring, keeping the old keys: %v\n", err)
+		}
+	}
+}
+
+// ActiveVersion returns the version new values are encrypted with.
+func (k *Keyring) ActiveVersion() uint32 {
+	return k.current().active
+}
+
+func (k *Keyring) current() *keySet {
+	return k.keys.Load().(*keySet)
+}
+
+func parseKeyring(data []byte) (*keySet, error) {
+	ks := &keySet{aeads: make(map[uint32]cipher.AEAD)}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a version and a key", line)
+		}
+
+		version, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("line %d: key versions must be positive integers", line)
+		}
+		if _, ok := ks.aeads[uint32(version)]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key version %d", line, version)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key is not valid base64", line)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		ks.aeads[uint32(version)] = aead
+		if uint32(version) > ks.active {
+			ks.active = uint32(version)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ks.aeads) == 0 {
+		return nil, errors.New("no keys")
+	}
+
+	return ks, nil
+}
@@ -0,0 +1,371 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"hash/fnv"
+)
+
+// Policy decides which key a shard evicts when it is over its byte budget. Each
+// shard has its own policy, which is only ever called with the shard locked, so
+// implementations don't need to be safe for concurrent use.
+type Policy interface {
+	// Added is called when a key that wasn't cached is stored.
+	Added(key string)
+	// Accessed is called when a cached key is read or overwritten.
+	Accessed(key string)
+	// Removed is called when a key leaves the cache for a reason other than
+	// being returned by Victim, e.g. a delete or expiry.
+	Removed(key string)
+	// Victim picks the next key to evict and forgets it. It returns false if
+	// the policy tracks no keys.
+	Victim() (string, bool)
+}
+
+// PolicyConst creates the policy for one shard.
+type PolicyConst func() Policy
+
+// PolicyByName returns the constructor for one of the policies in this
+// package: lru, lfu or tinylfu.
+func PolicyByName(name string) (PolicyConst, error) {
+	switch name {
+	case "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	case "tinylfu":
+		return TinyLFU, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// lru is a list of keys in the order they were last used, most recent first.
+type lru struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+// LRU evicts the least recently used key.
+func LRU() Policy {
+	return newLRU()
+}
+
+func newLRU() *lru {
+	return &lru{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) Added(key string) {
+	l.elems[key] = l.order.PushFront(key)
+}
+
+func (l *lru) Accessed(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *lru) Removed(key string) {
+	if e, ok := l.elems[key]; ok {
+		l.order.Remove(e)
+		delete(l.elems, key)
+	}
+}
+
+func (l *lru) Victim() (string, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	key := e.Value.(string)
+	l.Removed(key)
+	return key, true
+}
+
+func (l *lru) len() int {
+	return l.order.Len()
+}
+
+func (l *lru) oldest() (string, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// lfuItem is a key in the LFU heap. Ties on count go to the key added first.
+type lfuItem struct {
+	key   string
+	count uint64
+	seq   uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+type lfu struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	seq   uint64
+}
+
+// LFU evicts the least frequently used key. Counts start over when a key is
+// evicted or removed.
+func LFU() Policy {
+	return &lfu{items: make(map[string]*lfuItem)}
+}
+
+func (l *lfu) Added(key string) {
+	l.seq++
+	item := &lfuItem{key: key, count: 1, seq: l.seq}
+	heap.Push(&l.heap, item)
+	l.items[key] = item
+}
+
+func (l *lfu) Accessed(key string) {
+	if item, ok := l.items[key]; ok {
+		item.count++
+		heap.Fix(&l.heap, item.index)
+	}
+}
+
+func (l *lfu) Removed(key string) {
+	if item, ok := l.items[key]; ok {
+		heap.Remove(&l.heap, item.index)
+		delete(l.items, key)
+	}
+}
+
+func (l *lfu) Victim() (string, bool) {
+	if len(l.heap) == 0 {
+		return "", false
+	}
+	item := heap.Pop(&l.heap).(*lfuItem)
+	delete(l.items, item.key)
+	return item.key, true
+}
+
+const (
+	sketchDepth    = 4
+	sketchMaxCount = 15
+	sketchMinWidth = 1 << 10
+
+	// Percentages of the keys in the admission window and, of the rest, in the
+	// protected segment
+	windowPercent    = 1
+	protectedPercent = 80
+)
+
+// sketch is a count-min sketch of 4 bit counters that is aged by halving every
+// counter once it has seen 10 times as many increments as it has counters.
+type sketch struct {
+	counters [sketchDepth][]uint8
+	mask     uint64
+	samples  int
+}
+
+func newSketch(width int) *sketch {
+	w := sketchMinWidth
+	for w < width {
+		w <<= 1
+	}
+
+	s := &sketch{mask: uint64(w - 1)}
+	for i := range s.counters {
+		s.counters[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func (s *sketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+
+	lo, hi := sum, (sum>>32)|1
+
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (lo + uint64(i)*hi) & s.mask
+	}
+	return idx
+}
+
+func (s *sketch) increment(key string) {
+	for row, i := range s.indexes(key) {
+		if s.counters[row][i] < sketchMaxCount {
+			s.counters[row][i]++
+		}
+	}
+
+	s.samples++
+	if s.samples >= 10*len(s.counters[0]) {
+		s.samples = 0
+		for row := range s.counters {
+			for i := range s.counters[row] {
+				s.counters[row][i] >>= 1
+			}
+		}
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	est := uint8(sketchMaxCount)
+	for row, i := range s.indexes(key) {
+		if c := s.counters[row][i]; c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+// tinyLFU is W-TinyLFU: new keys go into a small LRU window, and a key leaving
+// the window only makes it into the main cache if the sketch says it is used
+// more often than the key the main cache would evict for it. The main cache is
+// a segmented LRU whose protected segment holds keys hit since entering it.
+type tinyLFU struct {
+	freq      *sketch
+	window    *lru
+	probation *lru
+	protected *lru
+}
+
+// TinyLFU evicts with W-TinyLFU, which keeps popular keys cached through scans
+// and bursts of keys that are only used once.
+func TinyLFU() Policy {
+	return &tinyLFU{
+		freq:      newSketch(0),
+		window:    newLRU(),
+		probation: newLRU(),
+		protected: newLRU(),
+	}
+}
+
+func (t *tinyLFU) size() int {
+	return t.window.len() + t.probation.len() + t.protected.len()
+}
+
+func (t *tinyLFU) Added(key string) {
+	t.freq.increment(key)
+	t.window.Added(key)
+
+	// Grow the sketch with the cache so estimates stay accurate. The counts
+	// start over, as they would after a few resets anyway.
+	if t.size() > 2*len(t.freq.counters[0]) {
+		old := t.freq
+		t.freq = newSketch(2 * t.size())
+		t.freq.samples = old.samples
+	}
+}
+
+func (t *tinyLFU) Accessed(key string) {
+	t.freq.increment(key)
+
+	switch {
+	case t.window.elems[key] != nil:
+		t.window.Accessed(key)
+	case t.probation.elems[key] != nil:
+		t.probation.Removed(key)
+		t.protected.Added(key)
+
+		maxProtected := (t.size() - t.window.len()) * protectedPercent / 100
+		for t.protected.len() > maxProtected {
+			demoted, _ := t.protected.Victim()
+			t.probation.Added(demoted)
+		}
+	default:
+		t.protected.Accessed(key)
+	}
+}
+
+func (t *tinyLFU) Removed(key string) {
+	t.window.Removed(key)
+	t.probation.Removed(key)
+	t.protected.Removed(key)
+}
+
+func (t *tinyLFU) Victim() (string, bool) {
+	maxWindow := t.size() * windowPercent / 100
+	if maxWindow < 1 {
+		maxWindow = 1
+	}
+
+	// Keys leaving the window go on probation in the main cache, and the last
+	// of them duels with the key the main cache would evict. The loser of the
+	// duel is evicted.
+	var candidate string
+	var moved bool
+	for t.window.len() > maxWindow {
+		candidate, _ = t.window.oldest()
+		moved = true
+		t.window.Removed(candidate)
+		t.probation.Added(candidate)
+	}
+
+	if moved {
+		victim, ok := t.probation.oldest()
+		if !ok || victim == candidate {
+			victim, ok = t.protected.oldest()
+		}
+
+		if ok {
+			if t.freq.estimate(candidate) > t.freq.estimate(victim) {
+				t.Removed(victim)
+				return victim, true
+			}
+			t.probation.Removed(candidate)
+			return candidate, true
+		}
+	}
+
+	if key, ok := t.probation.Victim(); ok {
+		return key, true
+	}
+	if key, ok := t.protected.Victim(); ok {
+		return key, true
+	}
+	return t.window.Victim()
+}
@@ -12,16 +12,65 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package inmem is an in-process cache that can stand in for memcached. Items
+// are spread over independently locked shards, each of which keeps to an equal
+// part of the byte budget by evicting keys chosen by its eviction policy.
+// Expired items are removed when they are read and by a background sweeper.
 package inmem
 
 import (
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
 )
 
+const (
+	defaultShards        = 16
+	defaultSweepInterval = 10 * time.Second
+
+	// The smallest budget the default number of shards is reduced to give each
+	// shard, so the cache takes items as large as memcached does by default
+	minShardBytes = 1 << 20
+
+	// Exptimes above this are absolute unix timestamps, like in memcached
+	maxRelativeExptime = 60 * 60 * 24 * 30
+
+	// An estimate of the memory used for each item beyond its key and data,
+	// covering the map entry and the eviction policy's bookkeeping
+	entryOverhead = 64
+)
+
+var (
+	MetricEvictions = metrics.AddCounter("inmem_evictions", nil)
+	MetricExpired   = metrics.AddCounter("inmem_expired", nil)
+	MetricTooLarge  = metrics.AddCounter("inmem_too_large", nil)
+)
+
+// Opts configures an in-memory cache.
+type Opts struct {
+	// MaxBytes is the budget for keys, data and overhead across all shards.
+	// Each shard keeps to an equal part of it, so an item larger than MaxBytes
+	// divided by the number of shards fails with common.ErrValueTooBig.
+	// Default: 0, unbounded
+	MaxBytes uint64
+
+	// Shards is the number of independently locked parts of the cache, rounded
+	// up to a power of 2 and then halved until each shard has at least a byte of
+	// MaxBytes. Default: 16, halved until each shard has at least 1MB
+	Shards int
+
+	// Eviction creates the eviction policy for each shard. Default: LRU
+	Eviction PolicyConst
+
+	// SweepInterval is the time between sweeps for expired items. Default: 10s
+	SweepInterval time.Duration
+}
+
 type entry struct {
 	exptime uint32
 	flags   uint32
@@ -32,144 +81,288 @@ func (e entry) isExpired() bool {
 	return e.exptime != 0 && e.exptime < uint32(time.Now().Unix())
 }
 
+func entrySize(key string, data []byte) uint64 {
+	return uint64(len(key)+len(data)) + entryOverhead
+}
+
+// absExptime turns a relative exptime into an absolute one.
+func absExptime(exptime uint32) uint32 {
+	if exptime == 0 || exptime > maxRelativeExptime {
+		return exptime
+	}
+	return uint32(time.Now().Unix()) + exptime
+}
+
+type shard struct {
+	sync.Mutex
+	data     map[string]entry
+	policy   Policy
+	maxBytes uint64
+	bytes    uint64
+}
+
+// Handler is an in-memory cache. It is safe for concurrent use and meant to be
+// shared by every connection.
 type Handler struct {
-	data  map[string]entry
-	mutex *sync.RWMutex
+	shards []*shard
+	mask   uint32
+	items  int64
+	bytes  int64
+
+	// Serializes snapshots, which share a temporary file
+	snapshotMu sync.Mutex
+}
+
+// NewHandler creates an in-memory cache and starts its expiry sweeper.
+func NewHandler(opts Opts) *Handler {
+	n := 1
+	for n < opts.Shards || (opts.Shards <= 0 && n < defaultShards) {
+		n <<= 1
+	}
+
+	// A shard with a budget of 0 would be unbounded
+	minBytes := uint64(1)
+	if opts.Shards <= 0 {
+		minBytes = minShardBytes
+	}
+	for opts.MaxBytes > 0 && n > 1 && opts.MaxBytes/uint64(n) < minBytes {
+		n >>= 1
+	}
+	if opts.Eviction == nil {
+		opts.Eviction = LRU
+	}
+	if opts.SweepInterval <= 0 {
+		opts.SweepInterval = defaultSweepInterval
+	}
+
+	h := &Handler{
+		shards: make([]*shard, n),
+		mask:   uint32(n - 1),
+	}
+	for i := range h.shards {
+		h.shards[i] = &shard{
+			data:     make(map[string]entry),
+			policy:   opts.Eviction(),
+			maxBytes: opts.MaxBytes / uint64(n),
+		}
+	}
+
+	metrics.RegisterIntGaugeCallback("inmem_bytes", nil, func() uint64 {
+		return uint64(atomic.LoadInt64(&h.bytes))
+	})
+	metrics.RegisterIntGaugeCallback("inmem_items", nil, func() uint64 {
+		return uint64(atomic.LoadInt64(&h.items))
+	})
+
+	go h.sweep(opts.SweepInterval)
+
+	return h
 }
 
-var singleton = &Handler{
-	data:  make(map[string]entry),
-	mutex: new(sync.RWMutex),
+// HandlerConst returns a constructor that gives every connection the same cache.
+func HandlerConst(h *Handler) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return h, nil
+	}
 }
 
+var (
+	singleton     *Handler
+	singletonOnce sync.Once
+)
+
+// New returns a shared, unbounded cache with the default options.
 func New() (handlers.Handler, error) {
-	// return the same singleton map each time so all connections see the same data
+	// return the same singleton each time so all connections see the same data
+	singletonOnce.Do(func() {
+		singleton = NewHandler(Opts{})
+	})
 	return singleton, nil
 }
 
-func (h *Handler) Set(cmd common.SetRequest) error {
-	h.mutex.Lock()
+func (h *Handler) shard(key []byte) *shard {
+	f := fnv.New32a()
+	f.Write(key)
+	return h.shards[f.Sum32()&h.mask]
+}
 
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
+// get returns the live entry for a key, removing it if it has expired. The shard
+// must be locked.
+func (h *Handler) get(s *shard, key string) (entry, bool) {
+	e, ok := s.data[key]
+	if !ok {
+		return e, false
 	}
-
-	h.data[string(cmd.Key)] = entry{
-		data:    cmd.Data,
-		exptime: exptime,
-		flags:   cmd.Flags,
+	if e.isExpired() {
+		h.remove(s, key, e)
+		s.policy.Removed(key)
+		metrics.IncCounter(MetricExpired)
+		return e, false
 	}
+	return e, true
+}
 
-	h.mutex.Unlock()
-	return nil
+// remove drops an entry from a shard without telling the policy. The shard must
+// be locked.
+func (h *Handler) remove(s *shard, key string, e entry) {
+	delete(s.data, key)
+	size := entrySize(key, e.data)
+	s.bytes -= size
+	atomic.AddInt64(&h.bytes, -int64(size))
+	atomic.AddInt64(&h.items, -1)
 }
 
-func (h *Handler) Add(cmd common.SetRequest) error {
-	h.mutex.Lock()
+// store adds or replaces an entry and then evicts until the shard is within its
+// budget. The shard must be locked.
+func (h *Handler) store(s *shard, key string, e entry) error {
+	size := entrySize(key, e.data)
+	if s.maxBytes > 0 && size > s.maxBytes {
+		metrics.IncCounter(MetricTooLarge)
+		return common.ErrValueTooBig
+	}
 
-	e, ok := h.data[string(cmd.Key)]
+	if old, ok := s.data[key]; ok {
+		oldSize := entrySize(key, old.data)
+		s.bytes -= oldSize
+		atomic.AddInt64(&h.bytes, -int64(oldSize))
+		s.policy.Accessed(key)
+	} else {
+		atomic.AddInt64(&h.items, 1)
+		s.policy.Added(key)
+	}
 
-	if ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
-		return common.ErrKeyExists
+	s.data[key] = e
+	s.bytes += size
+	atomic.AddInt64(&h.bytes, int64(size))
+
+	for s.maxBytes > 0 && s.bytes > s.maxBytes {
+		victim, ok := s.policy.Victim()
+		if !ok {
+			break
+		}
+		h.remove(s, victim, s.data[victim])
+		metrics.IncCounter(MetricEvictions)
 	}
 
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
+	return nil
+}
+
+// sweep periodically removes expired items, one shard at a time so requests
+// only wait for the shard being swept.
+func (h *Handler) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, s := range h.shards {
+			s.Lock()
+			for key, e := range s.data {
+				if e.isExpired() {
+					h.remove(s, key, e)
+					s.policy.Removed(key)
+					metrics.IncCounter(MetricExpired)
+				}
+			}
+			s.Unlock()
+		}
 	}
+}
+
+func (h *Handler) Set(cmd common.SetRequest) error {
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
 
-	h.data[string(cmd.Key)] = entry{
+	return h.store(s, string(cmd.Key), entry{
 		data:    cmd.Data,
-		exptime: exptime,
+		exptime: absExptime(cmd.Exptime),
 		flags:   cmd.Flags,
+	})
+}
+
+func (h *Handler) Add(cmd common.SetRequest) error {
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := h.get(s, string(cmd.Key)); ok {
+		return common.ErrKeyExists
 	}
 
-	h.mutex.Unlock()
-	return nil
+	return h.store(s, string(cmd.Key), entry{
+		data:    cmd.Data,
+		exptime: absExptime(cmd.Exptime),
+		flags:   cmd.Flags,
+	})
 }
 
 func (h *Handler) Replace(cmd common.SetRequest) error {
-	h.mutex.Lock()
-
-	e, ok := h.data[string(cmd.Key)]
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
 
-	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+	if _, ok := h.get(s, string(cmd.Key)); !ok {
 		return common.ErrKeyNotFound
 	}
 
-	var exptime uint32
-	if cmd.Exptime > 0 {
-		exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	}
-
-	h.data[string(cmd.Key)] = entry{
+	return h.store(s, string(cmd.Key), entry{
 		data:    cmd.Data,
-		exptime: exptime,
+		exptime: absExptime(cmd.Exptime),
 		flags:   cmd.Flags,
-	}
-
-	h.mutex.Unlock()
-	return nil
+	})
 }
 
 func (h *Handler) Append(cmd common.SetRequest) error {
-	h.mutex.Lock()
-
-	e, ok := h.data[string(cmd.Key)]
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
 
-	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+	e, ok := h.get(s, string(cmd.Key))
+	if !ok {
 		return common.ErrKeyNotFound
 	}
 
-	h.data[string(cmd.Key)] = entry{
-		data:    append(e.data, cmd.Data...),
-		exptime: e.exptime,
-		flags:   e.flags,
-	}
+	// Always copy, since the old data may have been handed out by a get
+	data := make([]byte, 0, len(e.data)+len(cmd.Data))
+	e.data = append(append(data, e.data...), cmd.Data...)
 
-	h.mutex.Unlock()
-	return nil
+	return h.store(s, string(cmd.Key), e)
 }
 
 func (h *Handler) Prepend(cmd common.SetRequest) error {
-	h.mutex.Lock()
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
 
-	e, ok := h.data[string(cmd.Key)]
-
-	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+	e, ok := h.get(s, string(cmd.Key))
+	if !ok {
 		return common.ErrKeyNotFound
 	}
 
-	h.data[string(cmd.Key)] = entry{
-		data:    append(cmd.Data, e.data...),
-		exptime: e.exptime,
-		flags:   e.flags,
-	}
+	data := make([]byte, 0, len(e.data)+len(cmd.Data))
+	e.data = append(append(data, cmd.Data...), e.data...)
 
-	h.mutex.Unlock()
-	return nil
+	return h.store(s, string(cmd.Key), e)
+}
+
+// lookup returns the live entry for a key and counts it as an access.
+func (h *Handler) lookup(key []byte) (entry, bool) {
+	s := h.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := h.get(s, string(key))
+	if ok {
+		s.policy.Accessed(string(key))
+	}
+	return e, ok
 }
 
 func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
 	dataOut := make(chan common.GetResponse, len(cmd.Keys))
 	errorOut := make(chan error)
 
-	h.mutex.RLock()
-
 	for idx, bk := range cmd.Keys {
-		e, ok := h.data[string(bk)]
+		e, ok := h.lookup(bk)
 
-		if !ok || e.isExpired() {
-			delete(h.data, string(bk))
+		if !ok {
 			dataOut <- common.GetResponse{
 				Miss:   true,
 				Quiet:  cmd.Quiet[idx],
@@ -189,8 +382,6 @@ func (h *Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan
 		}
 	}
 
-	h.mutex.RUnlock()
-
 	close(dataOut)
 	close(errorOut)
 	return dataOut, errorOut
@@ -200,13 +391,10 @@ func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-cha
 	dataOut := make(chan common.GetEResponse, len(cmd.Keys))
 	errorOut := make(chan error)
 
-	h.mutex.RLock()
-
 	for idx, bk := range cmd.Keys {
-		e, ok := h.data[string(bk)]
+		e, ok := h.lookup(bk)
 
-		if !ok || e.isExpired() {
-			delete(h.data, string(bk))
+		if !ok {
 			dataOut <- common.GetEResponse{
 				Miss:   true,
 				Quiet:  cmd.Quiet[idx],
@@ -227,21 +415,18 @@ func (h *Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-cha
 		}
 	}
 
-	h.mutex.RUnlock()
-
 	close(dataOut)
 	close(errorOut)
 	return dataOut, errorOut
 }
 
 func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	h.mutex.Lock()
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
 
-	e, ok := h.data[string(cmd.Key)]
-
-	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+	e, ok := h.get(s, string(cmd.Key))
+	if !ok {
 		return common.GetResponse{
 			Miss:   true,
 			Opaque: cmd.Opaque,
@@ -249,15 +434,9 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 		}, nil
 	}
 
-	if cmd.Exptime > 0 {
-		e.exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	} else {
-		e.exptime = 0
-	}
-
-	h.data[string(cmd.Key)] = e
-
-	h.mutex.Unlock()
+	e.exptime = absExptime(cmd.Exptime)
+	s.data[string(cmd.Key)] = e
+	s.policy.Accessed(string(cmd.Key))
 
 	return common.GetResponse{
 		Miss:   false,
@@ -269,36 +448,34 @@ func (h *Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
 }
 
 func (h *Handler) Delete(cmd common.DeleteRequest) error {
-	h.mutex.Lock()
-	delete(h.data, string(cmd.Key))
-	h.mutex.Unlock()
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.data[string(cmd.Key)]; ok {
+		h.remove(s, string(cmd.Key), e)
+		s.policy.Removed(string(cmd.Key))
+	}
 	return nil
 }
 
 func (h *Handler) Touch(cmd common.TouchRequest) error {
-	h.mutex.Lock()
-
-	e, ok := h.data[string(cmd.Key)]
+	s := h.shard(cmd.Key)
+	s.Lock()
+	defer s.Unlock()
 
-	if !ok || e.isExpired() {
-		delete(h.data, string(cmd.Key))
-		h.mutex.Unlock()
+	e, ok := h.get(s, string(cmd.Key))
+	if !ok {
 		return common.ErrKeyNotFound
 	}
 
-	if cmd.Exptime > 0 {
-		e.exptime = uint32(time.Now().Unix()) + cmd.Exptime
-	} else {
-		e.exptime = 0
-	}
-
-	h.data[string(cmd.Key)] = e
-
-	h.mutex.Unlock()
+	e.exptime = absExptime(cmd.Exptime)
+	s.data[string(cmd.Key)] = e
 
 	return nil
 }
 
+// Close does nothing, since the cache outlives the connections using it.
 func (h *Handler) Close() error {
 	return nil
 }
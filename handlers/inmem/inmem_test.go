@@ -0,0 +1,230 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func get(h *Handler, key string) (common.GetResponse, bool) {
+	resChan, _ := h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	res := <-resChan
+	return res, !res.Miss
+}
+
+func set(t *testing.T, h *Handler, key string, size int) {
+	if err := h.Set(common.SetRequest{Key: []byte(key), Data: make([]byte, size)}); err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("Semantics", func(t *testing.T) {
+		h := NewHandler(Opts{})
+		key := []byte("key")
+
+		if err := h.Replace(common.SetRequest{Key: key}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+		if err := h.Add(common.SetRequest{Key: key, Data: []byte("mid")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Add(common.SetRequest{Key: key}); err != common.ErrKeyExists {
+			t.Fatalf("Expected ErrKeyExists, got %v", err)
+		}
+		h.Append(common.SetRequest{Key: key, Data: []byte("end")})
+		h.Prepend(common.SetRequest{Key: key, Data: []byte("start")})
+
+		if res, ok := get(h, "key"); !ok || string(res.Data) != "startmidend" {
+			t.Fatalf("Expected startmidend, got %q", res.Data)
+		}
+
+		h.Delete(common.DeleteRequest{Key: key})
+		if _, ok := get(h, "key"); ok {
+			t.Fatalf("Expected a miss after delete")
+		}
+		if h.items != 0 || h.bytes != 0 {
+			t.Fatalf("Expected an empty cache, got %d items and %d bytes", h.items, h.bytes)
+		}
+	})
+	t.Run("Expiry", func(t *testing.T) {
+		h := NewHandler(Opts{SweepInterval: 10 * time.Millisecond})
+
+		past := uint32(time.Now().Unix()) - 10
+		h.Set(common.SetRequest{Key: []byte("gone"), Exptime: past})
+		h.Set(common.SetRequest{Key: []byte("kept"), Exptime: 100})
+
+		// The sweeper removes the item without anyone reading it
+		deadline := time.Now().Add(time.Second)
+		for {
+			s := h.shard([]byte("gone"))
+			s.Lock()
+			_, ok := s.data["gone"]
+			s.Unlock()
+			if !ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the sweeper to remove the expired item")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		if _, ok := get(h, "kept"); !ok {
+			t.Fatalf("Expected the live item to be kept")
+		}
+		if err := h.Touch(common.TouchRequest{Key: []byte("gone")}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+	})
+	t.Run("Budget", func(t *testing.T) {
+		h := NewHandler(Opts{MaxBytes: 4 * 1000, Shards: 4})
+
+		for i := 0; i < 100; i++ {
+			set(t, h, fmt.Sprintf("key%d", i), 100)
+		}
+		if h.bytes > 4*1000 {
+			t.Fatalf("Expected at most 4000 bytes, got %d", h.bytes)
+		}
+		if h.items == 0 || h.items == 100 {
+			t.Fatalf("Expected some items to be evicted, got %d", h.items)
+		}
+
+		if err := h.Set(common.SetRequest{Key: []byte("big"), Data: make([]byte, 2000)}); err != common.ErrValueTooBig {
+			t.Fatalf("Expected ErrValueTooBig, got %v", err)
+		}
+	})
+	t.Run("SmallBudget", func(t *testing.T) {
+		h := NewHandler(Opts{MaxBytes: 8, Shards: 16})
+
+		if err := h.Set(common.SetRequest{Key: []byte("key"), Data: make([]byte, 100)}); err != common.ErrValueTooBig {
+			t.Fatalf("Expected a budget smaller than the shard count to be kept, got %v", err)
+		}
+		if h.bytes != 0 {
+			t.Fatalf("Expected nothing stored, got %d bytes", h.bytes)
+		}
+	})
+	t.Run("ItemLimit", func(t *testing.T) {
+		// The default shards are reduced so each one has room for a 1MB item
+		h := NewHandler(Opts{MaxBytes: 4 << 20})
+
+		if err := h.Set(common.SetRequest{Key: []byte("big"), Data: make([]byte, 1<<20-100)}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Set(common.SetRequest{Key: []byte("huge"), Data: make([]byte, 2<<20)}); err != common.ErrValueTooBig {
+			t.Fatalf("Expected ErrValueTooBig, got %v", err)
+		}
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		h := NewHandler(Opts{MaxBytes: 1 << 16, Shards: 16, Eviction: TinyLFU})
+
+		wg := &sync.WaitGroup{}
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					key := fmt.Sprintf("key%d", (g*i)%500)
+					h.Set(common.SetRequest{Key: []byte(key), Data: make([]byte, 200)})
+					get(h, key)
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		var items int
+		for _, s := range h.shards {
+			s.Lock()
+			items += len(s.data)
+			s.Unlock()
+		}
+		if int64(items) != h.items {
+			t.Fatalf("Expected the item count to match the shards, got %d and %d", h.items, items)
+		}
+	})
+}
+
+// evictAll reports the order a policy evicts keys in.
+func evictAll(p Policy) []string {
+	var out []string
+	for {
+		key, ok := p.Victim()
+		if !ok {
+			return out
+		}
+		out = append(out, key)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	t.Run("LRU", func(t *testing.T) {
+		p := LRU()
+		p.Added("a")
+		p.Added("b")
+		p.Added("c")
+		p.Accessed("a")
+		p.Removed("c")
+
+		if got := fmt.Sprint(evictAll(p)); got != "[b a]" {
+			t.Fatalf("Expected b then a, got %s", got)
+		}
+	})
+	t.Run("LFU", func(t *testing.T) {
+		p := LFU()
+		p.Added("a")
+		p.Added("b")
+		p.Added("c")
+		p.Accessed("a")
+		p.Accessed("a")
+		p.Accessed("c")
+
+		if got := fmt.Sprint(evictAll(p)); got != "[b c a]" {
+			t.Fatalf("Expected b, c then a, got %s", got)
+		}
+	})
+	t.Run("TinyLFU", func(t *testing.T) {
+		h := NewHandler(Opts{MaxBytes: 100 * (entryOverhead + 10), Shards: 1, Eviction: TinyLFU})
+
+		// A popular working set survives a scan of keys used once
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 50; i++ {
+				set(t, h, fmt.Sprintf("hot%04d", i), 3)
+				get(h, fmt.Sprintf("hot%04d", i))
+			}
+		}
+		for i := 0; i < 1000; i++ {
+			set(t, h, fmt.Sprintf("scan%03d", i), 3)
+		}
+
+		var hits int
+		for i := 0; i < 50; i++ {
+			if _, ok := get(h, fmt.Sprintf("hot%04d", i)); ok {
+				hits++
+			}
+		}
+		if hits < 45 {
+			t.Fatalf("Expected the hot keys to stay cached, got %d of 50", hits)
+		}
+	})
+}
@@ -0,0 +1,263 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// Snapshot file format, all integers big endian:
+//
+//	header:  magic "RENDSNAP", version uint16
+//	section: item count uint32, items, CRC32C of the count and items uint32
+//	item:    key length uint16, flags uint32, exptime uint32, data length uint32,
+//	         key, data
+//	end:     a section with a count of 0xffffffff and no items or checksum
+//
+// Each shard is written as one section, so a restore only holds one shard's
+// worth of items in memory while checking them.
+const (
+	snapshotMagic   = "RENDSNAP"
+	snapshotVersion = 1
+
+	endOfSnapshot = 0xffffffff
+
+	itemHeaderSize = 2 + 4 + 4 + 4
+)
+
+var (
+	ErrBadSnapshot = errors.New("inmem: snapshot is corrupt or not a snapshot")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	MetricSnapshots       = metrics.AddCounter("inmem_snapshots", nil)
+	MetricSnapshotErrors  = metrics.AddCounter("inmem_snapshot_errors", nil)
+	MetricSnapshotItems   = metrics.AddCounter("inmem_snapshot_items", nil)
+	MetricRestoredItems   = metrics.AddCounter("inmem_restored_items", nil)
+	MetricRestoredExpired = metrics.AddCounter("inmem_restore_expired", nil)
+
+	HistSnapshot = metrics.AddHistogram("inmem_snapshot", false, nil)
+)
+
+type snapshotItem struct {
+	key string
+	entry
+}
+
+// Snapshot writes every live item to a file. Shards are copied one at a time,
+// and only their item references are copied under the lock, so requests wait
+// for at most one short copy. The file is written next to path and renamed into
+// place, so a crash mid-snapshot leaves the previous snapshot intact.
+func (h *Handler) Snapshot(path string) error {
+	start := timer.Now()
+	err := h.snapshot(path)
+	metrics.ObserveHist(HistSnapshot, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricSnapshotErrors)
+		return err
+	}
+	metrics.IncCounter(MetricSnapshots)
+	return nil
+}
+
+func (h *Handler) snapshot(path string) error {
+	h.snapshotMu.Lock()
+	defer h.snapshotMu.Unlock()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	w.WriteString(snapshotMagic)
+	binary.Write(w, binary.BigEndian, uint16(snapshotVersion))
+
+	var items []snapshotItem
+	for _, s := range h.shards {
+		items = items[:0]
+
+		s.Lock()
+		for key, e := range s.data {
+			if !e.isExpired() && len(key) <= 0xffff {
+				items = append(items, snapshotItem{key, e})
+			}
+		}
+		s.Unlock()
+
+		if err := writeSection(w, items); err != nil {
+			return err
+		}
+		metrics.IncCounterBy(MetricSnapshotItems, uint64(len(items)))
+	}
+
+	binary.Write(w, binary.BigEndian, uint32(endOfSnapshot))
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeSection(w io.Writer, items []snapshotItem) error {
+	crc := crc32.New(crcTable)
+	out := io.MultiWriter(w, crc)
+
+	buf := make([]byte, itemHeaderSize)
+	binary.BigEndian.PutUint32(buf, uint32(len(items)))
+	out.Write(buf[:4])
+
+	for _, it := range items {
+		binary.BigEndian.PutUint16(buf[0:], uint16(len(it.key)))
+		binary.BigEndian.PutUint32(buf[2:], it.flags)
+		binary.BigEndian.PutUint32(buf[6:], it.exptime)
+		binary.BigEndian.PutUint32(buf[10:], uint32(len(it.data)))
+		out.Write(buf)
+		io.WriteString(out, it.key)
+		out.Write(it.data)
+	}
+
+	_, err := w.Write(crc.Sum(nil))
+	return err
+}
+
+// Restore loads the items in a snapshot into the cache, skipping those that
+// expired since it was taken, and returns the number of items loaded. Sections
+// are checked before any of their items are loaded, so a corrupt or truncated
+// snapshot returns ErrBadSnapshot after loading only the sections before it.
+func (h *Handler) Restore(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrBadSnapshot
+	}
+	if v := binary.BigEndian.Uint16(header[len(snapshotMagic):]); v != snapshotVersion {
+		return 0, fmt.Errorf("inmem: unsupported snapshot version %d", v)
+	}
+
+	var restored int
+	for {
+		items, done, err := readSection(r)
+		if err != nil {
+			return restored, err
+		}
+		if done {
+			return restored, nil
+		}
+
+		for _, it := range items {
+			if it.isExpired() {
+				metrics.IncCounter(MetricRestoredExpired)
+				continue
+			}
+
+			s := h.shard([]byte(it.key))
+			s.Lock()
+			err := h.store(s, it.key, it.entry)
+			s.Unlock()
+
+			// Items too large for a smaller budget than the snapshot's are
+			// skipped
+			if err == nil {
+				restored++
+				metrics.IncCounter(MetricRestoredItems)
+			}
+		}
+	}
+}
+
+func readSection(r io.Reader) ([]snapshotItem, bool, error) {
+	crc := crc32.New(crcTable)
+	in := io.TeeReader(r, crc)
+
+	buf := make([]byte, itemHeaderSize)
+	if _, err := io.ReadFull(in, buf[:4]); err != nil {
+		return nil, false, ErrBadSnapshot
+	}
+	count := binary.BigEndian.Uint32(buf)
+	if count == endOfSnapshot {
+		return nil, true, nil
+	}
+
+	var items []snapshotItem
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(in, buf); err != nil {
+			return nil, false, ErrBadSnapshot
+		}
+
+		keyLen := int(binary.BigEndian.Uint16(buf[0:]))
+		it := snapshotItem{}
+		it.flags = binary.BigEndian.Uint32(buf[2:])
+		it.exptime = binary.BigEndian.Uint32(buf[6:])
+		dataLen := int(binary.BigEndian.Uint32(buf[10:]))
+
+		// Read the key and data through a limited copy rather than allocating
+		// a length that may be garbage
+		kd := &bytes.Buffer{}
+		if n, err := io.CopyN(kd, in, int64(keyLen+dataLen)); err != nil || n != int64(keyLen+dataLen) {
+			return nil, false, ErrBadSnapshot
+		}
+		it.key = string(kd.Next(keyLen))
+		it.data = kd.Bytes()
+
+		items = append(items, it)
+	}
+
+	sum := make([]byte, 4)
+	if _, err := io.ReadFull(r, sum); err != nil || !bytes.Equal(sum, crc.Sum(nil)) {
+		return nil, false, ErrBadSnapshot
+	}
+
+	return items, false, nil
+}
+
+// SnapshotEvery snapshots the cache to path at every interval. It never returns,
+// so it should be run in its own goroutine.
+func (h *Handler) SnapshotEvery(path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := h.Snapshot(path); err != nil {
+			log.Printf("Error snapshotting the in-memory cache to %s: %v\n", path, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inmem
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inmem")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+
+	h := NewHandler(Opts{Shards: 4})
+	for i := 0; i < 100; i++ {
+		h.Set(common.SetRequest{
+			Key:     []byte(fmt.Sprintf("key%d", i)),
+			Data:    []byte(fmt.Sprintf("value%d", i)),
+			Flags:   uint32(i),
+			Exptime: 100,
+		})
+	}
+
+	// Expires between the snapshot and the restore
+	soon := uint32(time.Now().Unix()) + 1
+	h.Set(common.SetRequest{Key: []byte("soon"), Data: []byte("x"), Exptime: soon})
+
+	if err := h.Snapshot(path); err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+
+	t.Run("Restore", func(t *testing.T) {
+		for uint32(time.Now().Unix()) <= soon {
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		restored := NewHandler(Opts{})
+		n, err := restored.Restore(path)
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if n != 100 {
+			t.Fatalf("Expected 100 items, got %d", n)
+		}
+
+		res, ok := get(restored, "key42")
+		if !ok || string(res.Data) != "value42" || res.Flags != 42 {
+			t.Fatalf("Expected key42 to be restored, got %+v", res)
+		}
+		if _, ok := get(restored, "soon"); ok {
+			t.Fatalf("Expected the expired item to be skipped")
+		}
+	})
+	t.Run("Corrupt", func(t *testing.T) {
+		data, _ := ioutil.ReadFile(path)
+		data[len(data)-20] ^= 0xff
+		bad := filepath.Join(dir, "bad")
+		ioutil.WriteFile(bad, data, 0644)
+
+		restored := NewHandler(Opts{})
+		n, err := restored.Restore(bad)
+		if err != ErrBadSnapshot {
+			t.Fatalf("Expected ErrBadSnapshot, got %v", err)
+		}
+
+		// Every shard before the corrupt one is still loaded
+		if n == 0 || n >= 100 {
+			t.Fatalf("Expected a partial restore, got %d items", n)
+		}
+
+		ioutil.WriteFile(bad, data[:len(data)/2], 0644)
+		if _, err := NewHandler(Opts{}).Restore(bad); err != ErrBadSnapshot {
+			t.Fatalf("Expected ErrBadSnapshot for a truncated file, got %v", err)
+		}
+	})
+}
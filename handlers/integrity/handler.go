@@ -0,0 +1,302 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package integrity provides a handler wrapper that stores a CRC32C checksum with
+// every value and verifies it on every read, so items corrupted in the backend
+// are never served.
+//
+// Checked items are marked with FlagChecksum and their data starts with a 4 byte
+// checksum of the key, the rest of the flags and the value. An item that fails
+// the check is deleted and returned as a miss. Items without the flag are passed
+// through untouched, so data written before checksums were turned on keeps
+// working.
+package integrity
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// FlagChecksum is the bit in an item's flags that marks it as checksummed. It is
+// reserved: clients can't set it and never see it.
+const FlagChecksum uint32 = 1 << 29
+
+const headerLen = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// layerMetrics are the metrics for all handlers wrapping the same layer.
+type layerMetrics struct {
+	verified  uint32
+	unchecked uint32
+	corrupt   uint32
+	deleted   uint32
+}
+
+var (
+	layersLock = new(sync.Mutex)
+	layers     = make(map[string]*layerMetrics)
+)
+
+func metricsFor(layer string) *layerMetrics {
+	layersLock.Lock()
+	defer layersLock.Unlock()
+
+	if m, ok := layers[layer]; ok {
+		return m
+	}
+
+	tags := metrics.Tags{"layer": layer}
+
+	m := &layerMetrics{
+		verified:  metrics.AddCounter("integrity_verified", tags),
+		unchecked: metrics.AddCounter("integrity_unchecked", tags),
+		corrupt:   metrics.AddCounter("integrity_corrupt", tags),
+		deleted:   metrics.AddCounter("integrity_corrupt_deleted", tags),
+	}
+
+	layers[layer] = m
+	return m
+}
+
+// Handler wraps a handler constructor so every value is stored with a checksum
+// that is verified when the value is read back. The layer names the wrapped
+// backend in metrics, e.g. "l1" or "l2".
+//
+// The checksum covers the whole value, so Append and Prepend on a checksummed
+// item verify it and write it back with a new checksum using Replace. A write
+// to the key between the read and the Replace is lost unless the locked orca
+// is used.
+func Handler(hc handlers.HandlerConst, layer string) handlers.HandlerConst {
+	m := metricsFor(layer)
+
+	return func() (handlers.Handler, error) {
+		inner, err := hc()
+		if err != nil {
+			return nil, err
+		}
+
+		return &handler{
+			h: inner,
+			m: m,
+		}, nil
+	}
+}
+
+type handler struct {
+	h handlers.Handler
+	m *layerMetrics
+}
+
+func checksum(key []byte, flags uint32, data []byte) uint32 {
+	var f [4]byte
+	binary.BigEndian.PutUint32(f[:], flags)
+
+	crc := crc32.Update(0, castagnoli, key)
+	crc = crc32.Update(crc, castagnoli, f[:])
+	return crc32.Update(crc, castagnoli, data)
+}
+
+// verify returns the value a client stored. ok is false if the item is
+// checksummed and doesn't match its checksum.
+func (h *handler) verify(key, data []byte, flags uint32) (out []byte, outFlags uint32, ok bool) {
+	if flags&FlagChecksum == 0 {
+		metrics.IncCounter(h.m.unchecked)
+		return data, flags, true
+	}
+	flags &^= FlagChecksum
+
+	if len(data) < headerLen || binary.BigEndian.Uint32(data) != checksum(key, flags, data[headerLen:]) {
+		metrics.IncCounter(h.m.corrupt)
+		return nil, flags, false
+	}
+
+	metrics.IncCounter(h.m.verified)
+	return data[headerLen:], flags, true
+}
+
+// drop deletes a corrupted item so it is fetched again from the next layer or
+// the client's source of truth.
+func (h *handler) drop(key []byte) {
+	if err := h.h.Delete(common.DeleteRequest{Key: key}); err == nil {
+		metrics.IncCounter(h.m.deleted)
+	}
+}
+
+func (h *handler) store(cmd common.SetRequest, f func(common.SetRequest) error) error {
+	if cmd.Flags&FlagChecksum != 0 {
+		return common.ErrInvalidArgs
+	}
+
+	data := make([]byte, headerLen+len(cmd.Data))
+	binary.BigEndian.PutUint32(data, checksum(cmd.Key, cmd.Flags, cmd.Data))
+	copy(data[headerLen:], cmd.Data)
+
+	cmd.Data = data
+	cmd.Flags |= FlagChecksum
+	return f(cmd)
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Set)
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Add)
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Replace)
+}
+
+func (h *handler) Append(cmd common.SetRequest) error {
+	return h.concat(cmd, h.h.Append, handlers.AppendData)
+}
+
+func (h *handler) Prepend(cmd common.SetRequest) error {
+	return h.concat(cmd, h.h.Prepend, handlers.PrependData)
+}
+
+// concat passes an append or prepend through if the stored item isn't
+// checksummed. Otherwise it verifies the item, joins the new data on and
+// replaces the item with the result, keeping its flags and TTL.
+func (h *handler) concat(cmd common.SetRequest, f func(common.SetRequest) error, join func(old, data []byte) []byte) error {
+	return handlers.Concat(h.h, cmd, FlagChecksum, f, func(cur common.GetEResponse) error {
+		data, flags, ok := h.verify(cmd.Key, cur.Data, cur.Flags)
+		if !ok {
+			// There's nothing to append to anymore
+			h.drop(cmd.Key)
+			return common.ErrItemNotStored
+		}
+
+		return h.store(common.SetRequest{
+			Key:     cmd.Key,
+			Data:    join(data, cmd.Data),
+			Flags:   flags,
+			Exptime: cur.Exptime,
+			Opaque:  cmd.Opaque,
+			Quiet:   cmd.Quiet,
+		}, h.h.Replace)
+	})
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	return h.h.Delete(cmd)
+}
+
+func (h *handler) Touch(cmd common.TouchRequest) error {
+	return h.h.Touch(cmd)
+}
+
+func (h *handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	res, err := h.h.GAT(cmd)
+	if err != nil || res.Miss {
+		return res, err
+	}
+
+	var ok bool
+	if res.Data, res.Flags, ok = h.verify(cmd.Key, res.Data, res.Flags); !ok {
+		h.drop(cmd.Key)
+		return common.GetResponse{
+			Miss:   true,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
+			Key:    res.Key,
+		}, nil
+	}
+
+	return res, nil
+}
+
+// Get results are verified as they arrive and corrupted items are returned as
+// misses. The corrupted items are only deleted once the inner get is done, since
+// the inner handler can't take another command while it is still reading
+// responses. The results channel is closed after that so the caller can't send
+// a command in the middle either.
+func (h *handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan, errChan := h.h.Get(cmd)
+	outRes := make(chan common.GetResponse, len(cmd.Keys))
+
+	go func() {
+		var corrupt [][]byte
+
+		for res := range resChan {
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = h.verify(res.Key, res.Data, res.Flags); !ok {
+					corrupt = append(corrupt, res.Key)
+					res = common.GetResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    res.Key,
+					}
+				}
+			}
+			outRes <- res
+		}
+
+		for _, key := range corrupt {
+			h.drop(key)
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan, errChan := h.h.GetE(cmd)
+	if resChan == nil {
+		return resChan, errChan
+	}
+
+	outRes := make(chan common.GetEResponse, len(cmd.Keys))
+
+	go func() {
+		var corrupt [][]byte
+
+		for res := range resChan {
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = h.verify(res.Key, res.Data, res.Flags); !ok {
+					corrupt = append(corrupt, res.Key)
+					res = common.GetEResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    res.Key,
+					}
+				}
+			}
+			outRes <- res
+		}
+
+		for _, key := range corrupt {
+			h.drop(key)
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) Close() error {
+	return h.h.Close()
+}
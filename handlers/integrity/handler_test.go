@@ -0,0 +1,167 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integrity
+
+import (
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+type item struct {
+	data    []byte
+	flags   uint32
+	exptime uint32
+}
+
+// storeHandler keeps items in a map and stores exactly what it is given.
+type storeHandler struct {
+	handlers.Handler
+	items map[string]item
+}
+
+func newStoreHandler() *storeHandler {
+	return &storeHandler{items: make(map[string]item)}
+}
+
+func (h *storeHandler) Set(cmd common.SetRequest) error {
+	h.items[string(cmd.Key)] = item{cmd.Data, cmd.Flags, cmd.Exptime}
+	return nil
+}
+
+func (h *storeHandler) Replace(cmd common.SetRequest) error {
+	if _, ok := h.items[string(cmd.Key)]; !ok {
+		return common.ErrItemNotStored
+	}
+	return h.Set(cmd)
+}
+
+func (h *storeHandler) Delete(cmd common.DeleteRequest) error {
+	delete(h.items, string(cmd.Key))
+	return nil
+}
+
+func (h *storeHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for _, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetResponse{Key: key, Data: it.data, Flags: it.flags, Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (h *storeHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	it, ok := h.items[string(cmd.Key)]
+	return common.GetResponse{Key: cmd.Key, Data: it.data, Flags: it.flags, Miss: !ok}, nil
+}
+
+func (h *storeHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for _, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetEResponse{Key: key, Data: it.data, Flags: it.flags, Exptime: it.exptime, Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func get(t *testing.T, h handlers.Handler, key string) common.GetResponse {
+	res, err := handlers.DrainGet(h.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}))
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return res
+}
+
+func TestHandler(t *testing.T) {
+	store := newStoreHandler()
+	h, _ := Handler(func() (handlers.Handler, error) { return store, nil }, "test")()
+
+	t.Run("Verified", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value"), Flags: 2}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if it := store.items["key"]; it.flags != 2|FlagChecksum || len(it.data) != headerLen+5 {
+			t.Fatalf("Expected a checksummed item, got flags %x", it.flags)
+		}
+		if res := get(t, h, "key"); res.Miss || res.Flags != 2 || string(res.Data) != "value" {
+			t.Fatalf("Expected the original value back, got %q with flags %x", res.Data, res.Flags)
+		}
+	})
+	t.Run("Corrupt", func(t *testing.T) {
+		h.Set(common.SetRequest{Key: []byte("bad"), Data: []byte("value")})
+		store.items["bad"].data[headerLen] ^= 0x01
+
+		if res := get(t, h, "bad"); !res.Miss {
+			t.Fatalf("Expected a corrupted item to be a miss")
+		}
+		if _, ok := store.items["bad"]; ok {
+			t.Fatalf("Expected the corrupted item to be deleted")
+		}
+	})
+	t.Run("CorruptFlags", func(t *testing.T) {
+		h.Set(common.SetRequest{Key: []byte("flags"), Data: []byte("value"), Flags: 1})
+		it := store.items["flags"]
+		it.flags ^= 0x10
+		store.items["flags"] = it
+
+		res, err := h.GAT(common.GATRequest{Key: []byte("flags")})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if !res.Miss {
+			t.Fatalf("Expected an item with corrupted flags to be a miss")
+		}
+		if _, ok := store.items["flags"]; ok {
+			t.Fatalf("Expected the corrupted item to be deleted")
+		}
+	})
+	t.Run("Legacy", func(t *testing.T) {
+		store.items["legacy"] = item{data: []byte("plain"), flags: 3}
+		if res := get(t, h, "legacy"); res.Flags != 3 || string(res.Data) != "plain" {
+			t.Fatalf("Expected unchecked items to pass through")
+		}
+	})
+	t.Run("ReservedFlag", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte("reserved"), Flags: FlagChecksum}); err != common.ErrInvalidArgs {
+			t.Fatalf("Expected ErrInvalidArgs, got %v", err)
+		}
+	})
+	t.Run("Append", func(t *testing.T) {
+		h.Set(common.SetRequest{Key: []byte("append"), Data: []byte("mid"), Exptime: 30})
+		if err := h.Append(common.SetRequest{Key: []byte("append"), Data: []byte("end")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Prepend(common.SetRequest{Key: []byte("append"), Data: []byte("start")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if res := get(t, h, "append"); string(res.Data) != "startmidend" {
+			t.Fatalf("Expected startmidend, got %q", res.Data)
+		}
+		if it := store.items["append"]; it.exptime != 30 {
+			t.Fatalf("Expected the TTL to be kept, got %d", it.exptime)
+		}
+	})
+}
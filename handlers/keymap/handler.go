@@ -0,0 +1,333 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keymap provides a handler wrapper that stores items under fixed length
+// hashes of their keys, so keys longer than memcached allows can be used.
+//
+// A hashed item is marked with FlagMappedKey and its data starts with the length
+// of the client's key and the key itself. Reads check the stored key against the
+// requested one, so a hash collision is a miss rather than someone else's data,
+// and responses carry the client's key. The mapping only depends on the key, so
+// every proxy sends a key to the same backend key and, through the cluster
+// handler, to the same node.
+package keymap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+)
+
+// FlagMappedKey is the bit in an item's flags that marks it as stored under a
+// hashed key. It is reserved: clients can't set it and never see it.
+const FlagMappedKey uint32 = 1 << 28
+
+// MaxKeyLength is the longest key memcached accepts.
+const MaxKeyLength = 250
+
+const (
+	// Backend keys are the prefix and the hex SHA-256 of the client's key
+	mappedPrefix = "~h:"
+
+	lenSize = 2
+)
+
+var (
+	MetricMapped     = metrics.AddCounter("keymap_mapped", nil)
+	MetricCollisions = metrics.AddCounter("keymap_collisions", nil)
+)
+
+// Opts configures the key mapping handler.
+type Opts struct {
+	// HashAll stores every key under its hash instead of only those longer than
+	// MaxKeyLength. This keeps backend key sizes uniform and key names out of
+	// the backend.
+	HashAll bool
+}
+
+// Handler wraps a handler constructor so keys that are too long for memcached
+// (or all keys, with opts.HashAll) are stored under a hash of the key. It must
+// wrap the cluster handler rather than the handlers for its nodes, so nodes are
+// picked by the backend key.
+//
+// Appends work as usual. A hashed item starts with its original key, so a
+// prepend has to go in after it: the item is read, changed and written back
+// with Replace, and can race with other writes to the key unless the locked
+// orca serializes them.
+func Handler(hc handlers.HandlerConst, opts Opts) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		inner, err := hc()
+		if err != nil {
+			return nil, err
+		}
+
+		return &handler{
+			h:       inner,
+			hashAll: opts.HashAll,
+		}, nil
+	}
+}
+
+type handler struct {
+	h       handlers.Handler
+	hashAll bool
+}
+
+// backendKey returns the key an item is stored under and whether it is hashed.
+func (h *handler) backendKey(key []byte) ([]byte, bool) {
+	if !h.hashAll && len(key) <= MaxKeyLength {
+		return key, false
+	}
+
+	sum := sha256.Sum256(key)
+	out := make([]byte, len(mappedPrefix)+hex.EncodedLen(len(sum)))
+	copy(out, mappedPrefix)
+	hex.Encode(out[len(mappedPrefix):], sum[:])
+	return out, true
+}
+
+// wrap prepends the client's key to a value stored under a hashed key.
+func wrap(key, data []byte) []byte {
+	out := make([]byte, lenSize+len(key)+len(data))
+	binary.BigEndian.PutUint16(out, uint16(len(key)))
+	copy(out[lenSize:], key)
+	copy(out[lenSize+len(key):], data)
+	return out
+}
+
+// unwrap returns the value a client stored under key. ok is false if the item
+// belongs to another key, either because of a hash collision or because an
+// unhashed key happens to look like a hashed one.
+func unwrap(key, data []byte, flags uint32, mapped bool) (out []byte, outFlags uint32, ok bool) {
+	if flags&FlagMappedKey == 0 {
+		if mapped {
+			metrics.IncCounter(MetricCollisions)
+			return nil, flags, false
+		}
+		return data, flags, true
+	}
+	flags &^= FlagMappedKey
+
+	if len(data) < lenSize {
+		return nil, flags, false
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < lenSize+n || !bytes.Equal(data[lenSize:lenSize+n], key) {
+		metrics.IncCounter(MetricCollisions)
+		return nil, flags, false
+	}
+
+	return data[lenSize+n:], flags, true
+}
+
+func (h *handler) store(cmd common.SetRequest, f func(common.SetRequest) error) error {
+	if cmd.Flags&FlagMappedKey != 0 {
+		return common.ErrInvalidArgs
+	}
+
+	bk, mapped := h.backendKey(cmd.Key)
+	if mapped {
+		if len(cmd.Key) > 0xffff {
+			return common.ErrInvalidArgs
+		}
+		metrics.IncCounter(MetricMapped)
+		cmd.Data = wrap(cmd.Key, cmd.Data)
+		cmd.Flags |= FlagMappedKey
+	}
+
+	cmd.Key = bk
+	return f(cmd)
+}
+
+func (h *handler) Set(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Set)
+}
+
+func (h *handler) Add(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Add)
+}
+
+func (h *handler) Replace(cmd common.SetRequest) error {
+	return h.store(cmd, h.h.Replace)
+}
+
+// Append adds to the end of the value, which is the same whether or not the key
+// is stored with it.
+func (h *handler) Append(cmd common.SetRequest) error {
+	cmd.Key, _ = h.backendKey(cmd.Key)
+	return h.h.Append(cmd)
+}
+
+// Prepend has to put the new data after the stored key, so a hashed item is
+// rewritten whole like the other wrappers rewrite theirs.
+func (h *handler) Prepend(cmd common.SetRequest) error {
+	bk, mapped := h.backendKey(cmd.Key)
+	if !mapped {
+		return h.h.Prepend(cmd)
+	}
+
+	key := cmd.Key
+	cmd.Key = bk
+
+	return handlers.Concat(h.h, cmd, FlagMappedKey, h.h.Prepend, func(cur common.GetEResponse) error {
+		data, flags, ok := unwrap(key, cur.Data, cur.Flags, true)
+		if !ok {
+			return common.ErrItemNotStored
+		}
+
+		return h.store(common.SetRequest{
+			Key:     key,
+			Data:    handlers.PrependData(data, cmd.Data),
+			Flags:   flags,
+			Exptime: cur.Exptime,
+			Opaque:  cmd.Opaque,
+			Quiet:   cmd.Quiet,
+		}, h.h.Replace)
+	})
+}
+
+func (h *handler) Delete(cmd common.DeleteRequest) error {
+	cmd.Key, _ = h.backendKey(cmd.Key)
+	return h.h.Delete(cmd)
+}
+
+func (h *handler) Touch(cmd common.TouchRequest) error {
+	cmd.Key, _ = h.backendKey(cmd.Key)
+	return h.h.Touch(cmd)
+}
+
+func (h *handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	key := cmd.Key
+	bk, mapped := h.backendKey(key)
+	cmd.Key = bk
+
+	res, err := h.h.GAT(cmd)
+	if err != nil {
+		return res, err
+	}
+
+	res.Key = key
+	if res.Miss {
+		return res, nil
+	}
+
+	var ok bool
+	if res.Data, res.Flags, ok = unwrap(key, res.Data, res.Flags, mapped); !ok {
+		return common.GetResponse{
+			Miss:   true,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
+			Key:    key,
+		}, nil
+	}
+
+	return res, nil
+}
+
+// mapKeys returns a copy of a get request with backend keys and a lookup from
+// backend keys to the clients' keys.
+func (h *handler) mapKeys(cmd common.GetRequest) (common.GetRequest, map[string][]byte) {
+	orig := make(map[string][]byte, len(cmd.Keys))
+	keys := make([][]byte, len(cmd.Keys))
+
+	for i, key := range cmd.Keys {
+		bk, mapped := h.backendKey(key)
+		if mapped {
+			orig[string(bk)] = key
+		}
+		keys[i] = bk
+	}
+
+	cmd.Keys = keys
+	return cmd, orig
+}
+
+// Get results are checked against the clients' keys as they arrive, and an item
+// that belongs to another key is returned as a miss.
+func (h *handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	cmd, orig := h.mapKeys(cmd)
+	resChan, errChan := h.h.Get(cmd)
+	outRes := make(chan common.GetResponse, len(cmd.Keys))
+
+	go func() {
+		for res := range resChan {
+			key, mapped := orig[string(res.Key)]
+			if !mapped {
+				key = res.Key
+			}
+			res.Key = key
+
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = unwrap(key, res.Data, res.Flags, mapped); !ok {
+					res = common.GetResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    key,
+					}
+				}
+			}
+			outRes <- res
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	cmd, orig := h.mapKeys(cmd)
+	resChan, errChan := h.h.GetE(cmd)
+	if resChan == nil {
+		return resChan, errChan
+	}
+
+	outRes := make(chan common.GetEResponse, len(cmd.Keys))
+
+	go func() {
+		for res := range resChan {
+			key, mapped := orig[string(res.Key)]
+			if !mapped {
+				key = res.Key
+			}
+			res.Key = key
+
+			if !res.Miss {
+				var ok bool
+				if res.Data, res.Flags, ok = unwrap(key, res.Data, res.Flags, mapped); !ok {
+					res = common.GetEResponse{
+						Miss:   true,
+						Opaque: res.Opaque,
+						Quiet:  res.Quiet,
+						Key:    key,
+					}
+				}
+			}
+			outRes <- res
+		}
+		close(outRes)
+	}()
+
+	return outRes, errChan
+}
+
+func (h *handler) Close() error {
+	return h.h.Close()
+}
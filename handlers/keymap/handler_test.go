@@ -0,0 +1,205 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keymap
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+)
+
+type item struct {
+	data    []byte
+	flags   uint32
+	exptime uint32
+}
+
+// storeHandler keeps items in a map and, like memcached, refuses long keys.
+type storeHandler struct {
+	handlers.Handler
+	items map[string]item
+}
+
+func newStoreHandler() *storeHandler {
+	return &storeHandler{items: make(map[string]item)}
+}
+
+func (h *storeHandler) Set(cmd common.SetRequest) error {
+	if len(cmd.Key) > MaxKeyLength {
+		return common.ErrInvalidArgs
+	}
+	h.items[string(cmd.Key)] = item{cmd.Data, cmd.Flags, cmd.Exptime}
+	return nil
+}
+
+func (h *storeHandler) Replace(cmd common.SetRequest) error {
+	if _, ok := h.items[string(cmd.Key)]; !ok {
+		return common.ErrItemNotStored
+	}
+	return h.Set(cmd)
+}
+
+func (h *storeHandler) Append(cmd common.SetRequest) error {
+	it, ok := h.items[string(cmd.Key)]
+	if !ok {
+		return common.ErrItemNotStored
+	}
+	it.data = append(it.data[:len(it.data):len(it.data)], cmd.Data...)
+	h.items[string(cmd.Key)] = it
+	return nil
+}
+
+func (h *storeHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	resChan := make(chan common.GetResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for i, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetResponse{Key: key, Data: it.data, Flags: it.flags, Opaque: cmd.Opaques[i], Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func (h *storeHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse, len(cmd.Keys))
+	errChan := make(chan error)
+	for _, key := range cmd.Keys {
+		it, ok := h.items[string(key)]
+		resChan <- common.GetEResponse{Key: key, Data: it.data, Flags: it.flags, Exptime: it.exptime, Miss: !ok}
+	}
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+// noGetEStore answers GetE like a stock memcached does.
+type noGetEStore struct {
+	*storeHandler
+}
+
+func (h noGetEStore) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan := make(chan common.GetEResponse)
+	errChan := make(chan error, 1)
+	errChan <- common.ErrUnknownCmd
+	close(resChan)
+	close(errChan)
+	return resChan, errChan
+}
+
+func getAll(t *testing.T, h handlers.Handler, keys ...string) []common.GetResponse {
+	req := common.GetRequest{}
+	for i, key := range keys {
+		req.Keys = append(req.Keys, []byte(key))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+
+	resChan, errChan := h.Get(req)
+	var out []common.GetResponse
+	for res := range resChan {
+		out = append(out, res)
+	}
+	for err := range errChan {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return out
+}
+
+func TestHandler(t *testing.T) {
+	long := strings.Repeat("k", 300)
+
+	store := newStoreHandler()
+	h, _ := Handler(func() (handlers.Handler, error) { return store, nil }, Opts{})()
+
+	t.Run("LongKey", func(t *testing.T) {
+		if err := h.Set(common.SetRequest{Key: []byte(long), Data: []byte("value"), Flags: 4}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Set(common.SetRequest{Key: []byte("short"), Data: []byte("plain")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		for key := range store.items {
+			if len(key) > MaxKeyLength {
+				t.Fatalf("Expected every backend key to fit in memcached, got %d bytes", len(key))
+			}
+		}
+		if it, ok := store.items["short"]; !ok || string(it.data) != "plain" {
+			t.Fatalf("Expected short keys to be stored as is")
+		}
+
+		res := getAll(t, h, "short", long)
+		if len(res) != 2 || string(res[0].Data) != "plain" || string(res[1].Key) != long ||
+			string(res[1].Data) != "value" || res[1].Flags != 4 || res[1].Opaque != 1 {
+			t.Fatalf("Expected both values with the clients' keys, got %+v", res)
+		}
+	})
+	t.Run("Collision", func(t *testing.T) {
+		// Pretend another key hashed to the same backend key
+		bk, _ := h.(*handler).backendKey([]byte(long))
+		store.items[string(bk)] = item{data: wrap([]byte("other"), []byte("theirs")), flags: FlagMappedKey}
+
+		if res := getAll(t, h, long); !res[0].Miss || string(res[0].Key) != long {
+			t.Fatalf("Expected a collision to be a miss for the client's key, got %+v", res[0])
+		}
+
+		// An unhashed key that looks like a hashed one doesn't count either
+		store.items[string(bk)] = item{data: []byte("theirs")}
+		if res := getAll(t, h, long); !res[0].Miss {
+			t.Fatalf("Expected an unhashed item to be a miss for a hashed key")
+		}
+	})
+	t.Run("AppendPrepend", func(t *testing.T) {
+		h.Set(common.SetRequest{Key: []byte(long), Data: []byte("mid"), Exptime: 10})
+		if err := h.Append(common.SetRequest{Key: []byte(long), Data: []byte("end")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Prepend(common.SetRequest{Key: []byte(long), Data: []byte("start")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if res := getAll(t, h, long); string(res[0].Data) != "startmidend" {
+			t.Fatalf("Expected startmidend, got %q", res[0].Data)
+		}
+	})
+	t.Run("PrependWithoutGetE", func(t *testing.T) {
+		store := newStoreHandler()
+		h, _ := Handler(func() (handlers.Handler, error) { return noGetEStore{store}, nil }, Opts{})()
+
+		h.Set(common.SetRequest{Key: []byte(long), Data: []byte("mid"), Exptime: 10})
+
+		// The TTL can't be read back, so the item would lose it
+		if err := h.Prepend(common.SetRequest{Key: []byte(long), Data: []byte("start")}); err != common.ErrNotSupported {
+			t.Fatalf("Expected ErrNotSupported, got %v", err)
+		}
+		if res := getAll(t, h, long); string(res[0].Data) != "mid" {
+			t.Fatalf("Expected the item to be left alone, got %q", res[0].Data)
+		}
+	})
+	t.Run("HashAll", func(t *testing.T) {
+		store := newStoreHandler()
+		h, _ := Handler(func() (handlers.Handler, error) { return store, nil }, Opts{HashAll: true})()
+
+		h.Set(common.SetRequest{Key: []byte("short"), Data: []byte("value")})
+		if _, ok := store.items["short"]; ok {
+			t.Fatalf("Expected every key to be hashed")
+		}
+		if res := getAll(t, h, "short"); string(res[0].Data) != "value" {
+			t.Fatalf("Expected the value back, got %q", res[0].Data)
+		}
+	})
+}
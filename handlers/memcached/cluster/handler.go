@@ -1,17 +1,93 @@
 package cluster
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers/memcached/std"
-	"github.com/netflix/rend/protocol/binprot"
-	"net"
+	"github.com/netflix/rend/metrics"
 )
 
+var (
+	MetricReplicaFallbacks     = metrics.AddCounter("cluster_replica_fallbacks", nil)
+	MetricReplicaReadErrors    = metrics.AddCounter("cluster_replica_read_errors", nil)
+	MetricReplicaWriteErrors   = metrics.AddCounter("cluster_replica_write_errors", nil)
+	MetricReplicaDrift         = metrics.AddCounter("cluster_replica_drift", nil)
+	MetricWriteConsistencyMiss = metrics.AddCounter("cluster_write_consistency_failures", nil)
+)
+
+// Consistency is how many replicas must acknowledge a write for it to succeed.
+type Consistency int
+
+const (
+	// WriteAll requires every replica to acknowledge a write.
+	WriteAll Consistency = iota
+	// WriteQuorum requires a majority of the replicas.
+	WriteQuorum
+	// WriteOne requires a single replica.
+	WriteOne
+)
+
+// ParseConsistency returns the write consistency with a name: all, quorum or
+// one.
+func ParseConsistency(name string) (Consistency, error) {
+	switch name {
+	case "all":
+		return WriteAll, nil
+	case "quorum":
+		return WriteQuorum, nil
+	case "one":
+		return WriteOne, nil
+	}
+	return 0, fmt.Errorf("unknown write consistency %q", name)
+}
+
+// acks returns the number of acknowledgements needed from a number of replicas.
+func (c Consistency) acks(replicas int) int {
+	switch c {
+	case WriteOne:
+		return 1
+	case WriteQuorum:
+		return replicas/2 + 1
+	default:
+		return replicas
+	}
+}
+
+// Opts configures replication, timeouts and connection pooling in a cluster
+// handler.
+type Opts struct {
+	// Replicas is the number of distinct nodes each key is written to, taken
+	// in order from the continuum. Default: 1
+	Replicas int
+
+	// WriteConsistency decides how many replicas must acknowledge a write.
+	// Default: WriteAll
+	WriteConsistency Consistency
+
+	// Timeout bounds waiting for a connection to a node, dialing it and each
+	// command sent to it, so a hung node fails commands instead of holding on
+	// to every pooled connection. Default: 1s
+	Timeout time.Duration
+
+	// Pool configures the connection pools to the nodes, for handlers that
+	// make their own membership.
+	Pool PoolOpts
+}
+
 type Node struct {
 	handler std.Handler
 	conn    net.Conn
 }
 
+func newNode(conn net.Conn) Node {
+	return Node{std.NewHandler(conn), conn}
+}
+
 func (n Node) Label() string {
 	return n.conn.RemoteAddr().String()
 }
@@ -20,48 +96,437 @@ func (n Node) Weight() uint32 {
 	return 1
 }
 
+// Handler sends each command to the nodes that hold its key. It follows its
+// membership, so nodes can join and leave the cluster while it is in use. It
+// borrows a connection from the node's pool for each command, so handlers for
+// many clients share a bounded number of connections to each node.
 type Handler struct {
-	nodes     []Node
-	Continuum *Continuum
-	name      string
+	members *Membership
+	name    string
+	opts    Opts
+
+	// ownMembership is set when the handler made its membership, so closing
+	// the handler closes it
+	ownMembership bool
 }
 
 func emptyClusterHandler() Handler {
-	return Handler{[]Node{}, nil, "EmptyCluster"}
+	return Handler{NewMembership("EmptyCluster", nil), "EmptyCluster", Opts{Replicas: 1}, true}
 }
 
+// NewHandler connects to every node and writes each key to a single node.
 func NewHandler(nodesAddresses []string, clusterName string) (Handler, error) {
-	nodes := make([]Node, len(nodesAddresses))
-	buckets := make([]Bucket, len(nodesAddresses))
+	return NewHandlerWithOpts(nodesAddresses, clusterName, Opts{})
+}
+
+// NewHandlerWithOpts connects to every node and writes each key to as many
+// nodes as opts.Replicas. Reads try each replica in turn until one has the key.
+// It fails if any node can't be reached.
+func NewHandlerWithOpts(nodesAddresses []string, clusterName string, opts Opts) (Handler, error) {
+	m := NewMembershipWithPool(clusterName, nodesAddresses, opts.Pool)
+	h := newHandler(m, clusterName, opts)
+	h.ownMembership = true
 
-	for ix, nodeAddr := range nodesAddresses {
-		conn, err := net.Dial("tcp", nodeAddr)
+	for _, p := range m.current().pools {
+		n, err := p.get(h.opts.Timeout)
 		if err != nil {
-			if conn != nil {
-				conn.Close()
-			}
+			m.Close()
 			return emptyClusterHandler(), err
 		}
-		nodes[ix] = Node{std.NewHandler(conn), conn}
-		buckets[ix] = nodes[ix]
+		p.put(n, false)
 	}
-	return Handler{nodes, New(buckets), clusterName}, nil
+	return h, nil
 }
 
+// NewHandlerWithMembership returns a handler for the nodes in a membership,
+// which may change over time. Nodes that can't be reached are tried again when
+// a request needs them instead of failing the handler. The membership's pools
+// are used, whatever opts.Pool is.
+func NewHandlerWithMembership(m *Membership, opts Opts) Handler {
+	return newHandler(m, m.name, opts)
+}
+
+func newHandler(m *Membership, clusterName string, opts Opts) Handler {
+	if opts.Replicas <= 0 {
+		opts.Replicas = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	return Handler{members: m, name: clusterName, opts: opts}
+}
+
+// Close leaves the connections in their pools for other handlers. It only
+// closes them if the handler made its own membership and nothing else uses it.
 func (h Handler) Close() error {
-	var err error
+	if h.ownMembership {
+		h.members.Close()
+	}
+	return nil
+}
+
+// errNoNodes is returned for every command when the cluster has no nodes.
+var errNoNodes = errors.New("cluster: no nodes to send the request to")
+
+// replicas returns the addresses of the nodes that hold a key, the owner
+// first.
+func (h Handler) replicas(key []byte) ([]string, error) {
+	buckets := h.members.current().continuum.HashN(key, h.opts.Replicas)
+	if len(buckets) == 0 {
+		return nil, errNoNodes
+	}
 
-	for _, node := range h.nodes {
-		ret := node.handler.Close()
-		if ret != nil {
-			err = ret
+	addrs := make([]string, len(buckets))
+	for i, b := range buckets {
+		addrs[i] = b.(member).addr
+	}
+	return addrs, nil
+}
+
+// do runs f on a connection to a node borrowed from its pool, bounded by the
+// timeout. The outcome counts toward the node's health, and a connection an
+// error left in an unknown state is closed instead of going back to the pool.
+func (h Handler) do(addr string, f func(std.Handler) error) error {
+	v := h.members.current()
+	if v.ejected[addr] {
+		metrics.IncCounter(MetricEjectedRequests)
+		return common.ErrTempFailure
+	}
+
+	p, ok := v.pools[addr]
+	if !ok {
+		// The node left the cluster since the command looked up its replicas
+		return common.ErrTempFailure
+	}
+
+	n, err := p.get(h.opts.Timeout)
+	if err != nil {
+		// A pool that is busy or closed says nothing about the node itself. Only
+		// failing to dial it does.
+		if err != errPoolTimeout && err != errPoolClosed {
+			h.members.observe(addr, err)
 		}
+		return err
 	}
+
+	n.conn.SetDeadline(time.Now().Add(h.opts.Timeout))
+
+	err = f(n.handler)
+	h.members.observe(addr, err)
+	p.put(n, err != nil && !common.IsAppError(err))
 	return err
 }
 
+// write sends a command to every replica of a key at once and waits for all of
+// them, since each connection must be left with no response unread. It succeeds
+// once enough replicas acknowledge it for the write consistency. With missOK, a
+// replica without the key counts as an acknowledgement unless none of them have
+// it, so deleting or touching a key a replica lost still succeeds.
+func (h Handler) write(key []byte, missOK bool, f func(std.Handler) error) error {
+	nodes, err := h.replicas(key)
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) == 1 {
+		return h.do(nodes[0], f)
+	}
+
+	return h.acked(h.send(nodes, f), missOK)
+}
+
+// writeIf is write for commands that depend on what a node already holds, like
+// add or replace. The owner goes first and decides: a write it refuses is
+// returned as is and never reaches the other replicas. Once the owner has
+// applied a write, a replica that refuses it has drifted from the owner, so it
+// is counted and fixed with repair instead of changing the result. Only if the
+// owner can't be reached do the other replicas' refusals decide.
+func (h Handler) writeIf(key []byte, f, repair func(std.Handler) error) error {
+	nodes, err := h.replicas(key)
+	if err != nil {
+		return err
+	}
+
+	ownerErr := h.do(nodes[0], f)
+	if len(nodes) == 1 || common.IsAppError(ownerErr) {
+		return ownerErr
+	}
+
+	errs := append([]error{ownerErr}, h.send(nodes[1:], f)...)
+	for i := 1; i < len(errs); i++ {
+		if !common.IsAppError(errs[i]) {
+			continue
+		}
+		if ownerErr != nil {
+			return errs[i]
+		}
+
+		metrics.IncCounter(MetricReplicaDrift)
+		errs[i] = h.do(nodes[i], repair)
+	}
+	return h.acked(errs, false)
+}
+
+// send runs a command on every node at once and returns each node's error.
+func (h Handler) send(nodes []string, f func(std.Handler) error) []error {
+	errs := make([]error, len(nodes))
+	wg := sync.WaitGroup{}
+
+	for i, addr := range nodes {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			errs[i] = h.do(addr, f)
+		}(i, addr)
+	}
+
+	wg.Wait()
+	return errs
+}
+
+// acked checks the replicas' errors for a write against the write consistency.
+func (h Handler) acked(errs []error, missOK bool) error {
+	var acks, misses int
+	var firstErr error
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			acks++
+		case missOK && err == common.ErrKeyNotFound:
+			misses++
+		default:
+			if !common.IsAppError(err) {
+				metrics.IncCounter(MetricReplicaWriteErrors)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if acks == 0 && misses == len(errs) {
+		return common.ErrKeyNotFound
+	}
+	if acks+misses < h.opts.WriteConsistency.acks(len(errs)) {
+		metrics.IncCounter(MetricWriteConsistencyMiss)
+		return firstErr
+	}
+	return nil
+}
+
 func (h Handler) Set(cmd common.SetRequest) error {
-	return h.Continuum.Hash(cmd.Key).(Node).handler.Set(cmd)
+	return h.write(cmd.Key, false, func(n std.Handler) error { return n.Set(cmd) })
+}
+
+// A replica that refused an add or replace the owner applied is given the same
+// item with a set.
+func (h Handler) Add(cmd common.SetRequest) error {
+	return h.writeIf(cmd.Key, func(n std.Handler) error { return n.Add(cmd) }, func(n std.Handler) error { return n.Set(cmd) })
+}
+
+func (h Handler) Replace(cmd common.SetRequest) error {
+	return h.writeIf(cmd.Key, func(n std.Handler) error { return n.Replace(cmd) }, func(n std.Handler) error { return n.Set(cmd) })
+}
+
+// The owner's value after an append or prepend isn't known without reading it
+// back, so a replica that refused one drops its copy instead and reads fall
+// back past it.
+func (h Handler) Append(cmd common.SetRequest) error {
+	return h.writeIf(cmd.Key, func(n std.Handler) error { return n.Append(cmd) }, dropper(cmd.Key))
+}
+
+func (h Handler) Prepend(cmd common.SetRequest) error {
+	return h.writeIf(cmd.Key, func(n std.Handler) error { return n.Prepend(cmd) }, dropper(cmd.Key))
+}
+
+func dropper(key []byte) func(std.Handler) error {
+	return func(n std.Handler) error {
+		if err := n.Delete(common.DeleteRequest{Key: key}); err != common.ErrKeyNotFound {
+			return err
+		}
+		return nil
+	}
+}
+
+func (h Handler) Delete(cmd common.DeleteRequest) error {
+	return h.write(cmd.Key, true, func(n std.Handler) error { return n.Delete(cmd) })
+}
+
+func (h Handler) Touch(cmd common.TouchRequest) error {
+	return h.write(cmd.Key, true, func(n std.Handler) error { return n.Touch(cmd) })
+}
+
+// GAT touches the key on every replica and returns the first hit in replica
+// order.
+func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	nodes, err := h.replicas(cmd.Key)
+	if err != nil {
+		return common.GetResponse{}, err
+	}
+
+	type result struct {
+		res common.GetResponse
+		err error
+	}
+
+	results := make([]chan result, len(nodes))
+	for i, addr := range nodes {
+		results[i] = make(chan result, 1)
+		go func(addr string, out chan result) {
+			var res common.GetResponse
+			err := h.do(addr, func(n std.Handler) (err error) {
+				res, err = n.GAT(cmd)
+				return err
+			})
+			out <- result{res, err}
+		}(addr, results[i])
+	}
+
+	var ret *common.GetResponse
+	var errCount int
+	var lastErr error
+
+	for i, c := range results {
+		r := <-c
+		if r.err != nil {
+			metrics.IncCounter(MetricReplicaReadErrors)
+			errCount++
+			lastErr = r.err
+			continue
+		}
+		if ret == nil && !r.res.Miss {
+			if i > 0 {
+				metrics.IncCounter(MetricReplicaFallbacks)
+			}
+			res := r.res
+			ret = &res
+		}
+	}
+
+	if ret != nil {
+		return *ret, nil
+	}
+	if errCount == len(nodes) {
+		return common.GetResponse{}, lastErr
+	}
+	return common.GetResponse{
+		Miss:   true,
+		Opaque: cmd.Opaque,
+		Key:    cmd.Key,
+	}, nil
+}
+
+// getResult is what a multi-get found for one key.
+type getResult struct {
+	data    []byte
+	flags   uint32
+	exptime uint32
+	hit     bool
+
+	// The number of the key's replicas, and how many of them returned an
+	// error, the last of which is err
+	replicas int
+	errs     int
+	err      error
+}
+
+// failed is whether every replica of the key returned an error.
+func (r getResult) failed() bool {
+	return !r.hit && r.errs == r.replicas
+}
+
+// getMulti reads keys from their nodes, with their exptimes if gete is set. The
+// keys are grouped by node and each node gets one pipelined batch, all nodes at
+// once. Keys a replica misses or fails go to their next replica in another
+// round. A key only fails if every one of its replicas returned an error.
+func (h Handler) getMulti(keys [][]byte, gete bool) ([]getResult, error) {
+	results := make([]getResult, len(keys))
+	replicas := make([][]string, len(keys))
+
+	for idx, key := range keys {
+		addrs, err := h.replicas(key)
+		if err != nil {
+			return nil, err
+		}
+		replicas[idx] = addrs
+		results[idx].replicas = len(addrs)
+	}
+
+	pending := make([]int, len(keys))
+	for idx := range pending {
+		pending[idx] = idx
+	}
+
+	for round := 0; len(pending) > 0; round++ {
+		batches := make(map[string][]int)
+		for _, idx := range pending {
+			if round < len(replicas[idx]) {
+				addr := replicas[idx][round]
+				batches[addr] = append(batches[addr], idx)
+			}
+		}
+		if len(batches) == 0 {
+			break
+		}
+
+		wg := sync.WaitGroup{}
+		for addr, idxs := range batches {
+			wg.Add(1)
+			go func(addr string, idxs []int) {
+				defer wg.Done()
+				h.getBatch(addr, keys, idxs, gete, results)
+			}(addr, idxs)
+		}
+		wg.Wait()
+
+		next := pending[:0]
+		for _, idx := range pending {
+			if results[idx].hit {
+				if round > 0 {
+					metrics.IncCounter(MetricReplicaFallbacks)
+				}
+				continue
+			}
+			next = append(next, idx)
+		}
+		pending = next
+	}
+
+	return results, nil
+}
+
+// getBatch reads the keys at idxs from one node. Each batch owns its keys'
+// results, so batches to different nodes can run at once.
+func (h Handler) getBatch(addr string, keys [][]byte, idxs []int, gete bool, results []getResult) {
+	batch := make([][]byte, len(idxs))
+	for i, idx := range idxs {
+		batch[i] = keys[idx]
+	}
+
+	failed := make([]bool, len(idxs))
+	err := h.do(addr, func(n std.Handler) error {
+		return std.GetBatchLocal(n.Rw, batch, gete, func(i int, data []byte, flags, exp uint32, err error) {
+			r := &results[idxs[i]]
+			if err != nil {
+				failed[i] = true
+				r.errs++
+				r.err = err
+				return
+			}
+			r.data, r.flags, r.exptime, r.hit = data, flags, exp, true
+		})
+	})
+
+	for i, idx := range idxs {
+		r := &results[idx]
+		if err != nil && !r.hit && !failed[i] {
+			r.errs++
+			r.err = err
+		}
+		if r.err != nil && !r.hit {
+			metrics.IncCounter(MetricReplicaReadErrors)
+		}
+	}
 }
 
 func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
@@ -72,68 +537,71 @@ func (h Handler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan e
 	return dataOut, errorOut
 }
 
-func (h *Handler) realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error) {
+// realHandleGet gets the keys from all of the nodes at once, then responds in
+// the order the keys were asked for.
+func (h Handler) realHandleGet(cmd common.GetRequest, dataOut chan common.GetResponse, errorOut chan error) {
 	defer close(errorOut)
 	defer close(dataOut)
 
-	for idx, key := range cmd.Keys {
-		handle := h.Continuum.Hash(key).(Node).handler
-		if err := binprot.WriteGetCmd(handle.Rw.Writer, key, 0); err != nil {
-			errorOut <- err
-			return
-		}
-
-		data, flags, _, err := std.GetLocal(handle.Rw, false)
-		if err != nil {
-			if err == common.ErrKeyNotFound {
-				dataOut <- common.GetResponse{
-					Miss:   true,
-					Quiet:  cmd.Quiet[idx],
-					Opaque: cmd.Opaques[idx],
-					Flags:  flags,
-					Key:    key,
-					Data:   nil,
-				}
-
-				continue
-			}
+	results, err := h.getMulti(cmd.Keys, false)
+	if err != nil {
+		errorOut <- err
+		return
+	}
 
-			errorOut <- err
+	for idx, key := range cmd.Keys {
+		r := results[idx]
+		if r.failed() {
+			errorOut <- r.err
 			return
 		}
 
 		dataOut <- common.GetResponse{
-			Miss:   false,
+			Miss:   !r.hit,
 			Quiet:  cmd.Quiet[idx],
 			Opaque: cmd.Opaques[idx],
-			Flags:  flags,
+			Flags:  r.flags,
 			Key:    key,
-			Data:   data,
+			Data:   r.data,
 		}
 	}
 }
 
+// GetE is like Get, but uses the gete extension to also return each item's
+// exptime. The nodes must support it, as Rend-based servers do.
 func (h Handler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
-	return nil, nil
-}
-func (h Handler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
-	return common.GetResponse{}, nil
-}
-func (h Handler) Delete(cmd common.DeleteRequest) error {
-	return nil
-}
-func (h Handler) Touch(cmd common.TouchRequest) error {
-	return nil
-}
-func (h Handler) Add(cmd common.SetRequest) error {
-	return nil
-}
-func (h Handler) Replace(cmd common.SetRequest) error {
-	return nil
-}
-func (h Handler) Append(cmd common.SetRequest) error {
-	return nil
+	dataOut := make(chan common.GetEResponse)
+	errorOut := make(chan error)
+	go h.realHandleGetE(cmd, dataOut, errorOut)
+
+	return dataOut, errorOut
 }
-func (h Handler) Prepend(cmd common.SetRequest) error {
-	return nil
+
+func (h Handler) realHandleGetE(cmd common.GetRequest, dataOut chan common.GetEResponse, errorOut chan error) {
+	defer close(errorOut)
+	defer close(dataOut)
+
+	results, err := h.getMulti(cmd.Keys, true)
+	if err != nil {
+		errorOut <- err
+		return
+	}
+
+	for idx, key := range cmd.Keys {
+		r := results[idx]
+		if r.failed() {
+			errorOut <- r.err
+			return
+		}
+
+		dataOut <- common.GetEResponse{
+			Miss:    !r.hit,
+			Quiet:   cmd.Quiet[idx],
+			Opaque:  cmd.Opaques[idx],
+			Flags:   r.flags,
+			Exptime: r.exptime,
+			Key:     key,
+			Data:    r.data,
+		}
+	}
 }
@@ -0,0 +1,454 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/inmem"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/server"
+)
+
+type testListener struct {
+	net.Listener
+}
+
+func (l testListener) Configure(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+// testNode is a Rend server with its own in-memory cache, which speaks the same
+// binary protocol as memcached plus the gete extension.
+type testNode struct {
+	addr  string
+	cache *inmem.Handler
+}
+
+func startNode(t *testing.T) testNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return serveNode(l)
+}
+
+func serveNode(l net.Listener) testNode {
+	cache := inmem.NewHandler(inmem.Opts{})
+	go server.ListenAndServe(
+		func() (server.Listener, error) { return testListener{l}, nil },
+		[]protocol.Components{binprot.Components},
+		server.Default,
+		orcas.L1Only,
+		inmem.HandlerConst(cache),
+		handlers.NilHandler,
+	)
+
+	return testNode{addr: l.Addr().String(), cache: cache}
+}
+
+func startCluster(t *testing.T, n int) ([]testNode, []string) {
+	var nodes []testNode
+	var addrs []string
+	for i := 0; i < n; i++ {
+		node := startNode(t)
+		nodes = append(nodes, node)
+		addrs = append(addrs, node.addr)
+	}
+	return nodes, addrs
+}
+
+func getKeys(keys ...string) common.GetRequest {
+	req := common.GetRequest{}
+	for i, key := range keys {
+		req.Keys = append(req.Keys, []byte(key))
+		req.Opaques = append(req.Opaques, uint32(i))
+		req.Quiet = append(req.Quiet, false)
+	}
+	return req
+}
+
+func TestHandler(t *testing.T) {
+	nodes, addrs := startCluster(t, 3)
+
+	h, err := NewHandler(addrs, "test")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	defer h.Close()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		if err := h.Add(common.SetRequest{Key: []byte(key), Data: []byte("mid"), Exptime: 100}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+	}
+
+	t.Run("Distribution", func(t *testing.T) {
+		total := 0
+		for _, node := range nodes {
+			resChan, _ := node.cache.Get(getKeys(keys...))
+
+			held := 0
+			for res := range resChan {
+				if !res.Miss {
+					held++
+				}
+			}
+			if held == 0 || held == len(keys) {
+				t.Fatalf("Expected the keys to be spread over the nodes, got %d on one", held)
+			}
+			total += held
+		}
+		if total != len(keys) {
+			t.Fatalf("Expected each key on exactly one node, got %d copies", total)
+		}
+	})
+	t.Run("Mutations", func(t *testing.T) {
+		key := []byte("key1")
+		if err := h.Add(common.SetRequest{Key: key}); err != common.ErrKeyExists {
+			t.Fatalf("Expected ErrKeyExists, got %v", err)
+		}
+		if err := h.Replace(common.SetRequest{Key: []byte("missing")}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+		if err := h.Append(common.SetRequest{Key: key, Data: []byte("end")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := h.Prepend(common.SetRequest{Key: key, Data: []byte("start")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		res, err := h.GAT(common.GATRequest{Key: key, Exptime: 200})
+		if err != nil || res.Miss || string(res.Data) != "startmidend" {
+			t.Fatalf("Expected startmidend, got %+v and %v", res, err)
+		}
+		if err := h.Touch(common.TouchRequest{Key: []byte("missing")}); err != common.ErrKeyNotFound {
+			t.Fatalf("Expected ErrKeyNotFound, got %v", err)
+		}
+
+		if err := h.Delete(common.DeleteRequest{Key: []byte("key2")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+	})
+	t.Run("GetE", func(t *testing.T) {
+		resChan, errChan := h.GetE(getKeys(keys...))
+
+		var hits int
+		for res := range resChan {
+			if !res.Miss {
+				hits++
+				if res.Exptime == 0 {
+					t.Fatalf("Expected an exptime for %s", res.Key)
+				}
+			}
+		}
+		for err := range errChan {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// key2 was deleted
+		if hits != 19 {
+			t.Fatalf("Expected 19 hits, got %d", hits)
+		}
+	})
+	t.Run("NoNodes", func(t *testing.T) {
+		h := emptyClusterHandler()
+		if err := h.Delete(common.DeleteRequest{Key: []byte("key")}); err != errNoNodes {
+			t.Fatalf("Expected errNoNodes, got %v", err)
+		}
+	})
+}
+
+func TestReplication(t *testing.T) {
+	nodes, addrs := startCluster(t, 3)
+
+	h, err := NewHandlerWithOpts(addrs, "test", Opts{Replicas: 2})
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	defer h.Close()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		h.Set(common.SetRequest{Key: []byte(key), Data: []byte("value")})
+	}
+
+	t.Run("Placement", func(t *testing.T) {
+		copies := make(map[string]int)
+		for _, node := range nodes {
+			resChan, _ := node.cache.Get(getKeys(keys...))
+			for res := range resChan {
+				if !res.Miss {
+					copies[string(res.Key)]++
+				}
+			}
+		}
+		for _, key := range keys {
+			if copies[key] != 2 {
+				t.Fatalf("Expected 2 copies of %s, got %d", key, copies[key])
+			}
+		}
+	})
+	t.Run("Fallback", func(t *testing.T) {
+		// Lose every item on one node
+		for _, node := range nodes[:1] {
+			for _, key := range keys {
+				node.cache.Delete(common.DeleteRequest{Key: []byte(key)})
+			}
+		}
+
+		resChan, errChan := h.Get(getKeys(keys...))
+		for res := range resChan {
+			if res.Miss {
+				t.Fatalf("Expected %s to be read from another replica", res.Key)
+			}
+		}
+		for err := range errChan {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// Deleting still works when a replica has already lost the key
+		for _, key := range keys {
+			if err := h.Delete(common.DeleteRequest{Key: []byte(key)}); err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+		}
+	})
+	t.Run("Consistency", func(t *testing.T) {
+		// One node becomes unreachable
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		down := l.Addr().String()
+		l.Close()
+
+		m := NewMembership("test", append(addrs[1:], down))
+		defer m.Close()
+
+		all := NewHandlerWithMembership(m, Opts{Replicas: 3})
+		quorum := NewHandlerWithMembership(m, Opts{Replicas: 3, WriteConsistency: WriteQuorum})
+
+		if err := all.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value")}); err == nil {
+			t.Fatalf("Expected a write to fail without every replica")
+		}
+		if err := quorum.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value")}); err != nil {
+			t.Fatalf("Expected a write to succeed with a quorum, got %v", err)
+		}
+
+		res, err := quorum.GAT(common.GATRequest{Key: []byte("key"), Exptime: 100})
+		if err != nil || res.Miss {
+			t.Fatalf("Expected a hit from the live replicas, got %+v and %v", res, err)
+		}
+	})
+	t.Run("ConditionalWrites", func(t *testing.T) {
+		owner, _ := NewHandler(addrs, "test")
+		one, _ := NewHandlerWithOpts(addrs, "test", Opts{Replicas: 3, WriteConsistency: WriteOne})
+		defer owner.Close()
+		defer one.Close()
+
+		// Only the key's owner holds it
+		key := []byte("conditional")
+		if err := owner.Set(common.SetRequest{Key: key, Data: []byte("old")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		if err := one.Add(common.SetRequest{Key: key, Data: []byte("new")}); err != common.ErrKeyExists {
+			t.Fatalf("Expected the owner's refusal to be returned, got %v", err)
+		}
+
+		for _, node := range nodes {
+			resChan, _ := node.cache.Get(getKeys(string(key)))
+			for res := range resChan {
+				if !res.Miss && string(res.Data) != "old" {
+					t.Fatalf("Expected no replica to take a value the owner refused, got %s", res.Data)
+				}
+			}
+		}
+	})
+	t.Run("ReplicaDrift", func(t *testing.T) {
+		owner, _ := NewHandler(addrs, "test")
+		all, _ := NewHandlerWithOpts(addrs, "test", Opts{Replicas: 3})
+		one, _ := NewHandlerWithOpts(addrs, "test", Opts{Replicas: 3, WriteConsistency: WriteOne})
+		defer owner.Close()
+		defer all.Close()
+		defer one.Close()
+
+		// Every replica but the key's owner still holds it
+		key := []byte("drift")
+		if err := all.Set(common.SetRequest{Key: key, Data: []byte("old")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := owner.Delete(common.DeleteRequest{Key: key}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		if err := one.Add(common.SetRequest{Key: key, Data: []byte("new")}); err != nil {
+			t.Fatalf("Expected the owner's result, got %v", err)
+		}
+
+		for _, node := range nodes {
+			resChan, _ := node.cache.Get(getKeys(string(key)))
+			for res := range resChan {
+				if res.Miss || string(res.Data) != "new" {
+					t.Fatalf("Expected the replicas to be repaired with the owner's value, got %+v", res)
+				}
+			}
+		}
+	})
+}
+
+func TestMultiGet(t *testing.T) {
+	_, addrs := startCluster(t, 3)
+
+	h, err := NewHandler(addrs, "test")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	defer h.Close()
+
+	// Every other key is set, and every third key is quiet
+	req := common.GetRequest{}
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if i%2 == 0 {
+			h.Set(common.SetRequest{Key: key, Data: []byte(fmt.Sprintf("value%d", i)), Flags: uint32(i), Exptime: 100})
+		}
+		req.Keys = append(req.Keys, key)
+		req.Opaques = append(req.Opaques, uint32(1000+i))
+		req.Quiet = append(req.Quiet, i%3 == 0)
+	}
+	// The same key twice in one request
+	req.Keys = append(req.Keys, []byte("key0"))
+	req.Opaques = append(req.Opaques, 2000)
+	req.Quiet = append(req.Quiet, false)
+
+	check := func(i int, miss bool, quiet bool, opaque uint32, key []byte, data []byte, flags uint32) {
+		expKey := fmt.Sprintf("key%d", i%100)
+		if i == 100 {
+			expKey = "key0"
+		}
+		if string(key) != expKey || opaque != req.Opaques[i] || quiet != req.Quiet[i] {
+			t.Fatalf("Expected %s with opaque %d in order, got %s with opaque %d", expKey, req.Opaques[i], key, opaque)
+		}
+
+		expHit := (i%100)%2 == 0
+		if miss == expHit {
+			t.Fatalf("Expected %s to be a hit: %v", key, expHit)
+		}
+		if expHit && (string(data) != fmt.Sprintf("value%d", i%100) || flags != uint32(i%100)) {
+			t.Fatalf("Expected the value and flags of %s, got %s and %d", key, data, flags)
+		}
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		resChan, errChan := h.Get(req)
+
+		i := 0
+		for res := range resChan {
+			check(i, res.Miss, res.Quiet, res.Opaque, res.Key, res.Data, res.Flags)
+			i++
+		}
+		for err := range errChan {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if i != len(req.Keys) {
+			t.Fatalf("Expected %d responses, got %d", len(req.Keys), i)
+		}
+	})
+	t.Run("GetE", func(t *testing.T) {
+		resChan, errChan := h.GetE(req)
+
+		i := 0
+		for res := range resChan {
+			check(i, res.Miss, res.Quiet, res.Opaque, res.Key, res.Data, res.Flags)
+			if !res.Miss && res.Exptime == 0 {
+				t.Fatalf("Expected the exptime of %s, got %d", res.Key, res.Exptime)
+			}
+			i++
+		}
+		for err := range errChan {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+	})
+	t.Run("NodeDown", func(t *testing.T) {
+		hung, closer := startHungNode(t)
+		defer closer.Close()
+
+		h, err := NewHandlerWithOpts(append(addrs, hung), "test", Opts{Timeout: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		defer h.Close()
+
+		// The error ends the responses early, as it does for a client
+		resChan, errChan := h.Get(req)
+		for {
+			select {
+			case _, ok := <-resChan:
+				if !ok {
+					t.Fatalf("Expected an error for the keys on a node that doesn't answer")
+				}
+				continue
+			case err := <-errChan:
+				if err == nil {
+					t.Fatalf("Expected an error for the keys on a node that doesn't answer")
+				}
+			}
+			break
+		}
+	})
+}
+
+func TestHashN(t *testing.T) {
+	var buckets []Bucket
+	for i := 0; i < 5; i++ {
+		buckets = append(buckets, testBucket(fmt.Sprintf("node%d", i)))
+	}
+	c := New(buckets)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		got := c.HashN(key, 3)
+
+		if len(got) != 3 || got[0] != c.Hash(key) {
+			t.Fatalf("Expected 3 buckets starting with the owner, got %v", got)
+		}
+		if got[0] == got[1] || got[1] == got[2] || got[0] == got[2] {
+			t.Fatalf("Expected distinct buckets, got %v", got)
+		}
+	}
+
+	if got := c.HashN([]byte("key"), 10); len(got) != 5 {
+		t.Fatalf("Expected at most every bucket, got %d", len(got))
+	}
+}
+
+type testBucket string
+
+func (b testBucket) Label() string  { return string(b) }
+func (b testBucket) Weight() uint32 { return 1 }
@@ -0,0 +1,295 @@
+package cluster
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/memcached/std"
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricNodeEjections      = metrics.AddCounter("cluster_ejections", nil)
+	MetricNodeReinstatements = metrics.AddCounter("cluster_reinstatements", nil)
+	MetricEjectedRequests    = metrics.AddCounter("cluster_ejected_node_requests", nil)
+)
+
+// Ejection is what happens to the keys of a node taken out of the cluster for
+// failing.
+type Ejection int
+
+const (
+	// Rehash takes the node out of the continuum, so its keys move to the next
+	// nodes until it recovers.
+	Rehash Ejection = iota
+	// FailFast leaves the node in the continuum and fails the commands for its
+	// keys with common.ErrTempFailure without sending them, so keys never move.
+	FailFast
+)
+
+// ParseEjection returns the ejection with a name: rehash or fail-fast.
+func ParseEjection(name string) (Ejection, error) {
+	switch name {
+	case "rehash":
+		return Rehash, nil
+	case "fail-fast":
+		return FailFast, nil
+	}
+	return 0, fmt.Errorf("unknown ejection %q", name)
+}
+
+// HealthOpts configures the health checks of a cluster's nodes.
+type HealthOpts struct {
+	// Interval is how often every node is sent a noop. Default: 1s
+	Interval time.Duration
+
+	// Timeout is how long a node has to answer a check. Default: 500ms
+	Timeout time.Duration
+
+	// FailureThreshold is the number of failures in a row, from checks or from
+	// commands, after which a node is ejected. Default: 3
+	FailureThreshold int
+
+	// RecoveryThreshold is the number of checks in a row an ejected node must
+	// pass to be reinstated. Default: 2
+	RecoveryThreshold int
+
+	// Ejection decides what happens to an ejected node's keys. Default: Rehash
+	Ejection Ejection
+}
+
+// nodeHealth is the health of one node, shared by every view it is in.
+type nodeHealth struct {
+	failures  int32
+	successes int32
+	metrics   *nodeMetrics
+}
+
+func newNodeHealth(clusterName, addr string) *nodeHealth {
+	return &nodeHealth{metrics: metricsFor(clusterName, addr)}
+}
+
+// nodeMetrics are the metrics of one node. They are registered once per node,
+// since metrics can't be removed and nodes may leave and join again.
+type nodeMetrics struct {
+	failures      uint32
+	checkFailures uint32
+	ejections     uint32
+	ejected       uint64
+}
+
+var (
+	nodeMetricsMu sync.Mutex
+	allNodeMetric = make(map[string]*nodeMetrics)
+)
+
+func metricsFor(clusterName, addr string) *nodeMetrics {
+	nodeMetricsMu.Lock()
+	defer nodeMetricsMu.Unlock()
+
+	key := clusterName + "/" + addr
+	if nm, ok := allNodeMetric[key]; ok {
+		return nm
+	}
+
+	tags := metrics.Tags{"cluster": clusterName, "node": addr}
+	nm := &nodeMetrics{
+		failures:      metrics.AddCounter("cluster_node_failures", tags),
+		checkFailures: metrics.AddCounter("cluster_node_check_failures", tags),
+		ejections:     metrics.AddCounter("cluster_node_ejections", tags),
+	}
+	metrics.RegisterIntGaugeCallback("cluster_node_ejected", tags, func() uint64 {
+		return atomic.LoadUint64(&nm.ejected)
+	})
+
+	allNodeMetric[key] = nm
+	return nm
+}
+
+// Ejected returns the addresses of the nodes taken out of the cluster for
+// failing, sorted. They are still in Nodes.
+func (m *Membership) Ejected() []string {
+	v := m.current()
+	ret := make([]string, 0, len(v.ejected))
+	for addr := range v.ejected {
+		ret = append(ret, addr)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// observe records the outcome of a command sent to a node. Application errors
+// are answers from a healthy node, anything else counts as a failure.
+func (m *Membership) observe(addr string, err error) {
+	v := m.current()
+	h, ok := v.health[addr]
+	if !ok {
+		return
+	}
+
+	if err == nil || common.IsAppError(err) {
+		if atomic.LoadInt32(&h.failures) != 0 {
+			atomic.StoreInt32(&h.failures, 0)
+		}
+		return
+	}
+
+	metrics.IncCounter(h.metrics.failures)
+	failures := atomic.AddInt32(&h.failures, 1)
+
+	if v.healthOpts != nil && int(failures) >= v.healthOpts.FailureThreshold && !v.ejected[addr] {
+		m.setEjected(addr, true)
+	}
+}
+
+// setEjected takes a node out of the cluster or puts it back with a new view.
+func (m *Membership) setEjected(addr string, ejected bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.current()
+	if !old.members[addr] || old.ejected[addr] == ejected {
+		return
+	}
+
+	h := old.health[addr]
+	if ejected {
+		metrics.IncCounter(MetricNodeEjections)
+		metrics.IncCounter(h.metrics.ejections)
+		atomic.StoreUint64(&h.metrics.ejected, 1)
+		log.Printf("Ejecting node %s from cluster %s after %d failures\n", addr, m.name, atomic.LoadInt32(&h.failures))
+	} else {
+		metrics.IncCounter(MetricNodeReinstatements)
+		atomic.StoreUint64(&h.metrics.ejected, 0)
+		log.Printf("Reinstating node %s in cluster %s\n", addr, m.name)
+	}
+	atomic.StoreInt32(&h.failures, 0)
+	atomic.StoreInt32(&h.successes, 0)
+
+	// The new view takes its ejected nodes from prev, so give it an updated set
+	prev := *old
+	prev.ejected = make(map[string]bool, len(old.ejected)+1)
+	for a := range old.ejected {
+		prev.ejected[a] = true
+	}
+	if ejected {
+		prev.ejected[addr] = true
+	} else {
+		delete(prev.ejected, addr)
+	}
+
+	m.view.Store(m.newView(old.version+1, old.addrs, &prev, old.healthOpts))
+}
+
+// StartHealthChecks sends every node a noop each opts.Interval, and from then
+// on ejects nodes that fail too often, whether in checks or in commands.
+// Ejected nodes keep being checked and are reinstated once they recover.
+func (m *Membership) StartHealthChecks(opts HealthOpts) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 3
+	}
+	if opts.RecoveryThreshold <= 0 {
+		opts.RecoveryThreshold = 2
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+
+	old := m.current()
+	m.view.Store(m.newView(old.version+1, old.addrs, old, &opts))
+
+	go m.checkHealth(opts, m.stop, m.done)
+}
+
+// StopHealthChecks stops the checks started by StartHealthChecks and waits for
+// the current round to finish. Ejected nodes stay ejected.
+func (m *Membership) StopHealthChecks() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop, m.done = nil, nil
+	m.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (m *Membership) checkHealth(opts HealthOpts, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		v := m.current()
+		wg := sync.WaitGroup{}
+
+		for _, addr := range v.addrs {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				m.checked(v, addr, check(addr, opts.Timeout), opts)
+			}(addr)
+		}
+
+		wg.Wait()
+	}
+}
+
+// check sends a noop to a node on a connection of its own.
+func check(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	return std.NewHandler(conn).Noop()
+}
+
+// checked records the result of a check of a node.
+func (m *Membership) checked(v *view, addr string, err error, opts HealthOpts) {
+	h := v.health[addr]
+
+	if err != nil {
+		metrics.IncCounter(h.metrics.checkFailures)
+		atomic.StoreInt32(&h.successes, 0)
+		m.observe(addr, err)
+		return
+	}
+
+	if !v.ejected[addr] {
+		m.observe(addr, nil)
+		return
+	}
+
+	if int(atomic.AddInt32(&h.successes, 1)) >= opts.RecoveryThreshold {
+		m.setEjected(addr, false)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// startHungNode accepts connections and never answers on them.
+func startHungNode(t *testing.T) (string, io.Closer) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	return l.Addr().String(), l
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func ejected(m *Membership, addr string) bool {
+	for _, a := range m.Ejected() {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func setKeys(h Handler, n int) error {
+	for i := 0; i < n; i++ {
+		if err := h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key%d", i)), Data: []byte("value")}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestHealthChecks(t *testing.T) {
+	_, addrs := startCluster(t, 2)
+
+	// A node that is down at first and comes back later on the same address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	m := NewMembership("test", append(addrs, down))
+	m.StartHealthChecks(HealthOpts{
+		Interval:          10 * time.Millisecond,
+		Timeout:           100 * time.Millisecond,
+		FailureThreshold:  2,
+		RecoveryThreshold: 2,
+	})
+	defer m.StopHealthChecks()
+
+	h := NewHandlerWithMembership(m, Opts{Timeout: 100 * time.Millisecond})
+	defer h.Close()
+
+	waitFor(t, "the down node to be ejected", func() bool { return ejected(m, down) })
+
+	t.Run("Ejected", func(t *testing.T) {
+		if len(m.Ejected()) != 1 || len(m.Nodes()) != 3 {
+			t.Fatalf("Expected only the down node ejected and every node kept, got %v of %v", m.Ejected(), m.Nodes())
+		}
+		if err := setKeys(h, 20); err != nil {
+			t.Fatalf("Expected the keys to be rehashed to live nodes, got %v", err)
+		}
+	})
+	t.Run("Reinstated", func(t *testing.T) {
+		l, err := net.Listen("tcp", down)
+		if err != nil {
+			t.Skipf("Couldn't listen on %s again: %v", down, err)
+		}
+		node := serveNode(l)
+
+		waitFor(t, "the node to be reinstated", func() bool { return !ejected(m, down) })
+
+		if err := setKeys(h, 20); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		resChan, _ := node.cache.Get(getKeys("key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7", "key8", "key9"))
+		held := 0
+		for res := range resChan {
+			if !res.Miss {
+				held++
+			}
+		}
+		if held == 0 {
+			t.Fatalf("Expected keys on the reinstated node")
+		}
+	})
+}
+
+func TestPassiveEjection(t *testing.T) {
+	_, addrs := startCluster(t, 2)
+	hung, closer := startHungNode(t)
+	defer closer.Close()
+
+	for name, ejection := range map[string]Ejection{"Rehash": Rehash, "FailFast": FailFast} {
+		t.Run(name, func(t *testing.T) {
+			m := NewMembership("test", append(addrs, hung))
+
+			// Only commands find the hung node before the first check
+			m.StartHealthChecks(HealthOpts{
+				Interval:         time.Hour,
+				FailureThreshold: 2,
+				Ejection:         ejection,
+			})
+			defer m.StopHealthChecks()
+
+			h := NewHandlerWithMembership(m, Opts{Timeout: 50 * time.Millisecond})
+			defer h.Close()
+
+			var timeouts int
+			for i := 0; i < 20 && !ejected(m, hung); i++ {
+				if err := h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key%d", i))}); err != nil {
+					timeouts++
+				}
+			}
+			if !ejected(m, hung) || timeouts != 2 {
+				t.Fatalf("Expected the hung node to be ejected after 2 timeouts, got %d", timeouts)
+			}
+
+			var tempFailures int
+			for i := 0; i < 20; i++ {
+				start := time.Now()
+				err := h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key%d", i))})
+				if time.Since(start) > 40*time.Millisecond {
+					t.Fatalf("Expected commands to stop waiting on the hung node")
+				}
+
+				switch {
+				case err == nil:
+				case ejection == FailFast && err == common.ErrTempFailure:
+					tempFailures++
+				default:
+					t.Fatalf("Error should be nil, got %v", err)
+				}
+			}
+			if ejection == FailFast && tempFailures == 0 {
+				t.Fatalf("Expected the hung node's keys to fail fast")
+			}
+		})
+	}
+}
+
+func TestHealthBusyPool(t *testing.T) {
+	node := startNode(t)
+	p := startDelayedProxy(t, node.addr, 100*time.Millisecond)
+
+	m := NewMembershipWithPool("test", []string{p.addr}, PoolOpts{Size: 1})
+	defer m.Close()
+	m.StartHealthChecks(HealthOpts{Interval: time.Hour, FailureThreshold: 2})
+	h := NewHandlerWithMembership(m, Opts{Timeout: 250 * time.Millisecond})
+
+	// Only one command fits in the pool at a time, so the later ones time out
+	// waiting for the connection
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		go func(i int) {
+			errs <- h.Set(common.SetRequest{Key: []byte(fmt.Sprintf("key%d", i)), Data: []byte("value")})
+		}(i)
+	}
+
+	var timeouts int
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			timeouts++
+		}
+	}
+	if timeouts < 2 {
+		t.Fatalf("Expected commands to time out waiting for the connection, got %d timeouts", timeouts)
+	}
+
+	if e := m.Ejected(); len(e) != 0 {
+		t.Fatalf("Expected a busy node to stay in the cluster, got %v ejected", e)
+	}
+}
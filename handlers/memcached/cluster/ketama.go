@@ -111,10 +111,39 @@ func (c *Continuum) Bucket(ringLocation uint32) Bucket {
 	if c == nil || len(c.ring) == 0 {
 		return nil
 	}
-	i := uint(sort.Search(len(c.ring), func(i int) bool { return c.ring[i].point >= ringLocation }))
-	if i >= uint(len(c.ring)) {
-		i = 0
+	return c.ring[c.search(ringLocation)].bucket
+}
+
+// HashN returns up to n distinct buckets for an array of bytes, found by walking
+// the ring from where it hashes to. The first is the bucket Hash returns.
+func (c *Continuum) HashN(thing []byte, n int) []Bucket {
+	if c == nil || len(c.ring) == 0 || n <= 0 {
+		return nil
+	}
+
+	hash := md5.Sum(thing)
+	start := c.search(binary.LittleEndian.Uint32(hash[0:4]))
+
+	ret := make([]Bucket, 0, n)
+	seen := make(map[string]bool, n)
+
+	for k := 0; k < len(c.ring) && len(ret) < n; k++ {
+		b := c.ring[(start+k)%len(c.ring)].bucket
+		if !seen[b.Label()] {
+			seen[b.Label()] = true
+			ret = append(ret, b)
+		}
 	}
 
-	return c.ring[i].bucket
+	return ret
+}
+
+// search returns the index of the first point at or after a location in the
+// ring, wrapping around to the start.
+func (c *Continuum) search(ringLocation uint32) int {
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].point >= ringLocation })
+	if i >= len(c.ring) {
+		i = 0
+	}
+	return i
 }
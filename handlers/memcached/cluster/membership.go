@@ -0,0 +1,204 @@
+package cluster
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricMembershipChanges      = metrics.AddCounter("cluster_membership_changes", nil)
+	MetricMembershipEmptyUpdates = metrics.AddCounter("cluster_membership_empty_updates", nil)
+)
+
+// member is a node in the continuum. Its label is the node's resolved address,
+// which is what its connection reports as the remote address, so keys hash the
+// same way whether nodes are given as host names or IPs.
+type member struct {
+	addr  string
+	label string
+}
+
+func (m member) Label() string {
+	return m.label
+}
+
+func (m member) Weight() uint32 {
+	return 1
+}
+
+func newMember(addr string) member {
+	label := addr
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		label = tcpAddr.String()
+	}
+	return member{addr: addr, label: label}
+}
+
+// view is one version of the cluster's membership. It is never changed once it
+// is visible to handlers.
+type view struct {
+	version uint64
+	addrs   []string
+	members map[string]bool
+	ejected map[string]bool
+	health  map[string]*nodeHealth
+	pools   map[string]*pool
+
+	// healthOpts is nil until health checks start, and nodes are only ejected
+	// once they do
+	healthOpts *HealthOpts
+
+	continuum *Continuum
+}
+
+// Membership is the set of nodes in a cluster, which can change while handlers
+// are using it. Each change builds a new continuum that is swapped in at once,
+// so a request sees either the old nodes or the new ones and never a mix.
+type Membership struct {
+	name     string
+	poolOpts PoolOpts
+
+	// mu serializes changes, reads go through view
+	mu   sync.Mutex
+	view atomic.Value
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMembership returns the membership of a cluster with the nodes at addrs,
+// connecting to them through pools with the default options.
+func NewMembership(clusterName string, addrs []string) *Membership {
+	return NewMembershipWithPool(clusterName, addrs, PoolOpts{})
+}
+
+// NewMembershipWithPool is like NewMembership, but the connection pools to the
+// nodes are configured with poolOpts. A node's pool is shared with every other
+// membership that has the node, and keeps the options it was first made with.
+func NewMembershipWithPool(clusterName string, addrs []string, poolOpts PoolOpts) *Membership {
+	m := &Membership{name: clusterName, poolOpts: poolOpts}
+	m.view.Store(m.newView(0, addrs, &view{}, nil))
+	return m
+}
+
+// Close stops the health checks and gives up the membership's connection
+// pools. The membership must not be used afterwards.
+func (m *Membership) Close() {
+	m.StopHealthChecks()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range m.current().pools {
+		p.release()
+	}
+	m.view.Store(m.newView(m.current().version+1, nil, &view{}, nil))
+}
+
+// newView builds the view after prev with the nodes at addrs. Nodes that were
+// already in the cluster keep their health and connection pool. The continuum
+// is built fresh, so handlers still using prev are unaffected.
+func (m *Membership) newView(version uint64, addrs []string, prev *view, healthOpts *HealthOpts) *view {
+	v := &view{
+		version:    version,
+		members:    make(map[string]bool, len(addrs)),
+		ejected:    make(map[string]bool),
+		health:     make(map[string]*nodeHealth, len(addrs)),
+		pools:      make(map[string]*pool, len(addrs)),
+		healthOpts: healthOpts,
+	}
+	var buckets []Bucket
+
+	for _, addr := range addrs {
+		if v.members[addr] {
+			continue
+		}
+		v.addrs = append(v.addrs, addr)
+		v.members[addr] = true
+
+		if h, ok := prev.health[addr]; ok {
+			v.health[addr] = h
+		} else {
+			v.health[addr] = newNodeHealth(m.name, addr)
+		}
+
+		if p, ok := prev.pools[addr]; ok {
+			v.pools[addr] = p
+		} else {
+			v.pools[addr] = acquirePool(addr, m.poolOpts)
+		}
+
+		if prev.ejected[addr] {
+			v.ejected[addr] = true
+			if healthOpts != nil && healthOpts.Ejection == Rehash {
+				continue
+			}
+		}
+		buckets = append(buckets, newMember(addr))
+	}
+
+	c := &Continuum{}
+	c.Reset(buckets)
+	v.continuum = c
+
+	return v
+}
+
+func (m *Membership) current() *view {
+	return m.view.Load().(*view)
+}
+
+// Nodes returns the addresses of the nodes in the cluster, sorted.
+func (m *Membership) Nodes() []string {
+	v := m.current()
+	ret := make([]string, len(v.addrs))
+	copy(ret, v.addrs)
+	sort.Strings(ret)
+	return ret
+}
+
+// Update replaces the nodes in the cluster with the ones at addrs. The pools
+// of removed nodes are released, and drained if nothing else uses them. An
+// empty list is ignored, since it is far more likely to be a failure upstream
+// than a cluster that is really gone.
+func (m *Membership) Update(addrs []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(addrs) == 0 {
+		metrics.IncCounter(MetricMembershipEmptyUpdates)
+		log.Printf("Ignoring an empty node list for cluster %s\n", m.name)
+		return
+	}
+
+	old := m.current()
+	if len(addrs) == len(old.members) {
+		same := true
+		for _, addr := range addrs {
+			if !old.members[addr] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+
+	metrics.IncCounter(MetricMembershipChanges)
+	log.Printf("Cluster %s nodes changed to %v\n", m.name, addrs)
+
+	v := m.newView(old.version+1, addrs, old, old.healthOpts)
+	m.view.Store(v)
+
+	for addr, p := range old.pools {
+		if _, ok := v.pools[addr]; !ok {
+			p.release()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/netflix/rend/common"
+)
+
+func TestMembership(t *testing.T) {
+	m := NewMembership("test", []string{"127.0.0.1:1", "127.0.0.1:2"})
+	before := m.current()
+
+	m.Update([]string{"127.0.0.1:2", "127.0.0.1:3"})
+	after := m.current()
+
+	if after == before || after.version != before.version+1 {
+		t.Fatalf("Expected a new view, got version %d", after.version)
+	}
+	if len(before.continuum.Buckets()) != 2 || before.members["127.0.0.1:3"] {
+		t.Fatalf("Expected the old view to be left as it was")
+	}
+	if expected := []string{"127.0.0.1:2", "127.0.0.1:3"}; !reflect.DeepEqual(m.Nodes(), expected) {
+		t.Fatalf("Expected %v, got %v", expected, m.Nodes())
+	}
+
+	m.Update([]string{"127.0.0.1:3", "127.0.0.1:2"})
+	if m.current() != after {
+		t.Fatalf("Expected the same nodes in another order to change nothing")
+	}
+
+	m.Update(nil)
+	if m.current() != after {
+		t.Fatalf("Expected an empty node list to be ignored")
+	}
+}
+
+func TestHandlerMembership(t *testing.T) {
+	nodes, addrs := startCluster(t, 3)
+
+	// The cluster reaches the node that is removed through a proxy, so the
+	// test can see its connections closed
+	p := startProxy(t, addrs[0])
+	addrs[0] = p.addr
+
+	m := NewMembership("test", addrs[:2])
+	defer m.Close()
+	h := NewHandlerWithMembership(m, Opts{})
+	defer h.Close()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	setAll := func() {
+		for _, key := range keys {
+			if err := h.Set(common.SetRequest{Key: []byte(key), Data: []byte("value")}); err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+		}
+	}
+	held := func(node testNode) int {
+		resChan, _ := node.cache.Get(getKeys(keys...))
+		count := 0
+		for res := range resChan {
+			if !res.Miss {
+				count++
+			}
+		}
+		return count
+	}
+
+	setAll()
+	if n := held(nodes[2]); n != 0 {
+		t.Fatalf("Expected no keys on a node outside the cluster, got %d", n)
+	}
+
+	t.Run("Added", func(t *testing.T) {
+		m.Update(addrs)
+		setAll()
+		if n := held(nodes[2]); n == 0 {
+			t.Fatalf("Expected keys on the added node")
+		}
+	})
+	t.Run("Removed", func(t *testing.T) {
+		m.Update(addrs[1:])
+		setAll()
+
+		for _, addr := range m.Nodes() {
+			if addr == addrs[0] {
+				t.Fatalf("Expected the removed node to be gone, got %v", m.Nodes())
+			}
+		}
+		waitFor(t, "the removed node's connections to be closed", func() bool { return p.open() == 0 })
+
+		resChan, errChan := h.Get(getKeys(keys...))
+		for res := range resChan {
+			if res.Miss {
+				t.Fatalf("Expected %s to be on the remaining nodes", res.Key)
+			}
+		}
+		for err := range errChan {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+	})
+}
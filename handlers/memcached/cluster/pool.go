@@ -0,0 +1,276 @@
+package cluster
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/metrics"
+)
+
+var (
+	MetricNodeConnsOpened     = metrics.AddCounter("cluster_node_conns_opened", nil)
+	MetricNodeConnsDrained    = metrics.AddCounter("cluster_node_conns_drained", nil)
+	MetricNodeDialErrors      = metrics.AddCounter("cluster_node_dial_errors", nil)
+	MetricPoolsCreated        = metrics.AddCounter("cluster_pools_created", nil)
+	MetricPoolsClosed         = metrics.AddCounter("cluster_pools_closed", nil)
+	MetricPoolWaitTimeouts    = metrics.AddCounter("cluster_pool_wait_timeouts", nil)
+	MetricPoolIdleChecks      = metrics.AddCounter("cluster_pool_idle_checks", nil)
+	MetricPoolIdleCheckErrors = metrics.AddCounter("cluster_pool_idle_check_errors", nil)
+)
+
+var numPoolConns = new(int64)
+
+func init() {
+	metrics.RegisterIntGaugeCallback("cluster_pool_conns", nil, func() uint64 {
+		return uint64(atomic.LoadInt64(numPoolConns))
+	})
+}
+
+// defaultTimeout bounds waiting for and dialing a connection, and each command,
+// when nothing else does.
+const defaultTimeout = time.Second
+
+var (
+	errPoolTimeout = errors.New("cluster: timed out waiting for a connection to the node")
+	errPoolClosed  = errors.New("cluster: the node's connection pool is closed")
+)
+
+// PoolOpts configures the connection pools to the nodes of a cluster.
+type PoolOpts struct {
+	// Size is the most connections open to a node at once. Commands wait for
+	// one to be free when they are all in use. Default: 32
+	Size int
+
+	// IdleCheckInterval is how often idle connections are sent a noop, so ones
+	// the node or the network closed are found before a command uses them.
+	// Default: 30s
+	IdleCheckInterval time.Duration
+
+	// IdleCheckTimeout is how long a node has to answer the noop on an idle
+	// connection. Default: 1s
+	IdleCheckTimeout time.Duration
+}
+
+// pools holds a pool for each node, shared by every handler in the process
+// whichever membership they use, so the number of connections to a node is
+// bounded by the pool size rather than growing with the number of clients.
+var (
+	pools    = make(map[string]*pool)
+	poolLock = new(sync.Mutex)
+)
+
+type pool struct {
+	addr string
+	opts PoolOpts
+
+	// refs is the number of memberships using the pool, guarded by poolLock
+	refs int
+
+	// slots bounds the connections open at once. A slot is taken for as long
+	// as a connection is in use or being checked.
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []Node
+	closed bool
+
+	stop chan struct{}
+}
+
+// acquirePool returns the pool for a node, creating it if it is the first use.
+// A pool that already exists keeps the options it was created with.
+func acquirePool(addr string, opts PoolOpts) *pool {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+
+	if p, ok := pools[addr]; ok {
+		p.refs++
+		return p
+	}
+
+	if opts.Size <= 0 {
+		opts.Size = 32
+	}
+	if opts.IdleCheckInterval <= 0 {
+		opts.IdleCheckInterval = 30 * time.Second
+	}
+	if opts.IdleCheckTimeout <= 0 {
+		opts.IdleCheckTimeout = time.Second
+	}
+
+	metrics.IncCounter(MetricPoolsCreated)
+
+	p := &pool{
+		addr:  addr,
+		opts:  opts,
+		refs:  1,
+		slots: make(chan struct{}, opts.Size),
+		stop:  make(chan struct{}),
+	}
+	pools[addr] = p
+
+	go p.checkIdle()
+
+	return p
+}
+
+// release gives up a reference to the pool. The last one closes it: its idle
+// connections are closed now, and the ones in use when they are put back.
+func (p *pool) release() {
+	poolLock.Lock()
+	p.refs--
+	if p.refs > 0 {
+		poolLock.Unlock()
+		return
+	}
+	delete(pools, p.addr)
+	poolLock.Unlock()
+
+	metrics.IncCounter(MetricPoolsClosed)
+	close(p.stop)
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, n := range idle {
+		closeConn(n)
+		metrics.IncCounter(MetricNodeConnsDrained)
+	}
+}
+
+func closeConn(n Node) {
+	n.handler.Close()
+	atomic.AddInt64(numPoolConns, -1)
+}
+
+// get takes a connection from the pool, dialing a new one if none is idle. It
+// waits for a connection to be free if the pool is at its size. Waiting and
+// dialing each take at most timeout, or defaultTimeout if it isn't set.
+func (p *pool) get(timeout time.Duration) (Node, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-t.C:
+		metrics.IncCounter(MetricPoolWaitTimeouts)
+		return Node{}, errPoolTimeout
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return Node{}, errPoolClosed
+	}
+	if l := len(p.idle); l > 0 {
+		// The most recently used connection is the least likely to be stale
+		n := p.idle[l-1]
+		p.idle = p.idle[:l-1]
+		p.mu.Unlock()
+		return n, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", p.addr, timeout)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		metrics.IncCounter(MetricNodeDialErrors)
+		<-p.slots
+		return Node{}, err
+	}
+
+	metrics.IncCounter(MetricNodeConnsOpened)
+	atomic.AddInt64(numPoolConns, 1)
+	return newNode(conn), nil
+}
+
+// put returns a connection taken with get. A broken connection, one an error
+// left in an unknown state, is closed instead of being used again.
+func (p *pool) put(n Node, broken bool) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	if broken || p.closed {
+		p.mu.Unlock()
+		closeConn(n)
+		if !broken {
+			metrics.IncCounter(MetricNodeConnsDrained)
+		}
+		return
+	}
+	p.idle = append(p.idle, n)
+	p.mu.Unlock()
+}
+
+// checkIdle sends a noop on each idle connection every IdleCheckInterval and
+// closes the ones that fail. Connections in use are left alone, since commands
+// find out soon enough if they are broken.
+func (p *pool) checkIdle() {
+	ticker := time.NewTicker(p.opts.IdleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		metrics.IncCounter(MetricPoolIdleChecks)
+
+		p.mu.Lock()
+		count := len(p.idle)
+		p.mu.Unlock()
+
+		for i := 0; i < count; i++ {
+			n, ok := p.takeIdle()
+			if !ok {
+				break
+			}
+
+			n.conn.SetDeadline(time.Now().Add(p.opts.IdleCheckTimeout))
+			err := n.handler.Noop()
+			n.conn.SetDeadline(time.Time{})
+
+			if err != nil {
+				metrics.IncCounter(MetricPoolIdleCheckErrors)
+			}
+			p.put(n, err != nil)
+		}
+	}
+}
+
+// takeIdle takes the oldest idle connection to check it, if there is one and a
+// free slot for it. Checked connections count toward the size like ones in use.
+func (p *pool) takeIdle() (Node, bool) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return Node{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) == 0 {
+		<-p.slots
+		return Node{}, false
+	}
+
+	n := p.idle[0]
+	p.idle = p.idle[1:]
+	return n, true
+}
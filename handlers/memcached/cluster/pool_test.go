@@ -0,0 +1,246 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+)
+
+// proxy sits in front of a node so tests can see, and cut, the connections the
+// cluster makes to it.
+type proxy struct {
+	addr string
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+	most  int
+}
+
+func startProxy(t *testing.T, addr string) *proxy {
+	return startDelayedProxy(t, addr, 0)
+}
+
+// startDelayedProxy starts a proxy that holds back everything the node sends by
+// delay, like a slow but healthy node.
+func startDelayedProxy(t *testing.T, addr string, delay time.Duration) *proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+
+	p := &proxy{addr: l.Addr().String(), conns: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", addr)
+			if err != nil {
+				client.Close()
+				continue
+			}
+
+			p.mu.Lock()
+			p.conns[client] = true
+			if len(p.conns) > p.most {
+				p.most = len(p.conns)
+			}
+			p.mu.Unlock()
+
+			go func() {
+				io.Copy(backend, client)
+				client.Close()
+				backend.Close()
+
+				p.mu.Lock()
+				delete(p.conns, client)
+				p.mu.Unlock()
+			}()
+			go func() {
+				copyDelayed(client, backend, delay)
+				client.Close()
+			}()
+		}
+	}()
+
+	return p
+}
+
+// copyDelayed is io.Copy with every read held back by delay.
+func copyDelayed(dst io.Writer, src io.Reader, delay time.Duration) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			time.Sleep(delay)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// open is the number of connections to the node open now.
+func (p *proxy) open() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// maxOpen is the most connections to the node that were open at once.
+func (p *proxy) maxOpen() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.most
+}
+
+// cut closes every connection to the node, as if it had restarted.
+func (p *proxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+}
+
+// expectTimeouts sends two commands at once to a hung node behind a pool of one
+// connection. The first holds the connection until it times out and the second
+// waits for it, and both must fail within the time given.
+func expectTimeouts(t *testing.T, opts Opts, within time.Duration) {
+	hung, closer := startHungNode(t)
+	defer closer.Close()
+
+	m := NewMembershipWithPool("test", []string{hung}, PoolOpts{Size: 1})
+	defer m.Close()
+	h := NewHandlerWithMembership(m, opts)
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- h.Set(common.SetRequest{Key: []byte("key"), Data: []byte("value")})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Fatalf("Expected a hung node to fail commands")
+			}
+		case <-time.After(within):
+			t.Fatalf("Expected commands to a hung node to time out")
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	t.Run("Shared", func(t *testing.T) {
+		node := startNode(t)
+		p := startProxy(t, node.addr)
+
+		var handlers []Handler
+		for i := 0; i < 10; i++ {
+			h, err := NewHandler([]string{p.addr}, "test")
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+			if err := setKeys(h, 5); err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+			handlers = append(handlers, h)
+		}
+		if n := p.maxOpen(); n != 1 {
+			t.Fatalf("Expected every handler to share one connection, got %d", n)
+		}
+
+		for _, h := range handlers[1:] {
+			h.Close()
+		}
+		time.Sleep(10 * time.Millisecond)
+		if n := p.open(); n != 1 {
+			t.Fatalf("Expected the connection to stay open for the last handler, got %d", n)
+		}
+
+		handlers[0].Close()
+		waitFor(t, "the pool to be closed with its last handler", func() bool { return p.open() == 0 })
+	})
+	t.Run("Bounded", func(t *testing.T) {
+		node := startNode(t)
+		p := startProxy(t, node.addr)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			h, err := NewHandlerWithOpts([]string{p.addr}, "test", Opts{Pool: PoolOpts{Size: 2}})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+			defer h.Close()
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					key := []byte(fmt.Sprintf("key%d-%d", i, j))
+					if err := h.Set(common.SetRequest{Key: key, Data: []byte("value")}); err != nil {
+						t.Errorf("Error should be nil, got %v", err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if n := p.maxOpen(); n > 2 {
+			t.Fatalf("Expected at most 2 connections to the node, got %d", n)
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		expectTimeouts(t, Opts{Timeout: 50 * time.Millisecond}, time.Second)
+	})
+	t.Run("DefaultTimeout", func(t *testing.T) {
+		expectTimeouts(t, Opts{}, 5*time.Second)
+	})
+	t.Run("IdleCheck", func(t *testing.T) {
+		node := startNode(t)
+		p := startProxy(t, node.addr)
+
+		m := NewMembershipWithPool("test", []string{p.addr}, PoolOpts{IdleCheckInterval: 10 * time.Millisecond})
+		defer m.Close()
+		h := NewHandlerWithMembership(m, Opts{})
+
+		if err := setKeys(h, 1); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// The idle connection breaks, and a check finds it before a command does
+		p.cut()
+		waitFor(t, "the connection to be cut", func() bool { return p.open() == 0 })
+		time.Sleep(50 * time.Millisecond)
+
+		if err := setKeys(h, 1); err != nil {
+			t.Fatalf("Expected the broken connection to be replaced, got %v", err)
+		}
+	})
+}
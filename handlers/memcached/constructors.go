@@ -69,10 +69,27 @@ func Batched(sock string, opts batched.Opts) handlers.HandlerConst {
 
 // Cluster returns an implementation of the Handler interface that implements
 // an interaction with a cluster of memcached instances. Ketama consistent hashing
-// is used in order to spread keys across instances.
-// TODO: Maybe add an RF parameter, for now only 1 replica is written to the cluster
+// is used in order to spread keys across instances. Each key is written to one
+// instance. Connections to the instances are pooled and shared by every handler
+// in the process, rather than opened for each client connection.
 func Cluster(nodeAddresses []string, clusterName string) handlers.HandlerConst{
 	return func() (handlers.Handler, error) {
 		return cluster.NewHandler(nodeAddresses, clusterName)
 	}
 }
+
+// ClusterWithOpts is like Cluster, but writes each key to opts.Replicas
+// instances and reads from the next replica when one misses or fails.
+func ClusterWithOpts(nodeAddresses []string, clusterName string, opts cluster.Opts) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return cluster.NewHandlerWithOpts(nodeAddresses, clusterName, opts)
+	}
+}
+
+// ClusterWithMembership is like ClusterWithOpts, but follows a membership whose
+// nodes can change while the proxy runs.
+func ClusterWithMembership(m *cluster.Membership, opts cluster.Opts) handlers.HandlerConst {
+	return func() (handlers.Handler, error) {
+		return cluster.NewHandlerWithMembership(m, opts), nil
+	}
+}
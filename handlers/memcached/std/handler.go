@@ -23,6 +23,8 @@ import (
 	"github.com/netflix/rend/protocol/binprot"
 )
 
+// readResponseHeader returns the header along with the error a response carries,
+// so the body can be discarded. The caller puts that header back in the pool.
 func readResponseHeader(r *bufio.Reader) (*binprot.ResponseHeader, error) {
 	resHeader, err := binprot.ReadResponseHeader(r)
 	if err != nil {
@@ -30,7 +32,6 @@ func readResponseHeader(r *bufio.Reader) (*binprot.ResponseHeader, error) {
 	}
 
 	if err := binprot.DecodeError(resHeader); err != nil {
-		binprot.PutResponseHeader(resHeader)
 		return resHeader, err
 	}
 
@@ -60,6 +61,15 @@ func (h Handler) Close() error {
 	return h.conn.Close()
 }
 
+// Noop performs a noop request on the remote backend, which only checks that
+// it is responsive
+func (h Handler) Noop() error {
+	if err := binprot.WriteNoopCmd(h.Rw.Writer, 0); err != nil {
+		return err
+	}
+	return simpleCmdLocal(h.Rw)
+}
+
 // Set performs a set request on the remote backend
 func (h Handler) Set(cmd common.SetRequest) error {
 	if err := binprot.WriteSetCmd(h.Rw.Writer, cmd.Key, cmd.Flags, cmd.Exptime, uint32(len(cmd.Data)), 0); err != nil {
@@ -114,8 +124,14 @@ func (h Handler) handleSetCommon(cmd common.SetRequest) error {
 	// Read server's response
 	resHeader, err := readResponseHeader(h.Rw.Reader)
 	if err != nil {
+		// No header was read, e.g. the connection failed or timed out
+		if resHeader == nil {
+			return err
+		}
+
 		// Discard response body
 		n, ioerr := h.Rw.Discard(int(resHeader.TotalBodyLength))
+		binprot.PutResponseHeader(resHeader)
 		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
 		if ioerr != nil {
 			return ioerr
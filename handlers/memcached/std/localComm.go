@@ -17,6 +17,7 @@ package std
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"io"
 
 	"github.com/netflix/rend/common"
@@ -96,3 +97,112 @@ func GetLocal(rw *bufio.ReadWriter, readExp bool) (data []byte, flags, exp uint3
 
 	return buf, serverFlags, serverExp, nil
 }
+
+// errBadBatchResponse means a batch got a response it can't make sense of, like
+// one to a request it did not send, so the connection can't be trusted anymore.
+var errBadBatchResponse = errors.New("std: malformed response to a batch get")
+
+// GetBatchLocal pipelines a quiet get (or gete, if readExp is set) for each key
+// followed by a noop, so a whole batch takes one round trip and only hits are
+// answered. Each request's opaque is the index of its key, which is how hits
+// are matched to keys: quiet gets don't echo the key in Rend-based servers.
+// res is called for each hit, or with err set for a key the backend answered
+// with an error other than a miss. Keys res is never called for are misses.
+//
+// Requests are written while responses are read, so a batch larger than the
+// socket buffers can't deadlock. If an error is returned, the connection is in
+// an unknown state and must be closed.
+func GetBatchLocal(rw *bufio.ReadWriter, keys [][]byte, readExp bool, res func(idx int, data []byte, flags, exp uint32, err error)) error {
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writeBatchLocal(rw.Writer, keys, readExp)
+	}()
+
+	for {
+		resHeader, err := binprot.ReadResponseHeader(rw)
+		if err != nil {
+			return err
+		}
+
+		opcode := resHeader.Opcode
+		idx := int(resHeader.OpaqueToken)
+		totalBodyLength := int(resHeader.TotalBodyLength)
+		keyLength := int(resHeader.KeyLength)
+		extraLength := int(resHeader.ExtraLength)
+		err = binprot.DecodeError(resHeader)
+		binprot.PutResponseHeader(resHeader)
+
+		if opcode == binprot.OpcodeNoop {
+			return <-writeErr
+		}
+		if idx >= len(keys) {
+			return errBadBatchResponse
+		}
+
+		if err != nil {
+			n, ioerr := rw.Discard(totalBodyLength)
+			metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+			if ioerr != nil {
+				return ioerr
+			}
+			if err != common.ErrKeyNotFound {
+				res(idx, nil, 0, 0, err)
+			}
+			continue
+		}
+
+		// flags, then the exptime for gete
+		var extras [8]byte
+		if extraLength > len(extras) || keyLength+extraLength > totalBodyLength {
+			return errBadBatchResponse
+		}
+		n, err := io.ReadFull(rw, extras[:extraLength])
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if err != nil {
+			return err
+		}
+
+		var flags, exp uint32
+		if extraLength >= 4 {
+			flags = binary.BigEndian.Uint32(extras[0:4])
+		}
+		if readExp && extraLength >= 8 {
+			exp = binary.BigEndian.Uint32(extras[4:8])
+		}
+
+		// A server may echo the key, which isn't needed
+		n, err = rw.Discard(keyLength)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, totalBodyLength-keyLength-extraLength)
+		n, err = io.ReadFull(rw, data)
+		metrics.IncCounterBy(common.MetricBytesReadLocal, uint64(n))
+		if err != nil {
+			return err
+		}
+
+		res(idx, data, flags, exp, nil)
+	}
+}
+
+func writeBatchLocal(w *bufio.Writer, keys [][]byte, readExp bool) error {
+	for idx, key := range keys {
+		var err error
+		if readExp {
+			err = binprot.WriteGetEQCmd(w, key, uint32(idx))
+		} else {
+			err = binprot.WriteGetQCmd(w, key, uint32(idx))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := binprot.WriteNoopCmd(w, uint32(len(keys))); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handlers
+
+import "github.com/netflix/rend/common"
+
+// DrainGet reads a single key get to the end. Both channels are read together
+// since handlers may send an error before closing the result channel.
+func DrainGet(resChan <-chan common.GetResponse, errChan <-chan error) (common.GetResponse, error) {
+	ret := common.GetResponse{Miss: true}
+	var err error
+
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				ret = res
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+
+	return ret, err
+}
+
+// DrainGetE is DrainGet for a single key gete.
+func DrainGetE(resChan <-chan common.GetEResponse, errChan <-chan error) (common.GetEResponse, error) {
+	ret := common.GetEResponse{Miss: true}
+	var err error
+
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				ret = res
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+
+	return ret, err
+}
+
+// Current reads the item stored under a key as it is. GetE is used for the TTL
+// when the handler supports it, and the bool returned is whether it did.
+func Current(h Handler, key []byte, opaque uint32) (common.GetEResponse, bool, error) {
+	req := common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{opaque},
+		Quiet:   []bool{false},
+	}
+
+	if resChan, errChan := h.GetE(req); resChan != nil {
+		res, err := DrainGetE(resChan, errChan)
+		switch err {
+		case nil:
+			return res, true, nil
+		case common.ErrNotSupported, common.ErrUnknownCmd:
+		default:
+			return common.GetEResponse{}, false, err
+		}
+	}
+
+	res, err := DrainGet(h.Get(req))
+	if err != nil {
+		return common.GetEResponse{}, false, err
+	}
+
+	return common.GetEResponse{
+		Key:   res.Key,
+		Data:  res.Data,
+		Flags: res.Flags,
+		Miss:  res.Miss,
+	}, false, nil
+}
+
+// SupportsGetE opens a handler with hc and reads a key with it to find out
+// whether the backend answers GetE. Wrappers that use Concat need it, so a
+// backend without it is best refused at startup.
+func SupportsGetE(hc HandlerConst) (bool, error) {
+	h, err := hc()
+	if err != nil {
+		return false, err
+	}
+	defer h.Close()
+
+	_, hasExptime, err := Current(h, []byte("rend_gete_probe"), 0)
+	return hasExptime, err
+}
+
+// Concat runs an append or prepend for a wrapper that changes values on their
+// way into h, since the new data can't just be joined onto a changed value. An
+// item without the flag the wrapper marks its items with is passed to pass as
+// is. Otherwise the stored item, with its TTL, is passed to rewrite, which
+// joins the new data on and writes it back with a Replace. Without GetE in h
+// the TTL is unknown and the append fails with ErrNotSupported; see
+// SupportsGetE.
+func Concat(h Handler, cmd common.SetRequest, flag uint32, pass func(common.SetRequest) error, rewrite func(cur common.GetEResponse) error) error {
+	cur, hasExptime, err := Current(h, cmd.Key, cmd.Opaque)
+	if err != nil {
+		return err
+	}
+	if cur.Miss {
+		return common.ErrItemNotStored
+	}
+	if cur.Flags&flag == 0 {
+		return pass(cmd)
+	}
+
+	// Without the TTL the item can't be written back as it was
+	if !hasExptime {
+		return common.ErrNotSupported
+	}
+
+	return rewrite(cur)
+}
+
+// AppendData returns the data of an append joined onto the old data, without
+// changing either.
+func AppendData(old, data []byte) []byte {
+	return append(old[:len(old):len(old)], data...)
+}
+
+// PrependData returns the data of a prepend joined onto the old data, without
+// changing either.
+func PrependData(old, data []byte) []byte {
+	return append(data[:len(data):len(data)], old...)
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Admission decides whether an item found in L2 is copied back into L1. A
+// policy is shared by every connection using the orca, so implementations must
+// be safe for concurrent use.
+type Admission interface {
+	// Admit is called once per candidate with the key and the size of its data.
+	Admit(key []byte, size int) bool
+}
+
+type alwaysAdmit struct{}
+
+func (alwaysAdmit) Admit(key []byte, size int) bool { return true }
+
+// AlwaysAdmit promotes every L2 hit into L1. This is the default.
+var AlwaysAdmit Admission = alwaysAdmit{}
+
+type sizeThreshold int
+
+func (s sizeThreshold) Admit(key []byte, size int) bool { return size <= int(s) }
+
+// SizeThreshold promotes only items whose data is at most maxSize bytes. Large
+// items cost a lot of L1 space for one hit and are cheap to keep fetching from
+// L2 in comparison to the number of small items they would evict.
+func SizeThreshold(maxSize int) Admission {
+	return sizeThreshold(maxSize)
+}
+
+type allAdmit []Admission
+
+func (a allAdmit) Admit(key []byte, size int) bool {
+	for _, p := range a {
+		if !p.Admit(key, size) {
+			return false
+		}
+	}
+	return true
+}
+
+// AdmitAll combines policies so an item is promoted only if every one of them
+// admits it. Policies are asked in order and asking stops at the first one that
+// rejects, so cheap checks like SizeThreshold should go first.
+func AdmitAll(policies ...Admission) Admission {
+	return allAdmit(policies)
+}
+
+const (
+	sketchDepth = 4
+	maxCount    = 15
+
+	defaultTinyLFUCounters     = 1 << 16
+	defaultTinyLFUSampleFactor = 10
+	defaultTinyLFUMinFrequency = 2
+)
+
+// TinyLFUOpts configures a TinyLFU admission policy.
+type TinyLFUOpts struct {
+	// Counters is the number of counters per row of the frequency sketch. It is
+	// rounded up to a power of two. Default: 65536
+	Counters uint32
+
+	// SampleSize is the number of candidates seen after which every count is
+	// halved, so old popularity fades. Default: 10 * Counters
+	SampleSize uint32
+
+	// MinFrequency is how many times a key must have been a candidate within
+	// the sample, including this time, to be admitted. Default: 2
+	MinFrequency uint32
+}
+
+// tinyLFU approximates how often each key has been a backfill candidate with a
+// count-min sketch of 4 bit (saturating) counters. A doorkeeper bloom filter in
+// front of the sketch absorbs the first sighting of every key, which keeps the
+// flood of one-hit-wonders from a scan out of the sketch entirely.
+type tinyLFU struct {
+	lock       sync.Mutex
+	counters   [sketchDepth][]uint8
+	doorkeeper []uint64
+	mask       uint64
+	samples    uint32
+	sampleSize uint32
+	minFreq    uint32
+}
+
+// NewTinyLFU creates a TinyLFU admission policy that admits keys that keep
+// missing L1 and rejects keys seen only once.
+func NewTinyLFU(opts TinyLFUOpts) Admission {
+	width := uint32(1)
+	for width < uint32ValueOrDefault(opts.Counters, defaultTinyLFUCounters) {
+		width <<= 1
+	}
+
+	t := &tinyLFU{
+		doorkeeper: make([]uint64, (width+63)/64),
+		mask:       uint64(width - 1),
+		sampleSize: uint32ValueOrDefault(opts.SampleSize, width*defaultTinyLFUSampleFactor),
+		minFreq:    uint32ValueOrDefault(opts.MinFrequency, defaultTinyLFUMinFrequency),
+	}
+
+	for i := range t.counters {
+		t.counters[i] = make([]uint8, width)
+	}
+
+	return t
+}
+
+func uint32ValueOrDefault(val, def uint32) uint32 {
+	if val == 0 {
+		return def
+	}
+	return val
+}
+
+// indexes derives one counter index per row from a single 64 bit hash using
+// double hashing.
+func (t *tinyLFU) indexes(key []byte) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+
+	lo, hi := sum, (sum>>32)|1
+
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (lo + uint64(i)*hi) & t.mask
+	}
+	return idx
+}
+
+func (t *tinyLFU) Admit(key []byte, size int) bool {
+	idx := t.indexes(key)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// The first two indexes double as the doorkeeper's bloom filter bits
+	seen := true
+	for _, i := range idx[:2] {
+		if t.doorkeeper[i/64]&(1<<(i%64)) == 0 {
+			seen = false
+			t.doorkeeper[i/64] |= 1 << (i % 64)
+		}
+	}
+
+	freq := uint32(1)
+
+	if seen {
+		est := uint8(maxCount)
+		for row, i := range idx {
+			if c := t.counters[row][i]; c < est {
+				est = c
+			}
+		}
+
+		// Conservative update: only bump the counters holding the minimum
+		for row, i := range idx {
+			if t.counters[row][i] == est && est < maxCount {
+				t.counters[row][i]++
+			}
+		}
+
+		freq += uint32(est) + 1
+	}
+
+	t.samples++
+	if t.samples >= t.sampleSize {
+		t.reset()
+	}
+
+	return freq >= t.minFreq
+}
+
+// reset ages the sketch by halving every counter and clearing the doorkeeper.
+func (t *tinyLFU) reset() {
+	t.samples = 0
+
+	for row := range t.counters {
+		for i := range t.counters[row] {
+			t.counters[row][i] >>= 1
+		}
+	}
+
+	for i := range t.doorkeeper {
+		t.doorkeeper[i] = 0
+	}
+}
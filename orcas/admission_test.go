@@ -0,0 +1,92 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestAdmission(t *testing.T) {
+	t.Run("SizeThreshold", func(t *testing.T) {
+		p := orcas.SizeThreshold(10)
+		if !p.Admit([]byte("small"), 10) {
+			t.Fatalf("Expected an item at the threshold to be admitted")
+		}
+		if p.Admit([]byte("big"), 11) {
+			t.Fatalf("Expected an item over the threshold to be rejected")
+		}
+	})
+	t.Run("TinyLFU", func(t *testing.T) {
+		p := orcas.NewTinyLFU(orcas.TinyLFUOpts{Counters: 1024})
+
+		// A scan of keys seen once each is entirely rejected
+		for i := 0; i < 100; i++ {
+			if p.Admit([]byte(fmt.Sprintf("scan%d", i)), 10) {
+				t.Fatalf("Expected a key seen once to be rejected")
+			}
+		}
+
+		if p.Admit([]byte("hot"), 10) {
+			t.Fatalf("Expected the first sighting of a key to be rejected")
+		}
+		if !p.Admit([]byte("hot"), 10) {
+			t.Fatalf("Expected the second sighting of a key to be admitted")
+		}
+	})
+	t.Run("AdmitAll", func(t *testing.T) {
+		p := orcas.AdmitAll(orcas.SizeThreshold(10), orcas.AlwaysAdmit)
+		if !p.Admit([]byte("small"), 5) || p.Admit([]byte("big"), 50) {
+			t.Fatalf("Expected only items passing every policy to be admitted")
+		}
+	})
+	t.Run("Backfill", func(t *testing.T) {
+		oc := orcas.L1L2WithOpts(orcas.L1L2Opts{
+			Admission: orcas.NewTinyLFU(orcas.TinyLFUOpts{}),
+		})
+		h1 := &l1MissHandler{}
+		h2 := &ttlHandler{}
+
+		for i := 1; i <= 3; i++ {
+			output := &bytes.Buffer{}
+			l1l2 := oc(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			err := l1l2.Get(common.GetRequest{
+				Keys:    [][]byte{[]byte("admission")},
+				Opaques: []uint32{0},
+				Quiet:   []bool{false},
+			})
+			if err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+
+			gold := "VALUE admission 0 3\r\nfoo\r\nEND\r\n"
+			if out := output.String(); out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+
+			// The first L2 hit is not copied to L1, every one after it is
+			if int(h1.sets) != i-1 {
+				t.Fatalf("Expected %d L1 backfills after %d gets, got %d", i-1, i, h1.sets)
+			}
+		}
+	})
+}
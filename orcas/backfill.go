@@ -2,83 +2,395 @@ package orcas
 
 import (
 	"log"
+	"sync"
 
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
 )
 
+const (
+	defaultBackfillWorkers   = 8
+	defaultBackfillQueueSize = 1024
+	defaultBackfillExptime   = 1500
+)
+
+// BackfillOpts configures the backfill orca. Any zero value assumes the default.
+type BackfillOpts struct {
+	// Workers is how many keys are fetched from the source and written to the
+	// local cluster at once, across all connections. Default: 8
+	Workers int
+
+	// QueueSize is how many keys can wait for a worker. Keys requested while the
+	// queue is full are not backfilled. Default: 1024
+	QueueSize int
+
+	// Exptime is the TTL given to backfilled items. Default: 1500
+	Exptime uint32
+
+	// PreserveTTL copies each item's remaining TTL from the source instead of
+	// using Exptime. Sources that don't support GetE fall back to Exptime.
+	PreserveTTL bool
+}
+
+type backfillJob struct {
+	key      []byte
+	enqueued uint64
+}
+
+// backfillPool fills keys into the local cluster in the background. It is shared
+// by every connection so the load on the source is bounded no matter how many
+// clients are connected.
+type backfillPool struct {
+	jobs chan backfillJob
+	opts BackfillOpts
+
+	lock     sync.Mutex
+	inflight map[string]struct{}
+}
+
+func newBackfillPool(source, local handlers.HandlerConst, opts BackfillOpts) *backfillPool {
+	p := &backfillPool{
+		jobs:     make(chan backfillJob, opts.QueueSize),
+		opts:     opts,
+		inflight: make(map[string]struct{}),
+	}
+
+	metrics.RegisterIntGaugeCallback("backfill_queue_depth", nil, func() uint64 {
+		return uint64(len(p.jobs))
+	})
+
+	for i := 0; i < opts.Workers; i++ {
+		w := &backfillWorker{
+			pool:          p,
+			sourceConst:   source,
+			localConst:    local,
+			getESupported: opts.PreserveTTL,
+		}
+		go w.run()
+	}
+
+	return p
+}
+
+// enqueue queues a key to be backfilled unless it is already queued or being
+// filled. It never blocks the client connection.
+func (p *backfillPool) enqueue(key []byte) {
+	p.lock.Lock()
+	if _, ok := p.inflight[string(key)]; ok {
+		p.lock.Unlock()
+		metrics.IncCounter(MetricBackfillDeduped)
+		return
+	}
+	p.inflight[string(key)] = struct{}{}
+	p.lock.Unlock()
+
+	// The key is kept until the worker is done with it, so it needs its own copy
+	job := backfillJob{
+		key:      append([]byte(nil), key...),
+		enqueued: timer.Now(),
+	}
+
+	select {
+	case p.jobs <- job:
+		metrics.IncCounter(MetricBackfillEnqueued)
+	default:
+		p.done(key)
+		metrics.IncCounter(MetricBackfillDropped)
+	}
+}
+
+func (p *backfillPool) done(key []byte) {
+	p.lock.Lock()
+	delete(p.inflight, string(key))
+	p.lock.Unlock()
+}
+
+// backfillWorker owns its own source and local handlers, since handlers are not
+// safe for concurrent use. A handler that fails is closed and created again for
+// the next key.
+type backfillWorker struct {
+	pool          *backfillPool
+	sourceConst   handlers.HandlerConst
+	localConst    handlers.HandlerConst
+	source        handlers.Handler
+	local         handlers.Handler
+	getESupported bool
+}
+
+func (w *backfillWorker) run() {
+	for job := range w.pool.jobs {
+		if err := w.fill(job.key); err != nil {
+			log.Println("Error backfilling key from source cluster:", err)
+			metrics.IncCounter(MetricBackfillErrors)
+		}
+		metrics.ObserveHist(HistBackfill, timer.Since(job.enqueued))
+		w.pool.done(job.key)
+	}
+}
+
+func (w *backfillWorker) connect() error {
+	var err error
+	if w.source == nil {
+		if w.source, err = w.sourceConst(); err != nil {
+			w.source = nil
+			return err
+		}
+	}
+	if w.local == nil {
+		if w.local, err = w.localConst(); err != nil {
+			w.local = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *backfillWorker) reset() {
+	if w.source != nil {
+		w.source.Close()
+		w.source = nil
+	}
+	if w.local != nil {
+		w.local.Close()
+		w.local = nil
+	}
+}
+
+func (w *backfillWorker) fill(key []byte) error {
+	if err := w.connect(); err != nil {
+		w.reset()
+		return err
+	}
+
+	item, found, err := w.fetch(key)
+	if err != nil {
+		w.reset()
+		return err
+	}
+	if !found {
+		metrics.IncCounter(MetricBackfillSourceMisses)
+		return nil
+	}
+
+	if err := w.local.Set(item); err != nil {
+		if !common.IsAppError(err) {
+			w.reset()
+		}
+		return err
+	}
+
+	metrics.IncCounter(MetricBackfillFilled)
+	return nil
+}
+
+// fetch reads a key from the source, with its TTL if the source supports GetE.
+func (w *backfillWorker) fetch(key []byte) (common.SetRequest, bool, error) {
+	req := common.GetRequest{
+		Keys:    [][]byte{key},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	}
+
+	if w.getESupported {
+		resChan, errChan := w.source.GetE(req)
+
+		// Handlers without GetE return no channels at all
+		if resChan != nil || errChan != nil {
+			item := common.SetRequest{Key: key, Quiet: true}
+			found := false
+
+			err := drainGetE(resChan, errChan, func(res common.GetEResponse) {
+				if !res.Miss {
+					item.Data, item.Flags, item.Exptime = res.Data, res.Flags, res.Exptime
+					found = true
+				}
+			})
+
+			if err != common.ErrNotSupported && err != common.ErrUnknownCmd {
+				return item, found, err
+			}
+		}
+
+		log.Println("Source cluster doesn't support GetE, backfilling with the default TTL")
+		w.getESupported = false
+	}
+
+	if w.pool.opts.PreserveTTL {
+		metrics.IncCounter(MetricBackfillTTLFallbacks)
+	}
+
+	item := common.SetRequest{Key: key, Exptime: w.pool.opts.Exptime, Quiet: true}
+	found := false
+
+	resChan, errChan := w.source.Get(req)
+	err := drainGet(resChan, errChan, func(res common.GetResponse) {
+		if !res.Miss {
+			item.Data, item.Flags = res.Data, res.Flags
+			found = true
+		}
+	})
+
+	return item, found, err
+}
+
+func drainGet(resChan <-chan common.GetResponse, errChan <-chan error, f func(common.GetResponse)) error {
+	var err error
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				f(res)
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			return err
+		}
+	}
+}
+
+func drainGetE(resChan <-chan common.GetEResponse, errChan <-chan error, f func(common.GetEResponse)) error {
+	var err error
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				f(res)
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			return err
+		}
+	}
+}
+
 type BackfillOrca struct {
-	remoteCluster handlers.Handler
-	localCluster  handlers.Handler
-	res           protocol.Responder
+	localCluster handlers.Handler
+	res          protocol.Responder
+	pool         *backfillPool
 }
 
-func Backfill(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-	return &BackfillOrca{
-		remoteCluster: l1,
-		localCluster:  l2,
-		res:           res,
+// Backfill returns an OrcaConst for an orca that warms a local cluster from a
+// remote source cluster. Gets are answered with a miss right away so clients
+// never wait on the remote call, and each missed key is queued to be copied from
+// the source into the local cluster by a shared pool of background workers.
+// Sets are acknowledged and dropped, and deletes go to the local cluster.
+//
+// The server's L2 handler must be for the local cluster and is used for deletes.
+// The server's L1 handler is not used, since all reads from the source are done
+// by the workers with handlers of their own.
+func Backfill(source, local handlers.HandlerConst, opts BackfillOpts) OrcaConst {
+	opts.Workers = intValueOrDefault(opts.Workers, defaultBackfillWorkers)
+	opts.QueueSize = intValueOrDefault(opts.QueueSize, defaultBackfillQueueSize)
+	opts.Exptime = uint32ValueOrDefault(opts.Exptime, defaultBackfillExptime)
+
+	pool := newBackfillPool(source, local, opts)
+
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &BackfillOrca{
+			localCluster: l2,
+			res:          res,
+			pool:         pool,
+		}
 	}
 }
 
 func (l *BackfillOrca) Set(req common.SetRequest) error {
 	// We don't of SET, we just swallow them and return a success
-	l.res.Set(req.Opaque, req.Quiet)
-	return nil
+	return l.res.Set(req.Opaque, req.Quiet)
 }
 
 func (l *BackfillOrca) Get(req common.GetRequest) error {
 	// We return miss upon get in order to not block clients with remote DC call
-	var emptyData []byte
 	for ix, key := range req.Keys {
-		l.res.Get(common.GetResponse{Key: key, Quiet: req.Quiet[ix], Opaque: req.Opaques[ix], Flags: 0, Data: emptyData, Miss: true})
-	}
-	l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
-
-	// And now we start async get to remote cluster in order to backfill the local one
-	responseChan, errChan := l.remoteCluster.Get(req)
-	func() {
-		var opaque uint32
-		for {
-			select {
-			case res, ok := <-responseChan:
-				if !ok {
-					responseChan = nil
-				} else if !res.Miss {
-					l.localCluster.Set(common.SetRequest{Key: res.Key, Data: res.Data, Exptime: 1500, Flags: 0, Opaque: opaque, Quiet: true})
-				}
+		l.pool.enqueue(key)
 
-			case err, ok := <-errChan:
-				if !ok {
-					errChan = nil
-				} else {
-					log.Println("Error during get from source cluster:", err)
-				}
-			}
-			if responseChan == nil && errChan == nil {
-				break
-			}
-			opaque++
+		err := l.res.Get(common.GetResponse{Key: key, Quiet: req.Quiet[ix], Opaque: req.Opaques[ix], Miss: true})
+		if err != nil {
+			return err
 		}
-	}()
+	}
 
-	return nil
+	return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (l *BackfillOrca) GetE(req common.GetRequest) error {
+	for ix, key := range req.Keys {
+		l.pool.enqueue(key)
+
+		err := l.res.GetE(common.GetEResponse{Key: key, Quiet: req.Quiet[ix], Opaque: req.Opaques[ix], Miss: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// Delete removes the key from the local cluster so it can be backfilled again
+// with the source's current value.
+func (l *BackfillOrca) Delete(req common.DeleteRequest) error {
+	err := l.localCluster.Delete(req)
+	if err == nil {
+		return l.res.Delete(req.Opaque)
+	}
+	return err
+}
+
+func (l *BackfillOrca) Add(req common.SetRequest) error     { return common.ErrNotSupported }
+func (l *BackfillOrca) Replace(req common.SetRequest) error { return common.ErrNotSupported }
+func (l *BackfillOrca) Append(req common.SetRequest) error  { return common.ErrNotSupported }
+func (l *BackfillOrca) Prepend(req common.SetRequest) error { return common.ErrNotSupported }
+func (l *BackfillOrca) Touch(req common.TouchRequest) error { return common.ErrNotSupported }
+func (l *BackfillOrca) Gat(req common.GATRequest) error     { return common.ErrNotSupported }
+func (l *BackfillOrca) Unknown(req common.Request) error    { return common.ErrUnknownCmd }
+
+func (l *BackfillOrca) Noop(req common.NoopRequest) error {
+	return l.res.Noop(req.Opaque)
+}
+
+func (l *BackfillOrca) Quit(req common.QuitRequest) error {
+	return l.res.Quit(req.Opaque, req.Quiet)
+}
+
+func (l *BackfillOrca) Version(req common.VersionRequest) error {
+	return l.res.Version(req.Opaque)
+}
+
+func (l *BackfillOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	var opaque uint32
+	var quiet bool
+
+	if req != nil {
+		opaque = req.GetOpaque()
+		quiet = req.IsQuiet()
+	}
+
+	l.res.Error(opaque, reqType, err, quiet)
 }
 
-func (l *BackfillOrca) Add(req common.SetRequest) error                                 { return common.ErrNoError }
-func (l *BackfillOrca) Replace(req common.SetRequest) error                             { return common.ErrNoError }
-func (l *BackfillOrca) Append(req common.SetRequest) error                              { return common.ErrNoError }
-func (l *BackfillOrca) Prepend(req common.SetRequest) error                             { return common.ErrNoError }
-func (l *BackfillOrca) Delete(req common.DeleteRequest) error                           { return common.ErrNoError }
-func (l *BackfillOrca) Touch(req common.TouchRequest) error                             { return common.ErrNoError }
-func (l *BackfillOrca) GetE(req common.GetRequest) error                                { return common.ErrNoError }
-func (l *BackfillOrca) Gat(req common.GATRequest) error                                 { return common.ErrNoError }
-func (l *BackfillOrca) Noop(req common.NoopRequest) error                               { return common.ErrNoError }
-func (l *BackfillOrca) Quit(req common.QuitRequest) error                               { return common.ErrNoError }
-func (l *BackfillOrca) Version(req common.VersionRequest) error                         { return common.ErrNoError }
-func (l *BackfillOrca) Unknown(req common.Request) error                                { return common.ErrNoError }
-func (l *BackfillOrca) Error(req common.Request, reqType common.RequestType, err error) {}
 func (l *BackfillOrca) Stat(req common.StatRequest) error {
 	return l.res.Stat(req.Opaque)
-}
\ No newline at end of file
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// setRecorder passes along every set it gets so tests can wait for backfills.
+type setRecorder struct {
+	testHandler
+	sets    chan common.SetRequest
+	deletes int
+}
+
+func newSetRecorder() *setRecorder {
+	return &setRecorder{sets: make(chan common.SetRequest, 16)}
+}
+
+func (h *setRecorder) Close() error { return nil }
+func (h *setRecorder) Set(cmd common.SetRequest) error {
+	h.sets <- cmd
+	return nil
+}
+func (h *setRecorder) Delete(cmd common.DeleteRequest) error {
+	h.deletes++
+	return nil
+}
+
+func (h *setRecorder) next(t *testing.T) common.SetRequest {
+	select {
+	case req := <-h.sets:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a backfill")
+	}
+	return common.SetRequest{}
+}
+
+// ttlSource returns a fixed TTL from GetE.
+type ttlSource struct {
+	*mapHandler
+	exptime uint32
+}
+
+func (h ttlSource) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	resChan, errChan := h.mapHandler.GetE(cmd)
+	out := make(chan common.GetEResponse, len(cmd.Keys))
+	for res := range resChan {
+		res.Exptime = h.exptime
+		out <- res
+	}
+	close(out)
+	return out, errChan
+}
+
+// noGetESource is a source whose handler doesn't implement GetE.
+type noGetESource struct {
+	*mapHandler
+}
+
+func (h noGetESource) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	return nil, nil
+}
+
+func backfillGet(t *testing.T, o orcas.Orca, key string) {
+	err := o.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+}
+
+func TestBackfillOrca(t *testing.T) {
+	t.Run("Get", func(t *testing.T) {
+		source, local := newMapHandler(), newSetRecorder()
+		source.data["backfill"] = "foo"
+
+		output := &bytes.Buffer{}
+		oc := orcas.Backfill(consts(source)[0], consts(local)[0], orcas.BackfillOpts{Exptime: 60})
+		o := oc(nil, local, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("backfill")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// Clients get a miss without waiting on the source
+		if output.String() != "END\r\n" {
+			t.Fatalf("Expected a miss but got '%v'", output.String())
+		}
+
+		set := local.next(t)
+		if string(set.Key) != "backfill" || string(set.Data) != "foo" || set.Exptime != 60 {
+			t.Fatalf("Unexpected backfill %s=%s with TTL %d", set.Key, set.Data, set.Exptime)
+		}
+	})
+	t.Run("PreserveTTL", func(t *testing.T) {
+		source, local := newMapHandler(), newSetRecorder()
+		source.data["backfill"] = "foo"
+
+		oc := orcas.Backfill(consts(ttlSource{source, 1234})[0], consts(local)[0], orcas.BackfillOpts{PreserveTTL: true})
+		o := oc(nil, local, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+		backfillGet(t, o, "backfill")
+
+		if set := local.next(t); set.Exptime != 1234 {
+			t.Fatalf("Expected the source's TTL, got %d", set.Exptime)
+		}
+	})
+	t.Run("PreserveTTLWithoutGetE", func(t *testing.T) {
+		source, local := newMapHandler(), newSetRecorder()
+		source.data["backfill"] = "foo"
+
+		oc := orcas.Backfill(consts(noGetESource{source})[0], consts(local)[0], orcas.BackfillOpts{PreserveTTL: true, Exptime: 60})
+		o := oc(nil, local, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+		backfillGet(t, o, "backfill")
+
+		if set := local.next(t); set.Exptime != 60 {
+			t.Fatalf("Expected the configured TTL, got %d", set.Exptime)
+		}
+	})
+	t.Run("Commands", func(t *testing.T) {
+		local := newSetRecorder()
+		oc := orcas.Backfill(consts(newMapHandler())[0], consts(local)[0], orcas.BackfillOpts{})
+		o := oc(nil, local, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+
+		if err := o.Noop(common.NoopRequest{}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := o.Version(common.VersionRequest{}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := o.Delete(common.DeleteRequest{Key: []byte("backfill")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if local.deletes != 1 {
+			t.Fatalf("Expected the delete to reach the local cluster")
+		}
+		if err := o.Add(common.SetRequest{}); !common.IsAppError(err) {
+			t.Fatalf("Expected unsupported commands to fail without closing the connection, got %v", err)
+		}
+	})
+}
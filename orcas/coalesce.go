@@ -0,0 +1,285 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/netflix/rend/common"
+)
+
+// errFlightAborted is handed to requests waiting on a flight whose leader went
+// away (e.g. panicked) before it could land a result for every key it owned.
+var errFlightAborted = errors.New("coalesced fetch aborted")
+
+// flights holds the flight groups of the orcas in front of one L2 backend. They
+// are shared by every orca an OrcaConst makes, so coalescing works across every
+// client connection, not just within the orca that a single connection owns.
+// Orcas in front of different backends must not share them, or they would hand
+// each other results from the wrong backend.
+type flights struct {
+	get *flightGroup
+	gat *flightGroup
+}
+
+func newFlights() *flights {
+	return &flights{
+		get: newFlightGroup(),
+		gat: newFlightGroup(),
+	}
+}
+
+// The flights of the deprecated L1L2 and L1L2Batch constructors. They are
+// separate because an L1L2 leader backfills L1 and a batch leader does not;
+// sharing would let a batch fetch stand in for a backfill that never happens.
+var (
+	l1l2Flights  = newFlights()
+	batchFlights = newFlights()
+)
+
+// flightKey identifies a fetch in flight. Exptime is only used for GAT, since
+// two GATs for the same key with different TTLs are not the same operation.
+type flightKey struct {
+	key     string
+	exptime uint32
+}
+
+type flight struct {
+	done chan struct{}
+	res  common.GetEResponse
+	err  error
+}
+
+// flightGroup coalesces concurrent fetches for the same key. The first request
+// to ask for a key becomes the leader for it and performs the fetch. Anyone
+// asking for the same key before the leader lands the result waits for it and
+// shares the result instead of going to the backend themselves.
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[flightKey]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		flights: make(map[flightKey]*flight),
+	}
+}
+
+// join returns the flight for the given key and whether the caller is the
+// leader. A leader must always land the flight, otherwise waiters block forever.
+func (g *flightGroup) join(key flightKey) (*flight, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// land records the result of a flight and releases everyone waiting on it. The
+// flight is removed from the group first so requests arriving afterwards start
+// a new fetch (and will most likely hit the freshly backfilled L1 anyway).
+func (g *flightGroup) land(key flightKey, f *flight, res common.GetEResponse, err error) {
+	g.lock.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.lock.Unlock()
+
+	f.res = res
+	f.err = err
+	close(f.done)
+}
+
+// do runs fn once for all concurrent callers using the same key. The bool
+// returned is true when the result was produced by another caller. If the
+// leader's fetch fails, followers run fn themselves rather than inheriting an
+// error that may have been specific to the leader's backend connection.
+func (g *flightGroup) do(key flightKey, fn func() (common.GetEResponse, error)) (common.GetEResponse, bool, error) {
+	f, leader := g.join(key)
+
+	if !leader {
+		<-f.done
+		if f.err == nil {
+			return f.res, true, nil
+		}
+		res, err := fn()
+		return res, false, err
+	}
+
+	var landed bool
+	defer func() {
+		if !landed {
+			g.land(key, f, common.GetEResponse{}, errFlightAborted)
+		}
+	}()
+
+	out, err := fn()
+	landed = true
+	g.land(key, f, out, err)
+
+	return out, false, err
+}
+
+// fetchFunc performs a batch fetch for the keys in req. It must call land once
+// for every response it receives, after any side effects (like an L1 backfill)
+// that followers should be able to rely on have completed.
+type fetchFunc func(req common.GetRequest, land func(res common.GetEResponse)) error
+
+// get performs a coalesced batch fetch. Keys that nobody else is fetching are
+// handed to fetch in a single request led by the caller; keys already in flight
+// are waited on. Every result, led or shared, is passed to respond with the
+// caller's own opaque and quiet values, in the order the keys were asked for.
+// Shared results for which the leader failed are re-fetched by the caller
+// without coalescing.
+func (g *flightGroup) get(req common.GetRequest, fetch fetchFunc, respond func(res common.GetEResponse, shared bool)) error {
+	type follower struct {
+		idx int
+		f   *flight
+	}
+
+	type slot struct {
+		res    common.GetEResponse
+		shared bool
+		done   bool
+		skip   bool
+	}
+
+	var lead common.GetRequest
+	var followers []follower
+	pending := make(map[flightKey]*flight)
+
+	// The slots of keys waiting on a fetch by this caller, in request order
+	waiting := make(map[string][]int)
+
+	for idx, key := range req.Keys {
+		fk := flightKey{key: string(key)}
+		f, leader := g.join(fk)
+
+		if !leader {
+			followers = append(followers, follower{idx: idx, f: f})
+			continue
+		}
+
+		pending[fk] = f
+		waiting[fk.key] = append(waiting[fk.key], idx)
+		lead.Keys = append(lead.Keys, key)
+		lead.Opaques = append(lead.Opaques, req.Opaques[idx])
+		lead.Quiet = append(lead.Quiet, req.Quiet[idx])
+	}
+
+	// If fetch panics, whoever is waiting on the flights it led is told so
+	defer func() {
+		for fk, f := range pending {
+			g.land(fk, f, common.GetEResponse{}, errFlightAborted)
+		}
+	}()
+
+	// Results are held until every key before them has been answered
+	slots := make([]slot, len(req.Keys))
+	var next int
+
+	fill := func(idx int, s slot) {
+		s.done = true
+		slots[idx] = s
+		for next < len(slots) && slots[next].done {
+			if !slots[next].skip {
+				respond(slots[next].res, slots[next].shared)
+			}
+			next++
+		}
+	}
+
+	// A response for a key nobody asked for has no slot, so it's passed on as is
+	found := func(res common.GetEResponse) {
+		idxs := waiting[string(res.Key)]
+		if len(idxs) == 0 {
+			respond(res, false)
+			return
+		}
+		waiting[string(res.Key)] = idxs[1:]
+		fill(idxs[0], slot{res: res})
+	}
+
+	// Keys a fetch didn't answer get no response, like before coalescing
+	unanswered := func() {
+		for key, idxs := range waiting {
+			delete(waiting, key)
+			for _, idx := range idxs {
+				fill(idx, slot{skip: true})
+			}
+		}
+	}
+
+	var err error
+
+	if len(lead.Keys) > 0 {
+		err = fetch(lead, func(res common.GetEResponse) {
+			fk := flightKey{key: string(res.Key)}
+			if f, ok := pending[fk]; ok {
+				delete(pending, fk)
+				g.land(fk, f, res, nil)
+			}
+
+			found(res)
+		})
+	}
+
+	// Any flight that didn't get a response by the time the fetch is done still
+	// has to be landed, and before waiting on anyone else's flights: two requests
+	// for the same keys in a different order would otherwise wait on each other
+	// forever. A clean fetch that simply didn't mention a key is a miss.
+	for fk, f := range pending {
+		delete(pending, fk)
+		g.land(fk, f, common.GetEResponse{Key: []byte(fk.key), Miss: true}, err)
+	}
+	unanswered()
+
+	var retry common.GetRequest
+
+	for _, fol := range followers {
+		<-fol.f.done
+
+		if fol.f.err != nil {
+			waiting[string(req.Keys[fol.idx])] = append(waiting[string(req.Keys[fol.idx])], fol.idx)
+			retry.Keys = append(retry.Keys, req.Keys[fol.idx])
+			retry.Opaques = append(retry.Opaques, req.Opaques[fol.idx])
+			retry.Quiet = append(retry.Quiet, req.Quiet[fol.idx])
+			continue
+		}
+
+		res := fol.f.res
+		res.Key = req.Keys[fol.idx]
+		res.Opaque = req.Opaques[fol.idx]
+		res.Quiet = req.Quiet[fol.idx]
+
+		fill(fol.idx, slot{res: res, shared: true})
+	}
+
+	if len(retry.Keys) > 0 {
+		rerr := fetch(retry, found)
+		if rerr != nil {
+			err = rerr
+		}
+		unanswered()
+	}
+
+	return err
+}
@@ -0,0 +1,382 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// slowHandler misses on every Get so it can stand in for L1, and blocks every
+// GetE and GAT until released so it can stand in for an L2 that concurrent
+// requests pile up behind.
+type slowHandler struct {
+	testHandler
+	l1gets  int32
+	gets    int32
+	sets    int32
+	adds    int32
+	gats    int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowHandler() *slowHandler {
+	return &slowHandler{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+}
+
+func (h *slowHandler) Set(cmd common.SetRequest) error {
+	atomic.AddInt32(&h.sets, 1)
+	return nil
+}
+func (h *slowHandler) Add(cmd common.SetRequest) error {
+	atomic.AddInt32(&h.adds, 1)
+	return nil
+}
+func (h *slowHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	atomic.AddInt32(&h.l1gets, 1)
+	reschan := make(chan common.GetResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		reschan <- common.GetResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx], Miss: true}
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+func (h *slowHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	atomic.AddInt32(&h.gets, 1)
+	h.started <- struct{}{}
+	<-h.release
+
+	reschan := make(chan common.GetEResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		reschan <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx], Data: []byte("foo")}
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+func (h *slowHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	atomic.AddInt32(&h.gats, 1)
+	h.started <- struct{}{}
+	<-h.release
+	return common.GetResponse{Key: cmd.Key, Opaque: cmd.Opaque, Data: []byte("foo")}, nil
+}
+
+// slowGetHandler blocks every Get like slowHandler blocks GetE, since the batch
+// orca reads L2 with Get.
+type slowGetHandler struct {
+	*slowHandler
+}
+
+func (h slowGetHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	atomic.AddInt32(&h.gets, 1)
+	h.started <- struct{}{}
+	<-h.release
+
+	reschan := make(chan common.GetResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		reschan <- common.GetResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx], Data: []byte("foo")}
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+
+type l1MissHandler struct {
+	slowHandler
+}
+
+func (h *l1MissHandler) GAT(cmd common.GATRequest) (common.GetResponse, error) {
+	return common.GetResponse{Key: cmd.Key, Opaque: cmd.Opaque, Miss: true}, nil
+}
+
+func TestL1L2OrcaCoalescing(t *testing.T) {
+	const numFollowers = 8
+
+	t.Run("Get", func(t *testing.T) {
+		h1 := &l1MissHandler{}
+		h2 := newSlowHandler()
+
+		var outputs []*bytes.Buffer
+		wg := &sync.WaitGroup{}
+
+		doGet := func() {
+			output := &bytes.Buffer{}
+			outputs = append(outputs, output)
+			l1l2 := orcas.L1L2(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := l1l2.Get(common.GetRequest{
+					Keys:    [][]byte{[]byte("coalesce")},
+					Opaques: []uint32{0},
+					Quiet:   []bool{false},
+				})
+				if err != nil {
+					t.Errorf("Error should be nil, got %v", err)
+				}
+			}()
+		}
+
+		// The leader gets stuck in L2 while everyone else misses L1 behind it
+		doGet()
+		<-h2.started
+		for i := 0; i < numFollowers; i++ {
+			doGet()
+		}
+		for atomic.LoadInt32(&h1.l1gets) < numFollowers+1 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		close(h2.release)
+		wg.Wait()
+
+		if n := atomic.LoadInt32(&h2.gets); n != 1 {
+			t.Fatalf("Expected 1 L2 fetch, got %d", n)
+		}
+		if n := atomic.LoadInt32(&h1.sets); n != 1 {
+			t.Fatalf("Expected 1 L1 backfill, got %d", n)
+		}
+
+		gold := "VALUE coalesce 0 3\r\nfoo\r\nEND\r\n"
+		for _, output := range outputs {
+			if out := output.String(); out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+		}
+	})
+	t.Run("Gat", func(t *testing.T) {
+		h1 := &l1MissHandler{}
+		h2 := newSlowHandler()
+
+		var outputs []*bytes.Buffer
+		var started int32
+		wg := &sync.WaitGroup{}
+
+		doGat := func() {
+			output := &bytes.Buffer{}
+			outputs = append(outputs, output)
+			l1l2 := orcas.L1L2(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				atomic.AddInt32(&started, 1)
+				err := l1l2.Gat(common.GATRequest{
+					Key:     []byte("coalesce"),
+					Exptime: 100,
+				})
+				if err != nil {
+					t.Errorf("Error should be nil, got %v", err)
+				}
+			}()
+		}
+
+		doGat()
+		<-h2.started
+		for i := 0; i < numFollowers; i++ {
+			doGat()
+		}
+		for atomic.LoadInt32(&started) < numFollowers+1 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		close(h2.release)
+		wg.Wait()
+
+		if n := atomic.LoadInt32(&h2.gats); n != 1 {
+			t.Fatalf("Expected 1 L2 GAT, got %d", n)
+		}
+		if n := atomic.LoadInt32(&h1.adds); n != 1 {
+			t.Fatalf("Expected 1 L1 add, got %d", n)
+		}
+
+		for _, output := range outputs {
+			if !bytes.HasSuffix(output.Bytes(), []byte("foo")) {
+				t.Fatalf("Expected a GAT hit with data 'foo' but got %v", output.Bytes())
+			}
+		}
+	})
+}
+
+// splitHandler stands in for an L2 that hangs on the key "slow" until released
+// and answers every other fetch at once, with an error unless hit is set.
+type splitHandler struct {
+	testHandler
+	hit     bool
+	hits    int32
+	failed  int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (h *splitHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	reschan := make(chan common.GetEResponse, len(cmd.Keys))
+	errchan := make(chan error, 1)
+
+	if string(cmd.Keys[0]) == "slow" {
+		h.started <- struct{}{}
+		<-h.release
+		for idx, key := range cmd.Keys {
+			reschan <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx], Data: []byte("foo")}
+		}
+	} else if h.hit {
+		atomic.AddInt32(&h.hits, 1)
+		for idx, key := range cmd.Keys {
+			reschan <- common.GetEResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx], Data: []byte("bar")}
+		}
+	} else {
+		atomic.AddInt32(&h.failed, 1)
+		errchan <- errors.New("fetch failed")
+	}
+
+	close(reschan)
+	close(errchan)
+	return reschan, errchan
+}
+
+func TestL1L2OrcaCoalescingFailures(t *testing.T) {
+	get := func(oc orcas.OrcaConst, h1, h2 handlers.Handler, keys ...string) <-chan error {
+		req := common.GetRequest{}
+		for i, key := range keys {
+			req.Keys = append(req.Keys, []byte(key))
+			req.Opaques = append(req.Opaques, uint32(i))
+			req.Quiet = append(req.Quiet, false)
+		}
+
+		done := make(chan error, 1)
+		l1l2 := oc(h1, h2, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+		go func() {
+			done <- l1l2.Get(req)
+		}()
+		return done
+	}
+
+	t.Run("LandedBeforeWaiting", func(t *testing.T) {
+		oc := orcas.L1L2WithOpts(orcas.L1L2Opts{})
+		h1 := &l1MissHandler{}
+		h2 := &splitHandler{started: make(chan struct{}, 1), release: make(chan struct{})}
+		defer close(h2.release)
+
+		// The first request leads a fetch that hangs, the second leads a fetch
+		// that fails and then waits on the first
+		get(oc, h1, h2, "slow")
+		<-h2.started
+		get(oc, h1, h2, "other", "slow")
+		for atomic.LoadInt32(&h2.failed) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// A third request for the failed key must not wait on the hung fetch
+		select {
+		case err := <-get(oc, h1, h2, "other"):
+			if err == nil {
+				t.Fatalf("Expected the fetch to fail")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the failed flight to be landed before its leader waits on others")
+		}
+	})
+	t.Run("RequestOrder", func(t *testing.T) {
+		oc := orcas.L1L2WithOpts(orcas.L1L2Opts{})
+		h1 := &l1MissHandler{}
+		h2 := &splitHandler{hit: true, started: make(chan struct{}, 1), release: make(chan struct{})}
+
+		get(oc, h1, h2, "slow")
+		<-h2.started
+
+		// The keys around the shared one are fetched first, but still answered
+		// after it
+		output := &bytes.Buffer{}
+		l1l2 := oc(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+		done := make(chan error, 1)
+		go func() {
+			done <- l1l2.Get(common.GetRequest{
+				Keys:    [][]byte{[]byte("a"), []byte("slow"), []byte("c")},
+				Opaques: []uint32{0, 1, 2},
+				Quiet:   []bool{false, false, false},
+			})
+		}()
+
+		for atomic.LoadInt32(&h2.hits) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		close(h2.release)
+		if err := <-done; err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		gold := "VALUE a 0 3\r\nbar\r\nVALUE slow 0 3\r\nfoo\r\nVALUE c 0 3\r\nbar\r\nEND\r\n"
+		if out := output.String(); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("SeparateBackends", func(t *testing.T) {
+		cases := []struct {
+			name    string
+			newOrca func(orcas.L1L2Opts) orcas.OrcaConst
+			l2      func(h *slowHandler) handlers.Handler
+		}{
+			{"L1L2", orcas.L1L2WithOpts, func(h *slowHandler) handlers.Handler { return h }},
+			{"L1L2Batch", orcas.L1L2BatchWithOpts, func(h *slowHandler) handlers.Handler { return slowGetHandler{h} }},
+		}
+
+		for _, c := range cases {
+			t.Run(c.name, func(t *testing.T) {
+				h1 := &l1MissHandler{}
+				hung := newSlowHandler()
+				defer close(hung.release)
+				live := newSlowHandler()
+				close(live.release)
+
+				get(c.newOrca(orcas.L1L2Opts{}), h1, c.l2(hung), "coalesce")
+				<-hung.started
+
+				select {
+				case err := <-get(c.newOrca(orcas.L1L2Opts{}), h1, c.l2(live), "coalesce"):
+					if err != nil {
+						t.Fatalf("Error should be nil, got %v", err)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("Expected an orca in front of another L2 to not share its fetch")
+				}
+				if n := atomic.LoadInt32(&live.gets); n != 1 {
+					t.Fatalf("Expected 1 fetch from the other L2, got %d", n)
+				}
+			})
+		}
+	})
+}
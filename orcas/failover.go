@@ -0,0 +1,216 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"io"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/handlers/breaker"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+type FailoverOrca struct {
+	normal Orca
+	l1only Orca
+	l2only Orca
+	l1b    *breaker.Breaker
+	l2b    *breaker.Breaker
+}
+
+// Failover wraps an L1/L2 orca with a degraded mode driven by the breakers for
+// each layer. The handlers given to the orca should be wrapped with
+// breaker.Handler using the same breakers. Either breaker may be nil, in which
+// case that layer is always considered up.
+//
+// While L1's breaker is open, reads and writes go straight to L2. Writes made
+// then are not in L1, so an L1 that comes back with its data intact may serve
+// older values until they expire or are written again.
+//
+// While L2's breaker is open, reads are served from L1 alone and writes are
+// rejected with a temporary failure, since they can't be made durable.
+//
+// While a breaker is half-open, requests take the normal path so its probe can
+// go through.
+func Failover(oc OrcaConst, l1b, l2b *breaker.Breaker) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		f := &FailoverOrca{
+			normal: oc(l1, l2, res),
+			l1only: L1Only(l1, nil, res),
+			l1b:    l1b,
+			l2b:    l2b,
+		}
+
+		// Without an L2 there's nothing to fail over to
+		if l2 != nil {
+			f.l2only = L1Only(l2, nil, res)
+		}
+
+		return f
+	}
+}
+
+func isOpen(b *breaker.Breaker) bool {
+	return b != nil && b.State() == breaker.Open
+}
+
+// reader picks the orca to serve a read with, or nil if both layers are down.
+func (f *FailoverOrca) reader() Orca {
+	l1down, l2down := isOpen(f.l1b), isOpen(f.l2b)
+
+	switch {
+	case l1down && (l2down || f.l2only == nil):
+		metrics.IncCounter(MetricFailoverRejected)
+		return nil
+	case l1down:
+		metrics.IncCounter(MetricFailoverL2Only)
+		return f.l2only
+	case l2down:
+		metrics.IncCounter(MetricFailoverL1Only)
+		return f.l1only
+	}
+
+	return f.normal
+}
+
+// writer picks the orca to serve a write with, or nil if writes are rejected.
+func (f *FailoverOrca) writer() Orca {
+	if isOpen(f.l2b) || (isOpen(f.l1b) && f.l2only == nil) {
+		metrics.IncCounter(MetricFailoverRejected)
+		return nil
+	}
+
+	if isOpen(f.l1b) {
+		metrics.IncCounter(MetricFailoverL2Only)
+		return f.l2only
+	}
+
+	return f.normal
+}
+
+// Close closes the wrapped orca if it holds resources of its own.
+func (f *FailoverOrca) Close() error {
+	if c, ok := f.normal.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (f *FailoverOrca) Set(req common.SetRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Set(req)
+}
+
+func (f *FailoverOrca) Add(req common.SetRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Add(req)
+}
+
+func (f *FailoverOrca) Replace(req common.SetRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Replace(req)
+}
+
+func (f *FailoverOrca) Append(req common.SetRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Append(req)
+}
+
+func (f *FailoverOrca) Prepend(req common.SetRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Prepend(req)
+}
+
+func (f *FailoverOrca) Delete(req common.DeleteRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Delete(req)
+}
+
+func (f *FailoverOrca) Touch(req common.TouchRequest) error {
+	o := f.writer()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Touch(req)
+}
+
+func (f *FailoverOrca) Get(req common.GetRequest) error {
+	o := f.reader()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Get(req)
+}
+
+func (f *FailoverOrca) GetE(req common.GetRequest) error {
+	o := f.reader()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.GetE(req)
+}
+
+// Gat is treated as a read. With L2 down the TTL is only changed in L1.
+func (f *FailoverOrca) Gat(req common.GATRequest) error {
+	o := f.reader()
+	if o == nil {
+		return common.ErrTempFailure
+	}
+	return o.Gat(req)
+}
+
+func (f *FailoverOrca) Noop(req common.NoopRequest) error {
+	return f.normal.Noop(req)
+}
+
+func (f *FailoverOrca) Quit(req common.QuitRequest) error {
+	return f.normal.Quit(req)
+}
+
+func (f *FailoverOrca) Version(req common.VersionRequest) error {
+	return f.normal.Version(req)
+}
+
+func (f *FailoverOrca) Unknown(req common.Request) error {
+	return f.normal.Unknown(req)
+}
+
+func (f *FailoverOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	f.normal.Error(req, reqType, err)
+}
+
+func (f *FailoverOrca) Stat(req common.StatRequest) error {
+	return f.normal.Stat(req)
+}
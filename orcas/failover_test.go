@@ -0,0 +1,80 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers/breaker"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// openBreaker returns a breaker that is already open.
+func openBreaker(name string) *breaker.Breaker {
+	b := breaker.New(name, breaker.Opts{MinRequests: 1, OpenSec: 3600})
+	b.Record(true, 0)
+	return b
+}
+
+func TestFailoverOrca(t *testing.T) {
+	t.Run("L1Down", func(t *testing.T) {
+		h1, h2 := newMapHandler(), newMapHandler()
+		output := &bytes.Buffer{}
+		o := orcas.Failover(orcas.L1L2, openBreaker("failover-l1-down"), nil)(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		if err := o.Set(common.SetRequest{Key: []byte("failover"), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if _, ok := h1.value("failover"); ok {
+			t.Fatalf("Expected L1 to be skipped while its breaker is open")
+		}
+
+		gold := "VALUE failover 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "failover"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("L2Down", func(t *testing.T) {
+		h1, h2 := newMapHandler(), newMapHandler()
+		h1.data["failover"] = "foo"
+		output := &bytes.Buffer{}
+		o := orcas.Failover(orcas.L1L2, nil, openBreaker("failover-l2-down"))(h1, h2, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		if err := o.Set(common.SetRequest{Key: []byte("failover"), Data: []byte("bar")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected writes to be rejected, got %v", err)
+		}
+
+		gold := "VALUE failover 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "failover"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("BothDown", func(t *testing.T) {
+		o := orcas.Failover(orcas.L1L2, openBreaker("failover-both-l1"), openBreaker("failover-both-l2"))(newMapHandler(), newMapHandler(), textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("failover")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		if err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+	})
+}
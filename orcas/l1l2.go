@@ -25,22 +25,86 @@ import (
 )
 
 type L1L2Orca struct {
-	l1  handlers.Handler
-	l2  handlers.Handler
-	res protocol.Responder
+	l1      handlers.Handler
+	l2      handlers.Handler
+	res     protocol.Responder
+	opts    L1L2Opts
+	flights *flights
+
+	// l1NoGetE is set once L1 turns out not to support GetE
+	l1NoGetE bool
 }
 
+// L1L2Opts holds the optional behavior of the L1L2 orca.
+type L1L2Opts struct {
+	// StaleGrace turns on stale-while-revalidate when non-zero. Every item is
+	// stored with its TTL extended by StaleGrace seconds. Once an item is within
+	// StaleGrace seconds of its stored expiration it is past its soft TTL (the
+	// one the client asked for) and is served as stale. The first client to see
+	// it stale is also told to refresh it; the rest keep getting the stale value
+	// until the item is set again or the refresh lease runs out.
+	StaleGrace uint32
+
+	// EarlyRefreshDelta turns on probabilistic early refresh (XFetch) when
+	// non-zero. It is the expected time, in seconds, that a client takes to
+	// recompute an item. Each fresh hit is picked for refresh with a probability
+	// that grows as the remaining soft TTL shrinks relative to this value.
+	EarlyRefreshDelta float64
+
+	// EarlyRefreshBeta scales EarlyRefreshDelta. Values over 1 favor earlier
+	// refreshes, values under 1 favor later ones. Default: 1.0
+	EarlyRefreshBeta float64
+
+	// RefreshLease is the number of seconds a client that was told to refresh an
+	// item has to do so before another client is told to. Default: 10
+	RefreshLease uint32
+
+	// Admission decides which L2 hits are copied back into L1 by Get and Gat.
+	// Default: AlwaysAdmit
+	Admission Admission
+}
+
+// L1L2 coalesces its L2 fetches with every other orca made by L1L2 in the
+// process, so they must all be in front of the same L2.
+//
+// Deprecated: an orca in front of a second L2 would be handed results from the
+// first. Use L1L2WithOpts, which coalesces per call.
 func L1L2(l1, l2 handlers.Handler, res protocol.Responder) Orca {
 	return &L1L2Orca{
-		l1:  l1,
-		l2:  l2,
-		res: res,
+		l1:      l1,
+		l2:      l2,
+		res:     res,
+		flights: l1l2Flights,
+	}
+}
+
+// L1L2WithOpts returns an OrcaConst for an L1L2 orca with the given options.
+// The zero value of L1L2Opts gives the same orca as L1L2. The orcas it makes
+// coalesce their L2 fetches with each other and with no others, so each call
+// should be for one L2.
+func L1L2WithOpts(opts L1L2Opts) OrcaConst {
+	f := newFlights()
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &L1L2Orca{
+			l1:      l1,
+			l2:      l2,
+			res:     res,
+			opts:    opts,
+			flights: f,
+		}
 	}
 }
 
 func (l *L1L2Orca) Set(req common.SetRequest) error {
 	//log.Println("set", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
+	// A new value ends any refresh in progress for the old one
+	if l.opts.tracksFreshness() {
+		defer refreshLeases.release(req.Key)
+	}
+
 	// Try L2 first
 	metrics.IncCounter(MetricCmdSetL2)
 	start := timer.Now()
@@ -115,6 +179,8 @@ func (l *L1L2Orca) Set(req common.SetRequest) error {
 func (l *L1L2Orca) Add(req common.SetRequest) error {
 	//log.Println("add", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
 	// Add in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdAddL2)
 	start := timer.Now()
@@ -188,6 +254,13 @@ func (l *L1L2Orca) Add(req common.SetRequest) error {
 func (l *L1L2Orca) Replace(req common.SetRequest) error {
 	//log.Println("replace", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
+	// A new value ends any refresh in progress for the old one
+	if l.opts.tracksFreshness() {
+		defer refreshLeases.release(req.Key)
+	}
+
 	// Replace in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdReplaceL2)
 	start := timer.Now()
@@ -456,6 +529,8 @@ func (l *L1L2Orca) Delete(req common.DeleteRequest) error {
 func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 	//log.Println("touch", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
 	// Try L2 first
 	metrics.IncCounter(MetricCmdTouchL2)
 	start := timer.Now()
@@ -522,6 +597,10 @@ func (l *L1L2Orca) Touch(req common.TouchRequest) error {
 }
 
 func (l *L1L2Orca) Get(req common.GetRequest) error {
+	if l.opts.tracksFreshness() && !l.l1NoGetE {
+		return l.getWithFreshness(req)
+	}
+
 	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
 	//debugString := "get"
 	//for _, k := range req.Keys {
@@ -591,7 +670,10 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
 	}
 
-	// Time for the same dance with L2
+	// Time for the same dance with L2. The L2 fetch is coalesced with any other
+	// connection that is missing on the same keys right now, so a hot key that
+	// just expired causes one L2 fetch and one L1 backfill rather than one per
+	// client.
 	req = common.GetRequest{
 		Keys:       l2keys,
 		NoopEnd:    req.NoopEnd,
@@ -600,10 +682,50 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 		Quiet:      l2quiets,
 	}
 
+	l2err := l.flights.get.get(req, l.getL2, func(res common.GetEResponse, shared bool) {
+		if shared {
+			metrics.IncCounter(MetricCmdGetCoalesced)
+		}
+
+		if res.Miss {
+			// Missing L2 means a true miss
+			metrics.IncCounter(MetricCmdGetMisses)
+		} else {
+			// overall operation is considered a hit
+			metrics.IncCounter(MetricCmdGetHits)
+		}
+
+		l.res.Get(common.GetResponse{
+			Key:    res.Key,
+			Flags:  res.Flags,
+			Data:   res.Data,
+			Miss:   res.Miss,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
+		})
+	})
+
+	if l2err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		err = l2err
+	}
+
+	if err == nil {
+		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+
+	return err
+}
+
+// getL2 is the fetchFunc used by Get to retrieve L1 misses from L2. It is only
+// ever run by the request leading the fetch for the keys in req, so each hit is
+// backfilled into L1 once no matter how many connections missed on it.
+func (l *L1L2Orca) getL2(req common.GetRequest, land func(res common.GetEResponse)) error {
 	metrics.IncCounter(MetricCmdGetEL2)
-	metrics.IncCounterBy(MetricCmdGetEKeysL2, uint64(len(l2keys)))
-	start = timer.Now()
+	metrics.IncCounterBy(MetricCmdGetEKeysL2, uint64(len(req.Keys)))
+	start := timer.Now()
 
+	var err error
 	resChanE, errChan := l.l2.GetE(req)
 
 	for {
@@ -614,80 +736,18 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 			} else {
 				if res.Miss {
 					metrics.IncCounter(MetricCmdGetEMissesL2)
-					// Missing L2 means a true miss
-					metrics.IncCounter(MetricCmdGetMisses)
 				} else {
 					metrics.IncCounter(MetricCmdGetEHitsL2)
-
-					//set in l1
-					setreq := common.SetRequest{
-						Key:     res.Key,
-						Flags:   res.Flags,
-						Exptime: res.Exptime,
-						Data:    res.Data,
-					}
-
-					metrics.IncCounter(MetricCmdGetSetL1)
-					start2 := timer.Now()
-
-					err = l.l1.Set(setreq)
-
-					metrics.ObserveHist(HistSetL1, timer.Since(start2))
-
-					if err != nil {
-						metrics.IncCounter(MetricCmdGetSetErrorsL1)
-
-						// TODO: REVIEW TO END OF BLOCK
-						metrics.IncCounter(MetricCmdGetSetErrorL1DeleteL1)
-
-						// in order to ensure consistency, attempt a delete from L1
-						// For keys that are unable to be set in L1 but were successfully set in
-						// L2 this may cause a shift in load. These keys tend to be large so this
-						// will probably put a significant burden on L2 if the data are large.
-						// Note that even if there's a major problem, e.g. the connection being
-						// closed, this will still return success.
-						dcmd := common.DeleteRequest{
-							Key: res.Key,
-						}
-
-						start = timer.Now()
-						err = l.l1.Delete(dcmd)
-						metrics.ObserveHist(HistDeleteL1, timer.Since(start))
-
-						if err == common.ErrKeyNotFound {
-							metrics.IncCounter(MetricCmdGetSetErrorL1DeleteMissesL1)
-						} else if err != nil {
-							metrics.IncCounter(MetricCmdGetSetErrorL1DeleteErrorsL1)
-						} else {
-							metrics.IncCounter(MetricCmdGetSetErrorL1DeleteHitsL1)
-						}
-
-						err = nil
-					}
-
-					metrics.IncCounter(MetricCmdGetSetSucessL1)
-
-					// overall operation is considered a hit
-					metrics.IncCounter(MetricCmdGetHits)
+					l.backfillL1(res)
 				}
 
-				getres := common.GetResponse{
-					Key:    res.Key,
-					Flags:  res.Flags,
-					Data:   res.Data,
-					Miss:   res.Miss,
-					Opaque: res.Opaque,
-					Quiet:  res.Quiet,
-				}
-
-				l.res.Get(getres)
+				land(res)
 			}
 
 		case getErr, ok := <-errChan:
 			if !ok {
 				errChan = nil
 			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
 				metrics.IncCounter(MetricCmdGetEErrorsL2)
 				err = getErr
 			}
@@ -701,11 +761,77 @@ func (l *L1L2Orca) Get(req common.GetRequest) error {
 	// finish up metrics for overall L2 (batch) get operation
 	metrics.ObserveHist(HistGetL2, timer.Since(start))
 
-	if err == nil {
-		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	return err
+}
+
+// backfillL1 sets an L2 hit into L1. Failures here do not fail the overall get;
+// a failed set is followed by a delete so L1 can't be left holding older data.
+func (l *L1L2Orca) backfillL1(res common.GetEResponse) {
+	if !l.admit(res.Key, res.Data) {
+		return
 	}
 
-	return err
+	setreq := common.SetRequest{
+		Key:     res.Key,
+		Flags:   res.Flags,
+		Exptime: res.Exptime,
+		Data:    res.Data,
+	}
+
+	metrics.IncCounter(MetricCmdGetSetL1)
+	start := timer.Now()
+
+	err := l.l1.Set(setreq)
+
+	metrics.ObserveHist(HistSetL1, timer.Since(start))
+
+	if err != nil {
+		metrics.IncCounter(MetricCmdGetSetErrorsL1)
+
+		// TODO: REVIEW TO END OF BLOCK
+		metrics.IncCounter(MetricCmdGetSetErrorL1DeleteL1)
+
+		// in order to ensure consistency, attempt a delete from L1
+		// For keys that are unable to be set in L1 but were successfully set in
+		// L2 this may cause a shift in load. These keys tend to be large so this
+		// will probably put a significant burden on L2 if the data are large.
+		// Note that even if there's a major problem, e.g. the connection being
+		// closed, this will still return success.
+		dcmd := common.DeleteRequest{
+			Key: res.Key,
+		}
+
+		start = timer.Now()
+		err = l.l1.Delete(dcmd)
+		metrics.ObserveHist(HistDeleteL1, timer.Since(start))
+
+		if err == common.ErrKeyNotFound {
+			metrics.IncCounter(MetricCmdGetSetErrorL1DeleteMissesL1)
+		} else if err != nil {
+			metrics.IncCounter(MetricCmdGetSetErrorL1DeleteErrorsL1)
+		} else {
+			metrics.IncCounter(MetricCmdGetSetErrorL1DeleteHitsL1)
+		}
+
+		return
+	}
+
+	metrics.IncCounter(MetricCmdGetSetSucessL1)
+}
+
+// admit asks the admission policy whether an L2 hit should be copied into L1.
+func (l *L1L2Orca) admit(key, data []byte) bool {
+	if l.opts.Admission == nil {
+		return true
+	}
+
+	if l.opts.Admission.Admit(key, len(data)) {
+		metrics.IncCounter(MetricL1AdmissionAdmitted)
+		return true
+	}
+
+	metrics.IncCounter(MetricL1AdmissionRejected)
+	return false
 }
 
 func (l *L1L2Orca) GetE(req common.GetRequest) error {
@@ -717,6 +843,8 @@ func (l *L1L2Orca) GetE(req common.GetRequest) error {
 func (l *L1L2Orca) Gat(req common.GATRequest) error {
 	//log.Println("gat", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
 	// Try L1 first
 	metrics.IncCounter(MetricCmdGatL1)
 	start := timer.Now()
@@ -741,55 +869,153 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 
 	if res.Miss {
 		// If we miss here, we have to GAT L2 to get the data, then put it back
-		// into L1 with the new TTL.
+		// into L1 with the new TTL. Concurrent GATs for the same key and TTL
+		// share a single L2 GAT and L1 add.
 		metrics.IncCounter(MetricCmdGatMissesL1)
 
-		metrics.IncCounter(MetricCmdGatL2)
-		start = timer.Now()
+		key := flightKey{key: string(req.Key), exptime: req.Exptime}
+		eres, shared, err := l.flights.gat.do(key, func() (common.GetEResponse, error) {
+			return l.gatL2(req)
+		})
 
-		res, err = l.l2.GAT(req)
-
-		metrics.ObserveHist(HistGatL2, timer.Since(start))
-
-		// fatal error
 		if err != nil {
-			metrics.IncCounter(MetricCmdGatErrorsL2)
-			metrics.IncCounter(MetricCmdGatErrors)
 			return err
 		}
 
-		// A miss on L2 after L1 is a true miss
-		if res.Miss {
-			metrics.IncCounter(MetricCmdGatMissesL2)
-			metrics.IncCounter(MetricCmdGatMisses)
-			return l.res.GAT(res)
+		res = common.GetResponse{
+			Key:    req.Key,
+			Data:   eres.Data,
+			Opaque: req.Opaque,
+			Flags:  eres.Flags,
+			Miss:   eres.Miss,
+			Quiet:  req.Quiet,
 		}
 
-		// Take the data from the L2 GAT and set into L1 with the new TTL.
-		// There's several problems that could arise from interleaving of other
-		// operations. Another GAT isn't a problem.
-		//
-		// Intermediate sets might get clobbered in L1 but remain in L2 if we
-		// used Set, but since we use Add we should not overwrite a Set that
-		// happens between the L2 GAT hit and subsequent L1 reconciliation.
-		//
-		// Deletes would be a possible problem since a delete hit in L2 and miss
-		// in L1 would interleave to have data in L1 not in L2. This is a risk
-		// that is understood and accepted. The typical use cases at Netflix
-		// will not use deletes concurrently with GATs.
-		setreq := common.SetRequest{
-			Key:     req.Key,
-			Exptime: req.Exptime,
-			Flags:   res.Flags,
-			Data:    res.Data,
+		if shared {
+			metrics.IncCounter(MetricCmdGatCoalesced)
+			if res.Miss {
+				metrics.IncCounter(MetricCmdGatMisses)
+			} else {
+				metrics.IncCounter(MetricCmdGatHits)
+			}
 		}
 
+		return l.res.GAT(res)
+	}
+
+	metrics.IncCounter(MetricCmdGatHitsL1)
+
+	// Touch in L2. This used to be a set operation, but touch allows the L2
+	// to have more control over the operation than a set does. This helps
+	// migrations internally at Netflix because we can choose to discount
+	// touch commands in L2 but not sets.
+	//
+	// The first possibility is a Set. A set into L2 would possibly cause a
+	// concurrent delete to not take, meaning the delete could say it was
+	// successful and then a subsequent get call would show the old data
+	// that was just deleted.
+	//
+	// Another option is to just send a touch, which allows us to send less
+	// data but gives the possibility of a touch miss on L2, which will be a
+	// problematic situation. If we get a touch miss, then we know we are
+	// inconsistent but we don't affect concurrent deletes.
+	//
+	// A third option is to use Replace, which could be helpful to avoid
+	// overriding concurrent deletes. This also might cause problems with
+	// othr sets at the same time, as it might overwrite a set that just
+	// finished.
+	//
+	// Many heavy users of EVCache at Netflix use GAT commands to lengthen
+	// TTLs of their data in use and to shorten the TTL of data they will
+	// not be using which is then async TTL'd out. I am explicitly
+	// discounting the concurrent delete situation here and accepting that
+	// they might not be exactly correct.
+	touchreq := common.TouchRequest{
+		Key:     req.Key,
+		Exptime: req.Exptime,
+	}
+
+	metrics.IncCounter(MetricCmdGatTouchL2)
+	start2 := timer.Now()
+
+	err = l.l2.Touch(touchreq)
+
+	metrics.ObserveHist(HistTouchL2, timer.Since(start2))
+
+	if err != nil {
+		if err == common.ErrKeyNotFound {
+			// this is a problem. L1 had the item but L2 doesn't. To avoid an
+			// inconsistent view, return the same ErrNotFound and fail the op.
+			metrics.IncCounter(MetricInconsistencyDetected)
+			metrics.IncCounter(MetricCmdGatTouchMissesL2)
+			metrics.IncCounter(MetricCmdGatMisses)
+		} else {
+			// If there's a true error, return it as our error. The GAT
+			// succeeded in L1 but if L2 didn't take, then likely something
+			// is seriously wrong.
+			metrics.IncCounter(MetricCmdGatTouchErrorsL2)
+			metrics.IncCounter(MetricCmdGatErrors)
+		}
+		return err
+	}
+	metrics.IncCounter(MetricCmdGatTouchHitsL2)
+
+	// overall operation succeeded
+	metrics.IncCounter(MetricCmdGatHits)
+
+	return l.res.GAT(res)
+}
+
+// gatL2 performs the L2 half of a GAT that missed in L1: a GAT in L2 followed
+// by an add into L1 on a hit. It is run once per coalesced flight.
+func (l *L1L2Orca) gatL2(req common.GATRequest) (common.GetEResponse, error) {
+	metrics.IncCounter(MetricCmdGatL2)
+	start := timer.Now()
+
+	res, err := l.l2.GAT(req)
+
+	metrics.ObserveHist(HistGatL2, timer.Since(start))
+
+	// fatal error
+	if err != nil {
+		metrics.IncCounter(MetricCmdGatErrorsL2)
+		metrics.IncCounter(MetricCmdGatErrors)
+		return common.GetEResponse{}, err
+	}
+
+	// A miss on L2 after L1 is a true miss
+	if res.Miss {
+		metrics.IncCounter(MetricCmdGatMissesL2)
+		metrics.IncCounter(MetricCmdGatMisses)
+		return common.GetEResponse{Key: req.Key, Miss: true}, nil
+	}
+
+	// Take the data from the L2 GAT and set into L1 with the new TTL.
+	// There's several problems that could arise from interleaving of other
+	// operations. Another GAT isn't a problem.
+	//
+	// Intermediate sets might get clobbered in L1 but remain in L2 if we
+	// used Set, but since we use Add we should not overwrite a Set that
+	// happens between the L2 GAT hit and subsequent L1 reconciliation.
+	//
+	// Deletes would be a possible problem since a delete hit in L2 and miss
+	// in L1 would interleave to have data in L1 not in L2. This is a risk
+	// that is understood and accepted. The typical use cases at Netflix
+	// will not use deletes concurrently with GATs.
+	setreq := common.SetRequest{
+		Key:     req.Key,
+		Exptime: req.Exptime,
+		Flags:   res.Flags,
+		Data:    res.Data,
+	}
+
+	if l.admit(req.Key, res.Data) {
 		metrics.IncCounter(MetricCmdGatAddL1)
-		start2 := timer.Now()
+		start = timer.Now()
 
 		err = l.l1.Add(setreq)
 
-		metrics.ObserveHist(HistAddL1, timer.Since(start2))
+		metrics.ObserveHist(HistAddL1, timer.Since(start))
 
 		if err != nil {
 			// we were trampled in the middle of performing the GAT operation
@@ -803,78 +1029,22 @@ func (l *L1L2Orca) Gat(req common.GATRequest) error {
 				// direct interaction with the two. THe overall metrics correspond
 				// to the more abstract orchestrator operation.
 				metrics.IncCounter(MetricCmdGatErrors)
-				return err
+				return common.GetEResponse{}, err
 			}
 		} else {
 			metrics.IncCounter(MetricCmdGatAddStoredL1)
 		}
-
-		// the overall operation succeeded
-		metrics.IncCounter(MetricCmdGatHits)
-
-	} else {
-		metrics.IncCounter(MetricCmdGatHitsL1)
-
-		// Touch in L2. This used to be a set operation, but touch allows the L2
-		// to have more control over the operation than a set does. This helps
-		// migrations internally at Netflix because we can choose to discount
-		// touch commands in L2 but not sets.
-		//
-		// The first possibility is a Set. A set into L2 would possibly cause a
-		// concurrent delete to not take, meaning the delete could say it was
-		// successful and then a subsequent get call would show the old data
-		// that was just deleted.
-		//
-		// Another option is to just send a touch, which allows us to send less
-		// data but gives the possibility of a touch miss on L2, which will be a
-		// problematic situation. If we get a touch miss, then we know we are
-		// inconsistent but we don't affect concurrent deletes.
-		//
-		// A third option is to use Replace, which could be helpful to avoid
-		// overriding concurrent deletes. This also might cause problems with
-		// othr sets at the same time, as it might overwrite a set that just
-		// finished.
-		//
-		// Many heavy users of EVCache at Netflix use GAT commands to lengthen
-		// TTLs of their data in use and to shorten the TTL of data they will
-		// not be using which is then async TTL'd out. I am explicitly
-		// discounting the concurrent delete situation here and accepting that
-		// they might not be exactly correct.
-		touchreq := common.TouchRequest{
-			Key:     req.Key,
-			Exptime: req.Exptime,
-		}
-
-		metrics.IncCounter(MetricCmdGatTouchL2)
-		start2 := timer.Now()
-
-		err := l.l2.Touch(touchreq)
-
-		metrics.ObserveHist(HistTouchL2, timer.Since(start2))
-
-		if err != nil {
-			if err == common.ErrKeyNotFound {
-				// this is a problem. L1 had the item but L2 doesn't. To avoid an
-				// inconsistent view, return the same ErrNotFound and fail the op.
-				metrics.IncCounter(MetricInconsistencyDetected)
-				metrics.IncCounter(MetricCmdGatTouchMissesL2)
-				metrics.IncCounter(MetricCmdGatMisses)
-			} else {
-				// If there's a true error, return it as our error. The GAT
-				// succeeded in L1 but if L2 didn't take, then likely something
-				// is seriously wrong.
-				metrics.IncCounter(MetricCmdGatTouchErrorsL2)
-				metrics.IncCounter(MetricCmdGatErrors)
-			}
-			return err
-		}
-		metrics.IncCounter(MetricCmdGatTouchHitsL2)
-
-		// overall operation succeeded
-		metrics.IncCounter(MetricCmdGatHits)
 	}
 
-	return l.res.GAT(res)
+	// the overall operation succeeded
+	metrics.IncCounter(MetricCmdGatHits)
+
+	return common.GetEResponse{
+		Key:     req.Key,
+		Data:    res.Data,
+		Flags:   res.Flags,
+		Exptime: req.Exptime,
+	}, nil
 }
 
 func (l *L1L2Orca) Noop(req common.NoopRequest) error {
@@ -25,22 +25,56 @@ import (
 )
 
 type L1L2BatchOrca struct {
-	l1  handlers.Handler
-	l2  handlers.Handler
-	res protocol.Responder
+	l1      handlers.Handler
+	l2      handlers.Handler
+	res     protocol.Responder
+	opts    L1L2Opts
+	flights *flights
 }
 
+// L1L2Batch coalesces its L2 fetches with every other orca made by L1L2Batch in
+// the process, so they must all be in front of the same L2.
+//
+// Deprecated: an orca in front of a second L2 would be handed results from the
+// first. Use L1L2BatchWithOpts, which coalesces per call.
 func L1L2Batch(l1, l2 handlers.Handler, res protocol.Responder) Orca {
 	return &L1L2BatchOrca{
-		l1:  l1,
-		l2:  l2,
-		res: res,
+		l1:      l1,
+		l2:      l2,
+		res:     res,
+		flights: batchFlights,
+	}
+}
+
+// L1L2BatchWithOpts returns an OrcaConst for an L1L2Batch orca with the given
+// options. Batch reads aren't marked stale or refresh, but items written through
+// the batch orca get the same hard TTL, and end refreshes the same way, as items
+// written through an L1L2 orca with the same options. The orcas it makes
+// coalesce their L2 fetches with each other and with no others, so each call
+// should be for one L2.
+func L1L2BatchWithOpts(opts L1L2Opts) OrcaConst {
+	f := newFlights()
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &L1L2BatchOrca{
+			l1:      l1,
+			l2:      l2,
+			res:     res,
+			opts:    opts,
+			flights: f,
+		}
 	}
 }
 
 func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 	//log.Println("set", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
+	// A new value ends any refresh in progress for the old one
+	if l.opts.tracksFreshness() {
+		defer refreshLeases.release(req.Key)
+	}
+
 	// Try L2 first
 	metrics.IncCounter(MetricCmdSetL2)
 	start := timer.Now()
@@ -109,6 +143,8 @@ func (l *L1L2BatchOrca) Set(req common.SetRequest) error {
 func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 	//log.Println("add", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
 	// Add in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdAddL2)
 	start := timer.Now()
@@ -165,6 +201,13 @@ func (l *L1L2BatchOrca) Add(req common.SetRequest) error {
 func (l *L1L2BatchOrca) Replace(req common.SetRequest) error {
 	//log.Println("replace", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
+	// A new value ends any refresh in progress for the old one
+	if l.opts.tracksFreshness() {
+		defer refreshLeases.release(req.Key)
+	}
+
 	// Add in L2 first, since it has the larger state
 	metrics.IncCounter(MetricCmdReplaceL2)
 	start := timer.Now()
@@ -412,6 +455,8 @@ func (l *L1L2BatchOrca) Delete(req common.DeleteRequest) error {
 func (l *L1L2BatchOrca) Touch(req common.TouchRequest) error {
 	//log.Println("touch", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
 	// Try L2 first
 	metrics.IncCounter(MetricCmdTouchL2)
 	start := timer.Now()
@@ -542,7 +587,8 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
 	}
 
-	// Time for the same dance with L2
+	// Time for the same dance with L2. As with L1L2, the L2 fetch is coalesced
+	// with other connections missing on the same keys.
 	req = common.GetRequest{
 		Keys:       l2keys,
 		NoopEnd:    req.NoopEnd,
@@ -551,11 +597,49 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 		Quiet:      l2quiets,
 	}
 
+	l2err := l.flights.get.get(req, l.getL2, func(res common.GetEResponse, shared bool) {
+		if shared {
+			metrics.IncCounter(MetricCmdGetCoalesced)
+		}
+
+		if res.Miss {
+			// Missing L2 means a true miss
+			metrics.IncCounter(MetricCmdGetMisses)
+		} else {
+			// overall operation is considered a hit
+			metrics.IncCounter(MetricCmdGetHits)
+		}
+
+		l.res.Get(common.GetResponse{
+			Key:    res.Key,
+			Flags:  res.Flags,
+			Data:   res.Data,
+			Miss:   res.Miss,
+			Opaque: res.Opaque,
+			Quiet:  res.Quiet,
+		})
+	})
+
+	if l2err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		err = l2err
+	}
+
+	if err == nil {
+		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+
+	return err
+}
+
+// getL2 is the fetchFunc used by Get to retrieve L1 misses from L2.
+func (l *L1L2BatchOrca) getL2(req common.GetRequest, land func(res common.GetEResponse)) error {
 	metrics.IncCounter(MetricCmdGetL2)
-	metrics.IncCounterBy(MetricCmdGetKeysL2, uint64(len(l2keys)))
-	start = timer.Now()
+	metrics.IncCounterBy(MetricCmdGetKeysL2, uint64(len(req.Keys)))
+	start := timer.Now()
 
-	resChan, errChan = l.l2.Get(req)
+	var err error
+	resChan, errChan := l.l2.Get(req)
 
 	for {
 		select {
@@ -565,8 +649,6 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 			} else {
 				if res.Miss {
 					metrics.IncCounter(MetricCmdGetMissesL2)
-					// Missing L2 means a true miss
-					metrics.IncCounter(MetricCmdGetMisses)
 				} else {
 					metrics.IncCounter(MetricCmdGetHitsL2)
 
@@ -574,28 +656,22 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 					// data once and not again, so setting in L1 will not be valuable.
 					// As well the data is typically just about to be replaced, making
 					// it doubly useless.
-
-					// overall operation is considered a hit
-					metrics.IncCounter(MetricCmdGetHits)
 				}
 
-				getres := common.GetResponse{
+				land(common.GetEResponse{
 					Key:    res.Key,
 					Flags:  res.Flags,
 					Data:   res.Data,
 					Miss:   res.Miss,
 					Opaque: res.Opaque,
 					Quiet:  res.Quiet,
-				}
-
-				l.res.Get(getres)
+				})
 			}
 
 		case getErr, ok := <-errChan:
 			if !ok {
 				errChan = nil
 			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
 				metrics.IncCounter(MetricCmdGetEErrorsL2)
 				err = getErr
 			}
@@ -608,10 +684,6 @@ func (l *L1L2BatchOrca) Get(req common.GetRequest) error {
 
 	metrics.ObserveHist(HistGetL2, timer.Since(start))
 
-	if err == nil {
-		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
-	}
-
 	return err
 }
 
@@ -624,6 +696,41 @@ func (l *L1L2BatchOrca) GetE(req common.GetRequest) error {
 func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 	//log.Println("gat", string(req.Key))
 
+	req.Exptime = l.opts.hardExptime(req.Exptime)
+
+	// Concurrent GATs for the same key and TTL share a single round of L2 and
+	// L1 operations.
+	key := flightKey{key: string(req.Key), exptime: req.Exptime}
+	eres, shared, err := l.flights.gat.do(key, func() (common.GetEResponse, error) {
+		return l.gatL2(req)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if shared {
+		metrics.IncCounter(MetricCmdGatCoalesced)
+		if eres.Miss {
+			metrics.IncCounter(MetricCmdGatMisses)
+		} else {
+			metrics.IncCounter(MetricCmdGatHits)
+		}
+	}
+
+	return l.res.GAT(common.GetResponse{
+		Key:    req.Key,
+		Data:   eres.Data,
+		Opaque: req.Opaque,
+		Flags:  eres.Flags,
+		Miss:   eres.Miss,
+		Quiet:  req.Quiet,
+	})
+}
+
+// gatL2 does the work of a GAT: a GAT in L2 and a touch of any hot data in L1.
+// It is run once per coalesced flight.
+func (l *L1L2BatchOrca) gatL2(req common.GATRequest) (common.GetEResponse, error) {
 	// Perform L2 for correctness, invalidate in L1 later
 	metrics.IncCounter(MetricCmdGatL2)
 	start := timer.Now()
@@ -643,7 +750,7 @@ func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 	if err != nil {
 		metrics.IncCounter(MetricCmdGatErrorsL2)
 		metrics.IncCounter(MetricCmdGatErrors)
-		return err
+		return common.GetEResponse{}, err
 	}
 
 	if res.Miss {
@@ -677,7 +784,7 @@ func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 			} else {
 				metrics.IncCounter(MetricCmdGatTouchErrorsL1)
 				metrics.IncCounter(MetricCmdGatErrors)
-				return err
+				return common.GetEResponse{}, err
 			}
 		} else {
 			metrics.IncCounter(MetricCmdGatTouchHitsL1)
@@ -687,7 +794,12 @@ func (l *L1L2BatchOrca) Gat(req common.GATRequest) error {
 		metrics.IncCounter(MetricCmdGatHits)
 	}
 
-	return l.res.GAT(res)
+	return common.GetEResponse{
+		Key:   res.Key,
+		Data:  res.Data,
+		Flags: res.Flags,
+		Miss:  res.Miss,
+	}, nil
 }
 
 func (l *L1L2BatchOrca) Noop(req common.NoopRequest) error {
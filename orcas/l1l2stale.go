@@ -0,0 +1,304 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+const (
+	// memcached treats any exptime over 30 days as an absolute unix timestamp
+	maxRelativeExptime = 60 * 60 * 24 * 30
+
+	defaultRefreshLease     = 10
+	defaultEarlyRefreshBeta = 1.0
+
+	// How many leases are handed out between sweeps of expired leases
+	leaseSweepInterval = 1024
+)
+
+func (o L1L2Opts) tracksFreshness() bool {
+	return o.StaleGrace > 0 || o.EarlyRefreshDelta > 0
+}
+
+// hardExptime extends the exptime a client asked for by the grace window so the
+// item outlives its soft TTL. A relative exptime pushed past the 30 day limit
+// would be read as an absolute time in 1970, so it is made absolute first.
+func (o L1L2Opts) hardExptime(exptime uint32) uint32 {
+	if o.StaleGrace == 0 || exptime == 0 {
+		return exptime
+	}
+
+	if exptime <= maxRelativeExptime && exptime+o.StaleGrace > maxRelativeExptime {
+		return uint32(time.Now().Unix()) + exptime + o.StaleGrace
+	}
+
+	return exptime + o.StaleGrace
+}
+
+// remainingTTL turns the exptime reported by GetE into the number of seconds
+// left. The bool is false for items that never expire.
+func remainingTTL(exptime uint32) (uint32, bool) {
+	if exptime == 0 {
+		return 0, false
+	}
+
+	if exptime > maxRelativeExptime {
+		now := uint32(time.Now().Unix())
+		if exptime <= now {
+			return 0, true
+		}
+		return exptime - now, true
+	}
+
+	return exptime, true
+}
+
+// freshness decides whether a hit is stale and whether the client getting it
+// should be the one to refresh it.
+func (o L1L2Opts) freshness(key []byte, exptime uint32) (stale, refresh bool) {
+	remaining, expires := remainingTTL(exptime)
+	if !expires {
+		return false, false
+	}
+
+	if remaining <= o.StaleGrace {
+		return true, refreshLeases.acquire(key, o.refreshLease())
+	}
+
+	if o.EarlyRefreshDelta <= 0 {
+		return false, false
+	}
+
+	// XFetch: refresh early with a probability that rises as expiration nears.
+	// 1 - rand.Float64() is in (0, 1] so the log is always finite.
+	beta := o.EarlyRefreshBeta
+	if beta <= 0 {
+		beta = defaultEarlyRefreshBeta
+	}
+
+	soft := float64(remaining - o.StaleGrace)
+	if -o.EarlyRefreshDelta*beta*math.Log(1-rand.Float64()) < soft {
+		return false, false
+	}
+
+	if refreshLeases.acquire(key, o.refreshLease()) {
+		metrics.IncCounter(MetricCmdGetEarlyRefresh)
+		return false, true
+	}
+
+	return false, false
+}
+
+func (o L1L2Opts) refreshLease() time.Duration {
+	if o.RefreshLease == 0 {
+		return defaultRefreshLease * time.Second
+	}
+	return time.Duration(o.RefreshLease) * time.Second
+}
+
+// refreshLeases is package level so only one client across all connections is
+// told to refresh a given item at a time.
+var refreshLeases = &leaseTable{
+	leases: make(map[string]int64),
+}
+
+// leaseTable tracks which keys have a client refreshing them and until when.
+type leaseTable struct {
+	lock   sync.Mutex
+	leases map[string]int64
+	grants int
+}
+
+// acquire returns true if nobody holds an unexpired lease on the key, in which
+// case the caller now holds it for the given duration.
+func (t *leaseTable) acquire(key []byte, dur time.Duration) bool {
+	now := time.Now().UnixNano()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if until, ok := t.leases[string(key)]; ok && until > now {
+		return false
+	}
+
+	// Leases for keys that are never set again would otherwise stay forever
+	t.grants++
+	if t.grants%leaseSweepInterval == 0 {
+		for k, until := range t.leases {
+			if until <= now {
+				delete(t.leases, k)
+			}
+		}
+	}
+
+	t.leases[string(key)] = now + int64(dur)
+	return true
+}
+
+func (t *leaseTable) release(key []byte) {
+	t.lock.Lock()
+	delete(t.leases, string(key))
+	t.lock.Unlock()
+}
+
+// respondFresh sends a hit or miss back to the client, marked stale and/or
+// refresh as needed.
+func (l *L1L2Orca) respondFresh(res common.GetEResponse) {
+	gres := common.GetResponse{
+		Key:    res.Key,
+		Flags:  res.Flags,
+		Data:   res.Data,
+		Miss:   res.Miss,
+		Opaque: res.Opaque,
+		Quiet:  res.Quiet,
+	}
+
+	if !res.Miss {
+		gres.Stale, gres.Refresh = l.opts.freshness(res.Key, res.Exptime)
+
+		if gres.Stale {
+			metrics.IncCounter(MetricCmdGetStale)
+		}
+		if gres.Refresh {
+			metrics.IncCounter(MetricCmdGetRefreshSignals)
+		}
+	}
+
+	l.res.Get(gres)
+}
+
+var noL1GetEWarning sync.Once
+
+// noL1GetE switches the orca to plain gets once L1 turns out not to support GetE.
+// Hits are then served without being marked stale or refresh.
+func (l *L1L2Orca) noL1GetE(req common.GetRequest) error {
+	noL1GetEWarning.Do(func() {
+		log.Println("L1 doesn't support GetE, serving gets without stale or refresh marks")
+	})
+	l.l1NoGetE = true
+	return l.Get(req)
+}
+
+// getWithFreshness is Get for stale-while-revalidate and early refresh. It is
+// the same dance as Get, except L1 is read with GetE so the remaining TTL of
+// every hit is known.
+func (l *L1L2Orca) getWithFreshness(req common.GetRequest) error {
+	resChan, errChan := l.l1.GetE(req)
+	if resChan == nil {
+		return l.noL1GetE(req)
+	}
+
+	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
+
+	metrics.IncCounter(MetricCmdGetEL1)
+	metrics.IncCounterBy(MetricCmdGetEKeysL1, uint64(len(req.Keys)))
+	start := timer.Now()
+
+	var responded bool
+	var err error
+	var l2keys [][]byte
+	var l2opaques []uint32
+	var l2quiets []bool
+
+	for {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				if res.Miss {
+					metrics.IncCounter(MetricCmdGetEMissesL1)
+					l2keys = append(l2keys, res.Key)
+					l2opaques = append(l2opaques, res.Opaque)
+					l2quiets = append(l2quiets, res.Quiet)
+				} else {
+					metrics.IncCounter(MetricCmdGetHits)
+					metrics.IncCounter(MetricCmdGetEHitsL1)
+					l.respondFresh(res)
+					responded = true
+				}
+			}
+
+		case getErr, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				metrics.IncCounter(MetricCmdGetErrors)
+				metrics.IncCounter(MetricCmdGetEErrorsL1)
+				err = getErr
+			}
+		}
+
+		if resChan == nil && errChan == nil {
+			break
+		}
+	}
+
+	metrics.ObserveHist(HistGetEL1, timer.Since(start))
+
+	// Nothing has been sent yet, so the whole get can start over without GetE
+	if (err == common.ErrNotSupported || err == common.ErrUnknownCmd) && !responded {
+		return l.noL1GetE(req)
+	}
+
+	if len(l2keys) == 0 {
+		if err != nil {
+			return err
+		}
+		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+
+	req = common.GetRequest{
+		Keys:       l2keys,
+		NoopEnd:    req.NoopEnd,
+		NoopOpaque: req.NoopOpaque,
+		Opaques:    l2opaques,
+		Quiet:      l2quiets,
+	}
+
+	l2err := l.flights.get.get(req, l.getL2, func(res common.GetEResponse, shared bool) {
+		if shared {
+			metrics.IncCounter(MetricCmdGetCoalesced)
+		}
+
+		if res.Miss {
+			metrics.IncCounter(MetricCmdGetMisses)
+		} else {
+			metrics.IncCounter(MetricCmdGetHits)
+		}
+
+		l.respondFresh(res)
+	})
+
+	if l2err != nil {
+		metrics.IncCounter(MetricCmdGetErrors)
+		err = l2err
+	}
+
+	if err == nil {
+		return l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+	}
+
+	return err
+}
@@ -0,0 +1,229 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/binprot"
+)
+
+// ttlHandler hits on every GetE with a fixed remaining TTL and records the
+// exptime of the last set.
+type ttlHandler struct {
+	testHandler
+	exptime    uint32
+	setExptime uint32
+}
+
+func (h *ttlHandler) Set(cmd common.SetRequest) error {
+	h.setExptime = cmd.Exptime
+	return nil
+}
+func (h *ttlHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	reschan := make(chan common.GetEResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		reschan <- common.GetEResponse{
+			Key:     key,
+			Opaque:  cmd.Opaques[idx],
+			Quiet:   cmd.Quiet[idx],
+			Data:    []byte("foo"),
+			Exptime: h.exptime,
+		}
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+
+// noGetEHandler is an L1 like a stock memcached, which answers GetE with
+// ErrUnknownCmd and Get with a hit.
+type noGetEHandler struct {
+	testHandler
+}
+
+func (h *noGetEHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	reschan := make(chan common.GetResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		reschan <- common.GetResponse{
+			Key:    key,
+			Opaque: cmd.Opaques[idx],
+			Quiet:  cmd.Quiet[idx],
+			Data:   []byte("foo"),
+		}
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+func (h *noGetEHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	reschan := make(chan common.GetEResponse)
+	close(reschan)
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	close(errchan)
+	return reschan, errchan
+}
+
+// Refresh leases are shared by every orca in the package, so each test uses
+// keys of its own.
+var keySeq int32
+
+func uniqueKey(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, atomic.AddInt32(&keySeq, 1))
+}
+
+// getStatus runs a single key get through the orca and returns the extras
+// length and status word of the binary response.
+func getStatus(t *testing.T, oc orcas.OrcaConst, h1, h2 *ttlHandler, key string) (uint8, uint32) {
+	output := &bytes.Buffer{}
+	l1l2 := oc(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(output)))
+
+	err := l1l2.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+
+	out := output.Bytes()
+	extlen := out[4]
+	if extlen == 8 {
+		return extlen, binary.BigEndian.Uint32(out[28:32])
+	}
+	return extlen, 0
+}
+
+func TestL1L2OrcaStale(t *testing.T) {
+	t.Run("SetExtendsTTL", func(t *testing.T) {
+		h1 := &ttlHandler{}
+		h2 := &ttlHandler{}
+		l1l2 := orcas.L1L2WithOpts(orcas.L1L2Opts{StaleGrace: 30})(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(&bytes.Buffer{})))
+
+		err := l1l2.Set(common.SetRequest{
+			Key:     []byte("stale-set"),
+			Exptime: 100,
+			Data:    []byte("foo"),
+		})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		if h1.setExptime != 130 || h2.setExptime != 130 {
+			t.Fatalf("Expected exptime 130 in both layers, got %d and %d", h1.setExptime, h2.setExptime)
+		}
+	})
+	t.Run("BatchSetExtendsTTL", func(t *testing.T) {
+		h1 := &ttlHandler{testHandler: testHandler{errors: []error{common.ErrKeyNotFound}}}
+		h2 := &ttlHandler{}
+		batch := orcas.L1L2BatchWithOpts(orcas.L1L2Opts{StaleGrace: 30})(h1, h2, binprot.NewBinaryResponder(bufio.NewWriter(&bytes.Buffer{})))
+
+		err := batch.Set(common.SetRequest{
+			Key:     []byte("stale-batch-set"),
+			Exptime: 100,
+			Data:    []byte("foo"),
+		})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		if h2.setExptime != 130 {
+			t.Fatalf("Expected exptime 130 in L2, got %d", h2.setExptime)
+		}
+	})
+	t.Run("NoL1GetE", func(t *testing.T) {
+		output := &bytes.Buffer{}
+		l1l2 := orcas.L1L2WithOpts(orcas.L1L2Opts{StaleGrace: 30})(&noGetEHandler{}, &ttlHandler{}, binprot.NewBinaryResponder(bufio.NewWriter(output)))
+
+		for i := 0; i < 2; i++ {
+			output.Reset()
+			err := l1l2.Get(common.GetRequest{
+				Keys:    [][]byte{[]byte("stale-nogete")},
+				Opaques: []uint32{0},
+				Quiet:   []bool{false},
+			})
+			if err != nil {
+				t.Fatalf("Expected a get without GetE in L1 to be served, got %v", err)
+			}
+
+			out := output.Bytes()
+			if len(out) < binprot.ReqHeaderLen || out[4] != 4 {
+				t.Fatalf("Expected a plain hit, got %v", out)
+			}
+		}
+	})
+	t.Run("Fresh", func(t *testing.T) {
+		oc := orcas.L1L2WithOpts(orcas.L1L2Opts{StaleGrace: 30})
+		h1 := &ttlHandler{exptime: 100}
+
+		extlen, _ := getStatus(t, oc, h1, &ttlHandler{}, "stale-fresh")
+		if extlen != 4 {
+			t.Fatalf("Expected plain 4 byte extras for a fresh item, got %d", extlen)
+		}
+	})
+	t.Run("StaleSingleRefresh", func(t *testing.T) {
+		oc := orcas.L1L2WithOpts(orcas.L1L2Opts{StaleGrace: 30})
+		h1 := &ttlHandler{exptime: 10}
+		key := uniqueKey("stale-refresh")
+
+		extlen, status := getStatus(t, oc, h1, &ttlHandler{}, key)
+		if extlen != 8 || status != binprot.GetStatusStale|binprot.GetStatusRefresh {
+			t.Fatalf("Expected the first stale hit to be told to refresh, got extras %d status %x", extlen, status)
+		}
+
+		for i := 0; i < 5; i++ {
+			extlen, status = getStatus(t, oc, h1, &ttlHandler{}, key)
+			if extlen != 8 || status != binprot.GetStatusStale {
+				t.Fatalf("Expected later stale hits to not refresh, got extras %d status %x", extlen, status)
+			}
+		}
+
+		// A set ends the refresh, so the next stale hit is told to refresh again
+		l1l2 := oc(h1, &ttlHandler{}, binprot.NewBinaryResponder(bufio.NewWriter(&bytes.Buffer{})))
+		l1l2.Set(common.SetRequest{Key: []byte(key), Exptime: 100})
+
+		_, status = getStatus(t, oc, h1, &ttlHandler{}, key)
+		if status != binprot.GetStatusStale|binprot.GetStatusRefresh {
+			t.Fatalf("Expected a refresh after the set, got status %x", status)
+		}
+	})
+	t.Run("EarlyRefresh", func(t *testing.T) {
+		// A delta far larger than the remaining TTL makes early refresh a certainty
+		oc := orcas.L1L2WithOpts(orcas.L1L2Opts{EarlyRefreshDelta: 1e9})
+		h1 := &ttlHandler{exptime: 100}
+		key := uniqueKey("stale-early")
+
+		extlen, status := getStatus(t, oc, h1, &ttlHandler{}, key)
+		if extlen != 8 || status != binprot.GetStatusRefresh {
+			t.Fatalf("Expected an early refresh of a fresh item, got extras %d status %x", extlen, status)
+		}
+
+		_, status = getStatus(t, oc, h1, &ttlHandler{}, key)
+		if status != 0 {
+			t.Fatalf("Expected only one early refresh, got status %x", status)
+		}
+	})
+}
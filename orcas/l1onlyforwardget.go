@@ -19,127 +19,132 @@ import (
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/metrics"
 	"github.com/netflix/rend/protocol"
-	"github.com/netflix/rend/timer"
 )
 
+// ForwardGetOpts configures the forwarding orca.
+type ForwardGetOpts struct {
+	// ReadOnly rejects every command that would change data with
+	// common.ErrNotSupported instead of forwarding it. Gat counts as a write
+	// since it changes the TTL.
+	ReadOnly bool
+}
+
 type L1OnlyForwardGetOrca struct {
-	l1  handlers.Handler
-	res protocol.Responder
+	wrapped Orca
+	opts    ForwardGetOpts
 }
 
+// L1OnlyForwardGet forwards every command to the L1 handler as is, with the
+// handler's real responses. It is L1Only under the name the forwarding proxy
+// mode has always used.
 func L1OnlyForwardGet(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-	return &L1OnlyForwardGetOrca{
-		l1:  l1,
-		res: res,
+	return L1OnlyForwardGetWithOpts(ForwardGetOpts{})(l1, l2, res)
+}
+
+// L1OnlyForwardGetWithOpts returns an OrcaConst for a forwarding orca with the
+// given options.
+func L1OnlyForwardGetWithOpts(opts ForwardGetOpts) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &L1OnlyForwardGetOrca{
+			wrapped: L1Only(l1, nil, res),
+			opts:    opts,
+		}
 	}
 }
 
-func (l *L1OnlyForwardGetOrca) Set(req common.SetRequest) error {
-	// We don't care of SET, we just swallow them and return a success
-	l.res.Set(req.Opaque, req.Quiet)
+// write reports whether a command that changes data may be forwarded.
+func (l *L1OnlyForwardGetOrca) write() error {
+	if l.opts.ReadOnly {
+		metrics.IncCounter(MetricForwardReadOnlyRejected)
+		return common.ErrNotSupported
+	}
 	return nil
 }
 
+func (l *L1OnlyForwardGetOrca) Set(req common.SetRequest) error {
+	if err := l.write(); err != nil {
+		return err
+	}
+	return l.wrapped.Set(req)
+}
+
+func (l *L1OnlyForwardGetOrca) Add(req common.SetRequest) error {
+	if err := l.write(); err != nil {
+		return err
+	}
+	return l.wrapped.Add(req)
+}
 
-func (l *L1OnlyForwardGetOrca) Get(req common.GetRequest) error {
-	metrics.IncCounterBy(MetricCmdGetKeys, uint64(len(req.Keys)))
-	//debugString := "get"
-	//for _, k := range req.Keys {
-	//	debugString += " "
-	//	debugString += string(k)
-	//}
-	//println(debugString)
-
-	metrics.IncCounter(MetricCmdGetL1)
-	metrics.IncCounterBy(MetricCmdGetKeysL1, uint64(len(req.Keys)))
-	start := timer.Now()
-
-	resChan, errChan := l.l1.Get(req)
-
-	var err error
-
-	// Read all the responses back from l.l1.
-	// The contract is that the resChan will have GetResponse's for get hits and misses,
-	// and the errChan will have any other errors, such as an out of memory error from
-	// memcached. If any receive happens from errChan, there will be no more responses
-	// from resChan.
-	for {
-		select {
-		case res, ok := <-resChan:
-			if !ok {
-				resChan = nil
-			} else {
-				if res.Miss {
-					metrics.IncCounter(MetricCmdGetMissesL1)
-					metrics.IncCounter(MetricCmdGetMisses)
-				} else {
-					metrics.IncCounter(MetricCmdGetHits)
-					metrics.IncCounter(MetricCmdGetHitsL1)
-				}
-				l.res.Get(res)
-			}
-
-		case getErr, ok := <-errChan:
-			if !ok {
-				errChan = nil
-			} else {
-				metrics.IncCounter(MetricCmdGetErrors)
-				metrics.IncCounter(MetricCmdGetErrorsL1)
-				err = getErr
-			}
-		}
+func (l *L1OnlyForwardGetOrca) Replace(req common.SetRequest) error {
+	if err := l.write(); err != nil {
+		return err
+	}
+	return l.wrapped.Replace(req)
+}
 
-		if resChan == nil && errChan == nil {
-			break
-		}
+func (l *L1OnlyForwardGetOrca) Append(req common.SetRequest) error {
+	if err := l.write(); err != nil {
+		return err
 	}
+	return l.wrapped.Append(req)
+}
 
-	metrics.ObserveHist(HistGetL1, timer.Since(start))
+func (l *L1OnlyForwardGetOrca) Prepend(req common.SetRequest) error {
+	if err := l.write(); err != nil {
+		return err
+	}
+	return l.wrapped.Prepend(req)
+}
+
+func (l *L1OnlyForwardGetOrca) Delete(req common.DeleteRequest) error {
+	if err := l.write(); err != nil {
+		return err
+	}
+	return l.wrapped.Delete(req)
+}
+
+func (l *L1OnlyForwardGetOrca) Touch(req common.TouchRequest) error {
+	if err := l.write(); err != nil {
+		return err
+	}
+	return l.wrapped.Touch(req)
+}
 
-	if err == nil {
-		l.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+func (l *L1OnlyForwardGetOrca) Gat(req common.GATRequest) error {
+	if err := l.write(); err != nil {
+		return err
 	}
+	return l.wrapped.Gat(req)
+}
 
-	return err
+func (l *L1OnlyForwardGetOrca) Get(req common.GetRequest) error {
+	return l.wrapped.Get(req)
+}
+
+func (l *L1OnlyForwardGetOrca) GetE(req common.GetRequest) error {
+	return l.wrapped.GetE(req)
 }
 
 func (l *L1OnlyForwardGetOrca) Noop(req common.NoopRequest) error {
-	return l.res.Noop(req.Opaque)
+	return l.wrapped.Noop(req)
 }
 
 func (l *L1OnlyForwardGetOrca) Quit(req common.QuitRequest) error {
-	return l.res.Quit(req.Opaque, req.Quiet)
+	return l.wrapped.Quit(req)
 }
 
 func (l *L1OnlyForwardGetOrca) Version(req common.VersionRequest) error {
-	return l.res.Version(req.Opaque)
+	return l.wrapped.Version(req)
 }
 
 func (l *L1OnlyForwardGetOrca) Unknown(req common.Request) error {
-	return common.ErrUnknownCmd
+	return l.wrapped.Unknown(req)
 }
 
 func (l *L1OnlyForwardGetOrca) Error(req common.Request, reqType common.RequestType, err error) {
-	var opaque uint32
-	var quiet bool
-
-	if req != nil {
-		opaque = req.GetOpaque()
-		quiet = req.IsQuiet()
-	}
-
-	l.res.Error(opaque, reqType, err, quiet)
+	l.wrapped.Error(req, reqType, err)
 }
 
-func (l *L1OnlyForwardGetOrca) Add(req common.SetRequest) error                                 { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) Replace(req common.SetRequest) error                             { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) Append(req common.SetRequest) error                              { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) Prepend(req common.SetRequest) error                             { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) Delete(req common.DeleteRequest) error                           { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) Touch(req common.TouchRequest) error                             { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) GetE(req common.GetRequest) error                                { return common.ErrNoError }
-func (l *L1OnlyForwardGetOrca) Gat(req common.GATRequest) error                                 { return common.ErrNoError }
-
 func (l *L1OnlyForwardGetOrca) Stat(req common.StatRequest) error {
-	return l.res.Stat(req.Opaque)
-}
\ No newline at end of file
+	return l.wrapped.Stat(req)
+}
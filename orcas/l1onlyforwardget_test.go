@@ -0,0 +1,63 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestL1OnlyForwardGetOrca(t *testing.T) {
+	t.Run("Forward", func(t *testing.T) {
+		h := newMapHandler()
+		output := &bytes.Buffer{}
+		o := orcas.L1OnlyForwardGet(h, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		if err := o.Add(common.SetRequest{Key: []byte("forward"), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := o.Add(common.SetRequest{Key: []byte("forward"), Data: []byte("foo")}); err != common.ErrKeyExists {
+			t.Fatalf("Expected the handler's ErrKeyExists, got %v", err)
+		}
+
+		gold := "VALUE forward 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "forward"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("ReadOnly", func(t *testing.T) {
+		h := newMapHandler()
+		h.data["forward"] = "foo"
+		output := &bytes.Buffer{}
+		o := orcas.L1OnlyForwardGetWithOpts(orcas.ForwardGetOpts{ReadOnly: true})(h, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		if err := o.Set(common.SetRequest{Key: []byte("forward"), Data: []byte("bar")}); err != common.ErrNotSupported {
+			t.Fatalf("Expected ErrNotSupported, got %v", err)
+		}
+		if err := o.Delete(common.DeleteRequest{Key: []byte("forward")}); err != common.ErrNotSupported {
+			t.Fatalf("Expected ErrNotSupported, got %v", err)
+		}
+
+		gold := "VALUE forward 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "forward"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+}
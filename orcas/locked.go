@@ -15,57 +15,14 @@
 package orcas
 
 import (
-	"hash"
-	"hash/fnv"
-	"sync"
-	"sync/atomic"
-
 	"github.com/netflix/rend/common"
 	"github.com/netflix/rend/handlers"
 	"github.com/netflix/rend/protocol"
 )
 
-const maxLockSets = 1024
-
-var (
-	locks   = make([][]sync.Locker, maxLockSets)
-	rlocks  = make([][]sync.Locker, maxLockSets)
-	curslot uint32
-)
-
-func getNewLocks(multipleReaders bool, concurrency uint8) (slot uint32) {
-	slot = atomic.AddUint32(&curslot, 1)
-
-	if slot > maxLockSets {
-		panic("Too many lock sets!")
-	}
-
-	locks[slot] = make([]sync.Locker, 1<<concurrency)
-	rlocks[slot] = make([]sync.Locker, 1<<concurrency)
-
-	if multipleReaders {
-		for idx := range locks[slot] {
-			temp := &sync.RWMutex{}
-			locks[slot][idx] = temp
-			rlocks[slot][idx] = temp.RLocker()
-		}
-	} else {
-		for idx := range locks[slot] {
-			temp := &sync.Mutex{}
-			locks[slot][idx] = temp
-			rlocks[slot][idx] = temp
-		}
-	}
-
-	return
-}
-
 type LockedOrca struct {
 	wrapped Orca
-	locks   []sync.Locker
-	rlocks  []sync.Locker
-	hpool   *sync.Pool
-	//counts  []uint32
+	locks   *lockSet
 }
 
 // Locking wraps an orcas.Orca to provide locking around operations on the same
@@ -75,212 +32,107 @@ type LockedOrca struct {
 // parallel. E.g. concurrency of 1 would allow 2 parallel operations, while a
 // concurrency of 4 allows 2^4 = 16 parallel operations.
 func Locked(oc OrcaConst, multipleReaders bool, concurrency uint8) (OrcaConst, uint32) {
-	if concurrency < 0 {
-		panic("Concurrency level must be at least 0")
-	}
-
-	slot := getNewLocks(multipleReaders, concurrency)
-
-	//counts := make([]uint32, 1<<concurrency)
-
-	hashpool := &sync.Pool{
-		New: func() interface{} {
-			return fnv.New32a()
-		},
-	}
+	return LockedWithOpts(oc, LockOpts{
+		MultipleReaders: multipleReaders,
+		Concurrency:     concurrency,
+	})
+}
 
-	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
-		return &LockedOrca{
-			wrapped: oc(l1, l2, res),
-			locks:   locks[slot],
-			rlocks:  rlocks[slot],
-			hpool:   hashpool,
-			//counts:  counts,
-		}
-	}, slot
+// LockedWithOpts is Locked with the full set of lock options, including
+// per-key locks and acquisition timeouts. The returned lock set id can be used
+// to share the locks or to resize them later with ResizeLocks.
+func LockedWithOpts(oc OrcaConst, opts LockOpts) (OrcaConst, uint32) {
+	slot := getNewLocks(opts)
+	return LockedWithExisting(oc, slot), slot
 }
 
 func LockedWithExisting(oc OrcaConst, locksetID uint32) OrcaConst {
-	if cur := atomic.LoadUint32(&curslot); cur < locksetID {
-		panic("Asked for lock set that does not exist!")
-	}
-
-	hashpool := &sync.Pool{
-		New: func() interface{} {
-			return fnv.New32a()
-		},
-	}
+	ls := getLocks(locksetID)
 
 	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
 		return &LockedOrca{
 			wrapped: oc(l1, l2, res),
-			locks:   locks[locksetID],
-			rlocks:  rlocks[locksetID],
-			hpool:   hashpool,
+			locks:   ls,
 		}
 	}
 }
 
-//var numops uint64 = 0
-
-func (l *LockedOrca) getlock(key []byte, read bool) sync.Locker {
-	h := l.hpool.Get().(hash.Hash32)
-	defer l.hpool.Put(h)
-	h.Reset()
-
-	// Calculate bucket using hash and mod. hash.Hash.Write() never returns an error.
-	h.Write(key)
-	bucket := int(h.Sum32())
-	bucket &= len(l.locks) - 1
-
-	//atomic.AddUint32(&l.counts[bucket], 1)
-
-	//if (atomic.AddUint64(&numops, 1) % 10000) == 0 {
-	//	for idx, count := range l.counts {
-	//		fmt.Printf("%d: %d\n", idx, count)
-	//	}
-	//}
-
-	if read {
-		return l.rlocks[bucket]
-	}
-
-	return l.locks[bucket]
-}
-
 func (l *LockedOrca) Set(req common.SetRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Set(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Set(req)
 }
 
 func (l *LockedOrca) Add(req common.SetRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Add(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Add(req)
 }
 
 func (l *LockedOrca) Replace(req common.SetRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Replace(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Replace(req)
 }
 
 func (l *LockedOrca) Append(req common.SetRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Append(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Append(req)
 }
 
 func (l *LockedOrca) Prepend(req common.SetRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Prepend(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Prepend(req)
 }
 
 func (l *LockedOrca) Delete(req common.DeleteRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Delete(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Delete(req)
 }
 
 func (l *LockedOrca) Touch(req common.TouchRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Touch(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Touch(req)
 }
 
 func (l *LockedOrca) Get(req common.GetRequest) error {
-	// Lock for each read key, complete the read, and then move on.
-	// The last key sent through should have a noop at the end to complete the
-	// whole interaction between the client and this server.
-	var ret error
-	var lock sync.Locker
-
-	// guarantee that an operation that failed with a panic will unlock its lock
-	defer func() {
-		if r := recover(); r != nil {
-			if lock != nil {
-				lock.Unlock()
-			}
-		}
-	}()
-
-	for idx, key := range req.Keys {
-		// Acquire read lock (true == read)
-		lock = l.getlock(key, true)
-		lock.Lock()
-
-		// The last request will have these set to complete the interaction
-		noopOpaque := uint32(0)
-		noopEnd := false
-		if idx == len(req.Keys)-1 {
-			noopOpaque = req.NoopOpaque
-			noopEnd = req.NoopEnd
-		}
-
-		subreq := common.GetRequest{
-			Keys:       [][]byte{key},
-			Opaques:    []uint32{req.Opaques[idx]},
-			Quiet:      []bool{req.Quiet[idx]},
-			NoopOpaque: noopOpaque,
-			NoopEnd:    noopEnd,
-		}
-
-		// Make the actual request
-		ret = l.wrapped.Get(subreq)
-
-		// release read lock
-		lock.Unlock()
-
-		// Bail out early if there was an error (misses are not errors in this sense)
-		// This will probably end up breaking the connection anyway, so no worries
-		// about leaving the gets half-done.
-		if ret != nil {
-			break
-		}
-	}
-
-	return ret
+	return l.eachKey(req, l.wrapped.Get)
 }
 
 func (l *LockedOrca) GetE(req common.GetRequest) error {
-	// Lock for each read key, complete the read, and then move on.
-	// The last key sent through should have a noop at the end to complete the
-	// whole interaction between the client and this server.
-	var ret error
-	var lock sync.Locker
-
-	// guarantee that an operation that failed with a panic will unlock its lock
-	defer func() {
-		if r := recover(); r != nil {
-			if lock != nil {
-				lock.Unlock()
-			}
-
-			panic(r)
-		}
-	}()
+	return l.eachKey(req, l.wrapped.GetE)
+}
 
+// eachKey locks for each read key, completes the read, and then moves on.
+// The last key sent through should have a noop at the end to complete the
+// whole interaction between the client and this server.
+func (l *LockedOrca) eachKey(req common.GetRequest, get func(common.GetRequest) error) error {
 	for idx, key := range req.Keys {
-		// Acquire read lock (true == read)
-		lock = l.getlock(key, true)
-		lock.Lock()
-
 		// The last request will have these set to complete the interaction
 		noopOpaque := uint32(0)
 		noopEnd := false
@@ -297,29 +149,36 @@ func (l *LockedOrca) GetE(req common.GetRequest) error {
 			NoopEnd:    noopEnd,
 		}
 
-		// Make the actual request
-		ret = l.wrapped.GetE(subreq)
-
-		// release read lock
-		lock.Unlock()
+		// Acquire read lock (true == read) and make the actual request. The
+		// deferred unlock guarantees that an operation that failed with a panic
+		// will unlock its lock.
+		err := func() error {
+			lock, err := l.locks.lock(key, true)
+			if err != nil {
+				return err
+			}
+			defer lock.unlock()
+			return get(subreq)
+		}()
 
 		// Bail out early if there was an error (misses are not errors in this sense)
 		// This will probably end up breaking the connection anyway, so no worries
 		// about leaving the gets half-done.
-		if ret != nil {
-			break
+		if err != nil {
+			return err
 		}
 	}
 
-	return ret
+	return nil
 }
 
 func (l *LockedOrca) Gat(req common.GATRequest) error {
-	lock := l.getlock(req.Key, false)
-	lock.Lock()
-	defer lock.Unlock()
-	ret := l.wrapped.Gat(req)
-	return ret
+	lock, err := l.locks.lock(req.Key, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return l.wrapped.Gat(req)
 }
 
 func (l *LockedOrca) Noop(req common.NoopRequest) error {
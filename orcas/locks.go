@@ -0,0 +1,506 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// keyLock is a reader/writer lock whose acquisition can time out. Writers that
+// are waiting keep new readers out so they aren't starved.
+type keyLock struct {
+	mu             sync.Mutex
+	readers        int
+	writer         bool
+	writersWaiting int
+	wake           chan struct{}
+
+	// Only used by the per-key table, under its shard lock
+	refs int
+}
+
+// lock acquires the lock, giving up when the deadline fires. A nil deadline
+// waits forever. It reports whether it had to wait and whether it got the lock.
+func (l *keyLock) lock(read bool, deadline <-chan time.Time) (contended, ok bool) {
+	waiting := false
+
+	for {
+		l.mu.Lock()
+
+		if !l.writer && ((read && l.writersWaiting == 0) || (!read && l.readers == 0)) {
+			if read {
+				l.readers++
+			} else {
+				if waiting {
+					l.writersWaiting--
+				}
+				l.writer = true
+			}
+			l.mu.Unlock()
+			return contended, true
+		}
+
+		if !read && !waiting {
+			l.writersWaiting++
+			waiting = true
+		}
+		if l.wake == nil {
+			l.wake = make(chan struct{})
+		}
+		wake := l.wake
+
+		l.mu.Unlock()
+		contended = true
+
+		select {
+		case <-wake:
+		case <-deadline:
+			if waiting {
+				// Readers held back for this writer may go now
+				l.mu.Lock()
+				l.writersWaiting--
+				l.broadcast()
+				l.mu.Unlock()
+			}
+			return true, false
+		}
+	}
+}
+
+func (l *keyLock) unlock(read bool) {
+	l.mu.Lock()
+	if read {
+		l.readers--
+	} else {
+		l.writer = false
+	}
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+// broadcast wakes every waiter. Must be called with l.mu held.
+func (l *keyLock) broadcast() {
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// lockTable maps keys to locks. Every get must be followed by a put once the
+// lock is no longer needed.
+type lockTable interface {
+	get(key []byte) *keyLock
+	put(key []byte, l *keyLock)
+}
+
+func fnv32a(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h
+}
+
+// stripedTable hashes keys onto a fixed number of locks, so unrelated keys can
+// share a lock.
+type stripedTable struct {
+	locks []*keyLock
+}
+
+func newStripedTable(concurrency uint8) *stripedTable {
+	t := &stripedTable{locks: make([]*keyLock, 1<<concurrency)}
+	for i := range t.locks {
+		t.locks[i] = &keyLock{}
+	}
+	return t
+}
+
+func (t *stripedTable) get(key []byte) *keyLock {
+	return t.locks[int(fnv32a(key))&(len(t.locks)-1)]
+}
+
+func (t *stripedTable) put(key []byte, l *keyLock) {}
+
+const perKeyShards = 256
+
+// perKeyTable has a lock for every key in use, so operations only ever wait on
+// the same key. Locks are dropped as soon as nobody holds or waits for them.
+type perKeyTable struct {
+	shards [perKeyShards]struct {
+		sync.Mutex
+		locks map[string]*keyLock
+	}
+}
+
+func newPerKeyTable() *perKeyTable {
+	t := &perKeyTable{}
+	for i := range t.shards {
+		t.shards[i].locks = make(map[string]*keyLock)
+	}
+	return t
+}
+
+func (t *perKeyTable) get(key []byte) *keyLock {
+	s := &t.shards[fnv32a(key)%perKeyShards]
+	s.Lock()
+	l, ok := s.locks[string(key)]
+	if !ok {
+		l = &keyLock{}
+		s.locks[string(key)] = l
+	}
+	l.refs++
+	s.Unlock()
+	return l
+}
+
+func (t *perKeyTable) put(key []byte, l *keyLock) {
+	s := &t.shards[fnv32a(key)%perKeyShards]
+	s.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(s.locks, string(key))
+	}
+	s.Unlock()
+}
+
+func (t *perKeyTable) size() int {
+	var n int
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.Lock()
+		n += len(s.locks)
+		s.Unlock()
+	}
+	return n
+}
+
+// lockGen is one configuration of a lock set's table. When the table is
+// replaced, holders of the new table also take the matching lock in the old one
+// until every operation that started on the old table is done, so two operations
+// on a key never run at once while the change is rolling out.
+type lockGen struct {
+	table lockTable
+
+	// How many operations are using this as their main table
+	direct int64
+
+	// The table this replaced, or a nil *lockGen once it has drained
+	prev atomic.Value
+}
+
+func newLockGen(t lockTable, prev *lockGen) *lockGen {
+	g := &lockGen{table: t}
+	g.prev.Store(prev)
+	return g
+}
+
+func (g *lockGen) previous() *lockGen {
+	p := g.prev.Load().(*lockGen)
+	if p != nil && atomic.LoadInt64(&p.direct) == 0 {
+		g.prev.Store((*lockGen)(nil))
+		return nil
+	}
+	return p
+}
+
+// LockOpts configures a lock set.
+type LockOpts struct {
+	// MultipleReaders allows many readers and a single writer on a key at a
+	// time, like a sync.RWMutex. Otherwise every operation is exclusive.
+	MultipleReaders bool
+
+	// Concurrency allows 2^(Concurrency) operations on different keys to happen
+	// in parallel, assuming no collisions. Ignored if PerKey is set.
+	Concurrency uint8
+
+	// PerKey gives every key its own lock instead of hashing keys onto
+	// 2^(Concurrency) shared locks.
+	PerKey bool
+
+	// TimeoutMillis is how long an operation waits for its lock before failing
+	// with common.ErrBusy. 0 waits forever.
+	TimeoutMillis uint32
+}
+
+var (
+	errLocksDraining      = errors.New("the previous lock set change is still in progress")
+	errConcurrencyTooHigh = fmt.Errorf("concurrency must be between 0 and %d", maxResizeConcurrency)
+)
+
+// maxResizeConcurrency is the most concurrency a lock set can be resized to
+// while in use. A resize allocates all 2^(concurrency) locks at once, and more
+// than 2^16 of them only eats memory.
+const maxResizeConcurrency = 16
+
+// lockSet is the locks shared by every orca (and middleware) using the same set.
+type lockSet struct {
+	id              uint32
+	multipleReaders bool
+	timeout         time.Duration
+
+	cur      atomic.Value
+	reconfig sync.Mutex
+	perKey   bool
+	stripes  int
+
+	metricAcquired  uint32
+	metricContended uint32
+	metricTimeouts  uint32
+	histWait        uint32
+}
+
+const maxLockSets = 1024
+
+var (
+	locksets [maxLockSets + 1]*lockSet
+	curslot  uint32
+)
+
+func init() {
+	http.Handle("/locks", http.HandlerFunc(serveLocks))
+}
+
+func getNewLocks(opts LockOpts) (slot uint32) {
+	slot = atomic.AddUint32(&curslot, 1)
+
+	if slot > maxLockSets {
+		panic("Too many lock sets!")
+	}
+
+	tags := metrics.Tags{"lockset": strconv.Itoa(int(slot))}
+
+	s := &lockSet{
+		id:              slot,
+		multipleReaders: opts.MultipleReaders,
+		timeout:         time.Duration(opts.TimeoutMillis) * time.Millisecond,
+
+		metricAcquired:  metrics.AddCounter("lock_acquired", tags),
+		metricContended: metrics.AddCounter("lock_contended", tags),
+		metricTimeouts:  metrics.AddCounter("lock_timeouts", tags),
+		histWait:        metrics.AddHistogram("lock_wait", false, tags),
+	}
+
+	s.cur.Store(newLockGen(s.newTable(opts.PerKey, opts.Concurrency), nil))
+
+	// 0 means per-key locks
+	metrics.RegisterIntGaugeCallback("lock_stripes", tags, func() uint64 {
+		s.reconfig.Lock()
+		defer s.reconfig.Unlock()
+		return uint64(s.stripes)
+	})
+	metrics.RegisterIntGaugeCallback("lock_table_keys", tags, func() uint64 {
+		if t, ok := s.gen().table.(*perKeyTable); ok {
+			return uint64(t.size())
+		}
+		return 0
+	})
+
+	locksets[slot] = s
+	return
+}
+
+func getLocks(locksetID uint32) *lockSet {
+	if cur := atomic.LoadUint32(&curslot); cur < locksetID || locksetID == 0 {
+		panic("Asked for lock set that does not exist!")
+	}
+	return locksets[locksetID]
+}
+
+// newTable must be called with s.reconfig held or before s is shared.
+func (s *lockSet) newTable(perKey bool, concurrency uint8) lockTable {
+	s.perKey = perKey
+	if perKey {
+		s.stripes = 0
+		return newPerKeyTable()
+	}
+	s.stripes = 1 << concurrency
+	return newStripedTable(concurrency)
+}
+
+func (s *lockSet) gen() *lockGen {
+	return s.cur.Load().(*lockGen)
+}
+
+// heldLock is a lock acquired from a lock set.
+type heldLock struct {
+	gen, prev *lockGen
+	l, pl     *keyLock
+	key       []byte
+	read      bool
+}
+
+func (h heldLock) unlock() {
+	if h.pl != nil {
+		h.pl.unlock(h.read)
+		h.prev.table.put(h.key, h.pl)
+	}
+	h.l.unlock(h.read)
+	h.gen.table.put(h.key, h.l)
+	atomic.AddInt64(&h.gen.direct, -1)
+}
+
+// lock acquires the lock for a key, or fails with common.ErrBusy if the lock
+// set's timeout passes first.
+func (s *lockSet) lock(key []byte, read bool) (heldLock, error) {
+	start := timer.Now()
+
+	if !s.multipleReaders {
+		read = false
+	}
+
+	var deadline <-chan time.Time
+	if s.timeout > 0 {
+		t := time.NewTimer(s.timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	// Register on the current table, making sure it wasn't replaced in between
+	var g *lockGen
+	for {
+		g = s.gen()
+		atomic.AddInt64(&g.direct, 1)
+		if s.gen() == g {
+			break
+		}
+		atomic.AddInt64(&g.direct, -1)
+	}
+
+	h := heldLock{gen: g, key: key, read: read}
+
+	h.l = g.table.get(key)
+	contended, ok := h.l.lock(read, deadline)
+	if !ok {
+		g.table.put(key, h.l)
+		atomic.AddInt64(&g.direct, -1)
+		return s.timedOut(start)
+	}
+
+	if p := g.previous(); p != nil {
+		pl := p.table.get(key)
+		c, ok := pl.lock(read, deadline)
+		if !ok {
+			p.table.put(key, pl)
+			h.unlock()
+			return s.timedOut(start)
+		}
+		h.prev, h.pl = p, pl
+		contended = contended || c
+	}
+
+	metrics.IncCounter(s.metricAcquired)
+	if contended {
+		metrics.IncCounter(s.metricContended)
+	}
+	metrics.ObserveHist(s.histWait, timer.Since(start))
+
+	return h, nil
+}
+
+func (s *lockSet) timedOut(start uint64) (heldLock, error) {
+	metrics.IncCounter(s.metricContended)
+	metrics.IncCounter(s.metricTimeouts)
+	metrics.ObserveHist(s.histWait, timer.Since(start))
+	return heldLock{}, common.ErrBusy
+}
+
+// reconfigure replaces the lock set's table. Operations already running keep
+// their locks and new ones start using the new table right away.
+func (s *lockSet) reconfigure(perKey bool, concurrency uint8) error {
+	s.reconfig.Lock()
+	defer s.reconfig.Unlock()
+
+	cur := s.gen()
+	if cur.previous() != nil {
+		return errLocksDraining
+	}
+
+	s.cur.Store(newLockGen(s.newTable(perKey, concurrency), cur))
+	return nil
+}
+
+// ResizeLocks changes the number of striped locks in a lock set to
+// 2^(concurrency) while it is in use. It fails if the set's last change is
+// still waiting on operations that started before it, or if concurrency is
+// over 16.
+func ResizeLocks(locksetID uint32, concurrency uint8) error {
+	if concurrency > maxResizeConcurrency {
+		return errConcurrencyTooHigh
+	}
+	return getLocks(locksetID).reconfigure(false, concurrency)
+}
+
+// UsePerKeyLocks switches a lock set in use to a lock per key. It fails if the
+// set's last change is still waiting on operations that started before it.
+func UsePerKeyLocks(locksetID uint32) error {
+	return getLocks(locksetID).reconfigure(true, 0)
+}
+
+// serveLocks lists the lock sets on GET. A POST with a lock set id and either a
+// concurrency or mode=per-key reconfigures that set.
+func serveLocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 32)
+		if err != nil || id == 0 || uint32(id) > atomic.LoadUint32(&curslot) {
+			http.Error(w, "unknown lock set", http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("mode") == "per-key" {
+			err = UsePerKeyLocks(uint32(id))
+		} else {
+			var c uint64
+			c, err = strconv.ParseUint(r.FormValue("concurrency"), 10, 8)
+			if err != nil || c > maxResizeConcurrency {
+				http.Error(w, errConcurrencyTooHigh.Error(), http.StatusBadRequest)
+				return
+			}
+			err = ResizeLocks(uint32(id), uint8(c))
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	n := atomic.LoadUint32(&curslot)
+	for id := uint32(1); id <= n && id <= maxLockSets; id++ {
+		s := locksets[id]
+		if s == nil {
+			continue
+		}
+
+		s.reconfig.Lock()
+		mode := "per-key"
+		if !s.perKey {
+			mode = fmt.Sprintf("striped %d", s.stripes)
+		}
+		s.reconfig.Unlock()
+
+		fmt.Fprintf(w, "%d %s\n", id, mode)
+	}
+}
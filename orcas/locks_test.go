@@ -0,0 +1,179 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol"
+)
+
+// blockingOrca holds every set until the test lets it go.
+type blockingOrca struct {
+	testPanicOrca
+	entered chan string
+	release chan struct{}
+}
+
+func newBlockingOrca() *blockingOrca {
+	return &blockingOrca{
+		entered: make(chan string, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingOrca) orcaConst(l1, l2 handlers.Handler, res protocol.Responder) orcas.Orca {
+	return b
+}
+
+func (b *blockingOrca) Set(req common.SetRequest) error {
+	b.entered <- string(req.Key)
+	<-b.release
+	return nil
+}
+
+func (b *blockingOrca) waitEntered(t *testing.T) string {
+	select {
+	case key := <-b.entered:
+		return key
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a set to start")
+	}
+	return ""
+}
+
+func (b *blockingOrca) expectBlocked(t *testing.T) {
+	select {
+	case key := <-b.entered:
+		t.Fatalf("Expected the set for %s to wait for the lock", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func lockedSet(o orcas.Orca, key string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- o.Set(common.SetRequest{Key: []byte(key)})
+	}()
+	return done
+}
+
+func TestLockedOrcaLockSets(t *testing.T) {
+	t.Run("Timeout", func(t *testing.T) {
+		b := newBlockingOrca()
+		oc, _ := orcas.LockedWithOpts(b.orcaConst, orcas.LockOpts{Concurrency: 2, TimeoutMillis: 20})
+		o := oc(nil, nil, nil)
+
+		first := lockedSet(o, "key")
+		b.waitEntered(t)
+
+		if err := o.Set(common.SetRequest{Key: []byte("key")}); err != common.ErrBusy {
+			t.Fatalf("Expected ErrBusy while the key is locked, got %v", err)
+		}
+
+		close(b.release)
+		if err := <-first; err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if err := o.Set(common.SetRequest{Key: []byte("key")}); err != nil {
+			t.Fatalf("Expected the lock to be free again, got %v", err)
+		}
+	})
+	t.Run("PerKey", func(t *testing.T) {
+		b := newBlockingOrca()
+		oc, _ := orcas.LockedWithOpts(b.orcaConst, orcas.LockOpts{PerKey: true})
+		o := oc(nil, nil, nil)
+
+		first := lockedSet(o, "a")
+		b.waitEntered(t)
+
+		// Any other key goes straight through, the same key waits
+		second := lockedSet(o, "b")
+		b.waitEntered(t)
+		third := lockedSet(o, "a")
+		b.expectBlocked(t)
+
+		close(b.release)
+		for _, done := range []<-chan error{first, second, third} {
+			if err := <-done; err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+		}
+	})
+	t.Run("Resize", func(t *testing.T) {
+		b := newBlockingOrca()
+		oc, id := orcas.LockedWithOpts(b.orcaConst, orcas.LockOpts{Concurrency: 0})
+		o := oc(nil, nil, nil)
+
+		first := lockedSet(o, "a")
+		b.waitEntered(t)
+
+		// With a single lock, unrelated keys wait too
+		second := lockedSet(o, "b")
+		b.expectBlocked(t)
+
+		if err := orcas.ResizeLocks(id, 4); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// Operations on the new locks still wait for the ones holding the old
+		// locks, so the same key never runs twice at once
+		third := lockedSet(o, "a")
+		b.expectBlocked(t)
+
+		// A second change has to wait until the first one is done
+		if err := orcas.UsePerKeyLocks(id); err == nil {
+			t.Fatalf("Expected the change to be refused while the old locks are in use")
+		}
+
+		close(b.release)
+		for _, done := range []<-chan error{first, second, third} {
+			if err := <-done; err != nil {
+				t.Fatalf("Error should be nil, got %v", err)
+			}
+		}
+
+		if err := orcas.UsePerKeyLocks(id); err != nil {
+			t.Fatalf("Expected the change once the old locks were released, got %v", err)
+		}
+	})
+	t.Run("ResizeLimit", func(t *testing.T) {
+		_, id := orcas.LockedWithOpts(newBlockingOrca().orcaConst, orcas.LockOpts{Concurrency: 0})
+
+		if err := orcas.ResizeLocks(id, 17); err == nil {
+			t.Fatalf("Expected a resize to 2^17 locks to be refused")
+		}
+
+		for concurrency, code := range map[string]int{"16": http.StatusOK, "17": http.StatusBadRequest, "31": http.StatusBadRequest} {
+			form := url.Values{"id": {strconv.Itoa(int(id))}, "concurrency": {concurrency}}
+			req := httptest.NewRequest(http.MethodPost, "/locks", nil)
+			req.PostForm = form
+
+			w := httptest.NewRecorder()
+			http.DefaultServeMux.ServeHTTP(w, req)
+			if w.Code != code {
+				t.Fatalf("Expected %d for concurrency %s, got %d", code, concurrency, w.Code)
+			}
+		}
+	})
+}
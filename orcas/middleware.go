@@ -0,0 +1,255 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"io"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+// Call is the context for a single request passing through a middleware chain.
+// Middlewares may replace Request (keeping it the type that matches Type) before
+// passing the call on, and can look at Err on the way back out to see how the
+// orca, and every middleware after them, handled it.
+type Call struct {
+	Type    common.RequestType
+	Request common.Request
+	Start   uint64
+	Err     error
+
+	values map[interface{}]interface{}
+}
+
+// Keys returns the keys the request operates on, if any.
+func (c *Call) Keys() [][]byte {
+	switch req := c.Request.(type) {
+	case common.SetRequest:
+		return [][]byte{req.Key}
+	case common.DeleteRequest:
+		return [][]byte{req.Key}
+	case common.TouchRequest:
+		return [][]byte{req.Key}
+	case common.GATRequest:
+		return [][]byte{req.Key}
+	case common.GetRequest:
+		return req.Keys
+	}
+	return nil
+}
+
+// Value returns a value stored on the call by a middleware.
+func (c *Call) Value(key interface{}) interface{} {
+	return c.values[key]
+}
+
+// SetValue stores a value on the call so middlewares further along the chain
+// can see it.
+func (c *Call) SetValue(key, val interface{}) {
+	if c.values == nil {
+		c.values = make(map[interface{}]interface{})
+	}
+	c.values[key] = val
+}
+
+// Next passes a call on to the rest of the chain.
+type Next func(c *Call) error
+
+// Middleware intercepts every request made to an orca. It is given the call and
+// the rest of the chain, and decides whether, how and how many times to pass the
+// call on. Middlewares are shared by every connection, so any state they keep
+// must be safe for concurrent use.
+//
+// Error is not intercepted, since it is how the server reports the errors that
+// middlewares return.
+type Middleware func(c *Call, next Next) error
+
+// Builder composes middlewares around an orca.
+//
+//	oc := orcas.Build(orcas.L1L2WithOpts(orcas.L1L2Opts{})).
+//	    Use(orcas.MetricsMiddleware("l1l2")).
+//	    Use(orcas.KeyValidationMiddleware(0)).
+//	    OrcaConst()
+type Builder struct {
+	base        OrcaConst
+	middlewares []Middleware
+}
+
+// Build starts a chain around the given orca.
+func Build(oc OrcaConst) *Builder {
+	return &Builder{base: oc}
+}
+
+// Use adds middlewares to the chain. Requests go through middlewares in the
+// order they were added, so the first one added sees every request first.
+func (b *Builder) Use(mws ...Middleware) *Builder {
+	b.middlewares = append(b.middlewares, mws...)
+	return b
+}
+
+// OrcaConst returns an OrcaConst for the orca wrapped in the chain.
+func (b *Builder) OrcaConst() OrcaConst {
+	mws := make([]Middleware, len(b.middlewares))
+	copy(mws, b.middlewares)
+	base := b.base
+
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return Wrap(base(l1, l2, res), mws...)
+	}
+}
+
+type MiddlewareOrca struct {
+	wrapped Orca
+	handle  Next
+}
+
+// Wrap puts a single orca inside a chain of middlewares.
+func Wrap(o Orca, mws ...Middleware) Orca {
+	handle := func(c *Call) error {
+		c.Err = dispatch(o, c)
+		return c.Err
+	}
+
+	for i := len(mws) - 1; i >= 0; i-- {
+		mw, next := mws[i], handle
+		handle = func(c *Call) error {
+			c.Err = mw(c, next)
+			return c.Err
+		}
+	}
+
+	return &MiddlewareOrca{
+		wrapped: o,
+		handle:  handle,
+	}
+}
+
+// dispatch calls the orca method that matches the call.
+func dispatch(o Orca, c *Call) error {
+	switch c.Type {
+	case common.RequestSet:
+		return o.Set(c.Request.(common.SetRequest))
+	case common.RequestAdd:
+		return o.Add(c.Request.(common.SetRequest))
+	case common.RequestReplace:
+		return o.Replace(c.Request.(common.SetRequest))
+	case common.RequestAppend:
+		return o.Append(c.Request.(common.SetRequest))
+	case common.RequestPrepend:
+		return o.Prepend(c.Request.(common.SetRequest))
+	case common.RequestDelete:
+		return o.Delete(c.Request.(common.DeleteRequest))
+	case common.RequestTouch:
+		return o.Touch(c.Request.(common.TouchRequest))
+	case common.RequestGet:
+		return o.Get(c.Request.(common.GetRequest))
+	case common.RequestGetE:
+		return o.GetE(c.Request.(common.GetRequest))
+	case common.RequestGat:
+		return o.Gat(c.Request.(common.GATRequest))
+	case common.RequestNoop:
+		return o.Noop(c.Request.(common.NoopRequest))
+	case common.RequestQuit:
+		return o.Quit(c.Request.(common.QuitRequest))
+	case common.RequestVersion:
+		return o.Version(c.Request.(common.VersionRequest))
+	case common.RequestStat:
+		return o.Stat(c.Request.(common.StatRequest))
+	}
+	return o.Unknown(c.Request)
+}
+
+func (m *MiddlewareOrca) call(reqType common.RequestType, req common.Request) error {
+	return m.handle(&Call{
+		Type:    reqType,
+		Request: req,
+		Start:   timer.Now(),
+	})
+}
+
+// Close closes the wrapped orca if it holds resources of its own.
+func (m *MiddlewareOrca) Close() error {
+	if c, ok := m.wrapped.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (m *MiddlewareOrca) Set(req common.SetRequest) error {
+	return m.call(common.RequestSet, req)
+}
+
+func (m *MiddlewareOrca) Add(req common.SetRequest) error {
+	return m.call(common.RequestAdd, req)
+}
+
+func (m *MiddlewareOrca) Replace(req common.SetRequest) error {
+	return m.call(common.RequestReplace, req)
+}
+
+func (m *MiddlewareOrca) Append(req common.SetRequest) error {
+	return m.call(common.RequestAppend, req)
+}
+
+func (m *MiddlewareOrca) Prepend(req common.SetRequest) error {
+	return m.call(common.RequestPrepend, req)
+}
+
+func (m *MiddlewareOrca) Delete(req common.DeleteRequest) error {
+	return m.call(common.RequestDelete, req)
+}
+
+func (m *MiddlewareOrca) Touch(req common.TouchRequest) error {
+	return m.call(common.RequestTouch, req)
+}
+
+func (m *MiddlewareOrca) Get(req common.GetRequest) error {
+	return m.call(common.RequestGet, req)
+}
+
+func (m *MiddlewareOrca) GetE(req common.GetRequest) error {
+	return m.call(common.RequestGetE, req)
+}
+
+func (m *MiddlewareOrca) Gat(req common.GATRequest) error {
+	return m.call(common.RequestGat, req)
+}
+
+func (m *MiddlewareOrca) Noop(req common.NoopRequest) error {
+	return m.call(common.RequestNoop, req)
+}
+
+func (m *MiddlewareOrca) Quit(req common.QuitRequest) error {
+	return m.call(common.RequestQuit, req)
+}
+
+func (m *MiddlewareOrca) Version(req common.VersionRequest) error {
+	return m.call(common.RequestVersion, req)
+}
+
+func (m *MiddlewareOrca) Unknown(req common.Request) error {
+	return m.call(common.RequestUnknown, req)
+}
+
+func (m *MiddlewareOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	m.wrapped.Error(req, reqType, err)
+}
+
+func (m *MiddlewareOrca) Stat(req common.StatRequest) error {
+	return m.call(common.RequestStat, req)
+}
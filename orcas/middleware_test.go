@@ -0,0 +1,151 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestMiddleware(t *testing.T) {
+	t.Run("Order", func(t *testing.T) {
+		var trace []string
+		record := func(name string) orcas.Middleware {
+			return func(c *orcas.Call, next orcas.Next) error {
+				trace = append(trace, name+" in")
+				err := next(c)
+				trace = append(trace, name+" out")
+				return err
+			}
+		}
+
+		h := newMapHandler()
+		oc := orcas.Build(orcas.L1Only).Use(record("a"), record("b")).Use(record("c")).OrcaConst()
+		o := oc(h, nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+
+		if err := o.Set(common.SetRequest{Key: []byte("mw"), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if _, ok := h.value("mw"); !ok {
+			t.Fatalf("Expected the set to reach the handler")
+		}
+
+		gold := "a in,b in,c in,c out,b out,a out"
+		if got := strings.Join(trace, ","); got != gold {
+			t.Fatalf("Expected middlewares to run as '%v' but got '%v'", gold, got)
+		}
+	})
+	t.Run("Context", func(t *testing.T) {
+		var seen error
+		var keys [][]byte
+		outer := func(c *orcas.Call, next orcas.Next) error {
+			c.SetValue("user", "test")
+			next(c)
+			seen = c.Err
+			return nil
+		}
+		inner := func(c *orcas.Call, next orcas.Next) error {
+			if c.Value("user") != "test" {
+				t.Fatalf("Expected the value set by the outer middleware")
+			}
+			keys = c.Keys()
+			return common.ErrKeyNotFound
+		}
+
+		o := orcas.Wrap(orcas.L1Only(newMapHandler(), nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{}))), outer, inner)
+
+		if err := o.Delete(common.DeleteRequest{Key: []byte("mw")}); err != nil {
+			t.Fatalf("Expected the outer middleware to swallow the error, got %v", err)
+		}
+		if seen != common.ErrKeyNotFound {
+			t.Fatalf("Expected the outer middleware to see ErrKeyNotFound, got %v", seen)
+		}
+		if len(keys) != 1 || string(keys[0]) != "mw" {
+			t.Fatalf("Expected the call to have the request key, got %q", keys)
+		}
+	})
+	t.Run("Locking", func(t *testing.T) {
+		mw, _ := orcas.LockingMiddleware(true, 2)
+
+		var gets int
+		count := func(c *orcas.Call, next orcas.Next) error {
+			if c.Type == common.RequestGet {
+				gets++
+			}
+			return next(c)
+		}
+
+		h := newMapHandler()
+		h.data["a"] = "foo"
+		h.data["b"] = "bar"
+		output := &bytes.Buffer{}
+		o := orcas.Build(orcas.L1Only).Use(mw, count).OrcaConst()(h, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("a"), []byte("b")},
+			Opaques: []uint32{0, 0},
+			Quiet:   []bool{false, false},
+		})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if gets != 2 {
+			t.Fatalf("Expected the get to be split per key, got %d calls", gets)
+		}
+
+		gold := "VALUE a 0 3\r\nfoo\r\nEND\r\nVALUE b 0 3\r\nbar\r\nEND\r\n"
+		if out := output.String(); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("KeyValidation", func(t *testing.T) {
+		h := newMapHandler()
+		o := orcas.Wrap(orcas.L1Only(h, nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{}))), orcas.KeyValidationMiddleware(8))
+
+		for _, key := range []string{"", "toolongkey"} {
+			if err := o.Set(common.SetRequest{Key: []byte(key)}); err != common.ErrInvalidArgs {
+				t.Fatalf("Expected ErrInvalidArgs for key %q, got %v", key, err)
+			}
+		}
+		if len(h.data) != 0 {
+			t.Fatalf("Expected invalid keys not to reach the handler")
+		}
+
+		// Binary protocol keys can hold any bytes
+		for _, key := range []string{"ok", "a b\x01"} {
+			if err := o.Set(common.SetRequest{Key: []byte(key)}); err != nil {
+				t.Fatalf("Error should be nil for key %q, got %v", key, err)
+			}
+		}
+	})
+	t.Run("Logging", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		mw := orcas.LoggingMiddleware(log.New(buf, "", 0))
+		o := orcas.Wrap(orcas.L1Only(newMapHandler(), nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{}))), orcas.MetricsMiddleware("test"), mw)
+
+		o.Set(common.SetRequest{Key: []byte("mw")})
+
+		if !strings.HasPrefix(buf.String(), `set ["mw"] ok `) {
+			t.Fatalf("Unexpected log line '%v'", buf.String())
+		}
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"log"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/timer"
+)
+
+// requestTypeNames are the names used for request types in metrics and logs.
+var requestTypeNames = [...]string{
+	common.RequestUnknown: "unknown",
+	common.RequestGet:     "get",
+	common.RequestGat:     "gat",
+	common.RequestGetE:    "gete",
+	common.RequestSet:     "set",
+	common.RequestAdd:     "add",
+	common.RequestReplace: "replace",
+	common.RequestAppend:  "append",
+	common.RequestPrepend: "prepend",
+	common.RequestDelete:  "delete",
+	common.RequestTouch:   "touch",
+	common.RequestNoop:    "noop",
+	common.RequestQuit:    "quit",
+	common.RequestVersion: "version",
+	common.RequestStat:    "stat",
+}
+
+func requestTypeName(t common.RequestType) string {
+	if int(t) < len(requestTypeNames) {
+		return requestTypeNames[t]
+	}
+	return requestTypeNames[common.RequestUnknown]
+}
+
+// LockingMiddleware is the middleware version of Locked. It takes the same
+// parameters and returns the ID of the lock set it created, which can be shared
+// with LockingMiddlewareWithExisting or LockedWithExisting.
+func LockingMiddleware(multipleReaders bool, concurrency uint8) (Middleware, uint32) {
+	slot := getNewLocks(LockOpts{MultipleReaders: multipleReaders, Concurrency: concurrency})
+	return lockingMiddleware(getLocks(slot)), slot
+}
+
+// LockingMiddlewareWithExisting locks using a lock set created before, so that
+// requests through different chains or Locked orcas exclude each other.
+func LockingMiddlewareWithExisting(locksetID uint32) Middleware {
+	return lockingMiddleware(getLocks(locksetID))
+}
+
+func lockingMiddleware(ls *lockSet) Middleware {
+	return func(c *Call, next Next) error {
+		switch c.Type {
+		case common.RequestGet, common.RequestGetE:
+			return lockEachKey(c, next, ls)
+
+		case common.RequestNoop, common.RequestQuit, common.RequestVersion,
+			common.RequestStat, common.RequestUnknown:
+			return next(c)
+		}
+
+		keys := c.Keys()
+		if len(keys) == 0 {
+			return next(c)
+		}
+
+		lock, err := ls.lock(keys[0], false)
+		if err != nil {
+			return err
+		}
+		defer lock.unlock()
+		return next(c)
+	}
+}
+
+// lockEachKey splits a multi-get into one call per key, like LockedOrca does, so
+// only one lock is held at a time. The last key carries the noop that completes
+// the response.
+func lockEachKey(c *Call, next Next, ls *lockSet) error {
+	req := c.Request.(common.GetRequest)
+
+	for idx, key := range req.Keys {
+		noopOpaque := uint32(0)
+		noopEnd := false
+		if idx == len(req.Keys)-1 {
+			noopOpaque = req.NoopOpaque
+			noopEnd = req.NoopEnd
+		}
+
+		c.Request = common.GetRequest{
+			Keys:       [][]byte{key},
+			Opaques:    []uint32{req.Opaques[idx]},
+			Quiet:      []bool{req.Quiet[idx]},
+			NoopOpaque: noopOpaque,
+			NoopEnd:    noopEnd,
+		}
+
+		err := func() error {
+			lock, err := ls.lock(key, true)
+			if err != nil {
+				return err
+			}
+			defer lock.unlock()
+			return next(c)
+		}()
+
+		if err != nil {
+			c.Request = req
+			return err
+		}
+	}
+
+	c.Request = req
+	return nil
+}
+
+// MetricsMiddleware counts requests and errors and records latency for each
+// request type. Every metric is tagged with the chain name and request type, so
+// the name should be unique for each chain.
+func MetricsMiddleware(name string) Middleware {
+	var (
+		reqs  [len(requestTypeNames)]uint32
+		errs  [len(requestTypeNames)]uint32
+		hists [len(requestTypeNames)]uint32
+	)
+
+	for t, cmd := range requestTypeNames {
+		tags := metrics.Tags{"chain": name, "cmd": cmd}
+		reqs[t] = metrics.AddCounter("chain_requests", tags)
+		errs[t] = metrics.AddCounter("chain_errors", tags)
+		hists[t] = metrics.AddHistogram("chain_latency", false, tags)
+	}
+
+	return func(c *Call, next Next) error {
+		t := c.Type
+		if int(t) >= len(requestTypeNames) {
+			t = common.RequestUnknown
+		}
+
+		metrics.IncCounter(reqs[t])
+		err := next(c)
+		metrics.ObserveHist(hists[t], timer.Since(c.Start))
+
+		if err != nil {
+			metrics.IncCounter(errs[t])
+		}
+		return err
+	}
+}
+
+// LoggingMiddleware logs each request with its keys, outcome and latency. A nil
+// logger logs through the standard logger.
+func LoggingMiddleware(logger *log.Logger) Middleware {
+	printf := log.Printf
+	if logger != nil {
+		printf = logger.Printf
+	}
+
+	return func(c *Call, next Next) error {
+		err := next(c)
+
+		res := "ok"
+		if err != nil {
+			res = err.Error()
+		}
+
+		printf("%s %q %s %dns", requestTypeName(c.Type), c.Keys(), res, timer.Since(c.Start))
+		return err
+	}
+}
+
+const defaultMaxKeyLength = 250
+
+// KeyValidationMiddleware rejects requests with empty keys or keys longer than
+// maxLen. A maxLen of 0 uses memcached's limit of 250 bytes. Rejected requests
+// fail with common.ErrInvalidArgs and never reach the orca. Whitespace and
+// control characters are left alone: they're legal in binary protocol keys,
+// and the text parser already refuses them.
+func KeyValidationMiddleware(maxLen int) Middleware {
+	maxLen = intValueOrDefault(maxLen, defaultMaxKeyLength)
+
+	return func(c *Call, next Next) error {
+		for _, key := range c.Keys() {
+			if !validKey(key, maxLen) {
+				return common.ErrInvalidArgs
+			}
+		}
+		return next(c)
+	}
+}
+
+func validKey(key []byte, maxLen int) bool {
+	return len(key) > 0 && len(key) <= maxLen
+}
@@ -0,0 +1,517 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+)
+
+// MigrationPhase is the stage a cluster-to-cluster migration is in.
+type MigrationPhase uint32
+
+const (
+	// PhaseSourcePrimary serves reads from the source cluster.
+	PhaseSourcePrimary MigrationPhase = iota
+	// PhaseDual serves reads from the destination cluster and falls back to the
+	// source for keys the destination doesn't have yet.
+	PhaseDual
+	// PhaseDestinationPrimary serves reads from the destination cluster.
+	PhaseDestinationPrimary
+)
+
+var migrationPhaseNames = [...]string{
+	PhaseSourcePrimary:      "source-primary",
+	PhaseDual:               "dual",
+	PhaseDestinationPrimary: "destination-primary",
+}
+
+func (p MigrationPhase) String() string {
+	if int(p) < len(migrationPhaseNames) {
+		return migrationPhaseNames[p]
+	}
+	return "unknown"
+}
+
+// ParseMigrationPhase returns the phase with the given name.
+func ParseMigrationPhase(name string) (MigrationPhase, error) {
+	for p, n := range migrationPhaseNames {
+		if n == name {
+			return MigrationPhase(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown migration phase %q", name)
+}
+
+// Migration holds the state of a live migration shared by every connection. Its
+// phase can be changed at any time and takes effect on the next request of each
+// connection. It serves its phase over HTTP: a GET returns the current phase and
+// a POST with a phase parameter changes it.
+type Migration struct {
+	phase   uint32
+	compare uint32
+}
+
+// NewMigration creates the state for a migration starting in the given phase.
+// When compare is true every read is also done on the other cluster and the
+// results are compared, at the cost of an extra backend call per read.
+func NewMigration(phase MigrationPhase, compare bool) *Migration {
+	m := &Migration{}
+	m.SetPhase(phase)
+	m.SetCompare(compare)
+
+	metrics.RegisterIntGaugeCallback("migration_phase", nil, func() uint64 {
+		return uint64(m.Phase())
+	})
+
+	return m
+}
+
+func (m *Migration) Phase() MigrationPhase {
+	return MigrationPhase(atomic.LoadUint32(&m.phase))
+}
+
+func (m *Migration) SetPhase(p MigrationPhase) {
+	atomic.StoreUint32(&m.phase, uint32(p))
+}
+
+func (m *Migration) Compare() bool {
+	return atomic.LoadUint32(&m.compare) == 1
+}
+
+func (m *Migration) SetCompare(compare bool) {
+	var v uint32
+	if compare {
+		v = 1
+	}
+	atomic.StoreUint32(&m.compare, v)
+}
+
+func (m *Migration) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		p, err := ParseMigrationPhase(r.FormValue("phase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.SetPhase(p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, m.Phase())
+}
+
+type MigrationOrca struct {
+	src, dst handlers.Handler
+	res      protocol.Responder
+	m        *Migration
+}
+
+// Migrating returns an OrcaConst for an orca that moves clients from one cluster
+// to another without downtime. The server's L1 handler is the source cluster and
+// its L2 handler is the destination.
+//
+// Every mutation is made in both clusters. The primary cluster for the current
+// phase is written first and its result is what the client sees. The source is
+// primary for writes until the destination-primary phase. If a mutation that
+// succeeded in the primary can't be made in the other cluster, the key is deleted
+// there so it can't serve the old value.
+func Migrating(m *Migration) OrcaConst {
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		return &MigrationOrca{
+			src: l1,
+			dst: l2,
+			res: res,
+			m:   m,
+		}
+	}
+}
+
+// writers returns the clusters to write to, primary first.
+func (o *MigrationOrca) writers() (primary, secondary handlers.Handler) {
+	if o.m.Phase() == PhaseDestinationPrimary {
+		return o.dst, o.src
+	}
+	return o.src, o.dst
+}
+
+// mirror applies a mutation to the secondary cluster after it succeeded in the
+// primary. Protocol errors mean the clusters disagree about the key, so it is
+// deleted from the secondary to let the primary's value win. Fatal errors are
+// returned, which closes the connection rather than letting the clusters drift
+// apart unnoticed.
+func (o *MigrationOrca) mirror(h handlers.Handler, key []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	metrics.IncCounter(MetricMigrationSecondaryWriteErrors)
+
+	if !common.IsAppError(err) {
+		return err
+	}
+
+	err = h.Delete(common.DeleteRequest{Key: key})
+	if err == nil || common.IsAppError(err) {
+		return nil
+	}
+	return err
+}
+
+func (o *MigrationOrca) Set(req common.SetRequest) error {
+	p, s := o.writers()
+	if err := p.Set(req); err != nil {
+		return err
+	}
+	if err := o.mirror(s, req.Key, s.Set(req)); err != nil {
+		return err
+	}
+	return o.res.Set(req.Opaque, req.Quiet)
+}
+
+// Add only succeeds if the primary didn't have the key, so the secondary gets a
+// set to match it regardless of what it had.
+func (o *MigrationOrca) Add(req common.SetRequest) error {
+	p, s := o.writers()
+	if err := p.Add(req); err != nil {
+		return err
+	}
+	if err := o.mirror(s, req.Key, s.Set(req)); err != nil {
+		return err
+	}
+	return o.res.Add(req.Opaque, req.Quiet)
+}
+
+// Replace only succeeds if the primary had the key, so the secondary gets a set
+// to match it regardless of what it had.
+func (o *MigrationOrca) Replace(req common.SetRequest) error {
+	p, s := o.writers()
+	if err := p.Replace(req); err != nil {
+		return err
+	}
+	if err := o.mirror(s, req.Key, s.Set(req)); err != nil {
+		return err
+	}
+	return o.res.Replace(req.Opaque, req.Quiet)
+}
+
+func (o *MigrationOrca) Append(req common.SetRequest) error {
+	p, s := o.writers()
+	if err := p.Append(req); err != nil {
+		return err
+	}
+	if err := o.mirror(s, req.Key, s.Append(req)); err != nil {
+		return err
+	}
+	return o.res.Append(req.Opaque, req.Quiet)
+}
+
+func (o *MigrationOrca) Prepend(req common.SetRequest) error {
+	p, s := o.writers()
+	if err := p.Prepend(req); err != nil {
+		return err
+	}
+	if err := o.mirror(s, req.Key, s.Prepend(req)); err != nil {
+		return err
+	}
+	return o.res.Prepend(req.Opaque, req.Quiet)
+}
+
+// Delete removes the key from both clusters. It is a hit if either had it.
+func (o *MigrationOrca) Delete(req common.DeleteRequest) error {
+	p, s := o.writers()
+
+	perr := p.Delete(req)
+	if perr != nil && perr != common.ErrKeyNotFound {
+		return perr
+	}
+
+	serr := s.Delete(req)
+	if serr != nil && serr != common.ErrKeyNotFound {
+		metrics.IncCounter(MetricMigrationSecondaryWriteErrors)
+		if !common.IsAppError(serr) {
+			return serr
+		}
+	}
+
+	if perr == nil || serr == nil {
+		return o.res.Delete(req.Opaque)
+	}
+	return common.ErrKeyNotFound
+}
+
+func (o *MigrationOrca) Touch(req common.TouchRequest) error {
+	p, s := o.writers()
+	if err := p.Touch(req); err != nil {
+		return err
+	}
+
+	// The secondary may not have every key yet
+	if err := s.Touch(req); err != nil && err != common.ErrKeyNotFound {
+		if err := o.mirror(s, req.Key, err); err != nil {
+			return err
+		}
+	}
+
+	return o.res.Touch(req.Opaque)
+}
+
+// Gat reads from the cluster reads come from in the current phase and touches
+// the key in the other.
+func (o *MigrationOrca) Gat(req common.GATRequest) error {
+	r, other := o.src, o.dst
+	if o.m.Phase() != PhaseSourcePrimary {
+		r, other = o.dst, o.src
+	}
+
+	res, err := r.GAT(req)
+	if err != nil {
+		return err
+	}
+
+	if res.Miss && o.m.Phase() == PhaseDual {
+		if res, err = other.GAT(req); err != nil {
+			return err
+		}
+	} else {
+		_, err := other.GAT(req)
+		if err != nil && !common.IsAppError(err) {
+			metrics.IncCounter(MetricMigrationSecondaryWriteErrors)
+			return err
+		}
+	}
+
+	return o.res.GAT(res)
+}
+
+// getAll reads every key in a request from one cluster. The results are in the
+// same order as the keys.
+func getAll(h handlers.Handler, req common.GetRequest, withExptime bool) ([]common.GetEResponse, error) {
+	out := make([]common.GetEResponse, len(req.Keys))
+	filled := make([]bool, len(req.Keys))
+
+	put := func(res common.GetEResponse) {
+		for i, key := range req.Keys {
+			if !filled[i] && bytes.Equal(key, res.Key) {
+				out[i] = res
+				filled[i] = true
+				return
+			}
+		}
+	}
+
+	var err error
+	if withExptime {
+		resChan, errChan := h.GetE(req)
+		err = drainGetE(resChan, errChan, put)
+	} else {
+		resChan, errChan := h.Get(req)
+		err = drainGet(resChan, errChan, func(res common.GetResponse) {
+			put(common.GetEResponse{
+				Key:    res.Key,
+				Data:   res.Data,
+				Opaque: res.Opaque,
+				Flags:  res.Flags,
+				Miss:   res.Miss,
+				Quiet:  res.Quiet,
+			})
+		})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Handlers don't always send quiet misses
+	for i, ok := range filled {
+		if !ok {
+			out[i] = common.GetEResponse{
+				Key:    req.Keys[i],
+				Opaque: req.Opaques[i],
+				Quiet:  req.Quiet[i],
+				Miss:   true,
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// subset builds a get for some of the keys in a request.
+func subset(req common.GetRequest, idxs []int) common.GetRequest {
+	sub := common.GetRequest{
+		Keys:    make([][]byte, len(idxs)),
+		Opaques: make([]uint32, len(idxs)),
+		Quiet:   make([]bool, len(idxs)),
+	}
+	for i, idx := range idxs {
+		sub.Keys[i] = req.Keys[idx]
+		sub.Opaques[i] = req.Opaques[idx]
+		sub.Quiet[i] = req.Quiet[idx]
+	}
+	return sub
+}
+
+// read answers a get from the cluster for the current phase, filling in misses
+// from the source during the dual phase, and compares the answers against the
+// other cluster if asked to.
+func (o *MigrationOrca) read(req common.GetRequest, withExptime bool) ([]common.GetEResponse, error) {
+	phase := o.m.Phase()
+
+	primary, other := o.src, o.dst
+	if phase != PhaseSourcePrimary {
+		primary, other = o.dst, o.src
+	}
+
+	out, err := getAll(primary, req, withExptime)
+	if err != nil {
+		return nil, err
+	}
+
+	var check []int
+	var missed []int
+	for i, res := range out {
+		if res.Miss && phase == PhaseDual {
+			missed = append(missed, i)
+		} else {
+			check = append(check, i)
+		}
+	}
+
+	if len(missed) > 0 {
+		metrics.IncCounterBy(MetricMigrationDualFallbacks, uint64(len(missed)))
+
+		fallback, err := getAll(other, subset(req, missed), withExptime)
+		if err != nil {
+			return nil, err
+		}
+		for i, idx := range missed {
+			out[idx] = fallback[i]
+		}
+	}
+
+	if o.m.Compare() && len(check) > 0 {
+		o.compare(other, req, out, check, withExptime)
+	}
+
+	return out, nil
+}
+
+// compare reads keys from the other cluster and counts where it disagrees with
+// the answers being sent. A fatal error here only means the comparison is lost,
+// so it isn't passed back to the client.
+func (o *MigrationOrca) compare(other handlers.Handler, req common.GetRequest, out []common.GetEResponse, idxs []int, withExptime bool) {
+	theirs, err := getAll(other, subset(req, idxs), withExptime)
+	if err != nil {
+		metrics.IncCounter(MetricMigrationCompareErrors)
+		return
+	}
+
+	metrics.IncCounterBy(MetricMigrationCompared, uint64(len(idxs)))
+
+	for i, idx := range idxs {
+		ours := out[idx]
+		switch {
+		case ours.Miss && theirs[i].Miss:
+		case theirs[i].Miss:
+			metrics.IncCounter(MetricMigrationMissingInOther)
+		case ours.Miss:
+			metrics.IncCounter(MetricMigrationMissingInPrimary)
+		case ours.Flags != theirs[i].Flags || !bytes.Equal(ours.Data, theirs[i].Data):
+			metrics.IncCounter(MetricMigrationDivergent)
+		}
+	}
+}
+
+func (o *MigrationOrca) Get(req common.GetRequest) error {
+	out, err := o.read(req, false)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range out {
+		err := o.res.Get(common.GetResponse{
+			Key:    res.Key,
+			Data:   res.Data,
+			Opaque: res.Opaque,
+			Flags:  res.Flags,
+			Miss:   res.Miss,
+			Quiet:  res.Quiet,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (o *MigrationOrca) GetE(req common.GetRequest) error {
+	out, err := o.read(req, true)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range out {
+		if err := o.res.GetE(res); err != nil {
+			return err
+		}
+	}
+
+	return o.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (o *MigrationOrca) Noop(req common.NoopRequest) error {
+	return o.res.Noop(req.Opaque)
+}
+
+func (o *MigrationOrca) Quit(req common.QuitRequest) error {
+	return o.res.Quit(req.Opaque, req.Quiet)
+}
+
+func (o *MigrationOrca) Version(req common.VersionRequest) error {
+	return o.res.Version(req.Opaque)
+}
+
+func (o *MigrationOrca) Unknown(req common.Request) error {
+	return common.ErrUnknownCmd
+}
+
+func (o *MigrationOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	var opaque uint32
+	var quiet bool
+
+	if req != nil {
+		opaque = req.GetOpaque()
+		quiet = req.IsQuiet()
+	}
+
+	o.res.Error(opaque, reqType, err, quiet)
+}
+
+func (o *MigrationOrca) Stat(req common.StatRequest) error {
+	return o.res.Stat(req.Opaque)
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestMigrationOrca(t *testing.T) {
+	src, dst := newMapHandler(), newMapHandler()
+	src.data["old"] = "foo"
+
+	m := orcas.NewMigration(orcas.PhaseSourcePrimary, true)
+	output := &bytes.Buffer{}
+	o := orcas.Migrating(m)(src, dst, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+	t.Run("DualWrite", func(t *testing.T) {
+		if err := o.Set(common.SetRequest{Key: []byte("new"), Data: []byte("bar")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+		if _, ok := src.value("new"); !ok {
+			t.Fatalf("Expected the write in the source")
+		}
+		if _, ok := dst.value("new"); !ok {
+			t.Fatalf("Expected the write in the destination")
+		}
+	})
+	t.Run("SourcePrimary", func(t *testing.T) {
+		gold := "VALUE old 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "old"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("Dual", func(t *testing.T) {
+		m.SetPhase(orcas.PhaseDual)
+		dst.data["new"] = "baz"
+
+		// Destination first, with misses filled in from the source
+		output.Reset()
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("old"), []byte("new")},
+			Opaques: []uint32{0, 0},
+			Quiet:   []bool{false, false},
+		})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		gold := "VALUE old 0 3\r\nfoo\r\nVALUE new 0 3\r\nbaz\r\nEND\r\n"
+		if output.String() != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, output.String())
+		}
+	})
+	t.Run("DestinationPrimary", func(t *testing.T) {
+		m.SetPhase(orcas.PhaseDestinationPrimary)
+
+		gold := "END\r\n"
+		if out := getOne(t, o, output, "old"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("PhaseEndpoint", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", "/migration?phase=dual", nil))
+		if m.Phase() != orcas.PhaseDual || w.Body.String() != "dual\n" {
+			t.Fatalf("Expected the phase to change to dual, got %v", m.Phase())
+		}
+
+		w = httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("POST", "/migration?phase=bogus", nil))
+		if w.Code != 400 || m.Phase() != orcas.PhaseDual {
+			t.Fatalf("Expected a bad phase to be rejected, got %d %v", w.Code, strings.TrimSpace(w.Body.String()))
+		}
+	})
+}
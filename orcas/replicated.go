@@ -0,0 +1,794 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+// ReadMode selects how the replicated orca answers a get from several replicas.
+type ReadMode int
+
+const (
+	// ReadFirstHit answers each key with the first replica that has it.
+	ReadFirstHit ReadMode = iota
+	// ReadQuorum waits for every replica read and answers each key with the
+	// value (or miss) the most replicas agree on.
+	ReadQuorum
+)
+
+const (
+	defaultReplicaQueueSize = 64
+	defaultReplicaTimeout   = time.Second
+)
+
+// ReplicatedOpts configures the replicated orca. With the defaults, W + R > N so
+// a read always includes at least one replica that acknowledged the last write.
+type ReplicatedOpts struct {
+	// WriteQuorum (W) is how many replicas must acknowledge a mutation before it
+	// is reported as successful. Default: a majority of the replicas
+	WriteQuorum int
+
+	// ReadReplicas (R) is how many replicas each get is sent to. Default: a
+	// majority of the replicas
+	ReadReplicas int
+
+	// ReadMode picks how replies from the R replicas are combined.
+	// Default: ReadFirstHit
+	ReadMode ReadMode
+
+	// QueueSize is how many operations can be waiting on a single replica
+	// before the client connection blocks. Default: 64
+	QueueSize int
+
+	// Timeout is how long an operation waits on the replicas, both for room in
+	// their queues and for their answers. Replicas that haven't answered by then
+	// count as failed for that operation. Default: 1s
+	Timeout time.Duration
+}
+
+func intValueOrDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
+
+// replica serializes all operations on one replica's handler. Handlers are not
+// safe for concurrent use, and mutations keep running on slower replicas after
+// the write quorum has answered the client, so every use of a handler goes
+// through its queue.
+type replica struct {
+	h    handlers.Handler
+	ops  chan func(h handlers.Handler)
+	done chan struct{}
+}
+
+func (r *replica) run() {
+	defer close(r.done)
+	for op := range r.ops {
+		op(r.h)
+	}
+}
+
+type ReplicatedOrca struct {
+	replicas  []*replica
+	res       protocol.Responder
+	opts      ReplicatedOpts
+	next      int
+	closeOnce sync.Once
+}
+
+// Replicated returns an OrcaConst for an orca that replicates every mutation
+// across the handlers created by the given constructors. Each client connection
+// gets its own set of replica handlers; a replica whose handler can't be created
+// counts as down for that connection. The L1 and L2 handlers passed in by the
+// server are not used.
+func Replicated(replicas []handlers.HandlerConst, opts ReplicatedOpts) OrcaConst {
+	n := len(replicas)
+
+	opts.WriteQuorum = intValueOrDefault(opts.WriteQuorum, n/2+1)
+	opts.ReadReplicas = intValueOrDefault(opts.ReadReplicas, n/2+1)
+	opts.QueueSize = intValueOrDefault(opts.QueueSize, defaultReplicaQueueSize)
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultReplicaTimeout
+	}
+
+	if opts.WriteQuorum > n {
+		opts.WriteQuorum = n
+	}
+	if opts.ReadReplicas > n {
+		opts.ReadReplicas = n
+	}
+
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		r := &ReplicatedOrca{
+			replicas: make([]*replica, n),
+			res:      res,
+			opts:     opts,
+		}
+
+		// Spread reads from different connections across the replicas
+		if n > 0 {
+			r.next = rand.Intn(n)
+		}
+
+		for i, hc := range replicas {
+			h, err := hc()
+			if err != nil {
+				log.Printf("Error opening connection to replica %d: %v\n", i, err.Error())
+				metrics.IncCounter(MetricReplicatedReplicasUnavailable)
+				continue
+			}
+
+			rep := &replica{
+				h:    h,
+				ops:  make(chan func(h handlers.Handler), opts.QueueSize),
+				done: make(chan struct{}),
+			}
+			go rep.run()
+
+			r.replicas[i] = rep
+		}
+
+		return r
+	}
+}
+
+// Close waits for every queued operation, including mutations still being
+// replicated after their client was answered, then closes the replica handlers.
+func (r *ReplicatedOrca) Close() error {
+	r.closeOnce.Do(func() {
+		for _, rep := range r.replicas {
+			if rep == nil {
+				continue
+			}
+			close(rep.ops)
+			<-rep.done
+			rep.h.Close()
+		}
+	})
+	return nil
+}
+
+// send queues an operation on a replica. It gives up, counting a timeout, if the
+// queue is still full when ctx is done.
+func send(ctx context.Context, rep *replica, op func(h handlers.Handler)) bool {
+	select {
+	case rep.ops <- op:
+		return true
+	case <-ctx.Done():
+		metrics.IncCounter(MetricReplicatedReplicaTimeouts)
+		return false
+	}
+}
+
+// write sends a mutation to every available replica and returns as soon as
+// WriteQuorum of them have acknowledged it. If the quorum isn't reached once
+// every replica has answered, the first protocol error any replica returned is
+// passed back so clients still see things like ErrKeyExists, otherwise the write
+// is a temporary failure. Replicas that don't answer within the timeout keep
+// applying the mutation but no longer count towards the quorum.
+func (r *ReplicatedOrca) write(op func(h handlers.Handler) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	results := make(chan error, len(r.replicas))
+
+	var sent int
+	for _, rep := range r.replicas {
+		if rep == nil {
+			continue
+		}
+		if send(ctx, rep, func(h handlers.Handler) { results <- op(h) }) {
+			sent++
+		}
+	}
+
+	start := timer.Now()
+
+	var acks int
+	var appErr error
+
+outer:
+	for i := 0; i < sent; i++ {
+		var err error
+		select {
+		case err = <-results:
+		case <-ctx.Done():
+			metrics.IncCounter(MetricReplicatedReplicaTimeouts)
+			break outer
+		}
+
+		if err == nil {
+			acks++
+			if acks >= r.opts.WriteQuorum {
+				metrics.ObserveHist(HistReplicatedWriteQuorum, timer.Since(start))
+				return nil
+			}
+			continue
+		}
+
+		if common.IsAppError(err) {
+			if appErr == nil {
+				appErr = err
+			}
+		} else {
+			metrics.IncCounter(MetricReplicatedReplicaErrors)
+		}
+	}
+
+	metrics.IncCounter(MetricReplicatedWriteQuorumFailures)
+
+	if appErr != nil {
+		return appErr
+	}
+	return common.ErrTempFailure
+}
+
+func (r *ReplicatedOrca) Set(req common.SetRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Set(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Set(req.Opaque, req.Quiet)
+}
+
+func (r *ReplicatedOrca) Add(req common.SetRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Add(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Add(req.Opaque, req.Quiet)
+}
+
+func (r *ReplicatedOrca) Replace(req common.SetRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Replace(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Replace(req.Opaque, req.Quiet)
+}
+
+func (r *ReplicatedOrca) Append(req common.SetRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Append(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Append(req.Opaque, req.Quiet)
+}
+
+func (r *ReplicatedOrca) Prepend(req common.SetRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Prepend(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Prepend(req.Opaque, req.Quiet)
+}
+
+func (r *ReplicatedOrca) Delete(req common.DeleteRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Delete(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Delete(req.Opaque)
+}
+
+func (r *ReplicatedOrca) Touch(req common.TouchRequest) error {
+	err := r.write(func(h handlers.Handler) error { return h.Touch(req) })
+	if err != nil {
+		return err
+	}
+	return r.res.Touch(req.Opaque)
+}
+
+// readReplicas picks the next ReadReplicas available replicas, rotating the
+// starting point on every read.
+func (r *ReplicatedOrca) readReplicas() []int {
+	var idxs []int
+	n := len(r.replicas)
+	if n == 0 {
+		return nil
+	}
+
+	for i := 0; i < n && len(idxs) < r.opts.ReadReplicas; i++ {
+		idx := (r.next + i) % n
+		if r.replicas[idx] != nil {
+			idxs = append(idxs, idx)
+		}
+	}
+
+	r.next = (r.next + 1) % n
+
+	return idxs
+}
+
+type replicaResult struct {
+	replica int
+	res     common.GetEResponse
+	exptime bool
+	err     error
+	done    bool
+}
+
+type keyVotes struct {
+	idxs      []int
+	votes     map[int]common.GetEResponse
+	exptimes  map[int]bool
+	responded bool
+	sent      common.GetEResponse
+}
+
+// withExptime finds a vote for the same value as res that carries its TTL, since
+// repairing with a value read through Get would store it without one.
+func (k *keyVotes) withExptime(order []int, res common.GetEResponse) (common.GetEResponse, bool) {
+	for _, ri := range order {
+		if v, ok := k.votes[ri]; ok && k.exptimes[ri] && sameValue(v, res) {
+			return v, true
+		}
+	}
+	return common.GetEResponse{}, false
+}
+
+// readReplica runs a get on one replica's handler and passes each response to
+// found. Handlers without GetE, like Couchbase or a stock memcached, are read
+// with Get instead, and their responses are passed on as having no TTL.
+func readReplica(h handlers.Handler, req common.GetRequest, found func(res common.GetEResponse, exptime bool)) error {
+	if resChan, errChan := h.GetE(req); resChan != nil {
+		var err error
+		for resChan != nil || errChan != nil {
+			select {
+			case res, ok := <-resChan:
+				if !ok {
+					resChan = nil
+				} else {
+					found(res, true)
+				}
+			case e, ok := <-errChan:
+				if !ok {
+					errChan = nil
+				} else {
+					err = e
+				}
+			}
+		}
+
+		switch err {
+		case common.ErrNotSupported, common.ErrUnknownCmd:
+		default:
+			return err
+		}
+	}
+
+	resChan, errChan := h.Get(req)
+	if resChan == nil {
+		return common.ErrNotSupported
+	}
+
+	var err error
+	for resChan != nil || errChan != nil {
+		select {
+		case res, ok := <-resChan:
+			if !ok {
+				resChan = nil
+			} else {
+				found(common.GetEResponse{
+					Key:    res.Key,
+					Data:   res.Data,
+					Opaque: res.Opaque,
+					Flags:  res.Flags,
+					Miss:   res.Miss,
+					Quiet:  res.Quiet,
+				}, false)
+			}
+		case e, ok := <-errChan:
+			if !ok {
+				errChan = nil
+			} else {
+				err = e
+			}
+		}
+	}
+
+	return err
+}
+
+func sameValue(a, b common.GetEResponse) bool {
+	if a.Miss || b.Miss {
+		return a.Miss == b.Miss
+	}
+	return a.Flags == b.Flags && bytes.Equal(a.Data, b.Data)
+}
+
+// pick chooses the value the most replicas returned. Ties go to the replica
+// earliest in read order. It also returns whether the choice was unanimous and
+// whether it had a strict majority of the replicas that answered.
+func (k *keyVotes) pick(order []int) (common.GetEResponse, bool, bool) {
+	var best common.GetEResponse
+	bestCount := -1
+	distinct := 0
+
+	for i, ri := range order {
+		v, ok := k.votes[ri]
+		if !ok {
+			continue
+		}
+
+		seenBefore := false
+		for _, rj := range order[:i] {
+			if w, ok := k.votes[rj]; ok && sameValue(v, w) {
+				seenBefore = true
+				break
+			}
+		}
+		if seenBefore {
+			continue
+		}
+
+		distinct++
+
+		count := 0
+		for _, w := range k.votes {
+			if sameValue(v, w) {
+				count++
+			}
+		}
+
+		if count > bestCount {
+			best, bestCount = v, count
+		}
+	}
+
+	if bestCount < 0 {
+		return common.GetEResponse{Miss: true}, true, false
+	}
+
+	return best, distinct <= 1, bestCount*2 > len(k.votes)
+}
+
+// read sends a get to the read replicas and answers every key through respond
+// according to the read mode. Once every replica has answered, replicas that
+// missed a key another replica had, or that disagree with a quorum, are
+// repaired in the background. Replicas that haven't answered within the timeout
+// count as failed.
+func (r *ReplicatedOrca) read(req common.GetRequest, respond func(res common.GetEResponse) error) error {
+	order := r.readReplicas()
+	if len(order) == 0 {
+		metrics.IncCounter(MetricReplicatedReadFailures)
+		return common.ErrTempFailure
+	}
+
+	keys := make(map[string]*keyVotes)
+	for idx, key := range req.Keys {
+		k, ok := keys[string(key)]
+		if !ok {
+			k = &keyVotes{
+				votes:    make(map[int]common.GetEResponse),
+				exptimes: make(map[int]bool),
+			}
+			keys[string(key)] = k
+		}
+		k.idxs = append(k.idxs, idx)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	// Buffered so replicas can always finish even when the read fails early. A
+	// replica can answer every key twice if it falls back from GetE to Get.
+	results := make(chan replicaResult, len(order)*(2*len(req.Keys)+1))
+
+	var done, failed int
+
+	for _, ri := range order {
+		ri := ri
+		sent := send(ctx, r.replicas[ri], func(h handlers.Handler) {
+			err := readReplica(h, req, func(res common.GetEResponse, exptime bool) {
+				results <- replicaResult{replica: ri, res: res, exptime: exptime}
+			})
+			results <- replicaResult{replica: ri, err: err, done: true}
+		})
+		if !sent {
+			done++
+			failed++
+		}
+	}
+
+	answer := func(k *keyVotes, res common.GetEResponse) error {
+		k.responded = true
+		k.sent = res
+		for _, idx := range k.idxs {
+			res.Key = req.Keys[idx]
+			res.Opaque = req.Opaques[idx]
+			res.Quiet = req.Quiet[idx]
+			if err := respond(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var err error
+
+	for done < len(order) {
+		var rr replicaResult
+		select {
+		case rr = <-results:
+		case <-ctx.Done():
+			metrics.IncCounter(MetricReplicatedReplicaTimeouts)
+			failed += len(order) - done
+			done = len(order)
+			continue
+		}
+
+		if rr.done {
+			done++
+			if rr.err != nil {
+				metrics.IncCounter(MetricReplicatedReplicaErrors)
+				failed++
+			}
+			continue
+		}
+
+		k, ok := keys[string(rr.res.Key)]
+		if !ok {
+			continue
+		}
+		if _, ok := k.votes[rr.replica]; ok {
+			continue
+		}
+		k.votes[rr.replica] = rr.res
+		k.exptimes[rr.replica] = rr.exptime
+
+		if k.responded || err != nil {
+			continue
+		}
+
+		if (r.opts.ReadMode == ReadFirstHit && !rr.res.Miss) || len(k.votes) == len(order) {
+			res, _, _ := k.pick(order)
+			if r.opts.ReadMode == ReadFirstHit {
+				res = rr.res
+			}
+			err = answer(k, res)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if failed == len(order) {
+		metrics.IncCounter(MetricReplicatedReadFailures)
+		return common.ErrTempFailure
+	}
+
+	for _, k := range keys {
+		best, unanimous, majority := k.pick(order)
+
+		if !unanimous {
+			metrics.IncCounter(MetricReplicatedReadDivergence)
+		}
+
+		// The first hit wins. If nobody had the key it would have answered already.
+		// There's no telling which of two different hits is newer, so only misses
+		// get repaired.
+		if r.opts.ReadMode == ReadFirstHit {
+			best, majority = common.GetEResponse{Miss: true}, false
+			if k.responded {
+				best = k.sent
+			}
+		}
+
+		if !k.responded {
+			if err := answer(k, best); err != nil {
+				return err
+			}
+		}
+
+		// Read repair. Misses are always repaired from a hit. Replicas holding a
+		// different value are only overwritten when a majority agrees.
+		if best.Miss {
+			continue
+		}
+
+		// Without a TTL the repair could keep the value around forever
+		src, ok := k.withExptime(order, best)
+		if !ok {
+			continue
+		}
+
+		for ri, v := range k.votes {
+			if sameValue(v, best) || (!v.Miss && !majority) {
+				continue
+			}
+			r.repair(ri, src)
+		}
+	}
+
+	return nil
+}
+
+func (r *ReplicatedOrca) repair(ri int, res common.GetEResponse) {
+	metrics.IncCounter(MetricReplicatedReadRepairs)
+
+	setreq := common.SetRequest{
+		Key:     res.Key,
+		Flags:   res.Flags,
+		Exptime: res.Exptime,
+		Data:    res.Data,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	sent := send(ctx, r.replicas[ri], func(h handlers.Handler) {
+		if err := h.Set(setreq); err != nil {
+			metrics.IncCounter(MetricReplicatedReadRepairErrors)
+		}
+	})
+	if !sent {
+		metrics.IncCounter(MetricReplicatedReadRepairErrors)
+	}
+}
+
+func (r *ReplicatedOrca) Get(req common.GetRequest) error {
+	err := r.read(req, func(res common.GetEResponse) error {
+		return r.res.Get(common.GetResponse{
+			Key:    res.Key,
+			Data:   res.Data,
+			Opaque: res.Opaque,
+			Flags:  res.Flags,
+			Miss:   res.Miss,
+			Quiet:  res.Quiet,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return r.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+func (r *ReplicatedOrca) GetE(req common.GetRequest) error {
+	err := r.read(req, r.res.GetE)
+	if err != nil {
+		return err
+	}
+	return r.res.GetEnd(req.NoopOpaque, req.NoopEnd)
+}
+
+// Gat changes the TTL, so it goes to every replica like a mutation. The client
+// is answered once the write quorum has acknowledged and a hit was seen, or once
+// every replica has answered.
+func (r *ReplicatedOrca) Gat(req common.GATRequest) error {
+	type gatResult struct {
+		res common.GetResponse
+		err error
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	results := make(chan gatResult, len(r.replicas))
+
+	var sent int
+	for _, rep := range r.replicas {
+		if rep == nil {
+			continue
+		}
+		ok := send(ctx, rep, func(h handlers.Handler) {
+			res, err := h.GAT(req)
+			results <- gatResult{res: res, err: err}
+		})
+		if ok {
+			sent++
+		}
+	}
+
+	var acks int
+	var appErr error
+	var hit *common.GetResponse
+
+outer:
+	for i := 0; i < sent; i++ {
+		var gr gatResult
+		select {
+		case gr = <-results:
+		case <-ctx.Done():
+			metrics.IncCounter(MetricReplicatedReplicaTimeouts)
+			break outer
+		}
+
+		if gr.err != nil {
+			if common.IsAppError(gr.err) {
+				if appErr == nil {
+					appErr = gr.err
+				}
+			} else {
+				metrics.IncCounter(MetricReplicatedReplicaErrors)
+			}
+			continue
+		}
+
+		acks++
+		if !gr.res.Miss && hit == nil {
+			hit = &gr.res
+		}
+
+		if acks >= r.opts.WriteQuorum && hit != nil {
+			break
+		}
+	}
+
+	if acks < r.opts.WriteQuorum {
+		metrics.IncCounter(MetricReplicatedWriteQuorumFailures)
+		if appErr != nil {
+			return appErr
+		}
+		return common.ErrTempFailure
+	}
+
+	res := common.GetResponse{Miss: true}
+	if hit != nil {
+		res = *hit
+	}
+	res.Key = req.Key
+	res.Opaque = req.Opaque
+	res.Quiet = req.Quiet
+
+	return r.res.GAT(res)
+}
+
+func (r *ReplicatedOrca) Noop(req common.NoopRequest) error {
+	return r.res.Noop(req.Opaque)
+}
+
+func (r *ReplicatedOrca) Quit(req common.QuitRequest) error {
+	return r.res.Quit(req.Opaque, req.Quiet)
+}
+
+func (r *ReplicatedOrca) Version(req common.VersionRequest) error {
+	return r.res.Version(req.Opaque)
+}
+
+func (r *ReplicatedOrca) Unknown(req common.Request) error {
+	return common.ErrUnknownCmd
+}
+
+func (r *ReplicatedOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	var opaque uint32
+	var quiet bool
+
+	if req != nil {
+		opaque = req.GetOpaque()
+		quiet = req.IsQuiet()
+	}
+
+	r.res.Error(opaque, reqType, err, quiet)
+}
+
+func (r *ReplicatedOrca) Stat(req common.StatRequest) error {
+	return r.res.Stat(req.Opaque)
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+// deadHandler fails every operation like a connection to a dead node would.
+type deadHandler struct {
+	testHandler
+}
+
+func (h *deadHandler) Close() error                    { return nil }
+func (h *deadHandler) Set(cmd common.SetRequest) error { return io.EOF }
+func (h *deadHandler) Add(cmd common.SetRequest) error { return io.EOF }
+func (h *deadHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	reschan := make(chan common.GetEResponse)
+	close(reschan)
+	errchan := make(chan error, 1)
+	errchan <- io.EOF
+	close(errchan)
+	return reschan, errchan
+}
+
+// getOnlyHandler is a store without GetE. It answers GetE like the Couchbase
+// handler, with nil channels, or like a stock memcached, with ErrUnknownCmd.
+type getOnlyHandler struct {
+	*mapHandler
+	unknownCmd bool
+}
+
+func (h *getOnlyHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	if !h.unknownCmd {
+		return nil, nil
+	}
+	reschan := make(chan common.GetEResponse)
+	close(reschan)
+	errchan := make(chan error, 1)
+	errchan <- common.ErrUnknownCmd
+	close(errchan)
+	return reschan, errchan
+}
+
+// hungHandler doesn't answer reads until it's released.
+type hungHandler struct {
+	*mapHandler
+	release chan struct{}
+}
+
+func (h *hungHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	<-h.release
+	return h.mapHandler.GetE(cmd)
+}
+
+func TestReplicatedOrca(t *testing.T) {
+	t.Run("WriteQuorum", func(t *testing.T) {
+		h1, h2 := newMapHandler(), newMapHandler()
+		hcs := consts(h1, h2, &deadHandler{})
+
+		o := orcas.Replicated(hcs, orcas.ReplicatedOpts{})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+		if err := o.Set(common.SetRequest{Key: []byte("quorum"), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Expected a 2 of 3 write to succeed, got %v", err)
+		}
+		o.(io.Closer).Close()
+
+		for _, h := range []*mapHandler{h1, h2} {
+			if v, _ := h.value("quorum"); v != "foo" {
+				t.Fatalf("Expected every live replica to have the write, got '%v'", v)
+			}
+		}
+
+		o = orcas.Replicated(hcs, orcas.ReplicatedOpts{WriteQuorum: 3})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+		defer o.(io.Closer).Close()
+		if err := o.Set(common.SetRequest{Key: []byte("quorum"), Data: []byte("foo")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected a 3 of 3 write with a dead replica to fail, got %v", err)
+		}
+
+		// Protocol errors are passed through when they prevent the quorum
+		if err := o.Add(common.SetRequest{Key: []byte("quorum"), Data: []byte("foo")}); err != common.ErrKeyExists {
+			t.Fatalf("Expected ErrKeyExists, got %v", err)
+		}
+	})
+	t.Run("UnavailableReplica", func(t *testing.T) {
+		h1, h2 := newMapHandler(), newMapHandler()
+		hcs := consts(h1, h2)
+		hcs = append(hcs, func() (handlers.Handler, error) { return nil, errors.New("connection refused") })
+
+		output := &bytes.Buffer{}
+		o := orcas.Replicated(hcs, orcas.ReplicatedOpts{})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+		defer o.(io.Closer).Close()
+
+		if err := o.Set(common.SetRequest{Key: []byte("unavailable"), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		gold := "VALUE unavailable 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "unavailable"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+	})
+	t.Run("FirstHitReadRepair", func(t *testing.T) {
+		h1, h2, h3 := newMapHandler(), newMapHandler(), newMapHandler()
+		h2.data["repair"] = "foo"
+
+		output := &bytes.Buffer{}
+		o := orcas.Replicated(consts(h1, h2, h3), orcas.ReplicatedOpts{ReadReplicas: 3})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		gold := "VALUE repair 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "repair"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+
+		// Close waits for the repairs to finish
+		o.(io.Closer).Close()
+
+		for _, h := range []*mapHandler{h1, h3} {
+			if v, _ := h.value("repair"); v != "foo" {
+				t.Fatalf("Expected replicas that missed to be repaired, got '%v'", v)
+			}
+		}
+	})
+	t.Run("QuorumRead", func(t *testing.T) {
+		h1, h2, h3 := newMapHandler(), newMapHandler(), newMapHandler()
+		h1.data["diverged"] = "old"
+		h2.data["diverged"] = "new"
+		h3.data["diverged"] = "new"
+
+		output := &bytes.Buffer{}
+		o := orcas.Replicated(consts(h1, h2, h3), orcas.ReplicatedOpts{
+			ReadReplicas: 3,
+			ReadMode:     orcas.ReadQuorum,
+		})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		for i := 0; i < 3; i++ {
+			gold := "VALUE diverged 0 3\r\nnew\r\nEND\r\n"
+			if out := getOne(t, o, output, "diverged"); out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+		}
+
+		o.(io.Closer).Close()
+
+		if v, _ := h1.value("diverged"); v != "new" {
+			t.Fatalf("Expected the minority replica to be repaired, got '%v'", v)
+		}
+	})
+	t.Run("NoGetE", func(t *testing.T) {
+		h1 := newMapHandler()
+		h2 := &getOnlyHandler{mapHandler: newMapHandler()}
+		h3 := &getOnlyHandler{mapHandler: newMapHandler(), unknownCmd: true}
+
+		output := &bytes.Buffer{}
+		o := orcas.Replicated(consts(h1, h2, h3), orcas.ReplicatedOpts{
+			ReadReplicas: 3,
+			ReadMode:     orcas.ReadQuorum,
+		})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+		if err := o.Set(common.SetRequest{Key: []byte("gete"), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		gold := "VALUE gete 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "gete"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+
+		o.(io.Closer).Close()
+
+		// A value read without its TTL isn't used to repair other replicas
+		o = orcas.Replicated(consts(h1, h2, h3), orcas.ReplicatedOpts{ReadReplicas: 3})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+		h2.data["nottl"] = "foo"
+		gold = "VALUE nottl 0 3\r\nfoo\r\nEND\r\n"
+		if out := getOne(t, o, output, "nottl"); out != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+		}
+
+		o.(io.Closer).Close()
+
+		for _, h := range []*mapHandler{h1, h3.mapHandler} {
+			if v, ok := h.value("nottl"); ok {
+				t.Fatalf("Expected no repair from a value without a TTL, got '%v'", v)
+			}
+		}
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		h1 := newMapHandler()
+		h2 := &hungHandler{mapHandler: newMapHandler(), release: make(chan struct{})}
+		h1.data["hung"] = "foo"
+
+		output := &bytes.Buffer{}
+		o := orcas.Replicated(consts(h1, h2), orcas.ReplicatedOpts{
+			ReadReplicas: 2,
+			Timeout:      50 * time.Millisecond,
+		})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+		defer o.(io.Closer).Close()
+		defer close(h2.release)
+
+		done := make(chan string, 1)
+		go func() {
+			done <- getOne(t, o, output, "hung")
+		}()
+
+		select {
+		case out := <-done:
+			gold := "VALUE hung 0 3\r\nfoo\r\nEND\r\n"
+			if out != gold {
+				t.Fatalf("Expected response '%v' but got '%v'", gold, out)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a read to stop waiting on a hung replica")
+		}
+	})
+	t.Run("AllReplicasDown", func(t *testing.T) {
+		o := orcas.Replicated(consts(&deadHandler{}, &deadHandler{}), orcas.ReplicatedOpts{})(nil, nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+		defer o.(io.Closer).Close()
+
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("down")},
+			Opaques: []uint32{0},
+			Quiet:   []bool{false},
+		})
+		if err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+	})
+}
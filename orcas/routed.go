@@ -0,0 +1,349 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"regexp"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/metrics"
+	"github.com/netflix/rend/protocol"
+	"github.com/netflix/rend/timer"
+)
+
+// DefaultRouteName is the route name used in metrics for keys that match no
+// route and are served by the fallback orca.
+const DefaultRouteName = "default"
+
+// Route sends the keys it matches to its own L1, L2 and orca.
+type Route struct {
+	// Name identifies the route in metrics and logs.
+	Name string
+
+	// Pattern, if set, matches keys by regular expression. Otherwise keys are
+	// matched by Prefix.
+	Pattern *regexp.Regexp
+	Prefix  []byte
+
+	// L1 and L2 create the route's handlers for each client connection. L2 may
+	// be nil for routes without one.
+	L1 handlers.HandlerConst
+	L2 handlers.HandlerConst
+
+	// Orca is the orca the route's requests go through.
+	Orca OrcaConst
+}
+
+func (r Route) matches(key []byte) bool {
+	if r.Pattern != nil {
+		return r.Pattern.Match(key)
+	}
+	return bytes.HasPrefix(key, r.Prefix)
+}
+
+type routeMetrics struct {
+	requests    uint32
+	keys        uint32
+	errors      uint32
+	unavailable uint32
+	latency     uint32
+}
+
+func newRouteMetrics(name string) routeMetrics {
+	tags := metrics.Tags{"route": name}
+	return routeMetrics{
+		requests:    metrics.AddCounter("route_requests", tags),
+		keys:        metrics.AddCounter("route_keys", tags),
+		errors:      metrics.AddCounter("route_errors", tags),
+		unavailable: metrics.AddCounter("route_unavailable", tags),
+		latency:     metrics.AddHistogram("route_latency", false, tags),
+	}
+}
+
+// routeResponder holds back the end of a get while the routed orca still has
+// more of the same request to send to other routes, so the client sees a single
+// response for the whole multi-get.
+type routeResponder struct {
+	protocol.Responder
+	holdEnd bool
+}
+
+func (r *routeResponder) GetEnd(opaque uint32, noopEnd bool) error {
+	if r.holdEnd {
+		return nil
+	}
+	return r.Responder.GetEnd(opaque, noopEnd)
+}
+
+// routeStack is one route's orca and handlers on a single client connection.
+type routeStack struct {
+	orca   Orca
+	l1, l2 handlers.Handler
+}
+
+type RoutedOrca struct {
+	routes   []Route
+	metrics  []routeMetrics
+	stacks   []*routeStack
+	fallback Orca
+	res      protocol.Responder
+	rres     *routeResponder
+}
+
+// Routed returns an OrcaConst for an orca that serves several logical caches at
+// once. Each key goes to the first route that matches it, and keys that match
+// no route go to the fallback orca, which uses the L1 and L2 handlers passed in
+// by the server.
+//
+// A route's handlers are created the first time a connection uses the route. If
+// that fails, the request fails with a temporary failure and creation is tried
+// again on the next request for that route.
+//
+// Multi-gets are split into runs of consecutive keys that go to the same route,
+// and the runs are sent in order, so responses come back in the order the keys
+// were requested.
+func Routed(routes []Route, fallback OrcaConst) OrcaConst {
+	rs := make([]Route, len(routes))
+	copy(rs, routes)
+
+	// The fallback is last so that a key's route is just an index
+	rms := make([]routeMetrics, len(rs)+1)
+	for i, r := range rs {
+		rms[i] = newRouteMetrics(r.Name)
+	}
+	rms[len(rs)] = newRouteMetrics(DefaultRouteName)
+
+	return func(l1, l2 handlers.Handler, res protocol.Responder) Orca {
+		rres := &routeResponder{Responder: res}
+		return &RoutedOrca{
+			routes:   rs,
+			metrics:  rms,
+			stacks:   make([]*routeStack, len(rs)),
+			fallback: fallback(l1, l2, rres),
+			res:      res,
+			rres:     rres,
+		}
+	}
+}
+
+// route returns the index of the route for a key. Keys with no route get
+// len(r.routes), which is the fallback.
+func (r *RoutedOrca) route(key []byte) int {
+	for i, rt := range r.routes {
+		if rt.matches(key) {
+			return i
+		}
+	}
+	return len(r.routes)
+}
+
+// orca returns the orca for a route, creating the route's handlers if needed.
+func (r *RoutedOrca) orca(idx int) (Orca, error) {
+	if idx == len(r.routes) {
+		return r.fallback, nil
+	}
+
+	if s := r.stacks[idx]; s != nil {
+		return s.orca, nil
+	}
+
+	rt := r.routes[idx]
+
+	l1, err := rt.L1()
+	if err != nil {
+		log.Printf("Error opening L1 connection for route %s: %v\n", rt.Name, err.Error())
+		metrics.IncCounter(r.metrics[idx].unavailable)
+		return nil, common.ErrTempFailure
+	}
+
+	l2 := handlers.Handler(nil)
+	if rt.L2 != nil {
+		l2, err = rt.L2()
+		if err != nil {
+			log.Printf("Error opening L2 connection for route %s: %v\n", rt.Name, err.Error())
+			metrics.IncCounter(r.metrics[idx].unavailable)
+			l1.Close()
+			return nil, common.ErrTempFailure
+		}
+	}
+
+	s := &routeStack{
+		orca: rt.Orca(l1, l2, r.rres),
+		l1:   l1,
+		l2:   l2,
+	}
+	r.stacks[idx] = s
+
+	return s.orca, nil
+}
+
+// do runs a request for a single route and records the route's metrics.
+func (r *RoutedOrca) do(idx int, keys int, op func(o Orca) error) error {
+	rm := r.metrics[idx]
+	metrics.IncCounter(rm.requests)
+	metrics.IncCounterBy(rm.keys, uint64(keys))
+	start := timer.Now()
+
+	o, err := r.orca(idx)
+	if err == nil {
+		err = op(o)
+	}
+
+	metrics.ObserveHist(rm.latency, timer.Since(start))
+	if err != nil {
+		metrics.IncCounter(rm.errors)
+	}
+
+	return err
+}
+
+func (r *RoutedOrca) doKey(key []byte, op func(o Orca) error) error {
+	return r.do(r.route(key), 1, op)
+}
+
+// Close closes every route's orca and handlers opened on this connection. The
+// server closes the fallback's handlers itself.
+func (r *RoutedOrca) Close() error {
+	for _, s := range r.stacks {
+		if s == nil {
+			continue
+		}
+		if c, ok := s.orca.(io.Closer); ok {
+			c.Close()
+		}
+		s.l1.Close()
+		if s.l2 != nil {
+			s.l2.Close()
+		}
+	}
+
+	if c, ok := r.fallback.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (r *RoutedOrca) Set(req common.SetRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Set(req) })
+}
+
+func (r *RoutedOrca) Add(req common.SetRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Add(req) })
+}
+
+func (r *RoutedOrca) Replace(req common.SetRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Replace(req) })
+}
+
+func (r *RoutedOrca) Append(req common.SetRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Append(req) })
+}
+
+func (r *RoutedOrca) Prepend(req common.SetRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Prepend(req) })
+}
+
+func (r *RoutedOrca) Delete(req common.DeleteRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Delete(req) })
+}
+
+func (r *RoutedOrca) Touch(req common.TouchRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Touch(req) })
+}
+
+func (r *RoutedOrca) Gat(req common.GATRequest) error {
+	return r.doKey(req.Key, func(o Orca) error { return o.Gat(req) })
+}
+
+// split calls op with each run of consecutive keys in a get that go to the same
+// route. Only the last run ends the response.
+func (r *RoutedOrca) split(req common.GetRequest, op func(o Orca, sub common.GetRequest) error) error {
+	defer func() { r.rres.holdEnd = false }()
+
+	for start := 0; start < len(req.Keys); {
+		idx := r.route(req.Keys[start])
+
+		end := start + 1
+		for end < len(req.Keys) && r.route(req.Keys[end]) == idx {
+			end++
+		}
+
+		sub := common.GetRequest{
+			Keys:    req.Keys[start:end],
+			Opaques: req.Opaques[start:end],
+			Quiet:   req.Quiet[start:end],
+		}
+
+		last := end == len(req.Keys)
+		if last {
+			sub.NoopOpaque = req.NoopOpaque
+			sub.NoopEnd = req.NoopEnd
+		}
+		r.rres.holdEnd = !last
+
+		err := r.do(idx, end-start, func(o Orca) error { return op(o, sub) })
+		if err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+func (r *RoutedOrca) Get(req common.GetRequest) error {
+	return r.split(req, func(o Orca, sub common.GetRequest) error { return o.Get(sub) })
+}
+
+func (r *RoutedOrca) GetE(req common.GetRequest) error {
+	return r.split(req, func(o Orca, sub common.GetRequest) error { return o.GetE(sub) })
+}
+
+func (r *RoutedOrca) Noop(req common.NoopRequest) error {
+	return r.fallback.Noop(req)
+}
+
+func (r *RoutedOrca) Quit(req common.QuitRequest) error {
+	return r.fallback.Quit(req)
+}
+
+func (r *RoutedOrca) Version(req common.VersionRequest) error {
+	return r.fallback.Version(req)
+}
+
+func (r *RoutedOrca) Unknown(req common.Request) error {
+	return r.fallback.Unknown(req)
+}
+
+func (r *RoutedOrca) Error(req common.Request, reqType common.RequestType, err error) {
+	var opaque uint32
+	var quiet bool
+
+	if req != nil {
+		opaque = req.GetOpaque()
+		quiet = req.IsQuiet()
+	}
+
+	r.res.Error(opaque, reqType, err, quiet)
+}
+
+func (r *RoutedOrca) Stat(req common.StatRequest) error {
+	return r.fallback.Stat(req)
+}
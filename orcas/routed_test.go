@@ -0,0 +1,106 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
+	"github.com/netflix/rend/protocol/textprot"
+)
+
+func TestRoutedOrca(t *testing.T) {
+	sessions, users, def := newMapHandler(), newMapHandler(), newMapHandler()
+
+	routes := []orcas.Route{
+		{
+			Name:   "sessions",
+			Prefix: []byte("session:"),
+			L1:     consts(sessions)[0],
+			Orca:   orcas.L1Only,
+		},
+		{
+			Name:    "users",
+			Pattern: regexp.MustCompile(`^user:\d+$`),
+			L1:      consts(users)[0],
+			Orca:    orcas.L1Only,
+		},
+	}
+
+	output := &bytes.Buffer{}
+	o := orcas.Routed(routes, orcas.L1Only)(def, nil, textprot.NewTextResponder(bufio.NewWriter(output)))
+
+	for _, key := range []string{"session:1", "user:1", "user:x"} {
+		if err := o.Set(common.SetRequest{Key: []byte(key), Data: []byte("foo")}); err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+	}
+
+	t.Run("Writes", func(t *testing.T) {
+		if _, ok := sessions.value("session:1"); !ok {
+			t.Fatalf("Expected the prefix route to get its key")
+		}
+		if _, ok := users.value("user:1"); !ok {
+			t.Fatalf("Expected the pattern route to get its key")
+		}
+		if _, ok := def.value("user:x"); !ok {
+			t.Fatalf("Expected unmatched keys to go to the fallback")
+		}
+	})
+	t.Run("MultiGet", func(t *testing.T) {
+		output.Reset()
+		err := o.Get(common.GetRequest{
+			Keys:    [][]byte{[]byte("user:1"), []byte("session:1"), []byte("session:2"), []byte("user:x")},
+			Opaques: []uint32{0, 0, 0, 0},
+			Quiet:   []bool{false, false, false, false},
+		})
+		if err != nil {
+			t.Fatalf("Error should be nil, got %v", err)
+		}
+
+		// Responses stay in request order with a single END
+		gold := "VALUE user:1 0 3\r\nfoo\r\n" +
+			"VALUE session:1 0 3\r\nfoo\r\n" +
+			"VALUE user:x 0 3\r\nfoo\r\n" +
+			"END\r\n"
+		if output.String() != gold {
+			t.Fatalf("Expected response '%v' but got '%v'", gold, output.String())
+		}
+	})
+	t.Run("Unavailable", func(t *testing.T) {
+		broken := []orcas.Route{{
+			Name:   "broken",
+			Prefix: []byte("broken:"),
+			L1: func() (handlers.Handler, error) {
+				return nil, errors.New("connection refused")
+			},
+			Orca: orcas.L1Only,
+		}}
+		o := orcas.Routed(broken, orcas.L1Only)(newMapHandler(), nil, textprot.NewTextResponder(bufio.NewWriter(&bytes.Buffer{})))
+
+		if err := o.Set(common.SetRequest{Key: []byte("broken:1")}); err != common.ErrTempFailure {
+			t.Fatalf("Expected ErrTempFailure, got %v", err)
+		}
+		if err := o.Set(common.SetRequest{Key: []byte("other")}); err != nil {
+			t.Fatalf("Expected other routes to keep working, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/metrics"
+)
+
+// MaxRelativeTTL is the largest exptime memcached treats as a number of seconds
+// from now. Anything larger is an absolute unix timestamp.
+const MaxRelativeTTL = 60 * 60 * 24 * 30
+
+// TTLRule limits the TTLs of the keys starting with a prefix. Zero values
+// leave that part of the TTL alone.
+type TTLRule struct {
+	// Name identifies the rule in metrics. Default: the prefix, or "default"
+	// for the empty prefix
+	Name string
+
+	// Prefix selects the keys the rule applies to. When several rules match,
+	// the one with the longest prefix wins. The empty prefix matches every key.
+	Prefix []byte
+
+	// Min and Max bound the TTL, in seconds.
+	Min uint32
+	Max uint32
+
+	// Default replaces a TTL of 0, which would otherwise keep the item
+	// forever. It is still subject to Max.
+	Default uint32
+
+	// JitterPercent shortens each TTL by a random amount of up to this
+	// percentage, so items written together don't all expire together. TTLs
+	// aren't shortened below Min.
+	JitterPercent uint32
+}
+
+type ttlRule struct {
+	TTLRule
+
+	metricNormalized uint32
+	metricDefaulted  uint32
+	metricClampedMin uint32
+	metricClampedMax uint32
+	metricJittered   uint32
+	metricExpired    uint32
+}
+
+// TTLPolicy rewrites the TTLs of incoming writes according to a set of rules.
+// Every TTL is first normalized to a number of seconds from now, so rules work
+// the same for clients sending absolute and relative exptimes.
+type TTLPolicy struct {
+	// rules are sorted by prefix length, longest first
+	rules    []*ttlRule
+	fallback *ttlRule
+}
+
+// NewTTLPolicy creates a policy from a set of rules. Keys that match no rule
+// only have their TTL normalized. Each rule has its own metrics, so a policy
+// should be created once and shared.
+func NewTTLPolicy(rules []TTLRule) *TTLPolicy {
+	p := &TTLPolicy{}
+
+	for _, r := range rules {
+		rule := newTTLRule(r)
+		if len(r.Prefix) == 0 {
+			p.fallback = rule
+		} else {
+			p.rules = append(p.rules, rule)
+		}
+	}
+
+	if p.fallback == nil {
+		p.fallback = newTTLRule(TTLRule{})
+	}
+
+	sort.SliceStable(p.rules, func(i, j int) bool {
+		return len(p.rules[i].Prefix) > len(p.rules[j].Prefix)
+	})
+
+	return p
+}
+
+func newTTLRule(r TTLRule) *ttlRule {
+	if r.Name == "" {
+		r.Name = string(r.Prefix)
+		if r.Name == "" {
+			r.Name = "default"
+		}
+	}
+
+	tags := metrics.Tags{"rule": r.Name}
+
+	return &ttlRule{
+		TTLRule: r,
+
+		metricNormalized: metrics.AddCounter("ttl_normalized", tags),
+		metricDefaulted:  metrics.AddCounter("ttl_defaulted", tags),
+		metricClampedMin: metrics.AddCounter("ttl_clamped_min", tags),
+		metricClampedMax: metrics.AddCounter("ttl_clamped_max", tags),
+		metricJittered:   metrics.AddCounter("ttl_jittered", tags),
+		metricExpired:    metrics.AddCounter("ttl_already_expired", tags),
+	}
+}
+
+func (p *TTLPolicy) rule(key []byte) *ttlRule {
+	for _, r := range p.rules {
+		if bytes.HasPrefix(key, r.Prefix) {
+			return r
+		}
+	}
+	return p.fallback
+}
+
+// Apply returns the exptime to store a key with in place of the one the client
+// sent. The result is relative unless it is too long to be, in which case it
+// is an absolute timestamp like memcached expects.
+func (p *TTLPolicy) Apply(key []byte, exptime uint32) uint32 {
+	r := p.rule(key)
+	now := uint32(time.Now().Unix())
+
+	ttl := exptime
+	if exptime > MaxRelativeTTL {
+		// An absolute time in the past means the item is expired on arrival,
+		// which memcached already handles.
+		if exptime <= now {
+			metrics.IncCounter(r.metricExpired)
+			return exptime
+		}
+		ttl = exptime - now
+		metrics.IncCounter(r.metricNormalized)
+	}
+
+	if ttl == 0 && r.Default > 0 {
+		ttl = r.Default
+		metrics.IncCounter(r.metricDefaulted)
+	}
+
+	// 0 still means forever if there's no default
+	if ttl == 0 {
+		return 0
+	}
+
+	if r.Max > 0 && ttl > r.Max {
+		ttl = r.Max
+		metrics.IncCounter(r.metricClampedMax)
+	}
+	if ttl < r.Min {
+		ttl = r.Min
+		metrics.IncCounter(r.metricClampedMin)
+	}
+
+	if r.JitterPercent > 0 && ttl > r.Min {
+		maxJitter := uint64(ttl) * uint64(r.JitterPercent) / 100
+		if room := uint64(ttl - r.Min); maxJitter > room {
+			maxJitter = room
+		}
+		if maxJitter > 0 {
+			ttl -= uint32(rand.Int63n(int64(maxJitter) + 1))
+			metrics.IncCounter(r.metricJittered)
+		}
+	}
+
+	// Keep at least a second so the item isn't stored forever
+	if ttl == 0 {
+		ttl = 1
+	}
+
+	if ttl > MaxRelativeTTL {
+		return now + ttl
+	}
+	return ttl
+}
+
+// TTLPolicyMiddleware applies a TTL policy to every command that sets a TTL:
+// Set, Add, Replace, Touch and Gat.
+func TTLPolicyMiddleware(p *TTLPolicy) Middleware {
+	return func(c *Call, next Next) error {
+		switch req := c.Request.(type) {
+		case common.SetRequest:
+			// Append and Prepend don't change the TTL
+			if c.Type == common.RequestSet || c.Type == common.RequestAdd || c.Type == common.RequestReplace {
+				req.Exptime = p.Apply(req.Key, req.Exptime)
+				c.Request = req
+			}
+		case common.TouchRequest:
+			req.Exptime = p.Apply(req.Key, req.Exptime)
+			c.Request = req
+		case common.GATRequest:
+			req.Exptime = p.Apply(req.Key, req.Exptime)
+			c.Request = req
+		}
+		return next(c)
+	}
+}
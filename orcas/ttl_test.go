@@ -0,0 +1,96 @@
+// Copyright 2017 Netflix, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package orcas_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/orcas"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	p := orcas.NewTTLPolicy([]orcas.TTLRule{
+		{Prefix: []byte("reco:"), Min: 60, Max: 3600, Default: 600},
+		{Prefix: []byte("reco:batch:"), Max: 1000, JitterPercent: 10},
+		{Name: "everything", Max: 2 * orcas.MaxRelativeTTL},
+	})
+
+	t.Run("Clamp", func(t *testing.T) {
+		if ttl := p.Apply([]byte("reco:1"), 10); ttl != 60 {
+			t.Fatalf("Expected the TTL to be raised to 60, got %d", ttl)
+		}
+		if ttl := p.Apply([]byte("reco:1"), 7200); ttl != 3600 {
+			t.Fatalf("Expected the TTL to be lowered to 3600, got %d", ttl)
+		}
+		if ttl := p.Apply([]byte("reco:1"), 0); ttl != 600 {
+			t.Fatalf("Expected the default TTL, got %d", ttl)
+		}
+	})
+	t.Run("Normalize", func(t *testing.T) {
+		abs := uint32(time.Now().Unix()) + 100
+		if ttl := p.Apply([]byte("reco:1"), abs); ttl < 98 || ttl > 100 {
+			t.Fatalf("Expected the absolute time to become about 100 seconds, got %d", ttl)
+		}
+
+		past := uint32(time.Now().Unix()) - 100
+		if ttl := p.Apply([]byte("reco:1"), past); ttl != past {
+			t.Fatalf("Expected an expired time to be left alone, got %d", ttl)
+		}
+
+		// Too long to be relative, so it goes back to absolute
+		if ttl := p.Apply([]byte("other"), 2*orcas.MaxRelativeTTL+100); ttl <= orcas.MaxRelativeTTL {
+			t.Fatalf("Expected an absolute time, got %d", ttl)
+		}
+		if ttl := p.Apply([]byte("other"), 0); ttl != 0 {
+			t.Fatalf("Expected 0 to stay 0 without a default, got %d", ttl)
+		}
+	})
+	t.Run("Jitter", func(t *testing.T) {
+		seen := make(map[uint32]bool)
+		for i := 0; i < 100; i++ {
+			ttl := p.Apply([]byte("reco:batch:1"), 1000)
+			if ttl < 900 || ttl > 1000 {
+				t.Fatalf("Expected the TTL to be within 10%% under 1000, got %d", ttl)
+			}
+			seen[ttl] = true
+		}
+		if len(seen) < 2 {
+			t.Fatalf("Expected jitter to spread the TTLs")
+		}
+	})
+	t.Run("Middleware", func(t *testing.T) {
+		var exptimes []uint32
+		record := func(c *orcas.Call, next orcas.Next) error {
+			switch req := c.Request.(type) {
+			case common.SetRequest:
+				exptimes = append(exptimes, req.Exptime)
+			case common.TouchRequest:
+				exptimes = append(exptimes, req.Exptime)
+			}
+			return nil
+		}
+
+		o := orcas.Wrap(testPanicOrca{}, orcas.TTLPolicyMiddleware(p), record)
+		o.Set(common.SetRequest{Key: []byte("reco:1"), Exptime: 1})
+		o.Append(common.SetRequest{Key: []byte("reco:1"), Exptime: 1})
+		o.Touch(common.TouchRequest{Key: []byte("reco:1"), Exptime: 0})
+
+		if len(exptimes) != 3 || exptimes[0] != 60 || exptimes[1] != 1 || exptimes[2] != 600 {
+			t.Fatalf("Expected TTLs 60, 1 and 600, got %v", exptimes)
+		}
+	})
+}
@@ -58,6 +58,69 @@ var (
 	MetricCmdGetKeysL1   = metrics.AddCounter("cmd_get_keys_l1", nil)
 	MetricCmdGetKeysL2   = metrics.AddCounter("cmd_get_keys_l2", nil)
 
+	// Coalesced L2 fetches. These count requests that were satisfied by a fetch
+	// already in flight for another connection instead of going to L2 themselves.
+	MetricCmdGetCoalesced = metrics.AddCounter("cmd_get_coalesced", nil)
+	MetricCmdGatCoalesced = metrics.AddCounter("cmd_gat_coalesced", nil)
+
+	// Stale-while-revalidate and early refresh. Stale counts hits served from
+	// the grace window past the soft TTL, refresh signals count clients that were
+	// told to refresh an item and early refreshes are the subset of those that
+	// were picked before the item went stale.
+	MetricCmdGetStale          = metrics.AddCounter("cmd_get_stale", nil)
+	MetricCmdGetRefreshSignals = metrics.AddCounter("cmd_get_refresh_signals", nil)
+	MetricCmdGetEarlyRefresh   = metrics.AddCounter("cmd_get_early_refresh", nil)
+
+	// L1 admission. These count L2 hits that the admission policy allowed or
+	// refused to copy back into L1, for both Get backfills and Gat adds.
+	MetricL1AdmissionAdmitted = metrics.AddCounter("l1_admission_admitted", nil)
+	MetricL1AdmissionRejected = metrics.AddCounter("l1_admission_rejected", nil)
+
+	// Replicated orca. Unavailable counts replica handlers that couldn't be
+	// created for a connection and replica errors count fatal errors from a single
+	// replica, which the orca tolerates as long as a quorum answers. Timeouts count
+	// operations that stopped waiting on replicas that were too slow.
+	MetricReplicatedReplicasUnavailable = metrics.AddCounter("replicated_replicas_unavailable", nil)
+	MetricReplicatedReplicaErrors       = metrics.AddCounter("replicated_replica_errors", nil)
+	MetricReplicatedReplicaTimeouts     = metrics.AddCounter("replicated_replica_timeouts", nil)
+	MetricReplicatedWriteQuorumFailures = metrics.AddCounter("replicated_write_quorum_failures", nil)
+	MetricReplicatedReadFailures        = metrics.AddCounter("replicated_read_failures", nil)
+	MetricReplicatedReadDivergence      = metrics.AddCounter("replicated_read_divergence", nil)
+	MetricReplicatedReadRepairs         = metrics.AddCounter("replicated_read_repairs", nil)
+	MetricReplicatedReadRepairErrors    = metrics.AddCounter("replicated_read_repair_errors", nil)
+
+	// Failover. These count requests routed around a layer whose breaker is
+	// open, and requests rejected because the layers they need are down.
+	MetricFailoverL1Only   = metrics.AddCounter("failover_l1_only", nil)
+	MetricFailoverL2Only   = metrics.AddCounter("failover_l2_only", nil)
+	MetricFailoverRejected = metrics.AddCounter("failover_rejected", nil)
+
+	// Backfill. Deduped counts keys already queued or being filled, dropped
+	// counts keys that didn't fit in the queue and TTL fallbacks count fills that
+	// used the configured TTL because the source doesn't support GetE.
+	MetricBackfillEnqueued     = metrics.AddCounter("backfill_enqueued", nil)
+	MetricBackfillDeduped      = metrics.AddCounter("backfill_deduped", nil)
+	MetricBackfillDropped      = metrics.AddCounter("backfill_dropped", nil)
+	MetricBackfillFilled       = metrics.AddCounter("backfill_filled", nil)
+	MetricBackfillSourceMisses = metrics.AddCounter("backfill_source_misses", nil)
+	MetricBackfillErrors       = metrics.AddCounter("backfill_errors", nil)
+	MetricBackfillTTLFallbacks = metrics.AddCounter("backfill_ttl_fallbacks", nil)
+
+	// Migration. Secondary write errors count mutations that succeeded in the
+	// primary cluster but not the other one. Dual fallbacks count keys read from
+	// the source because the destination missed during the dual phase. The rest
+	// count keys read from both clusters when comparing is on.
+	MetricMigrationSecondaryWriteErrors = metrics.AddCounter("migration_secondary_write_errors", nil)
+	MetricMigrationDualFallbacks        = metrics.AddCounter("migration_dual_fallbacks", nil)
+	MetricMigrationCompared             = metrics.AddCounter("migration_compared", nil)
+	MetricMigrationCompareErrors        = metrics.AddCounter("migration_compare_errors", nil)
+	MetricMigrationDivergent            = metrics.AddCounter("migration_divergent", nil)
+	MetricMigrationMissingInPrimary     = metrics.AddCounter("migration_missing_in_primary", nil)
+	MetricMigrationMissingInOther       = metrics.AddCounter("migration_missing_in_other", nil)
+
+	// Forwarding. Writes rejected because the forwarding orca is read-only.
+	MetricForwardReadOnlyRejected = metrics.AddCounter("forward_read_only_rejected", nil)
+
 	MetricCmdGetSetL1       = metrics.AddCounter("cmd_get_set_l1", nil)
 	MetricCmdGetSetErrorsL1 = metrics.AddCounter("cmd_get_set_errors_l1", nil)
 	MetricCmdGetSetSucessL1 = metrics.AddCounter("cmd_get_set_success_l1", nil)
@@ -261,4 +324,10 @@ var (
 	HistGatL2 = metrics.AddHistogram("gat_l2", false, nil) // not sampled until configurable
 	//HistGatSingleL1 = metrics.AddHistogram("gat_single_l1", false, nil) // not sampled until configurable
 	//HistGatSingleL2 = metrics.AddHistogram("gat_single_l2", false, nil) // not sampled until configurable
+
+	// Time until the write quorum acknowledged a replicated mutation
+	HistReplicatedWriteQuorum = metrics.AddHistogram("replicated_write_quorum", false, nil)
+
+	// Time from a key being queued for backfill until it is filled
+	HistBackfill = metrics.AddHistogram("backfill", false, nil)
 )
@@ -15,9 +15,13 @@
 package orcas_test
 
 import (
+	"bytes"
+	"sync"
 	"testing"
 
 	"github.com/netflix/rend/common"
+	"github.com/netflix/rend/handlers"
+	"github.com/netflix/rend/orcas"
 )
 
 type testHandler struct {
@@ -133,3 +137,99 @@ func (h *testHandler) Close() error {
 	h.errors = h.errors[1:]
 	return ret
 }
+
+// mapHandler is a minimal standalone store, so tests that need several backends
+// can give each its own data.
+type mapHandler struct {
+	testHandler
+	lock sync.Mutex
+	data map[string]string
+}
+
+func newMapHandler() *mapHandler {
+	return &mapHandler{data: make(map[string]string)}
+}
+
+func (h *mapHandler) Set(cmd common.SetRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+func (h *mapHandler) Add(cmd common.SetRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.data[string(cmd.Key)]; ok {
+		return common.ErrKeyExists
+	}
+	h.data[string(cmd.Key)] = string(cmd.Data)
+	return nil
+}
+func (h *mapHandler) Get(cmd common.GetRequest) (<-chan common.GetResponse, <-chan error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	reschan := make(chan common.GetResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		res := common.GetResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx]}
+		if data, ok := h.data[string(key)]; ok {
+			res.Data = []byte(data)
+		} else {
+			res.Miss = true
+		}
+		reschan <- res
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+func (h *mapHandler) GetE(cmd common.GetRequest) (<-chan common.GetEResponse, <-chan error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	reschan := make(chan common.GetEResponse, len(cmd.Keys))
+	for idx, key := range cmd.Keys {
+		res := common.GetEResponse{Key: key, Opaque: cmd.Opaques[idx], Quiet: cmd.Quiet[idx]}
+		if data, ok := h.data[string(key)]; ok {
+			res.Data = []byte(data)
+		} else {
+			res.Miss = true
+		}
+		reschan <- res
+	}
+	close(reschan)
+	errchan := make(chan error)
+	close(errchan)
+	return reschan, errchan
+}
+func (h *mapHandler) Close() error { return nil }
+func (h *mapHandler) value(key string) (string, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	v, ok := h.data[key]
+	return v, ok
+}
+
+func consts(hs ...handlers.Handler) []handlers.HandlerConst {
+	var hcs []handlers.HandlerConst
+	for _, h := range hs {
+		h := h
+		hcs = append(hcs, func() (handlers.Handler, error) { return h, nil })
+	}
+	return hcs
+}
+
+// getOne runs a single key get through the orca and returns what it wrote.
+func getOne(t *testing.T, o orcas.Orca, output *bytes.Buffer, key string) string {
+	output.Reset()
+	err := o.Get(common.GetRequest{
+		Keys:    [][]byte{[]byte(key)},
+		Opaques: []uint32{0},
+		Quiet:   []bool{false},
+	})
+	if err != nil {
+		t.Fatalf("Error should be nil, got %v", err)
+	}
+	return output.String()
+}
@@ -319,10 +319,26 @@ func reqTypeToOpcode(rt common.RequestType, quiet bool) uint8 {
 
 func getCommon(w *bufio.Writer, response common.GetResponse, opcode uint8) error {
 	// total body length = extras (flags, 4 bytes) + data length
-	totalBodyLength := len(response.Data) + 4
-	writeSuccessResponseHeader(w, opcode, 0, 4, totalBodyLength, response.Opaque, false)
-	buf := make([]byte, 4)
+	// Stale and refresh responses carry a second extras word with the status bits
+	extraLength := 4
+	var status uint32
+	if response.Stale {
+		status |= GetStatusStale
+	}
+	if response.Refresh {
+		status |= GetStatusRefresh
+	}
+	if status != 0 {
+		extraLength = 8
+	}
+
+	totalBodyLength := len(response.Data) + extraLength
+	writeSuccessResponseHeader(w, opcode, 0, extraLength, totalBodyLength, response.Opaque, false)
+	buf := make([]byte, extraLength)
 	binary.BigEndian.PutUint32(buf, response.Flags)
+	if status != 0 {
+		binary.BigEndian.PutUint32(buf[4:], status)
+	}
 	w.Write(buf)
 	w.Write(response.Data)
 	if err := w.Flush(); err != nil {
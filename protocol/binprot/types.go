@@ -83,6 +83,15 @@ const (
 	StatusInvalid        = uint16(0xFFFF)
 )
 
+// Status bits for the second extras word of a get response. The word is only
+// sent for items served by a stale-while-revalidate orca, so clients that don't
+// know about it only see it when that mode is turned on. The first extras word
+// is always the item flags.
+const (
+	GetStatusStale   = uint32(1 << 0)
+	GetStatusRefresh = uint32(1 << 1)
+)
+
 func DecodeError(header *ResponseHeader) error {
 	switch header.Status {
 	case StatusKeyEnoent:
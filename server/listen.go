@@ -199,7 +199,16 @@ func ListenAndServe(l ListenConst, ps []protocol.Components, s ServerConst, o or
 
 			metrics.IncCounter(MetricProtocolsAssigned)
 
-			server := s([]io.Closer{remoteConn, l1, l2}, reqParser, o(l1, l2, responder))
+			orca := o(l1, l2, responder)
+			conns := []io.Closer{remoteConn, l1, l2}
+
+			// Orcas that hold their own resources, like connections to extra backends,
+			// are closed along with the rest of the connection.
+			if c, ok := orca.(io.Closer); ok {
+				conns = append(conns, c)
+			}
+
+			server := s(conns, reqParser, orca)
 
 			go server.Loop()
 		}(remote)